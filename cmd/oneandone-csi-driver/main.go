@@ -0,0 +1,63 @@
+package main
+
+import (
+	"flag"
+	"os"
+
+	"github.com/1and1/oneandone-flex-volume/cmd/oneandone-flex-volume/config"
+	"github.com/1and1/oneandone-flex-volume/helper"
+	"github.com/1and1/oneandone-flex-volume/pkg/mount"
+	"github.com/1and1/oneandone-flex-volume/pkg/oneandone/cloud"
+	"github.com/1and1/oneandone-flex-volume/pkg/oneandone/csidriver"
+	"github.com/1and1/oneandone-flex-volume/pkg/oneandone/plugin"
+	"github.com/golang/glog"
+)
+
+func main() {
+	endpoint := flag.String("endpoint", "unix:///var/lib/kubelet/plugins/"+csidriver.DriverName+"/csi.sock", "CSI endpoint")
+	nodeID := flag.String("node-id", "", "1&1 server ID of the node, read from the metadata API when empty")
+	flag.Set("logtostderr", "true")
+	flag.Parse()
+
+	cfg, err := config.ReadConfig()
+	if err != nil {
+		glog.Errorf("Error reading config: %v", err.Error())
+		os.Exit(1)
+	}
+	helper.DebugLog = cfg.Logging.DebugLog()
+	if cfg.Endpoints.Metadata != "" {
+		helper.MetadataURL = cfg.Endpoints.Metadata
+	}
+
+	token, err := config.GetOneandoneToken()
+	if err != nil {
+		glog.Errorf("Error retrieving 1&1 token: %v", err.Error())
+		os.Exit(1)
+	}
+
+	oneandone, err := cloud.NewOneandoneManager(token, cfg.Endpoints.API)
+	if err != nil {
+		glog.Errorf("Error creating 1and1 client: %v", err.Error())
+		os.Exit(1)
+	}
+	oneandone.SetTimeouts(cfg.CloudTimeouts())
+
+	if *nodeID == "" {
+		*nodeID, err = helper.GetServerID()
+		if err != nil {
+			glog.Errorf("Error retrieving server ID from the metadata API: %v", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	driver := csidriver.NewDriver(*endpoint, *nodeID, oneandone, plugin.NewNodeMounter(mount.New(), cfg.Unmount.BusyPolicy), csidriver.Config{
+		Filesystems:    cfg.Filesystems,
+		FsType:         cfg.Defaults.FsType,
+		FormatPolicy:   cfg.Defaults.FormatPolicy,
+		StorageClasses: cfg.StorageClasses,
+	})
+	if err := driver.Run(); err != nil {
+		glog.Errorf("Error running CSI driver: %v", err.Error())
+		os.Exit(1)
+	}
+}
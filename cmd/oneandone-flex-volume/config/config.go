@@ -5,15 +5,23 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"reflect"
 	"strings"
+	"time"
 
 	"github.com/1and1/oneandone-flex-volume/helper"
+	"github.com/1and1/oneandone-flex-volume/pkg/format"
+	"github.com/1and1/oneandone-flex-volume/pkg/mount"
+	"github.com/1and1/oneandone-flex-volume/pkg/oneandone/cloud"
+	"github.com/1and1/oneandone-flex-volume/pkg/oneandone/plugin"
 )
 
 const (
 	tokenFileEnv         = "ONEANDONE_TOKEN_FILE_PATH"
 	tokenEnv             = "ONEANDONE_TOKEN"
 	tokenDefaultLocation = "/etc/kubernetes/oneandone.json"
+	// defaultDebugLog is the debug log file when the config sets none
+	defaultDebugLog = "/tmp/oneandone.log"
 )
 
 // GetOneandoneToken uses environment variables to locate a 1&1
@@ -52,9 +60,157 @@ func GetOneandoneToken() (string, error) {
 	return "", fmt.Errorf("No valid 1and1 tokens were found: %s", err)
 }
 
+// Version is the schema version of the config file
+const Version = 1
+
 // Config contains 1&1 configuration items
 type Config struct {
-	Token string `json:"token"`
+	// Version is the schema version of the file, files without one are read
+	// as version 1
+	Version int    `json:"version,omitempty"`
+	Token   string `json:"token"`
+	// Endpoints are the APIs the driver talks to
+	Endpoints Endpoints `json:"endpoints,omitempty"`
+	// Timeouts bound the calls and waits for the 1&1 API
+	Timeouts Timeouts `json:"timeouts,omitempty"`
+	// Logging holds the settings of the debug log
+	Logging Logging `json:"logging,omitempty"`
+	// Defaults are the filesystem settings of volumes that set none
+	Defaults Defaults `json:"defaults,omitempty"`
+	// Filesystems are the profiles of the filesystems volumes are formatted with
+	Filesystems format.Profiles `json:"filesystems,omitempty"`
+	// StorageClasses are the profiles volumes select with the storageClass
+	// option or parameter
+	StorageClasses plugin.StorageClasses `json:"storageClasses,omitempty"`
+	// Encryption holds the settings of encrypted volumes
+	Encryption Encryption `json:"encryption,omitempty"`
+	// Unmount holds the settings of volume teardown
+	Unmount Unmount `json:"unmount,omitempty"`
+}
+
+// Endpoints are the APIs the driver talks to
+type Endpoints struct {
+	// API is the 1&1 Cloud API base URL, empty means the public API
+	API string `json:"api,omitempty"`
+	// Metadata is the metadata API base URL, empty means the link-local
+	// default
+	Metadata string `json:"metadata,omitempty"`
+}
+
+// Duration is a duration such as 90s or 15m, empty means the default
+type Duration string
+
+// Duration returns the parsed duration, zero when empty or invalid
+func (d Duration) Duration() time.Duration {
+	v, _ := time.ParseDuration(string(d))
+	return v
+}
+
+// Timeouts bound the calls and waits for the 1&1 API
+type Timeouts struct {
+	// Command bounds a flex command before it reports the operation still
+	// in progress
+	Command Duration `json:"command,omitempty"`
+	// Retry is how long a call to the API is tried for
+	Retry Duration `json:"retry,omitempty"`
+	// PollInterval is the delay between two checks of a wait
+	PollInterval Duration `json:"pollInterval,omitempty"`
+	// Poll is how long a wait lasts before it fails
+	Poll Duration `json:"poll,omitempty"`
+}
+
+// Logging holds the settings of the debug log
+type Logging struct {
+	// Debug turns the debug log on or off, it is on when not set
+	Debug *bool `json:"debug,omitempty"`
+	// File is the debug log file
+	File string `json:"file,omitempty"`
+}
+
+// DebugLog returns the debug log file, empty when the debug log is off
+func (l Logging) DebugLog() string {
+	if l.Debug != nil && !*l.Debug {
+		return ""
+	}
+	if l.File == "" {
+		return defaultDebugLog
+	}
+	return l.File
+}
+
+// Defaults are the filesystem settings of volumes that set none
+type Defaults struct {
+	// FsType is the filesystem volumes are formatted with, ext4 when empty
+	FsType string `json:"fsType,omitempty"`
+	// FormatPolicy tells which devices may be formatted, ifEmpty when empty
+	FormatPolicy format.Policy `json:"formatPolicy,omitempty"`
+}
+
+// Encryption holds the settings of encrypted volumes
+type Encryption struct {
+	// KeyFile holds the passphrase of volumes without a passphrase secret
+	KeyFile string `json:"keyFile,omitempty"`
+}
+
+// Unmount holds the settings of volume teardown
+type Unmount struct {
+	// BusyPolicy tells whether mount points processes keep busy are
+	// unmounted lazily or forcibly, they are left mounted by default
+	BusyPolicy mount.BusyPolicy `json:"busyPolicy,omitempty"`
+}
+
+// CloudTimeouts returns the retry and wait timeouts of the 1&1 manager
+func (c *Config) CloudTimeouts() cloud.Timeouts {
+	return cloud.Timeouts{
+		Retry:        c.Timeouts.Retry.Duration(),
+		PollInterval: c.Timeouts.PollInterval.Duration(),
+		Poll:         c.Timeouts.Poll.Duration(),
+	}
+}
+
+// configFile returns the config file set at ONEANDONE_TOKEN_FILE_PATH or the
+// default location
+func configFile() string {
+	if f, ok := os.LookupEnv(tokenFileEnv); ok && f != "" {
+		return f
+	}
+	return tokenDefaultLocation
+}
+
+// ReadConfig reads the config file, an empty config when there is none,
+// applies the environment overrides and validates the result
+func ReadConfig() (*Config, error) {
+	return readConfig(configFile(), os.LookupEnv)
+}
+
+func readConfig(f string, lookupEnv func(string) (string, bool)) (*Config, error) {
+	config := &Config{}
+	problems := []string{}
+	c, err := ioutil.ReadFile(f)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	default:
+		if err := json.Unmarshal(c, config); err != nil {
+			return nil, fmt.Errorf("could not parse %s: %s", f, err.Error())
+		}
+		if problems, err = unknownFields(c, reflect.TypeOf(Config{})); err != nil {
+			return nil, fmt.Errorf("could not parse %s: %s", f, err.Error())
+		}
+	}
+
+	problems = append(problems, config.override(lookupEnv)...)
+	problems = append(problems, config.validate()...)
+	if len(problems) > 0 {
+		return nil, &ValidationError{File: f, Problems: problems}
+	}
+
+	if config.Version == 0 {
+		config.Version = Version
+	}
+	config.Unmount.BusyPolicy, _ = mount.ParseBusyPolicy(string(config.Unmount.BusyPolicy))
+	return config, nil
 }
 
 // ReadTokenFromJSONFile reads the 1&1 token from a config file
@@ -0,0 +1,178 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/1and1/oneandone-flex-volume/pkg/format"
+	"github.com/1and1/oneandone-flex-volume/pkg/mount"
+	"github.com/1and1/oneandone-flex-volume/pkg/oneandone/cloud"
+	"github.com/1and1/oneandone-flex-volume/pkg/oneandone/plugin"
+)
+
+const fullConfig = `{
+	"version": 1,
+	"token": "secret",
+	"endpoints": {"api": "https://cloudpanel-api.example.com/v1", "metadata": "http://169.254.169.254"},
+	"timeouts": {"command": "60s", "retry": "1m", "pollInterval": "5s", "poll": "10m"},
+	"logging": {"debug": true, "file": "/var/log/oneandone.log"},
+	"defaults": {"fsType": "xfs", "formatPolicy": "never"},
+	"filesystems": {"xfs": {"mkfsOptions": "-L data"}},
+	"storageClasses": {"fast": {"fsType": "ext4", "formatPolicy": "overwrite", "mkfsOptions": "-m 0", "mountFlags": "noatime"}},
+	"encryption": {"keyFile": "/etc/kubernetes/oneandone.key"},
+	"unmount": {"busyPolicy": "lazy"}
+}`
+
+func writeConfig(t *testing.T, content string) (string, func()) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatalf("an error ocurred creating a temporary directory %s", err)
+	}
+	f := filepath.Join(dir, "oneandone.json")
+	if err := ioutil.WriteFile(f, []byte(content), 0600); err != nil {
+		t.Fatalf("an error ocurred writing %s: %s", f, err)
+	}
+	return f, func() { os.RemoveAll(dir) }
+}
+
+func env(vars map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		v, ok := vars[key]
+		return v, ok
+	}
+}
+
+func TestReadConfig(t *testing.T) {
+	f, cleanup := writeConfig(t, fullConfig)
+	defer cleanup()
+
+	c, err := readConfig(f, env(nil))
+	if err != nil {
+		t.Fatalf("an error ocurred reading the config %s", err)
+	}
+	if c.Endpoints.API != "https://cloudpanel-api.example.com/v1" || c.Endpoints.Metadata != "http://169.254.169.254" {
+		t.Errorf("expected the endpoints of the file but got %+v", c.Endpoints)
+	}
+	if c.Timeouts.Command.Duration() != time.Minute {
+		t.Errorf("expected a command timeout of 1m but got %s", c.Timeouts.Command.Duration())
+	}
+	if expected := (cloud.Timeouts{Retry: time.Minute, PollInterval: 5 * time.Second, Poll: 10 * time.Minute}); c.CloudTimeouts() != expected {
+		t.Errorf("expected cloud timeouts %+v but got %+v", expected, c.CloudTimeouts())
+	}
+	if c.Logging.DebugLog() != "/var/log/oneandone.log" {
+		t.Errorf("expected debug log /var/log/oneandone.log but got %q", c.Logging.DebugLog())
+	}
+	if c.Defaults != (Defaults{FsType: "xfs", FormatPolicy: format.PolicyNever}) {
+		t.Errorf("expected the defaults of the file but got %+v", c.Defaults)
+	}
+	expected := plugin.StorageClasses{"fast": {FsType: "ext4", FormatPolicy: "overwrite", MkfsOptions: "-m 0", MountFlags: "noatime"}}
+	if !reflect.DeepEqual(c.StorageClasses, expected) {
+		t.Errorf("expected storage classes %+v but got %+v", expected, c.StorageClasses)
+	}
+	if c.Unmount.BusyPolicy != mount.BusyLazy {
+		t.Errorf("expected busy policy %s but got %s", mount.BusyLazy, c.Unmount.BusyPolicy)
+	}
+}
+
+func TestReadConfigDefaults(t *testing.T) {
+	legacy, cleanup := writeConfig(t, `{"token": "secret"}`)
+	defer cleanup()
+
+	for _, f := range []string{legacy, "/nonexistent/oneandone.json"} {
+		c, err := readConfig(f, env(nil))
+		if err != nil {
+			t.Errorf("an error ocurred reading %s: %s", f, err)
+			continue
+		}
+		if c.Version != Version {
+			t.Errorf("%s: expected version %d but got %d", f, Version, c.Version)
+		}
+		if c.Logging.DebugLog() != defaultDebugLog {
+			t.Errorf("%s: expected debug log %s but got %q", f, defaultDebugLog, c.Logging.DebugLog())
+		}
+		if c.CloudTimeouts() != (cloud.Timeouts{}) {
+			t.Errorf("%s: expected the default cloud timeouts but got %+v", f, c.CloudTimeouts())
+		}
+		if c.Unmount.BusyPolicy != mount.BusyFail {
+			t.Errorf("%s: expected busy policy %s but got %s", f, mount.BusyFail, c.Unmount.BusyPolicy)
+		}
+	}
+}
+
+func TestReadConfigReportsEveryProblem(t *testing.T) {
+	f, cleanup := writeConfig(t, `{
+		"version": 2,
+		"tokn": "secret",
+		"endpoints": {"api": "cloudpanel-api.example.com", "metdata": "http://169.254.169.254"},
+		"timeouts": {"command": "2s", "retry": "forever", "pollInterval": "20m", "poll": "10m"},
+		"logging": {"file": "oneandone.log"},
+		"defaults": {"fsType": "zfs", "formatPolicy": "always"},
+		"storageClasses": {"fast": {"fsType": "ext4", "mkfsOptions": "-f", "mountFlags": "nouuid", "size": "20"}},
+		"unmount": {"busyPolicy": "kill"}
+	}`)
+	defer cleanup()
+
+	_, err := readConfig(f, env(map[string]string{"ONEANDONE_DEBUG": "maybe"}))
+	verr, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("expected a validation error but got %v", err)
+	}
+
+	expected := []string{
+		"unknown setting endpoints.metdata",
+		"unknown setting storageClasses.fast.size",
+		"unknown setting tokn",
+		"ONEANDONE_DEBUG: \"maybe\" is not a boolean",
+		"version 2 is not supported, use 1",
+		"endpoints.api \"cloudpanel-api.example.com\" must be an http or https URL",
+		"timeouts.retry \"forever\" is not a duration such as 90s or 15m",
+		"timeouts.command \"2s\" must be longer than the 5s kept to report an operation in progress",
+		"timeouts.pollInterval \"20m\" is longer than timeouts.poll \"10m\"",
+		"logging.file \"oneandone.log\" must be an absolute path",
+	}
+	if len(verr.Problems) != len(expected)+5 {
+		t.Errorf("expected %d problems but got %d: %q", len(expected)+5, len(verr.Problems), verr.Problems)
+	}
+	if !reflect.DeepEqual(verr.Problems[:len(expected)], expected) {
+		t.Errorf("expected problems %q but got %q", expected, verr.Problems)
+	}
+}
+
+func TestEnvOverrides(t *testing.T) {
+	f, cleanup := writeConfig(t, fullConfig)
+	defer cleanup()
+
+	c, err := readConfig(f, env(map[string]string{
+		"ONEANDONE_API_URL":        "http://localhost:8080/v1",
+		"ONEANDONE_METADATA_URL":   " ",
+		"ONEANDONE_POLL_TIMEOUT":   "20m",
+		"ONEANDONE_DEBUG":          "false",
+		"ONEANDONE_DEFAULT_FSTYPE": "ext4",
+	}))
+	if err != nil {
+		t.Fatalf("an error ocurred reading the config %s", err)
+	}
+	if c.Endpoints.API != "http://localhost:8080/v1" {
+		t.Errorf("expected the API URL of the environment but got %s", c.Endpoints.API)
+	}
+	if c.Endpoints.Metadata != "http://169.254.169.254" {
+		t.Errorf("expected an empty variable to keep the metadata URL of the file but got %s", c.Endpoints.Metadata)
+	}
+	if c.Timeouts.Poll.Duration() != 20*time.Minute {
+		t.Errorf("expected a poll timeout of 20m but got %s", c.Timeouts.Poll.Duration())
+	}
+	if c.Logging.DebugLog() != "" {
+		t.Errorf("expected the debug log to be off but got %q", c.Logging.DebugLog())
+	}
+	if c.Defaults.FsType != "ext4" {
+		t.Errorf("expected default filesystem ext4 but got %s", c.Defaults.FsType)
+	}
+
+	if _, err := readConfig(f, env(map[string]string{"ONEANDONE_FORMAT_POLICY": "always"})); err == nil {
+		t.Errorf("expected an invalid override to fail validation")
+	}
+}
@@ -0,0 +1,52 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/1and1/oneandone-flex-volume/pkg/format"
+	"github.com/1and1/oneandone-flex-volume/pkg/mount"
+)
+
+// envOverrides are the environment variables that replace settings of the
+// config file, empty variables are ignored
+var envOverrides = []struct {
+	env string
+	set func(c *Config, value string) error
+}{
+	{"ONEANDONE_API_URL", func(c *Config, v string) error { c.Endpoints.API = v; return nil }},
+	{"ONEANDONE_METADATA_URL", func(c *Config, v string) error { c.Endpoints.Metadata = v; return nil }},
+	{"ONEANDONE_COMMAND_TIMEOUT", func(c *Config, v string) error { c.Timeouts.Command = Duration(v); return nil }},
+	{"ONEANDONE_RETRY_TIMEOUT", func(c *Config, v string) error { c.Timeouts.Retry = Duration(v); return nil }},
+	{"ONEANDONE_POLL_INTERVAL", func(c *Config, v string) error { c.Timeouts.PollInterval = Duration(v); return nil }},
+	{"ONEANDONE_POLL_TIMEOUT", func(c *Config, v string) error { c.Timeouts.Poll = Duration(v); return nil }},
+	{"ONEANDONE_DEBUG", func(c *Config, v string) error {
+		debug, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("%q is not a boolean", v)
+		}
+		c.Logging.Debug = &debug
+		return nil
+	}},
+	{"ONEANDONE_DEBUG_LOG", func(c *Config, v string) error { c.Logging.File = v; return nil }},
+	{"ONEANDONE_DEFAULT_FSTYPE", func(c *Config, v string) error { c.Defaults.FsType = v; return nil }},
+	{"ONEANDONE_FORMAT_POLICY", func(c *Config, v string) error { c.Defaults.FormatPolicy = format.Policy(v); return nil }},
+	{"ONEANDONE_BUSY_POLICY", func(c *Config, v string) error { c.Unmount.BusyPolicy = mount.BusyPolicy(v); return nil }},
+}
+
+// override applies the environment variables set on top of the config
+// file and returns the problems of those it could not apply
+func (c *Config) override(lookupEnv func(string) (string, bool)) []string {
+	problems := []string{}
+	for _, o := range envOverrides {
+		v, ok := lookupEnv(o.env)
+		if v = strings.TrimSpace(v); !ok || v == "" {
+			continue
+		}
+		if err := o.set(c, v); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", o.env, err.Error()))
+		}
+	}
+	return problems
+}
@@ -0,0 +1,199 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/1and1/oneandone-flex-volume/pkg/format"
+	"github.com/1and1/oneandone-flex-volume/pkg/mount"
+	"github.com/1and1/oneandone-flex-volume/pkg/oneandone/cloud"
+	"github.com/1and1/oneandone-flex-volume/pkg/oneandone/plugin"
+)
+
+// ValidationError lists every problem of a config file
+type ValidationError struct {
+	File     string
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid config %s: %s", e.File, strings.Join(e.Problems, "; "))
+}
+
+// validate returns the problems of the config, none when it is valid
+func (c *Config) validate() []string {
+	problems := []string{}
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if c.Version != 0 && c.Version != Version {
+		add("version %d is not supported, use %d", c.Version, Version)
+	}
+
+	for _, e := range []struct {
+		name string
+		url  string
+	}{
+		{"endpoints.api", c.Endpoints.API},
+		{"endpoints.metadata", c.Endpoints.Metadata},
+	} {
+		if e.url == "" {
+			continue
+		}
+		if u, err := url.Parse(e.url); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			add("%s %q must be an http or https URL", e.name, e.url)
+		}
+	}
+
+	for _, t := range []struct {
+		name     string
+		duration Duration
+	}{
+		{"timeouts.command", c.Timeouts.Command},
+		{"timeouts.retry", c.Timeouts.Retry},
+		{"timeouts.pollInterval", c.Timeouts.PollInterval},
+		{"timeouts.poll", c.Timeouts.Poll},
+	} {
+		if t.duration == "" {
+			continue
+		}
+		d, err := time.ParseDuration(string(t.duration))
+		if err != nil {
+			add("%s %q is not a duration such as 90s or 15m", t.name, t.duration)
+		} else if d <= 0 {
+			add("%s %q must be positive", t.name, t.duration)
+		}
+	}
+	if command := c.Timeouts.Command.Duration(); command > 0 && command <= cloud.DefaultPollMargin {
+		add("timeouts.command %q must be longer than the %s kept to report an operation in progress", c.Timeouts.Command, cloud.DefaultPollMargin)
+	}
+	if interval, poll := c.Timeouts.PollInterval.Duration(), c.Timeouts.Poll.Duration(); interval > 0 && poll > 0 && interval > poll {
+		add("timeouts.pollInterval %q is longer than timeouts.poll %q", c.Timeouts.PollInterval, c.Timeouts.Poll)
+	}
+
+	if f := c.Logging.File; f != "" && !filepath.IsAbs(f) {
+		add("logging.file %q must be an absolute path", f)
+	}
+
+	fsType := plugin.DefaultFsType
+	if c.Defaults.FsType != "" {
+		if err := format.ValidateFsType(c.Defaults.FsType); err != nil {
+			add("defaults.fsType: %s", err.Error())
+		} else {
+			fsType = c.Defaults.FsType
+		}
+	}
+	if _, err := format.ParsePolicy(string(c.Defaults.FormatPolicy)); err != nil {
+		add("defaults.formatPolicy: %s", err.Error())
+	}
+
+	for _, name := range sortedKeys(c.Filesystems) {
+		if _, err := format.ParseMkfsOptions(name, c.Filesystems[name].MkfsOptions); err != nil {
+			add("filesystems.%s: %s", name, err.Error())
+		}
+	}
+
+	for _, name := range sortedKeys(c.StorageClasses) {
+		problems = append(problems, validateStorageClass(name, c.StorageClasses[name], fsType)...)
+	}
+
+	if k := c.Encryption.KeyFile; k != "" && !filepath.IsAbs(k) {
+		add("encryption.keyFile %q must be an absolute path", k)
+	}
+	if _, err := mount.ParseBusyPolicy(string(c.Unmount.BusyPolicy)); err != nil {
+		add("unmount.busyPolicy: %s", err.Error())
+	}
+	return problems
+}
+
+// validateStorageClass returns the problems of the storage class, whose
+// filesystem is fsType when it names none
+func validateStorageClass(name string, class plugin.StorageClass, fsType string) []string {
+	problems := []string{}
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf("storageClasses.%s.%s", name, fmt.Sprintf(format, args...)))
+	}
+
+	if class.FsType != "" {
+		if err := format.ValidateFsType(class.FsType); err != nil {
+			add("fsType: %s", err.Error())
+			return problems
+		}
+		fsType = class.FsType
+	}
+	if _, err := format.ParsePolicy(class.FormatPolicy); err != nil {
+		add("formatPolicy: %s", err.Error())
+	}
+	if _, err := format.ParseMkfsOptions(fsType, class.MkfsOptions); err != nil {
+		add("mkfsOptions: %s", err.Error())
+	}
+	if err := mount.ValidateOptions(fsType, mount.SplitOptions(class.MountFlags)); err != nil {
+		add("mountFlags: %s", err.Error())
+	}
+	return problems
+}
+
+// sortedKeys returns the keys of the map, which has string keys, in order
+func sortedKeys(m interface{}) []string {
+	keys := []string{}
+	for _, k := range reflect.ValueOf(m).MapKeys() {
+		keys = append(keys, k.String())
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// unknownFields returns a problem for every key of the JSON object that no
+// field of the struct type reads, including the keys of nested objects
+func unknownFields(data []byte, t reflect.Type) ([]string, error) {
+	object := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &object); err != nil {
+		return nil, err
+	}
+	return unknownKeys("", object, t), nil
+}
+
+func unknownKeys(path string, object map[string]json.RawMessage, t reflect.Type) []string {
+	// encoding/json matches the keys of the fields case insensitively
+	fields := map[string]reflect.Type{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "" {
+			name = f.Name
+		}
+		fields[strings.ToLower(name)] = f.Type
+	}
+
+	problems := []string{}
+	for _, key := range sortedKeys(object) {
+		ft, ok := fields[strings.ToLower(key)]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("unknown setting %s%s", path, key))
+			continue
+		}
+
+		switch {
+		case ft.Kind() == reflect.Struct:
+			nested := map[string]json.RawMessage{}
+			if json.Unmarshal(object[key], &nested) == nil {
+				problems = append(problems, unknownKeys(path+key+".", nested, ft)...)
+			}
+		case ft.Kind() == reflect.Map && ft.Elem().Kind() == reflect.Struct:
+			entries := map[string]map[string]json.RawMessage{}
+			if json.Unmarshal(object[key], &entries) == nil {
+				for _, name := range sortedKeys(entries) {
+					problems = append(problems, unknownKeys(path+key+"."+name+".", entries[name], ft.Elem())...)
+				}
+			}
+		}
+	}
+	return problems
+}
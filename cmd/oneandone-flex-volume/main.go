@@ -8,6 +8,7 @@ import (
 	"github.com/1and1/oneandone-flex-volume/cmd/oneandone-flex-volume/config"
 	"github.com/1and1/oneandone-flex-volume/helper"
 	"github.com/1and1/oneandone-flex-volume/pkg/flex"
+	"github.com/1and1/oneandone-flex-volume/pkg/lock"
 	"github.com/1and1/oneandone-flex-volume/pkg/oneandone/cloud"
 	"github.com/1and1/oneandone-flex-volume/pkg/oneandone/plugin"
 	"github.com/golang/glog"
@@ -22,23 +23,49 @@ func main() {
 	flag.Set("logtostderr", "true")
 	flag.Parse()
 
-	// Create the 1&1 manager
-	token, err := config.GetOneandoneToken()
+	cfg, err := config.ReadConfig()
 	if err != nil {
-		glog.Errorf("Error retrieving 1&1 token: %v", err.Error())
+		glog.Errorf("Error reading config: %v", err.Error())
 		os.Exit(1)
 	}
+	helper.DebugLog = cfg.Logging.DebugLog()
+	if cfg.Endpoints.Metadata != "" {
+		helper.MetadataURL = cfg.Endpoints.Metadata
+	}
 
-	oneandone, err := cloud.NewOneandoneManager(token)
+	// Create the 1&1 managers, the global token is used by volumes without
+	// an apiKey secret
+	newManager := func(token string) (cloud.Provider, error) {
+		m, err := cloud.NewOneandoneManager(token, cfg.Endpoints.API)
+		if err != nil {
+			return nil, err
+		}
+		m.SetTimeouts(cfg.CloudTimeouts())
+		return m, nil
+	}
+
+	var oneandone cloud.Provider
+	token, err := config.GetOneandoneToken()
 	if err != nil {
+		helper.DebugFile(fmt.Sprintf("No global 1&1 token, only volumes with an apiKey secret work: %s", err.Error()))
+	} else if oneandone, err = newManager(token); err != nil {
 		glog.Errorf("Error creating 1and1 client: %v", err.Error())
 		os.Exit(1)
 	}
 
 	// create 1&1 flex volume instance
-	p := plugin.NewOneandoneVolumePlugin(oneandone)
+	p := plugin.NewOneandoneVolumePlugin(oneandone, plugin.Config{
+		Filesystems:    cfg.Filesystems,
+		KeyFile:        cfg.Encryption.KeyFile,
+		BusyPolicy:     cfg.Unmount.BusyPolicy,
+		Timeout:        cfg.Timeouts.Command.Duration(),
+		FsType:         cfg.Defaults.FsType,
+		FormatPolicy:   cfg.Defaults.FormatPolicy,
+		StorageClasses: cfg.StorageClasses,
+		NewManager:     newManager,
+	})
 	// create flex Executor
-	manager := flex.NewManager(p, os.Stdout)
+	manager := flex.NewManager(p, os.Stdout, lock.NewManager(lock.DefaultDir))
 
 	// read arguments
 	args := os.Args
@@ -55,7 +82,7 @@ func main() {
 		manager.WriteError(err)
 		os.Exit(1)
 	}
-	helper.DebugFile(fmt.Sprintf("command recieved %s", fc))
+	helper.DebugFile(fmt.Sprintf("command recieved %+v", fc))
 
 	// execute flex command
 	ds, err := manager.ExecuteCommand(fc)
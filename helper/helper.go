@@ -1,26 +1,27 @@
 package helper
 
 import (
-	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
-	"os/exec"
-	"regexp"
 	"strings"
 	"time"
+
+	"github.com/1and1/oneandone-flex-volume/pkg/mount"
+	"github.com/1and1/oneandone-flex-volume/pkg/probe"
 )
 
-//DebugFile writes debug messages to /tmp/oneandone.log
-func DebugFile(msg string) {
-	isDebug := true
+//DebugLog is the file DebugFile writes to, empty disables debug logging
+var DebugLog = "/tmp/oneandone.log"
 
-	if !isDebug {
+//DebugFile writes debug messages to DebugLog
+func DebugFile(msg string) {
+	file := DebugLog
+	if file == "" {
 		return
 	}
 
-	file := "/tmp/oneandone.log"
 	var f *os.File
 	t := time.Now()
 	if _, err := os.Stat(file); os.IsNotExist(err) {
@@ -41,9 +42,12 @@ func DebugFile(msg string) {
 	}
 }
 
+//MetadataURL is the base URL of the 1&1 Cloud Server Metadata API
+var MetadataURL = "http://169.254.169.254"
+
 //GetServerID gets server ID 1&1 Cloud Server Metadata API
 func GetServerID() (string, error) {
-	request, err := http.NewRequest("GET", "http://169.254.169.254/latest/meta_data/server_id", nil)
+	request, err := http.NewRequest("GET", strings.TrimRight(MetadataURL, "/")+"/latest/meta_data/server_id", nil)
 	if err != nil {
 		return "", err
 	}
@@ -64,55 +68,56 @@ func GetServerID() (string, error) {
 	return strings.TrimRight(string(body), "\n"), nil
 }
 
-//GetDevice fetches device's name from /sys/bus/sci/devices... directory
-func GetDevice(diskID string) string {
-	base := "/sys/bus/scsi/devices"
-	files, err := ioutil.ReadDir(base)
-	if err != nil {
-		DebugFile(fmt.Sprintf("err: %s", err.Error()))
-		return ""
-	}
-
-	DebugFile(fmt.Sprintf("REGEXP %s", `\d+`+diskID+`+:0`))
-	r, _ := regexp.Compile(`\d+:` + diskID + `+:0`)
-	for _, f := range files {
-		name := f.Name()
-		DebugFile(fmt.Sprintf("looking into %s", name))
-
-		if r.MatchString(name) {
-			DebugFile(fmt.Sprintf("looking in: %s/%s/block", base, name))
-			subfiles, err := ioutil.ReadDir(fmt.Sprintf("%s/%s/block", base, name))
-			if err != nil {
-				DebugFile(fmt.Sprintf("err: %s", err.Error()))
-				return ""
-			}
-			for _, s := range subfiles {
-				return s.Name()
-			}
-		}
-	}
-	return ""
-}
-
-//Lsblk returns parsed results from `lsblk` command executed on the host
+//Lsblk lists the block devices of the host with their mount points and
+//filesystems, read from sysfs, the mount table and the devices' superblocks
 func Lsblk() (*Result, error) {
-	cmd := exec.Command("lsblk", "-J", "-o", "NAME,MOUNTPOINT,TYPE,FSTYPE")
-
-	data, err := cmd.CombinedOutput()
+	devices, err := probe.ListBlockDevices()
 	if err != nil {
 		return nil, err
 	}
-	result := &Result{}
 
-	err = json.Unmarshal(data, result)
+	table, err := mount.New().List()
 	if err != nil {
 		return nil, err
 	}
 
-	return result, err
+	result := &Result{}
+	for _, d := range devices {
+		device := newDevice(d, table)
+		children := []Device{}
+		for _, p := range d.Partitions {
+			children = append(children, newDevice(p, table))
+		}
+		for _, h := range d.Holders {
+			children = append(children, Device{Name: h, Type: "dm"})
+		}
+		if len(children) > 0 {
+			device.Children = &children
+		}
+		result.Devices = append(result.Devices, device)
+	}
+
+	return result, nil
 }
 
-//Result struct representing `lsblk`` output
+func newDevice(d probe.BlockDevice, table []mount.MountInfo) Device {
+	device := Device{
+		Name: d.Name,
+		Type: d.Type,
+	}
+	for _, m := range table {
+		if m.Major == d.Major && m.Minor == d.Minor && m.Root == "/" {
+			device.Mountpoint = m.MountPoint
+			break
+		}
+	}
+	if r, err := probe.Probe(d.Path); err == nil {
+		device.FSType = r.Type
+	}
+	return device
+}
+
+//Result lists the block devices of the host like `lsblk`
 type Result struct {
 	Devices []Device `json:"blockdevices"`
 }
@@ -125,52 +130,3 @@ type Device struct {
 	Children   *[]Device `json:"children"`
 }
 
-//ResultDiff compares two Result structs and returns the differential.
-func ResultDiff(oldV, newV Result) (toreturn []*Device) {
-	var (
-		// lenMin   int
-		longest  Result
-		shortest Result
-		// f        *Device
-		found bool
-	)
-	// Determine the shortest length and the longest slice
-	if len(oldV.Devices) == 0 {
-		toreturn = append(toreturn, &newV.Devices[len(newV.Devices)-1])
-	} else if len(oldV.Devices) < len(newV.Devices) {
-		longest = newV
-		shortest = oldV
-
-	} else {
-		longest = oldV
-		shortest = newV
-	}
-
-	diff := make(map[string]Device)
-	for i, l := range longest.Devices {
-		if l.Children == nil && l.Type != "rom" {
-			for _, s := range shortest.Devices {
-				if s.Children == nil && s.Type != "rom" {
-					if len(shortest.Devices) > i {
-						if l.Name == s.Name {
-							found = true
-							break
-						} else {
-							found = false
-						}
-					}
-				}
-			}
-			if !found {
-				diff[l.Name] = l
-			}
-		}
-	}
-
-	toreturn = make([]*Device, 0)
-	for _, v := range diff {
-		toreturn = append(toreturn, &v)
-	}
-
-	return toreturn
-}
@@ -4,8 +4,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 
 	"github.com/1and1/oneandone-flex-volume/helper"
+	"github.com/1and1/oneandone-flex-volume/pkg/journal"
+	"github.com/1and1/oneandone-flex-volume/pkg/lock"
 )
 
 // Status codes
@@ -28,8 +33,47 @@ const (
 	unmountDeviceCmd = "unmountdevice"
 	mountCmd         = "mount"
 	unmountCmd       = "unmount"
+	expandVolumeCmd  = "expandvolume"
+	expandFSCmd      = "expandfs"
+	provisionCmd     = "provision"
+	deleteCmd        = "delete"
+	recoverCmd       = "recover"
 )
 
+// mutatingCmds are the commands run under the locks of their volume
+var mutatingCmds = map[string]bool{
+	attachCmd:        true,
+	detachCmd:        true,
+	mountDeviceCmd:   true,
+	unmountDeviceCmd: true,
+	mountCmd:         true,
+	unmountCmd:       true,
+	expandVolumeCmd:  true,
+	expandFSCmd:      true,
+	provisionCmd:     true,
+	deleteCmd:        true,
+}
+
+// argCount holds the number of arguments each flex command expects
+var argCount = map[string]int{
+	initCmd:          0,
+	getVolumeNameCmd: 1,
+	isAttachedCmd:    2,
+	attachCmd:        2,
+	waitForAttachCmd: 2,
+	mountDeviceCmd:   3,
+	detachCmd:        2,
+	waitForDetachCmd: 1,
+	unmountDeviceCmd: 1,
+	mountCmd:         2,
+	unmountCmd:       1,
+	expandVolumeCmd:  4,
+	expandFSCmd:      5,
+	provisionCmd:     1,
+	deleteCmd:        1,
+	recoverCmd:       0,
+}
+
 // VolumePlugin defines the interface that the internal plugin must implement
 type VolumePlugin interface {
 	Init() (*DriverStatus, error)
@@ -37,11 +81,37 @@ type VolumePlugin interface {
 	Attach(options string, node string) (*DriverStatus, error)
 	Detach(device, node string) (*DriverStatus, error)
 	WaitForAttach(device string, options string) (*DriverStatus, error)
+	WaitForDetach(device string) (*DriverStatus, error)
 	IsAttached(options string, node string) (*DriverStatus, error)
 	MountDevice(mountdir, device string, options string) (*DriverStatus, error)
 	UnmountDevice(device string) (*DriverStatus, error)
 	Mount(mountdir string, options string) (*DriverStatus, error)
 	Unmount(mountdir string) (*DriverStatus, error)
+	ExpandVolume(options string, newSize, oldSize int64) (*DriverStatus, error)
+	ExpandFS(options, device, mountdir string, newSize, oldSize int64) (*DriverStatus, error)
+}
+
+// VolumeProvisioner defines the interface that plugins able to create
+// and delete volumes must implement
+type VolumeProvisioner interface {
+	Provision(options string) (*DriverStatus, error)
+	Delete(options string) (*DriverStatus, error)
+}
+
+// LockKeyer is implemented by plugins naming the volumes a command acts on
+// from its arguments, the manager locks every key while the command runs
+type LockKeyer interface {
+	LockKeys(command, device, mountdir, options string) []string
+}
+
+// Recoverer is implemented by plugins journaling their operations, so the
+// ones a killed process left half done can be finished or undone
+type Recoverer interface {
+	// Pending returns the operations left unfinished
+	Pending() ([]journal.Entry, error)
+	// Recover rolls the operation forward or back, the manager holds the
+	// locks of the operation meanwhile
+	Recover(e journal.Entry) error
 }
 
 // DriverStatus represents the return value of the driver callout.
@@ -51,13 +121,15 @@ type DriverStatus struct {
 	DevicePath   string              `json:"device,omitempty"`
 	VolumeName   string              `json:"volumeName,omitempty"`
 	Attached     bool                `json:"attached,omitempty"`
+	Options      map[string]string   `json:"options,omitempty"`
 	Capabilities *DriverCapabilities `json:",omitempty"`
 }
 
 // DriverCapabilities stores 1&1 block storage capabilities
 type DriverCapabilities struct {
-	Attach         bool `json:"attach"`
-	SELinuxRelabel bool `json:"selinuxRelabel"`
+	Attach           bool `json:"attach"`
+	SELinuxRelabel   bool `json:"selinuxRelabel"`
+	RequiresFSResize bool `json:"requiresFSResize"`
 }
 
 // Command contains all parameters needed to run a plugin operation
@@ -67,6 +139,8 @@ type Command struct {
 	device   string
 	mountdir string
 	options  string
+	newSize  int64
+	oldSize  int64
 }
 
 // NewFlexCommand given an argument list returns a Flex Command structure
@@ -76,9 +150,19 @@ func NewFlexCommand(args []string) (*Command, error) {
 	}
 	fc := &Command{command: args[1]}
 	fa := args[2:]
+
+	n, ok := argCount[fc.command]
+	if !ok {
+		return nil, fmt.Errorf("command %q not recognized as a valid flex command", fc.command)
+	}
+	if len(fa) < n {
+		return nil, fmt.Errorf("command %q expects %d arguments but got %d", fc.command, n, len(fa))
+	}
+
+	var err error
 	switch fc.command {
 
-	case initCmd:
+	case initCmd, recoverCmd:
 		return fc, nil
 
 	case getVolumeNameCmd:
@@ -105,6 +189,9 @@ func NewFlexCommand(args []string) (*Command, error) {
 		fc.device = fa[1]
 		fc.options = fa[2]
 
+	case waitForDetachCmd:
+		fc.device = fa[0]
+
 	case unmountDeviceCmd:
 		fc.device = fa[0]
 
@@ -115,30 +202,214 @@ func NewFlexCommand(args []string) (*Command, error) {
 	case unmountCmd:
 		fc.mountdir = fa[0]
 
-	default:
-		return nil, fmt.Errorf("command %q not recognized as a valid flex command", fc.command)
+	case expandVolumeCmd:
+		fc.options = fa[0]
+		fc.device = fa[1]
+		if fc.newSize, fc.oldSize, err = parseSizes(fa[2], fa[3]); err != nil {
+			return nil, err
+		}
+
+	case expandFSCmd:
+		fc.options = fa[0]
+		fc.device = fa[1]
+		fc.mountdir = fa[2]
+		if fc.newSize, fc.oldSize, err = parseSizes(fa[3], fa[4]); err != nil {
+			return nil, err
+		}
+
+	case provisionCmd, deleteCmd:
+		fc.options = fa[0]
 	}
 
 	return fc, nil
 }
 
+// parseSizes parses the new and old volume sizes in bytes passed by the kubelet
+func parseSizes(newSize, oldSize string) (int64, int64, error) {
+	n, err := strconv.ParseInt(newSize, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid new size %q: %s", newSize, err.Error())
+	}
+	o, err := strconv.ParseInt(oldSize, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid old size %q: %s", oldSize, err.Error())
+	}
+	return n, o, nil
+}
+
 // Manager is able to execute flex commands
 type Manager struct {
 	output *os.File
 	plugin VolumePlugin
+	locks  *lock.Manager
 }
 
-// NewManager returns a Flex manager
-func NewManager(plugin VolumePlugin, output *os.File) *Manager {
+// NewManager returns a Flex manager running mutating commands under the
+// locks of their volumes, without locking when locks is nil
+func NewManager(plugin VolumePlugin, output *os.File, locks *lock.Manager) *Manager {
 	return &Manager{
 		output: output,
 		plugin: plugin,
+		locks:  locks,
 	}
 }
 
+// lockKeys returns the keys of the volumes the command acts on, paths are
+// keyed the same whether they come as a device or a mount directory since
+// the kubelet passes the device mount path to both mountdevice and
+// unmountdevice
+func (m *Manager) lockKeys(fc *Command) []string {
+	if k, ok := m.plugin.(LockKeyer); ok {
+		return k.LockKeys(fc.command, fc.device, fc.mountdir, fc.options)
+	}
+	keys := []string{}
+	for _, arg := range []string{fc.device, fc.mountdir} {
+		if arg != "" {
+			keys = append(keys, PathKey(arg))
+		}
+	}
+	return keys
+}
+
+// PathKey returns the lock key of a device or a mount directory argument
+func PathKey(arg string) string {
+	if strings.HasPrefix(arg, "/") {
+		return "path:" + filepath.Clean(arg)
+	}
+	return "device:" + arg
+}
+
 // ExecuteCommand given the command and the plugin
 func (m *Manager) ExecuteCommand(fc *Command) (*DriverStatus, error) {
 	helper.DebugFile(fmt.Sprintf("command to be executed %s", fc.command))
+	if fc.command == recoverCmd {
+		return m.recover()
+	}
+	if !mutatingCmds[fc.command] {
+		return m.execute(fc)
+	}
+
+	keys := m.lockKeys(fc)
+	if m.locks != nil {
+		l, err := m.locks.Lock(fc.command, keys...)
+		if err != nil {
+			return nil, err
+		}
+		defer l.Unlock()
+		for _, h := range l.Stale {
+			helper.DebugFile(fmt.Sprintf("%s took over the lock of %s that died before releasing it", fc.command, h))
+		}
+	}
+	// the operations a killed process left unfinished on the volume are
+	// recovered under its locks before the command acts on it
+	if err := m.recoverVolume(keys); err != nil {
+		helper.DebugFile(fmt.Sprintf("recovery failure %s", err.Error()))
+	}
+	return m.execute(fc)
+}
+
+// recover finishes or undoes the operations left unfinished by killed
+// processes. Operations whose locks are taken are still running and are
+// left alone.
+func (m *Manager) recover() (*DriverStatus, error) {
+	r, ok := m.plugin.(Recoverer)
+	if !ok {
+		return &DriverStatus{
+			Status: StatusNotSupported,
+		}, nil
+	}
+	pending, err := r.Pending()
+	if err != nil {
+		return nil, err
+	}
+
+	recovered, failed := []string{}, []string{}
+	for _, e := range pending {
+		done, err := m.recoverEntry(r, e, nil)
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", e, err.Error()))
+		} else if done {
+			recovered = append(recovered, e.String())
+		}
+	}
+
+	if len(failed) > 0 {
+		return nil, fmt.Errorf("could not recover %s", strings.Join(failed, "; "))
+	}
+	ds := &DriverStatus{
+		Status:  StatusSuccess,
+		Message: "nothing to recover",
+	}
+	if len(recovered) > 0 {
+		ds.Message = "recovered " + strings.Join(recovered, "; ")
+	}
+	return ds, nil
+}
+
+// recoverVolume recovers the unfinished operations sharing a key with the
+// held ones, the operations on other volumes are left to their own
+// commands or the recover command
+func (m *Manager) recoverVolume(held []string) error {
+	r, ok := m.plugin.(Recoverer)
+	if !ok {
+		return nil
+	}
+	pending, err := r.Pending()
+	if err != nil {
+		return err
+	}
+
+	isHeld := map[string]bool{}
+	for _, k := range held {
+		isHeld[k] = true
+	}
+	failed := []string{}
+	for _, e := range pending {
+		shared := false
+		for _, k := range e.Keys {
+			shared = shared || isHeld[k]
+		}
+		if !shared {
+			continue
+		}
+		if _, err := m.recoverEntry(r, e, isHeld); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", e, err.Error()))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("could not recover %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// recoverEntry recovers the operation under its locks, taking those not
+// held already, it tells whether it did since the operation is left alone
+// while its locks are taken
+func (m *Manager) recoverEntry(r Recoverer, e journal.Entry, held map[string]bool) (bool, error) {
+	if m.locks != nil {
+		keys := []string{}
+		for _, k := range e.Keys {
+			if !held[k] {
+				keys = append(keys, k)
+			}
+		}
+		l, err := m.locks.TryLock(recoverCmd, keys...)
+		if err != nil {
+			helper.DebugFile(fmt.Sprintf("not recovering %s: %s", e, err.Error()))
+			return false, nil
+		}
+		defer l.Unlock()
+	}
+
+	helper.DebugFile(fmt.Sprintf("recovering %s", e))
+	if err := r.Recover(e); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// execute runs the command on the plugin
+func (m *Manager) execute(fc *Command) (*DriverStatus, error) {
 	switch fc.command {
 	case initCmd:
 		return m.plugin.Init()
@@ -148,6 +419,8 @@ func (m *Manager) ExecuteCommand(fc *Command) (*DriverStatus, error) {
 		return m.plugin.Detach(fc.device, fc.nodeName)
 	case waitForAttachCmd:
 		return m.plugin.WaitForAttach(fc.device, fc.options)
+	case waitForDetachCmd:
+		return m.plugin.WaitForDetach(fc.device)
 	case isAttachedCmd:
 		return m.plugin.IsAttached(fc.options, fc.nodeName)
 	case mountDeviceCmd:
@@ -160,6 +433,18 @@ func (m *Manager) ExecuteCommand(fc *Command) (*DriverStatus, error) {
 		return m.plugin.GetVolumeName(fc.options)
 	case unmountCmd:
 		return m.plugin.Unmount(fc.mountdir)
+	case expandVolumeCmd:
+		return m.plugin.ExpandVolume(fc.options, fc.newSize, fc.oldSize)
+	case expandFSCmd:
+		return m.plugin.ExpandFS(fc.options, fc.device, fc.mountdir, fc.newSize, fc.oldSize)
+	case provisionCmd:
+		if p, ok := m.plugin.(VolumeProvisioner); ok {
+			return p.Provision(fc.options)
+		}
+	case deleteCmd:
+		if p, ok := m.plugin.(VolumeProvisioner); ok {
+			return p.Delete(fc.options)
+		}
 	}
 	return &DriverStatus{
 		Status: StatusNotSupported,
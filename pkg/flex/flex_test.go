@@ -1,8 +1,16 @@
 package flex
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/1and1/oneandone-flex-volume/pkg/journal"
+	"github.com/1and1/oneandone-flex-volume/pkg/lock"
 )
 
 func TestNexFlexCommand(t *testing.T) {
@@ -36,6 +44,65 @@ func TestNexFlexCommand(t *testing.T) {
 			},
 			false,
 		},
+		{
+			[]string{"cmd", "attach", `{"storageID":"id0123456789"}`},
+			nil,
+			true,
+		},
+		{
+			[]string{"cmd", "waitfordetach", "prueba"},
+			&Command{
+				command: "waitfordetach",
+				device:  "prueba",
+			},
+			false,
+		},
+		{
+			[]string{"cmd", "expandvolume", `{"storageID":"id0123456789"}`, "/dev/sdb", "21474836480", "10737418240"},
+			&Command{
+				command: "expandvolume",
+				options: `{"storageID":"id0123456789"}`,
+				device:  "/dev/sdb",
+				newSize: 21474836480,
+				oldSize: 10737418240,
+			},
+			false,
+		},
+		{
+			[]string{"cmd", "expandvolume", `{"storageID":"id0123456789"}`, "21474836480", "10737418240"},
+			nil,
+			true,
+		},
+		{
+			[]string{"cmd", "expandvolume", `{"storageID":"id0123456789"}`, "/dev/sdb", "20Gi", "10737418240"},
+			nil,
+			true,
+		},
+		{
+			[]string{"cmd", "expandfs", `{"storageID":"id0123456789"}`, "/dev/sdb", "/var/lib/kubelet/plugins/mounts/prueba", "21474836480", "10737418240"},
+			&Command{
+				command:  "expandfs",
+				options:  `{"storageID":"id0123456789"}`,
+				device:   "/dev/sdb",
+				mountdir: "/var/lib/kubelet/plugins/mounts/prueba",
+				newSize:  21474836480,
+				oldSize:  10737418240,
+			},
+			false,
+		},
+		{
+			[]string{"cmd", "provision", `{"size":"20","datacenterID":"dc0123456789"}`},
+			&Command{
+				command: "provision",
+				options: `{"size":"20","datacenterID":"dc0123456789"}`,
+			},
+			false,
+		},
+		{
+			[]string{"cmd", "delete"},
+			nil,
+			true,
+		},
 	}
 
 	for _, c := range cases {
@@ -60,3 +127,156 @@ func TestNexFlexCommand(t *testing.T) {
 		}
 	}
 }
+
+// lockingPlugin tries to take the lock of its volume while a command runs
+type lockingPlugin struct {
+	VolumePlugin
+	locks *lock.Manager
+	err   error
+}
+
+func (p *lockingPlugin) try(keys ...string) {
+	l, err := p.locks.Lock("test", keys...)
+	if err == nil {
+		l.Unlock()
+	}
+	p.err = err
+}
+
+func (p *lockingPlugin) MountDevice(mountdir, device string, options string) (*DriverStatus, error) {
+	p.try(PathKey(mountdir))
+	return &DriverStatus{Status: StatusSuccess}, nil
+}
+
+func (p *lockingPlugin) IsAttached(options string, node string) (*DriverStatus, error) {
+	p.try(PathKey("/mnt/pv-data"))
+	return &DriverStatus{Status: StatusSuccess}, nil
+}
+
+func TestExecuteCommandLocks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	locks := lock.NewManager(dir)
+	locks.Timeout = 20 * time.Millisecond
+	p := &lockingPlugin{locks: locks}
+	m := NewManager(p, os.Stdout, locks)
+
+	fc, _ := NewFlexCommand([]string{"cmd", "mountdevice", "/mnt/pv-data/", "pv-data", "{}"})
+	if _, err := m.ExecuteCommand(fc); err != nil {
+		t.Fatalf("an error ocurred executing mountdevice %s", err)
+	}
+	if p.err == nil {
+		t.Errorf("expected the mount directory to be locked while mountdevice runs")
+	}
+
+	fc, _ = NewFlexCommand([]string{"cmd", "isattached", "{}", "node01"})
+	if _, err := m.ExecuteCommand(fc); err != nil {
+		t.Fatalf("an error ocurred executing isattached %s", err)
+	}
+	if p.err != nil {
+		t.Errorf("expected isattached not to lock but got %s", p.err)
+	}
+}
+
+// recoveringPlugin has a journal of pending operations
+type recoveringPlugin struct {
+	VolumePlugin
+	pending   []journal.Entry
+	recovered []string
+}
+
+func (p *recoveringPlugin) Pending() ([]journal.Entry, error) {
+	return p.pending, nil
+}
+
+func (p *recoveringPlugin) Recover(e journal.Entry) error {
+	if e.Phase == "broken" {
+		return fmt.Errorf("injected")
+	}
+	p.recovered = append(p.recovered, e.StorageID)
+	return nil
+}
+
+func TestRecoverCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	locks := lock.NewManager(dir)
+	p := &recoveringPlugin{pending: []journal.Entry{
+		{Operation: "mountdevice", StorageID: "0123", Phase: "format", Keys: []string{"storage:0123"}},
+		{Operation: "unmountdevice", StorageID: "4567", Phase: "detach", Keys: []string{"storage:4567"}},
+	}}
+	m := NewManager(p, os.Stdout, locks)
+
+	// the second operation is still running in another process
+	running, err := locks.Lock("unmountdevice", "storage:4567")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fc, _ := NewFlexCommand([]string{"cmd", "recover"})
+	ds, err := m.ExecuteCommand(fc)
+	if err != nil {
+		t.Fatalf("an error ocurred recovering %s", err)
+	}
+	if !reflect.DeepEqual(p.recovered, []string{"0123"}) || !strings.Contains(ds.Message, "mountdevice of 0123") {
+		t.Errorf("expected only 0123 to be recovered but got %v %q", p.recovered, ds.Message)
+	}
+	running.Unlock()
+
+	p.pending = []journal.Entry{{Operation: "mountdevice", StorageID: "0123", Phase: "broken"}}
+	if _, err := m.ExecuteCommand(fc); err == nil {
+		t.Errorf("expected error when an operation cannot be recovered")
+	}
+}
+
+// journalingPlugin recovers its journal and runs mountdevice and isattached
+type journalingPlugin struct {
+	recoveringPlugin
+}
+
+func (p *journalingPlugin) MountDevice(mountdir, device string, options string) (*DriverStatus, error) {
+	return &DriverStatus{Status: StatusSuccess}, nil
+}
+
+func (p *journalingPlugin) IsAttached(options string, node string) (*DriverStatus, error) {
+	return &DriverStatus{Status: StatusSuccess}, nil
+}
+
+func TestExecuteCommandRecovers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	locks := lock.NewManager(dir)
+	locks.Timeout = 20 * time.Millisecond
+	p := &journalingPlugin{recoveringPlugin{pending: []journal.Entry{
+		{Operation: "mountdevice", StorageID: "0123", Phase: "format", Keys: []string{"storage:0123", PathKey("/mnt/pv-data")}},
+		{Operation: "mountdevice", StorageID: "4567", Phase: "format", Keys: []string{"storage:4567", PathKey("/mnt/pv-other")}},
+	}}}
+	m := NewManager(p, os.Stdout, locks)
+
+	fc, _ := NewFlexCommand([]string{"cmd", "isattached", "{}", "node01"})
+	if _, err := m.ExecuteCommand(fc); err != nil {
+		t.Fatalf("an error ocurred executing isattached %s", err)
+	}
+	if len(p.recovered) != 0 {
+		t.Errorf("expected isattached not to recover but got %v", p.recovered)
+	}
+
+	fc, _ = NewFlexCommand([]string{"cmd", "mountdevice", "/mnt/pv-data", "pv-data", "{}"})
+	if _, err := m.ExecuteCommand(fc); err != nil {
+		t.Fatalf("an error ocurred executing mountdevice %s", err)
+	}
+	if !reflect.DeepEqual(p.recovered, []string{"0123"}) {
+		t.Errorf("expected mountdevice to recover only the operation on its volume but got %v", p.recovered)
+	}
+}
@@ -0,0 +1,211 @@
+package format
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// mkfsFlag describes an option accepted by mkfs, a nil value pattern means
+// the flag takes no value
+type mkfsFlag struct {
+	value *regexp.Regexp
+}
+
+// mkfsSpec lists the options accepted by the mkfs of a filesystem and the
+// flag forcing it to format over an existing signature
+type mkfsSpec struct {
+	flags map[string]mkfsFlag
+	force string
+}
+
+var (
+	number      = regexp.MustCompile(`^[0-9]+$`)
+	size        = regexp.MustCompile(`^[0-9]+[kKmMgG]?$`)
+	percentage  = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?$`)
+	featureList = regexp.MustCompile(`^\^?[a-z0-9_]+(,\^?[a-z0-9_]+)*$`)
+	subOptions  = regexp.MustCompile(`^[a-z_][a-z0-9_]*(=[a-zA-Z0-9_]+)?(,[a-z_][a-z0-9_]*(=[a-zA-Z0-9_]+)?)*$`)
+	keyValues   = regexp.MustCompile(`^[a-z_][a-z0-9_]*=[a-zA-Z0-9_]+(,[a-z_][a-z0-9_]*=[a-zA-Z0-9_]+)*$`)
+	extLabel    = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,16}$`)
+	xfsLabel    = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,12}$`)
+	btrfsLabel  = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,255}$`)
+	blockSize   = regexp.MustCompile(`^(1024|2048|4096|8192|16384|32768|65536)$`)
+	raidProfile = regexp.MustCompile(`^(single|dup|raid0|raid1|raid1c3|raid1c4|raid10|raid5|raid6)$`)
+)
+
+// extSpec covers mke2fs, which formats ext2, ext3 and ext4
+var extSpec = mkfsSpec{
+	flags: map[string]mkfsFlag{
+		"-b": {blockSize},
+		"-E": {subOptions},
+		"-i": {number},
+		"-I": {number},
+		"-j": {},
+		"-L": {extLabel},
+		"-m": {percentage},
+		"-N": {number},
+		"-O": {featureList},
+		"-T": {featureList},
+	},
+	force: "-F",
+}
+
+// mkfsSpecs are the filesystems the driver formats
+var mkfsSpecs = map[string]mkfsSpec{
+	"ext2": extSpec,
+	"ext3": extSpec,
+	"ext4": extSpec,
+	"xfs": {
+		flags: map[string]mkfsFlag{
+			"-b": {keyValues},
+			"-d": {keyValues},
+			"-i": {keyValues},
+			"-K": {},
+			"-l": {keyValues},
+			"-L": {xfsLabel},
+			"-m": {keyValues},
+			"-n": {keyValues},
+			"-r": {keyValues},
+			"-s": {keyValues},
+		},
+		force: "-f",
+	},
+	"btrfs": {
+		flags: map[string]mkfsFlag{
+			"-d": {raidProfile},
+			"-K": {},
+			"-L": {btrfsLabel},
+			"-m": {raidProfile},
+			"-n": {size},
+			"-O": {featureList},
+			"-R": {featureList},
+			"-s": {size},
+		},
+		force: "-f",
+	},
+}
+
+// Filesystems returns the filesystems the driver can format
+func Filesystems() []string {
+	names := []string{}
+	for name := range mkfsSpecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ValidateFsType checks that the driver can format the filesystem
+func ValidateFsType(fsType string) error {
+	if _, ok := mkfsSpecs[fsType]; !ok {
+		return fmt.Errorf("unsupported filesystem %q, use one of %s", fsType, strings.Join(Filesystems(), ", "))
+	}
+	return nil
+}
+
+// MkfsOption is a mkfs flag with its value, if any
+type MkfsOption struct {
+	Flag  string
+	Value string
+}
+
+// MkfsOptions are the options mkfs runs with, in order
+type MkfsOptions []MkfsOption
+
+// ParseMkfsOptions parses and validates the blank separated mkfs options of
+// the filesystem, such as "-b 4096 -L data -E lazy_itable_init=0"
+func ParseMkfsOptions(fsType, s string) (MkfsOptions, error) {
+	spec, ok := mkfsSpecs[fsType]
+	if !ok {
+		return nil, ValidateFsType(fsType)
+	}
+
+	options := MkfsOptions{}
+	fields := strings.Fields(s)
+	for i := 0; i < len(fields); i++ {
+		flag, ok := spec.flags[fields[i]]
+		if !ok {
+			return nil, fmt.Errorf("mkfs option %q is not allowed for %s", fields[i], fsType)
+		}
+		option := MkfsOption{Flag: fields[i]}
+		if flag.value != nil {
+			if i+1 == len(fields) {
+				return nil, fmt.Errorf("mkfs option %s of %s needs a value", option.Flag, fsType)
+			}
+			i++
+			if !flag.value.MatchString(fields[i]) {
+				return nil, fmt.Errorf("invalid value %q of mkfs option %s of %s", fields[i], option.Flag, fsType)
+			}
+			option.Value = fields[i]
+		}
+		options = append(options, option)
+	}
+	return options, nil
+}
+
+// Merge returns the options with the overrides, an override replaces the
+// options with the same flag
+func (o MkfsOptions) Merge(overrides MkfsOptions) MkfsOptions {
+	replaced := map[string]bool{}
+	for _, opt := range overrides {
+		replaced[opt.Flag] = true
+	}
+
+	merged := MkfsOptions{}
+	for _, opt := range o {
+		if !replaced[opt.Flag] {
+			merged = append(merged, opt)
+		}
+	}
+	return append(merged, overrides...)
+}
+
+// MkfsArgs returns the arguments of mkfs formatting the device, forcing it
+// over existing signatures when the policy is PolicyOverwrite
+func MkfsArgs(device, fsType string, options MkfsOptions, policy Policy) []string {
+	args := []string{"-t", fsType}
+	if policy == PolicyOverwrite && mkfsSpecs[fsType].force != "" {
+		args = append(args, mkfsSpecs[fsType].force)
+	}
+	for _, opt := range options {
+		args = append(args, opt.Flag)
+		if opt.Value != "" {
+			args = append(args, opt.Value)
+		}
+	}
+	return append(args, device)
+}
+
+// Profile holds the defaults of a filesystem set in the driver config
+type Profile struct {
+	// MkfsOptions are the mkfs options of every volume with the filesystem
+	MkfsOptions string `json:"mkfsOptions,omitempty"`
+}
+
+// Profiles are the filesystem profiles by filesystem type
+type Profiles map[string]Profile
+
+// Validate checks the filesystem and the options of every profile
+func (p Profiles) Validate() error {
+	for fsType, profile := range p {
+		if _, err := ParseMkfsOptions(fsType, profile.MkfsOptions); err != nil {
+			return fmt.Errorf("invalid %s profile: %s", fsType, err.Error())
+		}
+	}
+	return nil
+}
+
+// MkfsOptions returns the options of the filesystem profile overridden by
+// the options of the volume
+func (p Profiles) MkfsOptions(fsType, volumeOptions string) (MkfsOptions, error) {
+	defaults, err := ParseMkfsOptions(fsType, p[fsType].MkfsOptions)
+	if err != nil {
+		return nil, err
+	}
+	overrides, err := ParseMkfsOptions(fsType, volumeOptions)
+	if err != nil {
+		return nil, err
+	}
+	return defaults.Merge(overrides), nil
+}
@@ -0,0 +1,99 @@
+package format
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseMkfsOptions(t *testing.T) {
+	cases := []struct {
+		fsType        string
+		options       string
+		expected      MkfsOptions
+		expectedError bool
+	}{
+		{"ext4", "", MkfsOptions{}, false},
+		{"ext4", "-b 4096 -m 1 -L data -E lazy_itable_init=0,lazy_journal_init=0", MkfsOptions{{"-b", "4096"}, {"-m", "1"}, {"-L", "data"}, {"-E", "lazy_itable_init=0,lazy_journal_init=0"}}, false},
+		{"ext3", "-j -O ^has_journal,dir_index", MkfsOptions{{"-j", ""}, {"-O", "^has_journal,dir_index"}}, false},
+		{"xfs", "-b size=8192 -d su=64k,sw=4 -L db -K", MkfsOptions{{"-b", "size=8192"}, {"-d", "su=64k,sw=4"}, {"-L", "db"}, {"-K", ""}}, false},
+		{"btrfs", "-d raid1 -m dup -n 16k -L data", MkfsOptions{{"-d", "raid1"}, {"-m", "dup"}, {"-n", "16k"}, {"-L", "data"}}, false},
+		{"vfat", "", nil, true},
+		{"ext4", "-b 3000", nil, true},
+		{"ext4", "-L", nil, true},
+		{"ext4", "-L this-label-is-too-long", nil, true},
+		{"xfs", "-f", nil, true},
+		{"ext4", "-F", nil, true},
+		{"ext4", "/dev/sdb", nil, true},
+		{"xfs", "-L data -b 4096", nil, true},
+		{"btrfs", "-d raid7", nil, true},
+	}
+
+	for _, c := range cases {
+		options, err := ParseMkfsOptions(c.fsType, c.options)
+		if (err != nil) != c.expectedError {
+			t.Errorf("%s %q: expected error %t but got %v", c.fsType, c.options, c.expectedError, err)
+			continue
+		}
+		if !reflect.DeepEqual(options, c.expected) {
+			t.Errorf("%s %q: expected %v but got %v", c.fsType, c.options, c.expected, options)
+		}
+	}
+}
+
+func TestProfiles(t *testing.T) {
+	profiles := Profiles{
+		"ext4": {MkfsOptions: "-m 0 -E lazy_itable_init=0"},
+		"xfs":  {MkfsOptions: "-b size=4096"},
+	}
+	if err := profiles.Validate(); err != nil {
+		t.Fatalf("an error ocurred validating the profiles: %s", err)
+	}
+
+	cases := []struct {
+		fsType   string
+		volume   string
+		expected []string
+	}{
+		{"ext4", "", []string{"-t", "ext4", "-m", "0", "-E", "lazy_itable_init=0", "/dev/sdb"}},
+		{"ext4", "-m 1 -L data", []string{"-t", "ext4", "-E", "lazy_itable_init=0", "-m", "1", "-L", "data", "/dev/sdb"}},
+		{"xfs", "-L db", []string{"-t", "xfs", "-b", "size=4096", "-L", "db", "/dev/sdb"}},
+		{"btrfs", "", []string{"-t", "btrfs", "/dev/sdb"}},
+	}
+
+	for _, c := range cases {
+		options, err := profiles.MkfsOptions(c.fsType, c.volume)
+		if err != nil {
+			t.Errorf("an error ocurred merging %s options %q: %s", c.fsType, c.volume, err)
+			continue
+		}
+		if args := MkfsArgs("/dev/sdb", c.fsType, options, PolicyIfEmpty); !reflect.DeepEqual(args, c.expected) {
+			t.Errorf("%s %q: expected mkfs arguments %v but got %v", c.fsType, c.volume, c.expected, args)
+		}
+	}
+
+	if err := (Profiles{"xfs": {MkfsOptions: "-E lazy_itable_init=0"}}).Validate(); err == nil {
+		t.Errorf("expected error validating a profile with ext4 options for xfs")
+	}
+	if err := (Profiles{"zfs": {}}).Validate(); err == nil {
+		t.Errorf("expected error validating a profile of an unsupported filesystem")
+	}
+}
+
+func TestMkfsArgsForce(t *testing.T) {
+	cases := []struct {
+		fsType   string
+		policy   Policy
+		expected []string
+	}{
+		{"ext4", PolicyIfEmpty, []string{"-t", "ext4", "/dev/sdb"}},
+		{"ext4", PolicyOverwrite, []string{"-t", "ext4", "-F", "/dev/sdb"}},
+		{"xfs", PolicyOverwrite, []string{"-t", "xfs", "-f", "/dev/sdb"}},
+		{"btrfs", PolicyIfNoSignature, []string{"-t", "btrfs", "/dev/sdb"}},
+	}
+
+	for _, c := range cases {
+		if args := MkfsArgs("/dev/sdb", c.fsType, nil, c.policy); !reflect.DeepEqual(args, c.expected) {
+			t.Errorf("%s %s: expected %v but got %v", c.fsType, c.policy, c.expected, args)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+/*
+Package format decides whether a device may be formatted, so mkfs never runs
+over data the driver did not write.
+*/
+package format
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/1and1/oneandone-flex-volume/pkg/probe"
+	"golang.org/x/sys/unix"
+)
+
+// Policy tells which devices may be formatted
+type Policy string
+
+// Format policies
+const (
+	// PolicyNever never formats, the device must hold the filesystem already
+	PolicyNever Policy = "never"
+	// PolicyIfEmpty formats devices without any signature and with zeroed
+	// start and end, it is the default
+	PolicyIfEmpty Policy = "ifEmpty"
+	// PolicyIfNoSignature also formats devices holding data no known
+	// signature matches
+	PolicyIfNoSignature Policy = "ifNoSignature"
+	// PolicyOverwrite formats over any other filesystem, partition table,
+	// RAID, LVM or LUKS header
+	PolicyOverwrite Policy = "overwrite"
+)
+
+// ParsePolicy validates the formatPolicy option, empty means PolicyIfEmpty
+func ParsePolicy(s string) (Policy, error) {
+	switch p := Policy(s); p {
+	case "":
+		return PolicyIfEmpty, nil
+	case PolicyNever, PolicyIfEmpty, PolicyIfNoSignature, PolicyOverwrite:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown format policy %q, use one of %s, %s, %s or %s", s, PolicyNever, PolicyIfEmpty, PolicyIfNoSignature, PolicyOverwrite)
+	}
+}
+
+// NeedsFormat probes the device with probeDevice, usually probe.Probe, and
+// tells whether it has to be formatted with fsType before mounting. It
+// returns an error when the device does not hold fsType and the policy does
+// not allow formatting it.
+func NeedsFormat(device, fsType string, policy Policy, probeDevice func(device string) (*probe.Result, error)) (bool, error) {
+	result, err := probeDevice(device)
+	if err != nil {
+		return false, err
+	}
+	format, err := Decide(device, result, fsType, policy)
+	if err != nil || !format {
+		return false, err
+	}
+	if err := ensureNotInUse(device); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Decide tells whether a device with the probed contents has to be formatted
+// with fsType under the policy
+func Decide(device string, result *probe.Result, fsType string, policy Policy) (bool, error) {
+	if result.Usage == probe.UsageFilesystem && result.Type == fsType {
+		return false, nil
+	}
+
+	refuse := func(allowedBy Policy) error {
+		return fmt.Errorf("refusing to format %s with %s: the device holds %s and formatPolicy is %s, set formatPolicy to %s to format it anyway", device, fsType, result, policy, allowedBy)
+	}
+
+	switch {
+	case policy == PolicyNever:
+		return false, fmt.Errorf("refusing to format %s with %s: the device holds %s and formatPolicy is %s", device, fsType, result, policy)
+	case result.Empty:
+		return true, nil
+	case result.Usage == "":
+		if policy == PolicyIfNoSignature || policy == PolicyOverwrite {
+			return true, nil
+		}
+		return false, refuse(PolicyIfNoSignature)
+	default:
+		if policy == PolicyOverwrite {
+			return true, nil
+		}
+		return false, refuse(PolicyOverwrite)
+	}
+}
+
+// ensureNotInUse opens the device exclusively, which fails while it is
+// mounted or held by another device such as a device mapper target
+func ensureNotInUse(device string) error {
+	f, err := os.OpenFile(device, os.O_RDONLY|unix.O_EXCL, 0)
+	if err != nil {
+		return fmt.Errorf("refusing to format %s: the device is in use: %s", device, err.Error())
+	}
+	return f.Close()
+}
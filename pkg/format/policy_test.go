@@ -0,0 +1,111 @@
+package format
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/1and1/oneandone-flex-volume/pkg/probe"
+)
+
+func TestParsePolicy(t *testing.T) {
+	cases := []struct {
+		value         string
+		expected      Policy
+		expectedError bool
+	}{
+		{"", PolicyIfEmpty, false},
+		{"never", PolicyNever, false},
+		{"ifEmpty", PolicyIfEmpty, false},
+		{"ifNoSignature", PolicyIfNoSignature, false},
+		{"overwrite", PolicyOverwrite, false},
+		{"always", "", true},
+	}
+
+	for _, c := range cases {
+		policy, err := ParsePolicy(c.value)
+		if (err != nil) != c.expectedError {
+			t.Errorf("%q: expected error %t but got %v", c.value, c.expectedError, err)
+		}
+		if policy != c.expected {
+			t.Errorf("%q: expected %q but got %q", c.value, c.expected, policy)
+		}
+	}
+}
+
+func TestDecide(t *testing.T) {
+	empty := &probe.Result{Empty: true}
+	unknown := &probe.Result{}
+	ext4 := &probe.Result{Type: "ext4", Usage: probe.UsageFilesystem}
+	xfs := &probe.Result{Type: "xfs", Usage: probe.UsageFilesystem}
+	luks := &probe.Result{Type: "crypto_LUKS", Usage: probe.UsageCrypto}
+	gpt := &probe.Result{Type: "gpt", Usage: probe.UsagePartitionTable}
+
+	cases := []struct {
+		result   *probe.Result
+		policy   Policy
+		format   bool
+		errorHas string
+	}{
+		{ext4, PolicyNever, false, ""},
+		{ext4, PolicyIfEmpty, false, ""},
+		{ext4, PolicyOverwrite, false, ""},
+		{empty, PolicyNever, false, "formatPolicy is never"},
+		{empty, PolicyIfEmpty, true, ""},
+		{unknown, PolicyIfEmpty, false, "set formatPolicy to ifNoSignature"},
+		{unknown, PolicyIfNoSignature, true, ""},
+		{xfs, PolicyIfEmpty, false, "holds a xfs filesystem signature"},
+		{xfs, PolicyIfNoSignature, false, "set formatPolicy to overwrite"},
+		{xfs, PolicyOverwrite, true, ""},
+		{luks, PolicyIfNoSignature, false, "crypto_LUKS"},
+		{gpt, PolicyIfEmpty, false, "gpt partition_table"},
+		{gpt, PolicyOverwrite, true, ""},
+	}
+
+	for _, c := range cases {
+		format, err := Decide("/dev/sdb", c.result, "ext4", c.policy)
+		if format != c.format {
+			t.Errorf("%s under %s: expected format %t but got %t", c.result, c.policy, c.format, format)
+		}
+		if c.errorHas == "" && err != nil {
+			t.Errorf("%s under %s: expected no error but got %s", c.result, c.policy, err)
+		}
+		if c.errorHas != "" && (err == nil || !strings.Contains(err.Error(), c.errorHas)) {
+			t.Errorf("%s under %s: expected an error containing %q but got %v", c.result, c.policy, c.errorHas, err)
+		}
+	}
+}
+
+func TestNeedsFormat(t *testing.T) {
+	cases := []struct {
+		result   *probe.Result
+		probeErr error
+		errorHas string
+	}{
+		{&probe.Result{Type: "ext4", Usage: probe.UsageFilesystem}, nil, ""},
+		{&probe.Result{Type: "xfs", Usage: probe.UsageFilesystem}, nil, "refusing to format /dev/sdb"},
+		{nil, fmt.Errorf("blkid failed"), "blkid failed"},
+	}
+
+	for _, c := range cases {
+		probed := ""
+		probeDevice := func(device string) (*probe.Result, error) {
+			probed = device
+			return c.result, c.probeErr
+		}
+
+		format, err := NeedsFormat("/dev/sdb", "ext4", PolicyIfEmpty, probeDevice)
+		if probed != "/dev/sdb" {
+			t.Errorf("expected /dev/sdb to be probed but got %q", probed)
+		}
+		if format {
+			t.Errorf("%s: expected no format", c.result)
+		}
+		if c.errorHas == "" && err != nil {
+			t.Errorf("%s: expected no error but got %s", c.result, err)
+		}
+		if c.errorHas != "" && (err == nil || !strings.Contains(err.Error(), c.errorHas)) {
+			t.Errorf("%s: expected an error containing %q but got %v", c.result, c.errorHas, err)
+		}
+	}
+}
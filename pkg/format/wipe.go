@@ -0,0 +1,41 @@
+package format
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// wipeSize is how much of the start and the end of a device is zeroed, it
+// covers the area the probe checks to tell whether a device is empty
+const wipeSize = 1 << 20
+
+// Wipe zeroes the start and the end of the device so it probes as empty
+func Wipe(device string) error {
+	f, err := os.OpenFile(device, os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("could not open %s: %s", device, err.Error())
+	}
+	defer f.Close()
+
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return fmt.Errorf("could not get the size of %s: %s", device, err.Error())
+	}
+
+	zeros := make([]byte, wipeSize)
+	offsets := []int64{0}
+	if size > wipeSize {
+		offsets = append(offsets, size-wipeSize)
+	}
+	for _, off := range offsets {
+		n := int64(len(zeros))
+		if off+n > size {
+			n = size - off
+		}
+		if _, err := f.WriteAt(zeros[:n], off); err != nil {
+			return fmt.Errorf("could not wipe %s: %s", device, err.Error())
+		}
+	}
+	return f.Sync()
+}
@@ -0,0 +1,45 @@
+package format
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestWipe(t *testing.T) {
+	for _, size := range []int{4096, wipeSize, 3 * wipeSize} {
+		f, err := ioutil.TempFile("", "wipe")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(f.Name())
+		f.Write(bytes.Repeat([]byte{0xff}, size))
+		f.Close()
+
+		if err := Wipe(f.Name()); err != nil {
+			t.Fatalf("an error ocurred wiping %d bytes: %s", size, err)
+		}
+
+		b, _ := ioutil.ReadFile(f.Name())
+		if len(b) != size {
+			t.Errorf("expected wiping not to change the size %d but got %d", size, len(b))
+		}
+		if !bytes.Equal(b[:minInt(size, wipeSize)], make([]byte, minInt(size, wipeSize))) {
+			t.Errorf("expected the start of %d bytes to be zeroed", size)
+		}
+		if !bytes.Equal(b[size-minInt(size, wipeSize):], make([]byte, minInt(size, wipeSize))) {
+			t.Errorf("expected the end of %d bytes to be zeroed", size)
+		}
+		if size > 2*wipeSize && b[wipeSize] != 0xff {
+			t.Errorf("expected the middle of %d bytes to be kept", size)
+		}
+	}
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,169 @@
+/*
+Package journal records the phases of the operations the driver runs on the
+node, so the operations a killed process left half done can be found and
+rolled forward or back afterwards.
+*/
+package journal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultDir keeps the journal across reboots
+const DefaultDir = "/var/lib/oneandone-flex-volume/journal"
+
+// Entry is an operation in progress
+type Entry struct {
+	// ID names the journal file of the entry
+	ID string `json:"id"`
+	// Operation is the flex command, such as mountdevice
+	Operation string `json:"operation"`
+	// Phase is the step the operation was at last
+	Phase string `json:"phase"`
+	// StorageID is the storage the operation acts on
+	StorageID string `json:"storageID,omitempty"`
+	// Device is the device argument of the command, or the device being
+	// formatted during the format phase
+	Device string `json:"device,omitempty"`
+	// UUID is the UUID of the storage, it tells whether the device is
+	// still its disk
+	UUID string `json:"uuid,omitempty"`
+	// MountDir is the mount directory argument of the command
+	MountDir string `json:"mountDir,omitempty"`
+	// Keys are the locks the operation runs under
+	Keys    []string  `json:"keys,omitempty"`
+	PID     int       `json:"pid"`
+	Started time.Time `json:"started"`
+	Updated time.Time `json:"updated"`
+}
+
+func (e Entry) String() string {
+	volume := e.StorageID
+	if volume == "" {
+		volume = e.Device
+	}
+	return fmt.Sprintf("%s of %s at phase %s started %s by pid %d", e.Operation, volume, e.Phase, e.Started.Format(time.RFC3339), e.PID)
+}
+
+// Journal keeps an entry file per operation in progress. A nil journal
+// records nothing.
+type Journal struct {
+	dir string
+}
+
+// New returns a journal keeping its entries in dir
+func New(dir string) *Journal {
+	return &Journal{dir: dir}
+}
+
+// Begin records the start of the operation at its first phase
+func (j *Journal) Begin(e *Entry, phase string) error {
+	if j == nil {
+		return nil
+	}
+	e.PID = os.Getpid()
+	e.Started = time.Now()
+	e.ID = fmt.Sprintf("%s-%d-%d", e.Operation, e.Started.UnixNano(), e.PID)
+	return j.Phase(e, phase)
+}
+
+// Phase records that the operation moved on to the phase
+func (j *Journal) Phase(e *Entry, phase string) error {
+	if j == nil {
+		return nil
+	}
+	e.Phase = phase
+	e.Updated = time.Now()
+	return j.write(e)
+}
+
+// Done removes the entry of the finished operation
+func (j *Journal) Done(e *Entry) error {
+	if j == nil {
+		return nil
+	}
+	if err := os.Remove(j.path(e.ID)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("could not remove journal entry %s: %s", e.ID, err.Error())
+	}
+	return nil
+}
+
+// Pending returns the entries of the operations not done, oldest first
+func (j *Journal) Pending() ([]Entry, error) {
+	if j == nil {
+		return nil, nil
+	}
+	files, err := ioutil.ReadDir(j.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read journal %s: %s", j.dir, err.Error())
+	}
+
+	entries := []Entry{}
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(j.dir, f.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("could not read journal entry %s: %s", f.Name(), err.Error())
+		}
+		e := Entry{}
+		if err := json.Unmarshal(b, &e); err != nil {
+			return nil, fmt.Errorf("could not parse journal entry %s: %s", f.Name(), err.Error())
+		}
+		entries = append(entries, e)
+	}
+
+	sort.SliceStable(entries, func(a, b int) bool { return entries[a].Started.Before(entries[b].Started) })
+	return entries, nil
+}
+
+// write replaces the entry file atomically and syncs it to disk, so a crash
+// leaves either the previous phase or the new one
+func (j *Journal) write(e *Entry) error {
+	if err := os.MkdirAll(j.dir, 0700); err != nil {
+		return fmt.Errorf("could not create journal %s: %s", j.dir, err.Error())
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("could not encode journal entry %s: %s", e.ID, err.Error())
+	}
+
+	tmp, err := ioutil.TempFile(j.dir, ".entry")
+	if err != nil {
+		return fmt.Errorf("could not write journal entry %s: %s", e.ID, err.Error())
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not write journal entry %s: %s", e.ID, err.Error())
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not sync journal entry %s: %s", e.ID, err.Error())
+	}
+	tmp.Close()
+
+	if err := os.Rename(tmp.Name(), j.path(e.ID)); err != nil {
+		return fmt.Errorf("could not write journal entry %s: %s", e.ID, err.Error())
+	}
+	if d, err := os.Open(j.dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+func (j *Journal) path(id string) string {
+	return filepath.Join(j.dir, id+".json")
+}
@@ -0,0 +1,65 @@
+package journal
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	j := New(dir + "/journal")
+
+	if pending, err := j.Pending(); err != nil || len(pending) != 0 {
+		t.Fatalf("expected an empty journal but got %v %v", pending, err)
+	}
+
+	mount := &Entry{Operation: "mountdevice", StorageID: "0123", MountDir: "/mnt/pv-data", Keys: []string{"storage:0123"}}
+	unmount := &Entry{Operation: "unmountdevice", Device: "/mnt/pv-other"}
+	if err := j.Begin(mount, "attach"); err != nil {
+		t.Fatalf("an error ocurred beginning an operation %s", err)
+	}
+	if err := j.Begin(unmount, "unmount"); err != nil {
+		t.Fatalf("an error ocurred beginning an operation %s", err)
+	}
+	if err := j.Phase(mount, "format"); err != nil {
+		t.Fatalf("an error ocurred recording a phase %s", err)
+	}
+
+	pending, err := j.Pending()
+	if err != nil {
+		t.Fatalf("an error ocurred reading the journal %s", err)
+	}
+	if len(pending) != 2 || pending[0].ID != mount.ID || pending[1].ID != unmount.ID {
+		t.Fatalf("expected both operations oldest first but got %v", pending)
+	}
+	if pending[0].Phase != "format" || !reflect.DeepEqual(pending[0].Keys, mount.Keys) || pending[0].PID != os.Getpid() {
+		t.Errorf("expected %+v but got %+v", *mount, pending[0])
+	}
+
+	if err := j.Done(mount); err != nil {
+		t.Fatalf("an error ocurred finishing an operation %s", err)
+	}
+	if err := j.Done(mount); err != nil {
+		t.Errorf("expected finishing twice to succeed but got %s", err)
+	}
+	if pending, _ := j.Pending(); len(pending) != 1 || pending[0].ID != unmount.ID {
+		t.Errorf("expected only the unmount to be pending but got %v", pending)
+	}
+}
+
+func TestNilJournal(t *testing.T) {
+	var j *Journal
+	e := &Entry{Operation: "mountdevice"}
+	if err := j.Begin(e, "attach"); err != nil {
+		t.Errorf("expected a nil journal to record nothing but got %s", err)
+	}
+	if pending, err := j.Pending(); err != nil || len(pending) != 0 {
+		t.Errorf("expected a nil journal to have nothing pending but got %v %v", pending, err)
+	}
+}
@@ -0,0 +1,230 @@
+/*
+Package lock serializes the operations the kubelet runs concurrently on the
+same volume with flock(2) locks on files named after the volume keys.
+*/
+package lock
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// DefaultDir keeps the lock files on a tmpfs, so they go away on reboot
+const DefaultDir = "/var/run/oneandone-flex-volume/locks"
+
+// Lock defaults
+const (
+	DefaultTimeout  = 2 * time.Minute
+	DefaultInterval = 100 * time.Millisecond
+)
+
+// unsafeChars are replaced in lock file names
+var unsafeChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// Holder describes the process holding a lock
+type Holder struct {
+	PID     int
+	Command string
+	Since   time.Time
+}
+
+func (h Holder) String() string {
+	return fmt.Sprintf("pid %d (%s) since %s", h.PID, h.Command, h.Since.Format(time.RFC3339))
+}
+
+// Manager hands out the locks of the volume keys
+type Manager struct {
+	// Dir holds the lock files
+	Dir string
+	// Timeout is how long to wait for a lock held by another process
+	Timeout time.Duration
+	// Interval is the delay between two tries
+	Interval time.Duration
+	// sleep is replaced in tests
+	sleep func(time.Duration)
+}
+
+// NewManager returns a lock manager keeping its files in dir
+func NewManager(dir string) *Manager {
+	return &Manager{
+		Dir:      dir,
+		Timeout:  DefaultTimeout,
+		Interval: DefaultInterval,
+		sleep:    time.Sleep,
+	}
+}
+
+// Lock is a set of held volume locks
+type Lock struct {
+	files []*os.File
+	// Stale are the holders that died without releasing one of the locks,
+	// their operation may have been left half done
+	Stale []Holder
+}
+
+// Lock takes the locks of every key for the command, in a fixed order so
+// two commands sharing keys cannot deadlock. It waits up to the timeout for
+// locks held by other processes and reports their holders when it gives up.
+func (m *Manager) Lock(command string, keys ...string) (*Lock, error) {
+	return m.lock(command, m.Timeout, keys)
+}
+
+// TryLock takes the locks of every key for the command without waiting for
+// locks held by other processes
+func (m *Manager) TryLock(command string, keys ...string) (*Lock, error) {
+	return m.lock(command, 0, keys)
+}
+
+func (m *Manager) lock(command string, timeout time.Duration, keys []string) (*Lock, error) {
+	if err := os.MkdirAll(m.Dir, 0700); err != nil {
+		return nil, fmt.Errorf("could not create lock directory %s: %s", m.Dir, err.Error())
+	}
+
+	l := &Lock{}
+	deadline := time.Now().Add(timeout)
+	for _, key := range sortedKeys(keys) {
+		f, stale, err := m.lockKey(command, key, timeout, deadline)
+		if err != nil {
+			l.Unlock()
+			return nil, err
+		}
+		l.files = append(l.files, f)
+		if stale != nil {
+			l.Stale = append(l.Stale, *stale)
+		}
+	}
+	return l, nil
+}
+
+// lockKey waits for the lock of the key, records the command as its holder
+// and returns the holder left behind by a process that died holding it
+func (m *Manager) lockKey(command, key string, timeout time.Duration, deadline time.Time) (*os.File, *Holder, error) {
+	path := filepath.Join(m.Dir, FileName(key))
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not open lock file %s: %s", path, err.Error())
+	}
+
+	for {
+		err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if err != unix.EWOULDBLOCK {
+			f.Close()
+			return nil, nil, fmt.Errorf("could not lock %s: %s", path, err.Error())
+		}
+		if time.Now().Add(m.Interval).After(deadline) {
+			msg := fmt.Sprintf("the lock of %s is taken", key)
+			if timeout > 0 {
+				msg = fmt.Sprintf("timed out after %s waiting for the lock of %s", timeout, key)
+			}
+			if h, ok := readHolder(f); ok {
+				msg += ", held by " + h.String()
+			}
+			f.Close()
+			return nil, nil, errors.New(msg)
+		}
+		m.sleep(m.Interval)
+	}
+
+	var stale *Holder
+	if h, ok := readHolder(f); ok {
+		stale = &h
+	}
+	if err := writeHolder(f, Holder{PID: os.Getpid(), Command: command, Since: time.Now()}); err != nil {
+		unix.Flock(int(f.Fd()), unix.LOCK_UN)
+		f.Close()
+		return nil, nil, fmt.Errorf("could not record the holder of %s: %s", path, err.Error())
+	}
+	return f, stale, nil
+}
+
+// Unlock clears the holder records and releases the locks
+func (l *Lock) Unlock() error {
+	var failed []string
+	for i := len(l.files) - 1; i >= 0; i-- {
+		f := l.files[i]
+		f.Truncate(0)
+		if err := unix.Flock(int(f.Fd()), unix.LOCK_UN); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", f.Name(), err.Error()))
+		}
+		f.Close()
+	}
+	l.files = nil
+	if len(failed) > 0 {
+		return fmt.Errorf("could not unlock %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// FileName returns the lock file name of the key, readable but made unique
+// by a hash of the key
+func FileName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	name := strings.Trim(unsafeChars.ReplaceAllString(key, "_"), "_")
+	if len(name) > 64 {
+		name = name[len(name)-64:]
+	}
+	return name + "-" + hex.EncodeToString(sum[:8]) + ".lock"
+}
+
+// sortedKeys returns the distinct non-empty keys in order
+func sortedKeys(keys []string) []string {
+	seen := map[string]bool{}
+	sorted := []string{}
+	for _, k := range keys {
+		if k != "" && !seen[k] {
+			seen[k] = true
+			sorted = append(sorted, k)
+		}
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+// readHolder reads the holder record of the lock file, a released lock has
+// none
+func readHolder(f *os.File) (Holder, bool) {
+	if _, err := f.Seek(0, 0); err != nil {
+		return Holder{}, false
+	}
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return Holder{}, false
+	}
+	fields := strings.SplitN(strings.TrimSpace(string(b)), " ", 3)
+	if len(fields) != 3 {
+		return Holder{}, false
+	}
+	pid, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return Holder{}, false
+	}
+	since, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return Holder{}, false
+	}
+	return Holder{PID: pid, Since: time.Unix(since, 0), Command: fields[2]}, true
+}
+
+// writeHolder replaces the holder record of the lock file
+func writeHolder(f *os.File, h Holder) error {
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	_, err := f.WriteAt([]byte(fmt.Sprintf("%d %d %s\n", h.PID, h.Since.Unix(), h.Command)), 0)
+	return err
+}
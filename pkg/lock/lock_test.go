@@ -0,0 +1,90 @@
+package lock
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestManager(t *testing.T) (*Manager, func()) {
+	dir, err := ioutil.TempDir("", "lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewManager(filepath.Join(dir, "locks"))
+	m.Timeout = 50 * time.Millisecond
+	m.Interval = 10 * time.Millisecond
+	return m, func() { os.RemoveAll(dir) }
+}
+
+func TestLock(t *testing.T) {
+	m, cleanup := newTestManager(t)
+	defer cleanup()
+
+	l, err := m.Lock("mountdevice", "storage:0123", "path:/mnt/pv-data")
+	if err != nil {
+		t.Fatalf("an error ocurred locking %s", err)
+	}
+
+	_, err = m.Lock("unmountdevice", "path:/mnt/pv-data")
+	if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("held by pid %d (mountdevice)", os.Getpid())) {
+		t.Errorf("expected a timeout naming the holder but got %v", err)
+	}
+
+	other, err := m.Lock("mountdevice", "storage:4567", "path:/mnt/pv-other")
+	if err != nil {
+		t.Errorf("an error ocurred locking another volume %s", err)
+	} else {
+		other.Unlock()
+	}
+
+	if err := l.Unlock(); err != nil {
+		t.Fatalf("an error ocurred unlocking %s", err)
+	}
+	l, err = m.Lock("unmountdevice", "path:/mnt/pv-data", "path:/mnt/pv-data")
+	if err != nil {
+		t.Fatalf("an error ocurred locking once released %s", err)
+	}
+	if len(l.Stale) != 0 {
+		t.Errorf("expected no stale holder after a release but got %v", l.Stale)
+	}
+	l.Unlock()
+}
+
+func TestStaleLock(t *testing.T) {
+	m, cleanup := newTestManager(t)
+	defer cleanup()
+
+	// a process killed while holding the lock leaves its record behind
+	os.MkdirAll(m.Dir, 0700)
+	since := time.Unix(1500000000, 0)
+	ioutil.WriteFile(filepath.Join(m.Dir, FileName("storage:0123")), []byte("4242 1500000000 mountdevice\n"), 0600)
+
+	l, err := m.Lock("unmountdevice", "storage:0123")
+	if err != nil {
+		t.Fatalf("an error ocurred taking over a stale lock %s", err)
+	}
+	defer l.Unlock()
+	expected := Holder{PID: 4242, Command: "mountdevice", Since: since}
+	if len(l.Stale) != 1 || l.Stale[0] != expected {
+		t.Errorf("expected stale holder %v but got %v", expected, l.Stale)
+	}
+}
+
+func TestFileName(t *testing.T) {
+	a := FileName("path:/var/lib/kubelet/plugins/mounts/pv-data")
+	b := FileName("path:/var/lib/kubelet/plugins/mounts/pv_data")
+	if a == b {
+		t.Errorf("expected distinct file names for distinct keys but got %s", a)
+	}
+	if strings.Contains(a, "/") || !strings.HasPrefix(a, "path_var_lib_kubelet") {
+		t.Errorf("expected a readable file name without slashes but got %s", a)
+	}
+	if long := FileName(strings.Repeat("x", 300)); len(long) > 100 {
+		t.Errorf("expected a short file name but got %d characters", len(long))
+	}
+}
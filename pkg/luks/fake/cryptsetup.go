@@ -0,0 +1,104 @@
+/*
+Package fake provides an in-memory implementation of luks.Cryptsetup.
+*/
+package fake
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+
+	"github.com/1and1/oneandone-flex-volume/pkg/luks"
+)
+
+// Cryptsetup is an in-memory luks.Cryptsetup remembering the key of every
+// formatted device and the open mappings
+type Cryptsetup struct {
+	mu       sync.Mutex
+	keys     map[string][]byte
+	mappings map[string]string
+	actions  []string
+}
+
+var _ luks.Cryptsetup = &Cryptsetup{}
+
+// NewCryptsetup returns a fake without any LUKS device
+func NewCryptsetup() *Cryptsetup {
+	return &Cryptsetup{
+		keys:     map[string][]byte{},
+		mappings: map[string]string{},
+	}
+}
+
+// Actions returns the calls made so far, such as "Format /dev/sdb"
+func (c *Cryptsetup) Actions() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.actions...)
+}
+
+// IsLUKS tells whether the device was formatted
+func (c *Cryptsetup) IsLUKS(device string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.keys[device]
+	return ok
+}
+
+// Format remembers the key of the device and opens the mapping
+func (c *Cryptsetup) Format(device, name string, key []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.actions = append(c.actions, "Format "+device)
+	c.keys[device] = append([]byte(nil), key...)
+	c.mappings[name] = device
+	return nil
+}
+
+// Open maps the device when the key matches the one it was formatted with
+func (c *Cryptsetup) Open(device, name string, key []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.actions = append(c.actions, "Open "+device)
+	stored, ok := c.keys[device]
+	if !ok {
+		return fmt.Errorf("device %s is not a LUKS device", device)
+	}
+	if !bytes.Equal(stored, key) {
+		return fmt.Errorf("no key available with this passphrase for %s", device)
+	}
+	c.mappings[name] = device
+	return nil
+}
+
+// Close removes the mapping
+func (c *Cryptsetup) Close(name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.actions = append(c.actions, "Close "+name)
+	delete(c.mappings, name)
+	return nil
+}
+
+// Resize fails when the mapping does not exist or the key does not match
+func (c *Cryptsetup) Resize(name string, key []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.actions = append(c.actions, "Resize "+name)
+	device, ok := c.mappings[name]
+	if !ok {
+		return fmt.Errorf("mapping %s is not active", name)
+	}
+	if !bytes.Equal(c.keys[device], key) {
+		return fmt.Errorf("no key available with this passphrase for %s", name)
+	}
+	return nil
+}
+
+// IsOpen tells whether the mapping exists
+func (c *Cryptsetup) IsOpen(name string) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.mappings[name]
+	return ok, nil
+}
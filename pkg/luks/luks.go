@@ -0,0 +1,108 @@
+/*
+Package luks encrypts block devices with LUKS and maps them as dm-crypt
+devices through cryptsetup.
+*/
+package luks
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/1and1/oneandone-flex-volume/pkg/format"
+)
+
+// DevMapperPath is where the device mapper creates the mapped devices
+var DevMapperPath = "/dev/mapper"
+
+// Cryptsetup formats and maps LUKS devices
+type Cryptsetup interface {
+	// Format writes a LUKS header protected by the key on the device, opens
+	// it as the mapping and zeroes the start and the end of the mapping so
+	// it probes as an empty device
+	Format(device, name string, key []byte) error
+	// Open maps the LUKS device at MapperPath(name) with the key
+	Open(device, name string, key []byte) error
+	// Close removes the mapping
+	Close(name string) error
+	// Resize grows the mapping to the size of the underlying device, LUKS2
+	// mappings need the key
+	Resize(name string, key []byte) error
+	// IsOpen tells whether the mapping exists
+	IsOpen(name string) (bool, error)
+}
+
+// MapperPath returns the path of the mapped device
+func MapperPath(name string) string {
+	return filepath.Join(DevMapperPath, name)
+}
+
+// BinaryCryptsetup runs the cryptsetup binary of the host
+type BinaryCryptsetup struct{}
+
+var _ Cryptsetup = &BinaryCryptsetup{}
+
+// New returns a Cryptsetup running the cryptsetup binary
+func New() Cryptsetup {
+	return &BinaryCryptsetup{}
+}
+
+// Format writes a LUKS2 header on the device. cryptsetup refuses to format
+// a device in use since it opens it exclusively.
+func (c *BinaryCryptsetup) Format(device, name string, key []byte) error {
+	if err := run(key, "luksFormat", "--batch-mode", "--type", "luks2", "--key-file", "-", device); err != nil {
+		return err
+	}
+	if err := c.Open(device, name, key); err != nil {
+		return err
+	}
+	return format.Wipe(MapperPath(name))
+}
+
+// Open maps the device, reading the key from stdin
+func (c *BinaryCryptsetup) Open(device, name string, key []byte) error {
+	if open, err := c.IsOpen(name); err != nil || open {
+		return err
+	}
+	return run(key, "luksOpen", "--key-file", "-", device, name)
+}
+
+// Close removes the mapping if it exists
+func (c *BinaryCryptsetup) Close(name string) error {
+	if open, err := c.IsOpen(name); err != nil || !open {
+		return err
+	}
+	return run(nil, "luksClose", name)
+}
+
+// Resize grows the mapping to the size of the device, reading the key from
+// stdin
+func (c *BinaryCryptsetup) Resize(name string, key []byte) error {
+	return run(key, "resize", "--key-file", "-", name)
+}
+
+// IsOpen checks whether the mapped device exists
+func (c *BinaryCryptsetup) IsOpen(name string) (bool, error) {
+	_, err := os.Stat(MapperPath(name))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("could not stat %s: %s", MapperPath(name), err.Error())
+	}
+	return true, nil
+}
+
+// run runs cryptsetup with the key on stdin, the key is never passed as an
+// argument so it does not show in the process list
+func run(key []byte, args ...string) error {
+	cmd := exec.Command("cryptsetup", args...)
+	cmd.Stdin = bytes.NewReader(key)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("cryptsetup %s failed with error [%s] and output [%s]", strings.Join(args, " "), err.Error(), string(out))
+	}
+	return nil
+}
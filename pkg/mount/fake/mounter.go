@@ -0,0 +1,199 @@
+/*
+Package fake provides an in-memory implementation of mount.Mounter.
+
+It keeps a mount table with the semantics of /proc/self/mountinfo: bind
+mounts share the device of their source and mounts stack on top of each
+other at the same mount point.
+*/
+package fake
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/1and1/oneandone-flex-volume/pkg/mount"
+)
+
+// Operations errors can be injected into
+const (
+	OpMount       = "Mount"
+	OpUnmount     = "Unmount"
+	OpUnmountBusy = "UnmountBusy"
+	OpList        = "List"
+)
+
+// Action is a call recorded by the fake mounter
+type Action struct {
+	Op      string
+	Source  string
+	Target  string
+	FsType  string
+	Options []string
+}
+
+// Mounter is an in-memory mount.Mounter
+type Mounter struct {
+	mu      sync.Mutex
+	next    int
+	minor   int
+	devices map[string]int
+	table   []mount.MountInfo
+	errors  map[string]error
+	actions []Action
+}
+
+var _ mount.Mounter = &Mounter{}
+
+// NewMounter returns a fake mounter with only the root filesystem mounted
+func NewMounter() *Mounter {
+	m := &Mounter{
+		next:    1,
+		devices: map[string]int{},
+		errors:  map[string]error{},
+	}
+	m.add("/dev/root", "/", "/", "ext4", []string{"rw"})
+	return m
+}
+
+// InjectError makes the operation fail, target empty matches any target
+func (m *Mounter) InjectError(op, target string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.errors[op+":"+target] = err
+}
+
+// Actions returns the calls made so far
+func (m *Mounter) Actions() []Action {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Action(nil), m.actions...)
+}
+
+// Mount mounts source at target
+func (m *Mounter) Mount(source, target, fsType string, options []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	target = filepath.Clean(target)
+	m.actions = append(m.actions, Action{Op: OpMount, Source: source, Target: target, FsType: fsType, Options: options})
+	if err := m.injected(OpMount, target); err != nil {
+		return err
+	}
+
+	if mount.HasOption(options, "bind") || mount.HasOption(options, "rbind") {
+		var parent *mount.MountInfo
+		source = filepath.Clean(source)
+		for i := range m.table {
+			if isUnder(source, m.table[i].MountPoint) && (parent == nil || len(m.table[i].MountPoint) >= len(parent.MountPoint)) {
+				parent = &m.table[i]
+			}
+		}
+		if parent == nil {
+			return fmt.Errorf("mounting %s at %s failed: no such file or directory", source, target)
+		}
+		rel, _ := filepath.Rel(parent.MountPoint, source)
+		m.add(parent.Source, filepath.Join(parent.Root, rel), target, parent.FsType, mountOptions(options))
+		return nil
+	}
+
+	m.add(source, "/", target, fsType, mountOptions(options))
+	return nil
+}
+
+// Unmount unmounts the topmost mount at target
+func (m *Mounter) Unmount(target string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	target = filepath.Clean(target)
+	m.actions = append(m.actions, Action{Op: OpUnmount, Target: target})
+	if err := m.injected(OpUnmount, target); err != nil {
+		return err
+	}
+	return m.remove(target)
+}
+
+// UnmountBusy unmounts the topmost mount at target, recording the policy
+// as the only option of the action
+func (m *Mounter) UnmountBusy(target string, policy mount.BusyPolicy) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	target = filepath.Clean(target)
+	m.actions = append(m.actions, Action{Op: OpUnmountBusy, Target: target, Options: []string{string(policy)}})
+	if err := m.injected(OpUnmountBusy, target); err != nil {
+		return err
+	}
+	return m.remove(target)
+}
+
+// remove drops the topmost entry at target from the table
+func (m *Mounter) remove(target string) error {
+	for i := len(m.table) - 1; i >= 0; i-- {
+		if m.table[i].MountPoint == target {
+			m.table = append(m.table[:i], m.table[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("unmounting %s failed: invalid argument", target)
+}
+
+// List returns a copy of the mount table
+func (m *Mounter) List() ([]mount.MountInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.injected(OpList, ""); err != nil {
+		return nil, err
+	}
+	return append([]mount.MountInfo(nil), m.table...), nil
+}
+
+func (m *Mounter) injected(op, target string) error {
+	if err, ok := m.errors[op+":"+target]; ok {
+		return err
+	}
+	return m.errors[op+":"]
+}
+
+// add appends an entry to the table, giving each source its own device
+func (m *Mounter) add(source, root, target, fsType string, options []string) {
+	minor, ok := m.devices[source]
+	if !ok {
+		m.minor++
+		minor = m.minor
+		m.devices[source] = minor
+	}
+
+	parentID, depth := 0, -1
+	for _, e := range m.table {
+		if isUnder(target, e.MountPoint) && len(e.MountPoint) >= depth {
+			parentID, depth = e.ID, len(e.MountPoint)
+		}
+	}
+
+	m.table = append(m.table, mount.MountInfo{
+		ID:         m.next,
+		ParentID:   parentID,
+		Major:      8,
+		Minor:      minor,
+		Root:       root,
+		MountPoint: target,
+		Options:    options,
+		FsType:     fsType,
+		Source:     source,
+	})
+	m.next++
+}
+
+// mountOptions returns the per mount point options as the kernel reports them
+func mountOptions(options []string) []string {
+	if mount.HasOption(options, "ro") {
+		return []string{"ro"}
+	}
+	return []string{"rw"}
+}
+
+// isUnder tells whether path is dir or below it
+func isUnder(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, "../")
+}
@@ -0,0 +1,61 @@
+package fake
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/1and1/oneandone-flex-volume/pkg/mount"
+)
+
+func TestStackedAndBindMounts(t *testing.T) {
+	m := NewMounter()
+	staging, target := "/staging/pv-0123", "/pods/uid/volumes/pv-0123"
+
+	if err := m.Mount("/dev/sdb", staging, "ext4", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Mount(staging+"/data", target, "", []string{"bind", "ro"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Mount("tmpfs", staging, "tmpfs", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	table, _ := m.List()
+	bind := mount.MountsAt(table, target)
+	if len(bind) != 1 || bind[0].Source != "/dev/sdb" || bind[0].Root != "/data" || !bind[0].ReadOnly() || !bind[0].IsBind(table) {
+		t.Errorf("expected a read only bind mount of /dev/sdb[/data] but got %+v", bind)
+	}
+
+	if err := m.Unmount(staging); err != nil {
+		t.Fatal(err)
+	}
+	mounted, err := mount.IsMountPoint(m, staging)
+	if err != nil || !mounted {
+		t.Errorf("expected ext4 to stay mounted under the stacked tmpfs, got %t and error %v", mounted, err)
+	}
+	if err := m.Unmount(staging); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Unmount(staging); err == nil {
+		t.Errorf("expected unmounting a directory that is not mounted to fail")
+	}
+}
+
+func TestInjectError(t *testing.T) {
+	m := NewMounter()
+	busy := errors.New("device or resource busy")
+	m.InjectError(OpUnmount, "/mnt/busy", busy)
+
+	m.Mount("/dev/sdb", "/mnt/busy", "ext4", nil)
+	m.Mount("/dev/sdc", "/mnt/other", "ext4", nil)
+	if err := m.Unmount("/mnt/busy"); err != busy {
+		t.Errorf("expected %v but got %v", busy, err)
+	}
+	if err := m.Unmount("/mnt/other"); err != nil {
+		t.Errorf("expected the fault to be limited to /mnt/busy but got %v", err)
+	}
+	if len(m.Actions()) != 4 {
+		t.Errorf("expected 4 recorded actions but got %d", len(m.Actions()))
+	}
+}
@@ -0,0 +1,57 @@
+/*
+Package mount mounts and unmounts filesystems on the node without depending
+on the util-linux binaries installed on the host.
+*/
+package mount
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// Mounter mounts filesystems and inspects the mount table
+type Mounter interface {
+	// Mount mounts source at target with the given filesystem type and
+	// mount(8) style options, fsType is ignored for bind mounts
+	Mount(source, target, fsType string, options []string) error
+	// Unmount unmounts the topmost mount at target
+	Unmount(target string) error
+	// UnmountBusy unmounts the topmost mount at target while processes
+	// keep it busy, as the lazy or force policy tells
+	UnmountBusy(target string, policy BusyPolicy) error
+	// List returns the current mount table
+	List() ([]MountInfo, error)
+}
+
+// IsMountPoint tells whether something is mounted at target
+func IsMountPoint(m Mounter, target string) (bool, error) {
+	mounts, err := MountsAtPath(m, target)
+	if err != nil {
+		return false, err
+	}
+	return len(mounts) > 0, nil
+}
+
+// MountsAtPath returns the entries mounted at target, resolving symlinks
+// the way the kernel reports mount points
+func MountsAtPath(m Mounter, target string) ([]MountInfo, error) {
+	table, err := m.List()
+	if err != nil {
+		return nil, fmt.Errorf("could not list mounts: %s", err.Error())
+	}
+
+	if resolved, err := filepath.EvalSymlinks(target); err == nil {
+		target = resolved
+	}
+	return MountsAt(table, target), nil
+}
+
+// HasOption tells whether the mount(8) style option is in options
+func HasOption(options []string, option string) bool {
+	for _, o := range options {
+		if o == option {
+			return true
+		}
+	}
+	return false
+}
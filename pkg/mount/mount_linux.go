@@ -0,0 +1,173 @@
+package mount
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// flags maps mount(8) options to the mount(2) flags they set or clear
+var flags = map[string]struct {
+	clear bool
+	flag  uintptr
+}{
+	"async":         {true, unix.MS_SYNCHRONOUS},
+	"atime":         {true, unix.MS_NOATIME},
+	"bind":          {false, unix.MS_BIND},
+	"defaults":      {false, 0},
+	"dev":           {true, unix.MS_NODEV},
+	"diratime":      {true, unix.MS_NODIRATIME},
+	"dirsync":       {false, unix.MS_DIRSYNC},
+	"exec":          {true, unix.MS_NOEXEC},
+	"mand":          {false, unix.MS_MANDLOCK},
+	"noatime":       {false, unix.MS_NOATIME},
+	"nodev":         {false, unix.MS_NODEV},
+	"nodiratime":    {false, unix.MS_NODIRATIME},
+	"noexec":        {false, unix.MS_NOEXEC},
+	"nomand":        {true, unix.MS_MANDLOCK},
+	"norelatime":    {true, unix.MS_RELATIME},
+	"nostrictatime": {true, unix.MS_STRICTATIME},
+	"nosuid":        {false, unix.MS_NOSUID},
+	"rbind":         {false, unix.MS_BIND | unix.MS_REC},
+	"relatime":      {false, unix.MS_RELATIME},
+	"remount":       {false, unix.MS_REMOUNT},
+	"ro":            {false, unix.MS_RDONLY},
+	"rw":            {true, unix.MS_RDONLY},
+	"strictatime":   {false, unix.MS_STRICTATIME},
+	"suid":          {true, unix.MS_NOSUID},
+	"sync":          {false, unix.MS_SYNCHRONOUS},
+}
+
+// propagationFlags maps mount(8) propagation options to mount(2) flags
+var propagationFlags = map[string]uintptr{
+	"private":     unix.MS_PRIVATE,
+	"rprivate":    unix.MS_PRIVATE | unix.MS_REC,
+	"shared":      unix.MS_SHARED,
+	"rshared":     unix.MS_SHARED | unix.MS_REC,
+	"slave":       unix.MS_SLAVE,
+	"rslave":      unix.MS_SLAVE | unix.MS_REC,
+	"unbindable":  unix.MS_UNBINDABLE,
+	"runbindable": unix.MS_UNBINDABLE | unix.MS_REC,
+}
+
+// SyscallMounter mounts through mount(2) and reads /proc/self/mountinfo
+type SyscallMounter struct{}
+
+// New returns a Mounter acting on the host
+func New() Mounter {
+	return SyscallMounter{}
+}
+
+// Mount mounts source at target
+func (SyscallMounter) Mount(source, target, fsType string, options []string) error {
+	flag, propagation, data := parseOptions(options)
+
+	if fsType == "nfs" || fsType == "nfs4" {
+		data = nfsData(source, data)
+	}
+
+	// the kernel ignores all flags but MS_REC on a new bind mount, they
+	// have to be applied by remounting it
+	mountFlag := flag
+	if flag&unix.MS_BIND != 0 {
+		fsType = ""
+		mountFlag = flag & (unix.MS_BIND | unix.MS_REC)
+	}
+	if err := unix.Mount(source, target, fsType, mountFlag, strings.Join(data, ",")); err != nil {
+		return fmt.Errorf("mounting %s at %s failed: %s", source, target, err.Error())
+	}
+
+	if mountFlag != flag {
+		if err := unix.Mount("", target, "", flag|unix.MS_REMOUNT, ""); err != nil {
+			unix.Unmount(target, 0)
+			return fmt.Errorf("remounting bind mount %s failed: %s", target, err.Error())
+		}
+	}
+
+	if propagation != 0 {
+		if err := unix.Mount("", target, "", propagation, ""); err != nil {
+			return fmt.Errorf("changing propagation of %s failed: %s", target, err.Error())
+		}
+	}
+	return nil
+}
+
+// Unmount unmounts the topmost mount at target
+func (SyscallMounter) Unmount(target string) error {
+	if err := unix.Unmount(target, 0); err != nil {
+		return fmt.Errorf("unmounting %s failed: %s", target, err.Error())
+	}
+	return nil
+}
+
+// UnmountBusy detaches the topmost mount at target from the tree, forcing
+// pending requests to abort first with the force policy
+func (SyscallMounter) UnmountBusy(target string, policy BusyPolicy) error {
+	flags := unix.MNT_DETACH
+	switch policy {
+	case BusyLazy:
+	case BusyForce:
+		flags |= unix.MNT_FORCE
+	default:
+		return fmt.Errorf("busy policy %q does not unmount busy mount points", policy)
+	}
+	if err := unix.Unmount(target, flags); err != nil {
+		return fmt.Errorf("unmounting busy %s with policy %s failed: %s", target, policy, err.Error())
+	}
+	return nil
+}
+
+// List returns the mount table of the process
+func (SyscallMounter) List() ([]MountInfo, error) {
+	return ReadMountInfo(MountInfoPath)
+}
+
+// parseOptions splits mount(8) options into mount(2) flags, propagation
+// flags and filesystem specific data
+func parseOptions(options []string) (uintptr, uintptr, []string) {
+	var flag, propagation uintptr
+	data := []string{}
+	for _, o := range options {
+		if f, ok := flags[o]; ok {
+			if f.clear {
+				flag &^= f.flag
+			} else {
+				flag |= f.flag
+			}
+			continue
+		}
+		if p, ok := propagationFlags[o]; ok {
+			propagation |= p
+			continue
+		}
+		if o != "" {
+			data = append(data, o)
+		}
+	}
+	return flag, propagation, data
+}
+
+// nfsData adds the server address that mount.nfs would otherwise resolve,
+// the kernel does not resolve host names itself
+func nfsData(source string, data []string) []string {
+	for _, d := range data {
+		if strings.HasPrefix(d, "addr=") {
+			return data
+		}
+	}
+
+	host := source
+	if i := strings.LastIndex(source, ":"); i > 0 {
+		host = source[:i]
+	}
+	host = strings.Trim(host, "[]")
+
+	if net.ParseIP(host) == nil {
+		if addrs, err := net.LookupHost(host); err == nil && len(addrs) > 0 {
+			host = addrs[0]
+		}
+	}
+	return append(data, "addr="+host)
+}
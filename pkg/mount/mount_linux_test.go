@@ -0,0 +1,42 @@
+package mount
+
+import (
+	"reflect"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestParseOptions(t *testing.T) {
+	cases := []struct {
+		options     []string
+		flag        uintptr
+		propagation uintptr
+		data        []string
+	}{
+		{nil, 0, 0, []string{}},
+		{[]string{"defaults"}, 0, 0, []string{}},
+		{[]string{"bind", "ro"}, unix.MS_BIND | unix.MS_RDONLY, 0, []string{}},
+		{[]string{"ro", "rw", "noexec"}, unix.MS_NOEXEC, 0, []string{}},
+		{[]string{"hard", "nfsvers=3", "rslave"}, 0, unix.MS_SLAVE | unix.MS_REC, []string{"hard", "nfsvers=3"}},
+	}
+
+	for _, c := range cases {
+		flag, propagation, data := parseOptions(c.options)
+		if flag != c.flag || propagation != c.propagation || !reflect.DeepEqual(data, c.data) {
+			t.Errorf("%v: expected %x %x %v but got %x %x %v", c.options, c.flag, c.propagation, c.data, flag, propagation, data)
+		}
+	}
+}
+
+func TestNFSData(t *testing.T) {
+	data := nfsData("10.0.0.1:/snas/shared", []string{"hard"})
+	if !reflect.DeepEqual(data, []string{"hard", "addr=10.0.0.1"}) {
+		t.Errorf("expected the server address to be added but got %v", data)
+	}
+
+	data = nfsData("10.0.0.1:/snas/shared", []string{"addr=10.0.0.2"})
+	if !reflect.DeepEqual(data, []string{"addr=10.0.0.2"}) {
+		t.Errorf("expected the given address to be kept but got %v", data)
+	}
+}
@@ -0,0 +1,37 @@
+//go:build !linux
+// +build !linux
+
+package mount
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// SyscallMounter is only implemented on linux
+type SyscallMounter struct{}
+
+// New returns a Mounter acting on the host
+func New() Mounter {
+	return SyscallMounter{}
+}
+
+// Mount is not supported on this platform
+func (SyscallMounter) Mount(source, target, fsType string, options []string) error {
+	return fmt.Errorf("mount is not supported on %s", runtime.GOOS)
+}
+
+// Unmount is not supported on this platform
+func (SyscallMounter) Unmount(target string) error {
+	return fmt.Errorf("unmount is not supported on %s", runtime.GOOS)
+}
+
+// UnmountBusy is not supported on this platform
+func (SyscallMounter) UnmountBusy(target string, policy BusyPolicy) error {
+	return fmt.Errorf("unmount is not supported on %s", runtime.GOOS)
+}
+
+// List is not supported on this platform
+func (SyscallMounter) List() ([]MountInfo, error) {
+	return nil, fmt.Errorf("listing mounts is not supported on %s", runtime.GOOS)
+}
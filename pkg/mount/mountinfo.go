@@ -0,0 +1,190 @@
+package mount
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// MountInfoPath is the mount table of the calling process
+const MountInfoPath = "/proc/self/mountinfo"
+
+// Propagation types of a mount point
+const (
+	PropagationPrivate    = "private"
+	PropagationShared     = "shared"
+	PropagationSlave      = "slave"
+	PropagationUnbindable = "unbindable"
+)
+
+// MountInfo is an entry of /proc/self/mountinfo
+type MountInfo struct {
+	ID           int
+	ParentID     int
+	Major        int
+	Minor        int
+	Root         string
+	MountPoint   string
+	Options      []string
+	Optional     []string
+	FsType       string
+	Source       string
+	SuperOptions []string
+}
+
+// Propagation returns the propagation type from the optional fields
+func (m MountInfo) Propagation() string {
+	propagation := PropagationPrivate
+	for _, field := range m.Optional {
+		switch {
+		case strings.HasPrefix(field, "shared:"):
+			return PropagationShared
+		case strings.HasPrefix(field, "master:"):
+			propagation = PropagationSlave
+		case field == "unbindable":
+			propagation = PropagationUnbindable
+		}
+	}
+	return propagation
+}
+
+// ReadOnly tells whether the mount point is mounted read only
+func (m MountInfo) ReadOnly() bool {
+	for _, o := range m.Options {
+		if o == "ro" {
+			return true
+		}
+	}
+	return false
+}
+
+// IsBind tells whether the entry is a bind mount of a filesystem already
+// mounted elsewhere in the table
+func (m MountInfo) IsBind(table []MountInfo) bool {
+	if m.Root != "/" {
+		return true
+	}
+	for _, other := range table {
+		if other.ID < m.ID && other.Major == m.Major && other.Minor == m.Minor && other.Root == "/" {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseMountInfo parses a table in the format of /proc/self/mountinfo
+func ParseMountInfo(r io.Reader) ([]MountInfo, error) {
+	table := []MountInfo{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		m, err := parseMountInfoLine(line)
+		if err != nil {
+			return nil, err
+		}
+		table = append(table, m)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read mount info: %s", err.Error())
+	}
+	return table, nil
+}
+
+// ReadMountInfo parses the mountinfo file at path
+func ReadMountInfo(path string) ([]MountInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseMountInfo(f)
+}
+
+// MountsAt returns the entries mounted at target, the last one being on top
+// when mounts are stacked
+func MountsAt(table []MountInfo, target string) []MountInfo {
+	target = filepath.Clean(target)
+	result := []MountInfo{}
+	for _, m := range table {
+		if m.MountPoint == target {
+			result = append(result, m)
+		}
+	}
+	return result
+}
+
+// parseMountInfoLine parses a line such as
+// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+func parseMountInfoLine(line string) (MountInfo, error) {
+	fields := strings.Fields(line)
+	separator := -1
+	for i := 6; i < len(fields); i++ {
+		if fields[i] == "-" {
+			separator = i
+			break
+		}
+	}
+	if separator == -1 || len(fields) < separator+3 {
+		return MountInfo{}, fmt.Errorf("malformed mount info line %q", line)
+	}
+
+	m := MountInfo{
+		Root:       unescape(fields[3]),
+		MountPoint: unescape(fields[4]),
+		Options:    strings.Split(fields[5], ","),
+		Optional:   fields[6:separator],
+		FsType:     unescape(fields[separator+1]),
+		Source:     unescape(fields[separator+2]),
+	}
+	if len(fields) > separator+3 {
+		m.SuperOptions = strings.Split(fields[separator+3], ",")
+	}
+
+	var err error
+	if m.ID, err = strconv.Atoi(fields[0]); err != nil {
+		return MountInfo{}, fmt.Errorf("malformed mount ID in %q: %s", line, err.Error())
+	}
+	if m.ParentID, err = strconv.Atoi(fields[1]); err != nil {
+		return MountInfo{}, fmt.Errorf("malformed parent ID in %q: %s", line, err.Error())
+	}
+	device := strings.Split(fields[2], ":")
+	if len(device) != 2 {
+		return MountInfo{}, fmt.Errorf("malformed device number in %q", line)
+	}
+	if m.Major, err = strconv.Atoi(device[0]); err != nil {
+		return MountInfo{}, fmt.Errorf("malformed major number in %q: %s", line, err.Error())
+	}
+	if m.Minor, err = strconv.Atoi(device[1]); err != nil {
+		return MountInfo{}, fmt.Errorf("malformed minor number in %q: %s", line, err.Error())
+	}
+
+	return m, nil
+}
+
+// unescape decodes the octal escapes the kernel uses for spaces, tabs,
+// newlines and backslashes in paths
+func unescape(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if v, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,90 @@
+package mount
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const sampleMountInfo = `22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw,errors=remount-ro
+25 22 0:22 / /proc rw,nosuid,nodev,noexec,relatime shared:12 - proc proc rw
+40 22 8:17 / /var/lib/kubelet/plugins/oneandone/mounts/pv-0123 rw,relatime shared:20 - ext4 /dev/sdb rw,data=ordered
+41 22 8:17 / /var/lib/kubelet/pods/uid/volumes/pv-0123 rw,relatime shared:20 - ext4 /dev/sdb rw,data=ordered
+42 22 8:1 /srv/data /mnt/with\040space ro,relatime master:1 - ext4 /dev/sda1 rw,errors=remount-ro
+43 40 0:45 / /var/lib/kubelet/plugins/oneandone/mounts/pv-0123 rw,relatime - tmpfs tmpfs rw
+44 22 0:46 / /mnt/nfs rw,relatime - nfs 10.0.0.1:/snas/shared rw,vers=3,addr=10.0.0.1
+`
+
+func TestParseMountInfo(t *testing.T) {
+	table, err := ParseMountInfo(strings.NewReader(sampleMountInfo))
+	if err != nil {
+		t.Fatalf("an error ocurred parsing mount info %s", err)
+	}
+	if len(table) != 7 {
+		t.Fatalf("expected 7 entries but got %d", len(table))
+	}
+
+	expected := MountInfo{
+		ID:           42,
+		ParentID:     22,
+		Major:        8,
+		Minor:        1,
+		Root:         "/srv/data",
+		MountPoint:   "/mnt/with space",
+		Options:      []string{"ro", "relatime"},
+		Optional:     []string{"master:1"},
+		FsType:       "ext4",
+		Source:       "/dev/sda1",
+		SuperOptions: []string{"rw", "errors=remount-ro"},
+	}
+	if !reflect.DeepEqual(table[4], expected) {
+		t.Errorf("expected %+v but got %+v", expected, table[4])
+	}
+
+	cases := []struct {
+		id          int
+		propagation string
+		readOnly    bool
+		bind        bool
+	}{
+		{22, PropagationShared, false, false},
+		{40, PropagationShared, false, false},
+		{41, PropagationShared, false, true},
+		{42, PropagationSlave, true, true},
+		{44, PropagationPrivate, false, false},
+	}
+	for _, c := range cases {
+		for _, m := range table {
+			if m.ID != c.id {
+				continue
+			}
+			if m.Propagation() != c.propagation {
+				t.Errorf("%d: expected propagation %s but got %s", c.id, c.propagation, m.Propagation())
+			}
+			if m.ReadOnly() != c.readOnly {
+				t.Errorf("%d: expected read only %t but got %t", c.id, c.readOnly, m.ReadOnly())
+			}
+			if m.IsBind(table) != c.bind {
+				t.Errorf("%d: expected bind %t but got %t", c.id, c.bind, m.IsBind(table))
+			}
+		}
+	}
+
+	stacked := MountsAt(table, "/var/lib/kubelet/plugins/oneandone/mounts/pv-0123/")
+	if len(stacked) != 2 || stacked[1].FsType != "tmpfs" {
+		t.Errorf("expected tmpfs stacked on top of ext4 but got %+v", stacked)
+	}
+}
+
+func TestParseMountInfoMalformed(t *testing.T) {
+	lines := []string{
+		"22 1 8:1 / / rw,relatime shared:1 ext4 /dev/sda1 rw",
+		"x 1 8:1 / / rw - ext4 /dev/sda1 rw",
+		"22 1 8 / / rw - ext4 /dev/sda1 rw",
+	}
+	for _, line := range lines {
+		if _, err := ParseMountInfo(strings.NewReader(line)); err == nil {
+			t.Errorf("expected an error parsing %q", line)
+		}
+	}
+}
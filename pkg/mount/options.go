@@ -0,0 +1,90 @@
+package mount
+
+import (
+	"fmt"
+	"strings"
+)
+
+// commonOptions are the filesystem independent options allowed for every
+// volume. Options such as suid, dev or bind are left out on purpose.
+var commonOptions = []string{
+	"defaults", "ro", "rw", "sync", "async", "dirsync",
+	"atime", "noatime", "diratime", "nodiratime", "relatime", "norelatime",
+	"strictatime", "nostrictatime", "lazytime", "nolazytime",
+	"noexec", "nosuid", "nodev",
+}
+
+// extOptions are allowed for ext2, ext3 and ext4
+var extOptions = []string{
+	"acl", "noacl", "user_xattr", "nouser_xattr",
+	"barrier", "nobarrier", "barrier=", "commit=", "data=", "errors=",
+	"discard", "nodiscard", "delalloc", "nodelalloc", "dioread_nolock", "dioread_lock",
+	"journal_checksum", "nojournal_checksum", "journal_async_commit",
+	"init_itable", "init_itable=", "noinit_itable", "inode_readahead_blks=", "stripe=",
+	"quota", "noquota", "usrquota", "grpquota", "prjquota",
+}
+
+// fsOptions lists the options allowed per filesystem on top of the common
+// ones, an entry ending with = accepts any value
+var fsOptions = map[string][]string{
+	"ext2": extOptions,
+	"ext3": extOptions,
+	"ext4": extOptions,
+	"xfs": {
+		"attr2", "noattr2", "discard", "nodiscard", "inode32", "inode64",
+		"largeio", "nolargeio", "logbufs=", "logbsize=", "allocsize=",
+		"nouuid", "norecovery", "wsync", "swalloc", "filestreams", "sunit=", "swidth=",
+		"noquota", "uquota", "usrquota", "gquota", "grpquota", "pquota", "prjquota",
+	},
+	"btrfs": {
+		"compress", "compress=", "compress-force", "compress-force=",
+		"discard", "discard=", "nodiscard", "ssd", "nossd", "ssd_spread", "nossd_spread",
+		"autodefrag", "noautodefrag", "space_cache", "space_cache=", "nospace_cache",
+		"commit=", "subvol=", "subvolid=", "degraded", "nodatacow", "datacow",
+		"nodatasum", "datasum", "flushoncommit", "noflushoncommit", "skip_balance",
+	},
+	"nfs": {
+		"hard", "soft", "intr", "nointr", "nfsvers=", "vers=", "proto=", "port=",
+		"rsize=", "wsize=", "timeo=", "retrans=", "retry=",
+		"ac", "noac", "actimeo=", "acregmin=", "acregmax=", "acdirmin=", "acdirmax=",
+		"lookupcache=", "lock", "nolock", "local_lock=", "sec=", "resvport", "noresvport",
+		"cto", "nocto", "sharecache", "nosharecache", "fsc", "nofsc",
+		"mountproto=", "mountport=", "mountvers=", "namlen=", "minorversion=", "clientaddr=",
+	},
+}
+
+// SplitOptions splits a comma separated list of mount options, ignoring
+// blanks and empty entries
+func SplitOptions(s string) []string {
+	options := []string{}
+	for _, o := range strings.Split(s, ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			options = append(options, o)
+		}
+	}
+	return options
+}
+
+// ValidateOptions checks the options against the allowlist of the
+// filesystem type
+func ValidateOptions(fsType string, options []string) error {
+	for _, o := range options {
+		if !optionAllowed(commonOptions, o) && !optionAllowed(fsOptions[fsType], o) {
+			return fmt.Errorf("mount option %q is not allowed for %s volumes", o, fsType)
+		}
+	}
+	return nil
+}
+
+func optionAllowed(allowed []string, option string) bool {
+	name := option
+	if i := strings.Index(option, "="); i >= 0 {
+		name = option[:i+1]
+	}
+	for _, a := range allowed {
+		if a == name {
+			return true
+		}
+	}
+	return false
+}
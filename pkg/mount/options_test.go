@@ -0,0 +1,55 @@
+package mount
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitOptions(t *testing.T) {
+	cases := []struct {
+		s       string
+		options []string
+	}{
+		{"", []string{}},
+		{"noatime", []string{"noatime"}},
+		{" noatime, ,data=ordered,", []string{"noatime", "data=ordered"}},
+	}
+
+	for _, c := range cases {
+		if options := SplitOptions(c.s); !reflect.DeepEqual(options, c.options) {
+			t.Errorf("%q: expected %v but got %v", c.s, c.options, options)
+		}
+	}
+}
+
+func TestValidateOptions(t *testing.T) {
+	cases := []struct {
+		fsType        string
+		options       []string
+		expectedError bool
+	}{
+		{"ext4", nil, false},
+		{"ext4", []string{"ro", "noatime", "nosuid", "data=ordered", "commit=30"}, false},
+		{"ext3", []string{"discard"}, false},
+		{"xfs", []string{"nouuid", "logbsize=256k", "inode64"}, false},
+		{"btrfs", []string{"compress=zstd", "ssd", "subvol=data"}, false},
+		{"nfs", []string{"hard", "nfsvers=4.1", "proto=tcp", "ro"}, false},
+		{"ext4", []string{"nouuid"}, true},
+		{"xfs", []string{"data=ordered"}, true},
+		{"ext4", []string{"suid"}, true},
+		{"ext4", []string{"bind"}, true},
+		{"nfs", []string{"remount"}, true},
+		{"vfat", []string{"noatime"}, false},
+		{"vfat", []string{"uid=1000"}, true},
+	}
+
+	for _, c := range cases {
+		err := ValidateOptions(c.fsType, c.options)
+		if c.expectedError && err == nil {
+			t.Errorf("expected error validating %v for %s", c.options, c.fsType)
+		}
+		if !c.expectedError && err != nil {
+			t.Errorf("an error ocurred validating %v for %s: %s", c.options, c.fsType, err)
+		}
+	}
+}
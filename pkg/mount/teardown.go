@@ -0,0 +1,203 @@
+package mount
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ProcPath is where the kernel lists the processes
+var ProcPath = "/proc"
+
+// BusyPolicy tells what to do with a mount point processes keep busy
+type BusyPolicy string
+
+// Busy policies
+const (
+	// BusyFail leaves the mount point mounted and reports its holders
+	BusyFail BusyPolicy = "fail"
+	// BusyLazy detaches the mount point from the tree right away, the
+	// kernel cleans it up once it is no longer busy
+	BusyLazy BusyPolicy = "lazy"
+	// BusyForce aborts pending requests before detaching the mount point,
+	// mostly useful for unreachable NFS servers
+	BusyForce BusyPolicy = "force"
+)
+
+// ParseBusyPolicy parses a busy policy, empty means BusyFail
+func ParseBusyPolicy(s string) (BusyPolicy, error) {
+	switch p := BusyPolicy(s); p {
+	case "":
+		return BusyFail, nil
+	case BusyFail, BusyLazy, BusyForce:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown busy policy %q, expected %s, %s or %s", s, BusyFail, BusyLazy, BusyForce)
+}
+
+// Holder is a process with files open or its working directory below a
+// mount point
+type Holder struct {
+	PID     int
+	Command string
+	Files   []string
+}
+
+func (h Holder) String() string {
+	return fmt.Sprintf("%d (%s) %s", h.PID, h.Command, strings.Join(h.Files, ", "))
+}
+
+// Teardown unmounts target and removes the empty directory or device file
+// left behind. It never removes anything still mounted or holding data: it
+// checks the mount table again after unmounting and refuses to remove a
+// directory that is not empty. When processes keep the mount point busy
+// the policy tells whether it is unmounted anyway, otherwise the error
+// lists them.
+func Teardown(m Mounter, target string, policy BusyPolicy) error {
+	mounts, err := MountsAtPath(m, target)
+	if err != nil {
+		return err
+	}
+
+	if len(mounts) > 0 {
+		if err := m.Unmount(target); err != nil {
+			if policy == BusyFail || policy == "" {
+				return busyError(target, err)
+			}
+			if err := m.UnmountBusy(target, policy); err != nil {
+				return busyError(target, err)
+			}
+		}
+
+		mounts, err = MountsAtPath(m, target)
+		if err != nil {
+			return err
+		}
+		if len(mounts) > 0 {
+			return fmt.Errorf("%s is still mounted from %s after unmounting it", target, mounts[len(mounts)-1].Source)
+		}
+	}
+
+	return removeMountPoint(target)
+}
+
+// busyError adds the processes holding the mount point to the unmount error
+func busyError(target string, err error) error {
+	holders, herr := Holders(target)
+	if herr != nil {
+		return fmt.Errorf("%s, could not list the processes using it: %s", err.Error(), herr.Error())
+	}
+	if len(holders) == 0 {
+		return err
+	}
+	used := make([]string, len(holders))
+	for i, h := range holders {
+		used[i] = h.String()
+	}
+	return fmt.Errorf("%s, %s is used by %s", err.Error(), target, strings.Join(used, "; "))
+}
+
+// removeMountPoint removes the empty directory or empty device file a
+// volume was mounted at
+func removeMountPoint(target string) error {
+	info, err := os.Lstat(target)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not stat %s: %s", target, err.Error())
+	}
+
+	switch {
+	case info.IsDir():
+		empty, err := isEmptyDir(target)
+		if err != nil {
+			return err
+		}
+		if !empty {
+			return fmt.Errorf("not removing %s: the directory is not empty", target)
+		}
+	case info.Mode().IsRegular():
+		if info.Size() != 0 {
+			return fmt.Errorf("not removing %s: the file is not empty", target)
+		}
+	default:
+		return fmt.Errorf("not removing %s: it is neither a directory nor a file", target)
+	}
+
+	if err := os.Remove(target); err != nil {
+		return fmt.Errorf("could not remove %s: %s", target, err.Error())
+	}
+	return nil
+}
+
+// isEmptyDir tells whether the directory has no entries
+func isEmptyDir(dir string) (bool, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return false, fmt.Errorf("could not open %s: %s", dir, err.Error())
+	}
+	defer f.Close()
+
+	if _, err := f.Readdirnames(1); err == io.EOF {
+		return true, nil
+	} else if err != nil {
+		return false, fmt.Errorf("could not read %s: %s", dir, err.Error())
+	}
+	return false, nil
+}
+
+// Holders lists the processes with open files or their working directory
+// below target, looking at /proc/<pid>/fd and /proc/<pid>/cwd. Processes
+// that go away or cannot be inspected are skipped.
+func Holders(target string) ([]Holder, error) {
+	if resolved, err := filepath.EvalSymlinks(target); err == nil {
+		target = resolved
+	}
+
+	entries, err := ioutil.ReadDir(ProcPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not list processes: %s", err.Error())
+	}
+
+	holders := []Holder{}
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil || !e.IsDir() {
+			continue
+		}
+		dir := filepath.Join(ProcPath, e.Name())
+
+		files := []string{}
+		if cwd, err := os.Readlink(filepath.Join(dir, "cwd")); err == nil && under(cwd, target) {
+			files = append(files, cwd)
+		}
+		fds, _ := ioutil.ReadDir(filepath.Join(dir, "fd"))
+		for _, fd := range fds {
+			if f, err := os.Readlink(filepath.Join(dir, "fd", fd.Name())); err == nil && under(f, target) {
+				files = append(files, f)
+			}
+		}
+		if len(files) == 0 {
+			continue
+		}
+
+		comm, _ := ioutil.ReadFile(filepath.Join(dir, "comm"))
+		holders = append(holders, Holder{PID: pid, Command: strings.TrimSpace(string(comm)), Files: files})
+	}
+
+	sort.Slice(holders, func(i, j int) bool { return holders[i].PID < holders[j].PID })
+	return holders, nil
+}
+
+// under tells whether path is dir or below it, the kernel appends
+// " (deleted)" to removed files
+func under(path, dir string) bool {
+	path = strings.TrimSuffix(path, " (deleted)")
+	return path == dir || strings.HasPrefix(path, strings.TrimSuffix(dir, "/")+"/")
+}
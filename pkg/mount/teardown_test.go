@@ -0,0 +1,182 @@
+package mount
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// stubMounter has a single mount at target that is busy when busy is set
+type stubMounter struct {
+	target  string
+	mounted bool
+	busy    bool
+	actions []string
+}
+
+func (m *stubMounter) Mount(source, target, fsType string, options []string) error {
+	m.mounted = true
+	return nil
+}
+
+func (m *stubMounter) Unmount(target string) error {
+	m.actions = append(m.actions, "Unmount")
+	if m.busy {
+		return errors.New("unmounting " + target + " failed: device or resource busy")
+	}
+	m.mounted = false
+	return nil
+}
+
+func (m *stubMounter) UnmountBusy(target string, policy BusyPolicy) error {
+	m.actions = append(m.actions, "UnmountBusy "+string(policy))
+	m.mounted = false
+	return nil
+}
+
+func (m *stubMounter) List() ([]MountInfo, error) {
+	if !m.mounted {
+		return nil, nil
+	}
+	return []MountInfo{{MountPoint: m.target, Source: "/dev/sdb"}}, nil
+}
+
+// fakeProc creates a process table where pid 1234 works and has a file open
+// below target
+func fakeProc(t *testing.T, root, target string) {
+	ProcPath = filepath.Join(root, "proc")
+	for _, dir := range []string{"1234/fd", "5678/fd", "self"} {
+		if err := os.MkdirAll(filepath.Join(ProcPath, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Symlink(filepath.Join(target, "logs"), filepath.Join(ProcPath, "1234", "cwd"))
+	os.Symlink(filepath.Join(target, "logs", "app.log"), filepath.Join(ProcPath, "1234", "fd", "3"))
+	os.Symlink("/dev/null", filepath.Join(ProcPath, "1234", "fd", "0"))
+	ioutil.WriteFile(filepath.Join(ProcPath, "1234", "comm"), []byte("nginx\n"), 0644)
+	os.Symlink("/", filepath.Join(ProcPath, "5678", "cwd"))
+	os.Symlink(target+"-other/file", filepath.Join(ProcPath, "5678", "fd", "3"))
+}
+
+func TestTeardown(t *testing.T) {
+	root, err := ioutil.TempDir("", "teardown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	defer func(p string) { ProcPath = p }(ProcPath)
+
+	target := filepath.Join(root, "mount")
+	fakeProc(t, root, target)
+
+	cases := []struct {
+		name    string
+		busy    bool
+		policy  BusyPolicy
+		file    string
+		actions []string
+		message string
+		removed bool
+	}{
+		{"unmounted and removed", false, BusyFail, "", []string{"Unmount"}, "", true},
+		{"busy", true, BusyFail, "", []string{"Unmount"}, "is used by 1234 (nginx) " + filepath.Join(target, "logs"), false},
+		{"busy unmounted lazily", true, BusyLazy, "", []string{"Unmount", "UnmountBusy lazy"}, "", true},
+		{"busy unmounted forcibly", true, BusyForce, "", []string{"Unmount", "UnmountBusy force"}, "", true},
+		{"data left behind", false, BusyFail, "data", []string{"Unmount"}, "the directory is not empty", false},
+	}
+
+	for _, c := range cases {
+		os.MkdirAll(target, 0750)
+		if c.file != "" {
+			ioutil.WriteFile(filepath.Join(target, c.file), []byte("data"), 0644)
+		}
+		m := &stubMounter{target: target, mounted: true, busy: c.busy}
+
+		err := Teardown(m, target, c.policy)
+		if c.message == "" && err != nil {
+			t.Errorf("%s: an error ocurred tearing down %s", c.name, err)
+		}
+		if c.message != "" && (err == nil || !strings.Contains(err.Error(), c.message)) {
+			t.Errorf("%s: expected error %q but got %v", c.name, c.message, err)
+		}
+		if !reflect.DeepEqual(m.actions, c.actions) {
+			t.Errorf("%s: expected actions %v but got %v", c.name, c.actions, m.actions)
+		}
+		if _, err := os.Stat(target); os.IsNotExist(err) != c.removed {
+			t.Errorf("%s: expected removed to be %t", c.name, c.removed)
+		}
+		if c.file != "" {
+			if _, err := os.Stat(filepath.Join(target, c.file)); err != nil {
+				t.Errorf("%s: expected %s to be kept", c.name, c.file)
+			}
+		}
+		os.RemoveAll(target)
+	}
+}
+
+func TestTeardownStillMounted(t *testing.T) {
+	root, err := ioutil.TempDir("", "teardown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	target := filepath.Join(root, "mount")
+	os.MkdirAll(target, 0750)
+	m := &stubMounter{target: target, mounted: true}
+	stuck := &stuckMounter{m}
+
+	if err := Teardown(stuck, target, BusyFail); err == nil || !strings.Contains(err.Error(), "is still mounted") {
+		t.Errorf("expected a still mounted error but got %v", err)
+	}
+	if _, err := os.Stat(target); err != nil {
+		t.Errorf("expected %s to be kept while mounted", target)
+	}
+}
+
+// stuckMounter pretends to unmount but leaves the mount in place
+type stuckMounter struct {
+	*stubMounter
+}
+
+func (m *stuckMounter) Unmount(target string) error {
+	return nil
+}
+
+func TestTeardownDeviceFile(t *testing.T) {
+	root, err := ioutil.TempDir("", "teardown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	target := filepath.Join(root, "block")
+	ioutil.WriteFile(target, nil, 0640)
+	if err := Teardown(&stubMounter{target: target}, target, BusyFail); err != nil {
+		t.Errorf("an error ocurred removing the device file %s", err)
+	}
+	if _, err := os.Stat(target); !os.IsNotExist(err) {
+		t.Errorf("expected %s to be removed", target)
+	}
+
+	ioutil.WriteFile(target, []byte("data"), 0640)
+	if err := Teardown(&stubMounter{target: target}, target, BusyFail); err == nil {
+		t.Errorf("expected error removing a file holding data")
+	}
+}
+
+func TestParseBusyPolicy(t *testing.T) {
+	cases := map[string]BusyPolicy{"": BusyFail, "fail": BusyFail, "lazy": BusyLazy, "force": BusyForce}
+	for s, expected := range cases {
+		if p, err := ParseBusyPolicy(s); err != nil || p != expected {
+			t.Errorf("%q: expected %s but got %s %v", s, expected, p, err)
+		}
+	}
+	if _, err := ParseBusyPolicy("kill"); err == nil {
+		t.Errorf("expected error parsing an unknown policy")
+	}
+}
@@ -0,0 +1,155 @@
+package cloud
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ErrorClass tells how an error of the 1&1 API is handled
+type ErrorClass string
+
+// Error classes
+const (
+	// ErrorRetryable errors are transient: server errors, rate limiting and
+	// network failures
+	ErrorRetryable ErrorClass = "retryable"
+	// ErrorConflict errors come from a resource whose state does not allow
+	// the request, such as deleting an attached storage
+	ErrorConflict ErrorClass = "conflict"
+	// ErrorNotFound errors come from a resource that does not exist
+	ErrorNotFound ErrorClass = "not-found"
+	// ErrorAuth errors come from a token that is invalid or lacks permissions
+	ErrorAuth ErrorClass = "auth"
+	// ErrorInProgress errors come from an operation the API still carries
+	// out when the caller's deadline comes, see InProgressError
+	ErrorInProgress ErrorClass = "in-progress"
+	// ErrorPermanent errors are any other error, trying again does not help
+	ErrorPermanent ErrorClass = "permanent"
+)
+
+// statusPattern finds the status of an API error, the SDK formats them as
+// "<status> - <message>"
+var statusPattern = regexp.MustCompile(`(?:^|[^0-9])([1-5][0-9]{2}) - `)
+
+// Error is an error of the 1&1 API with its class
+type Error struct {
+	Class ErrorClass
+	// Status is the HTTP status of the API error, 0 when there is none
+	Status int
+	// Attempts is how often the call was tried
+	Attempts int
+	Err      error
+}
+
+func (e *Error) Error() string {
+	if e.Attempts > 1 {
+		return fmt.Sprintf("%s (after %d attempts)", e.Err.Error(), e.Attempts)
+	}
+	return e.Err.Error()
+}
+
+// classify returns the classified error
+func classify(err error, attempts int) *Error {
+	if e, ok := err.(*Error); ok {
+		return e
+	}
+	status := Status(err)
+	return &Error{Class: classOf(err, status), Status: status, Attempts: attempts, Err: err}
+}
+
+// wrapError adds context to the error and keeps its class
+func wrapError(err error, format string, args ...interface{}) error {
+	e := classify(err, 1)
+	return &Error{Class: e.Class, Status: e.Status, Err: fmt.Errorf("%s %s", fmt.Sprintf(format, args...), err.Error())}
+}
+
+// notFoundError is the error of a resource missing from a listing
+func notFoundError(format string, args ...interface{}) error {
+	return &Error{Class: ErrorNotFound, Err: fmt.Errorf(format, args...)}
+}
+
+// Status returns the HTTP status of the API error, 0 when there is none
+func Status(err error) int {
+	if err == nil {
+		return 0
+	}
+	if e, ok := err.(*Error); ok {
+		return e.Status
+	}
+	m := statusPattern.FindStringSubmatch(err.Error())
+	if m == nil {
+		return 0
+	}
+	status, _ := strconv.Atoi(m[1])
+	return status
+}
+
+// ClassOf returns the class of the error, also of errors of the SDK and of
+// errors that only kept its message
+func ClassOf(err error) ErrorClass {
+	if err == nil {
+		return ""
+	}
+	if e, ok := err.(*Error); ok {
+		return e.Class
+	}
+	return classOf(err, Status(err))
+}
+
+func classOf(err error, status int) ErrorClass {
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return ErrorAuth
+	case status == http.StatusNotFound:
+		return ErrorNotFound
+	case status == http.StatusConflict:
+		return ErrorConflict
+	case status == http.StatusRequestTimeout || status == http.StatusTooManyRequests || status >= 500:
+		return ErrorRetryable
+	case status != 0:
+		return ErrorPermanent
+	}
+
+	switch err.(type) {
+	case *url.Error, net.Error:
+		return ErrorRetryable
+	case *InProgressError:
+		return ErrorInProgress
+	}
+	if err == context.DeadlineExceeded || err == context.Canceled {
+		return ErrorRetryable
+	}
+	// the SDK gives up on a rate limited request without a reset header
+	if strings.Contains(err.Error(), "X-Rate-Limit-Reset") {
+		return ErrorRetryable
+	}
+	return ErrorPermanent
+}
+
+// IsNotFound reports whether the error was caused by a 1&1 resource
+// that does not exist
+func IsNotFound(err error) bool {
+	return ClassOf(err) == ErrorNotFound
+}
+
+// IsConflict reports whether the 1&1 resource is in a state that does not
+// allow the request
+func IsConflict(err error) bool {
+	return ClassOf(err) == ErrorConflict
+}
+
+// IsAuth reports whether the 1&1 token was rejected
+func IsAuth(err error) bool {
+	return ClassOf(err) == ErrorAuth
+}
+
+// IsRetryable reports whether the error is transient
+func IsRetryable(err error) bool {
+	return ClassOf(err) == ErrorRetryable
+}
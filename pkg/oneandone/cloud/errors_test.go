@@ -0,0 +1,49 @@
+package cloud
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"testing"
+)
+
+func TestClassOf(t *testing.T) {
+	cases := []struct {
+		err    error
+		class  ErrorClass
+		status int
+	}{
+		{nil, "", 0},
+		{errors.New("401 - Type: UNAUTHORIZED; Message: invalid token"), ErrorAuth, 401},
+		{errors.New("403 - Type: FORBIDDEN; Message: denied"), ErrorAuth, 403},
+		{errors.New("error fetching 1and1 block storage 0123 404 - Type: NOT_FOUND; Message: gone"), ErrorNotFound, 404},
+		{errors.New("409 - Type: CONFLICT; Message: block storage is attached"), ErrorConflict, 409},
+		{errors.New("408 - Type: REQUEST_TIMEOUT; Message: slow"), ErrorRetryable, 408},
+		{errors.New("503 - Type: SERVICE_UNAVAILABLE; Message: down"), ErrorRetryable, 503},
+		{errors.New("400 - Type: BAD_REQUEST; Message: size is required"), ErrorPermanent, 400},
+		{fmt.Errorf("no 'X-Rate-Limit-Reset' has been returned"), ErrorRetryable, 0},
+		{&url.Error{Op: "Get", URL: "http://api", Err: errors.New("connection refused")}, ErrorRetryable, 0},
+		{errors.New("storage 1500 - 2 is broken"), ErrorPermanent, 0},
+		{notFoundError("storage with name %q was not found", "pv"), ErrorNotFound, 0},
+		{wrapError(errors.New("500 - Type: INTERNAL; Message: boom"), "error listing"), ErrorRetryable, 500},
+	}
+
+	for _, c := range cases {
+		if class := ClassOf(c.err); class != c.class {
+			t.Errorf("expected class %q for %v but got %q", c.class, c.err, class)
+		}
+		if status := Status(c.err); status != c.status {
+			t.Errorf("expected status %d for %v but got %d", c.status, c.err, status)
+		}
+	}
+}
+
+func TestWrapErrorKeepsClass(t *testing.T) {
+	err := wrapError(notFoundError("storage with name %q was not found", "pv"), "error fetching %s", "pv")
+	if !IsNotFound(err) {
+		t.Errorf("expected a not found error but got %v", err)
+	}
+	if msg := err.Error(); msg != `error fetching pv storage with name "pv" was not found` {
+		t.Errorf("expected the message to keep the cause but got %q", msg)
+	}
+}
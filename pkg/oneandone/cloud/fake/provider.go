@@ -0,0 +1,635 @@
+/*
+Package fake provides an in-memory implementation of cloud.Provider.
+
+It models servers, block storages, shared storages, attachments and the state
+transitions the 1&1 API goes through, and lets tests inject errors, latency
+and resources stuck in a transitional state.
+*/
+package fake
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/1and1/oneandone-cloudserver-sdk-go"
+	"github.com/1and1/oneandone-flex-volume/pkg/oneandone/cloud"
+)
+
+// Operations faults can be injected into
+const (
+	OpGetServer                        = "GetServer"
+	OpFindServerFromNodeName           = "FindServerFromNodeName"
+	OpGetBlockstorage                  = "GetBlockstorage"
+	OpGetBlockstorageByName            = "GetBlockstorageByName"
+	OpListBlockstorages                = "ListBlockstorages"
+	OpCreateStorageAndWait             = "CreateStorageAndWait"
+	OpDeleteStorageAndWait             = "DeleteStorageAndWait"
+	OpResizeStorageAndWait             = "ResizeStorageAndWait"
+	OpAssignStorageAndWait             = "AssignStorageAndWait"
+	OpRemoveStorageAndWait             = "RemoveStorageAndWait"
+	OpGetSharedStorage                 = "GetSharedStorage"
+	OpGetSharedStorageByName           = "GetSharedStorageByName"
+	OpGrantSharedStorageAccessAndWait  = "GrantSharedStorageAccessAndWait"
+	OpRevokeSharedStorageAccessAndWait = "RevokeSharedStorageAccessAndWait"
+	OpGetSharedStorageCredentials      = "GetSharedStorageCredentials"
+)
+
+// Resource states
+const (
+	StatePoweredOn   = "POWERED_ON"
+	StateActive      = "ACTIVE"
+	StateDeploying   = "DEPLOYING"
+	StateConfiguring = "CONFIGURING"
+	StateRemoving    = "REMOVING"
+)
+
+// Fault describes a failure injected into an operation
+type Fault struct {
+	// Err is returned by the operation before it has any effect
+	Err error
+	// Latency delays the operation
+	Latency time.Duration
+	// Stuck leaves the resource in its transitional state and makes the
+	// waiting operation return an InProgressError. Calling the operation
+	// again resumes waiting, it succeeds once SetState ends the transition.
+	Stuck bool
+	// Times limits how often the fault triggers, zero means on every call
+	Times int
+}
+
+// Provider is an in-memory cloud.Provider
+type Provider struct {
+	// Latency delays every operation
+	Latency time.Duration
+
+	mu       sync.Mutex
+	next     int
+	servers  map[string]*oneandone.Server
+	storages map[string]*oneandone.BlockStorage
+	shared   map[string]*oneandone.SharedStorage
+	access   map[string]*oneandone.SharedStorageAccess
+	faults   map[string]*Fault
+	calls    map[string]int
+}
+
+var _ cloud.Provider = &Provider{}
+
+// NewProvider returns an empty fake provider
+func NewProvider() *Provider {
+	return &Provider{
+		servers:  map[string]*oneandone.Server{},
+		storages: map[string]*oneandone.BlockStorage{},
+		shared:   map[string]*oneandone.SharedStorage{},
+		access:   map[string]*oneandone.SharedStorageAccess{},
+		faults:   map[string]*Fault{},
+		calls:    map[string]int{},
+	}
+}
+
+// APIError returns an error formatted like the errors of the 1&1 SDK
+func APIError(status int, message string) error {
+	return fmt.Errorf("%d - Type: %s; Message: %s", status, strings.ToUpper(strings.Replace(http.StatusText(status), " ", "_", -1)), message)
+}
+
+func notFound(kind, id string) error {
+	return APIError(http.StatusNotFound, fmt.Sprintf("%s %s not found", kind, id))
+}
+
+func busy(kind, id, state string) error {
+	return APIError(http.StatusConflict, fmt.Sprintf("%s %s is %s", kind, id, state))
+}
+
+func inProgress(kind, id, state, want string) error {
+	return &cloud.InProgressError{Resource: kind + " " + id, State: state, Want: want}
+}
+
+// InjectFault makes the operation fail as described by the fault
+func (p *Provider) InjectFault(op string, f Fault) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.faults[op] = &f
+}
+
+// ClearFaults removes every injected fault
+func (p *Provider) ClearFaults() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.faults = map[string]*Fault{}
+}
+
+// Calls returns how many times the operation has been called
+func (p *Provider) Calls(op string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.calls[op]
+}
+
+// AddServer registers a server reachable at the given IPs
+func (p *Provider) AddServer(id, name string, ips ...string) *oneandone.Server {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := &oneandone.Server{}
+	s.Id = id
+	s.Name = name
+	for _, ip := range ips {
+		s.Ips = append(s.Ips, oneandone.ServerIp{Ip: ip})
+	}
+	p.servers[id] = s
+	return copyServer(s)
+}
+
+// AddBlockStorage registers an unattached block storage of size GB
+func (p *Provider) AddBlockStorage(name string, size int) *oneandone.BlockStorage {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := p.newBlockStorage(name, size)
+	s.State = StatePoweredOn
+	return copyBlockStorage(s)
+}
+
+// AddSharedStorage registers a shared storage of size GB with active credentials for its site
+func (p *Provider) AddSharedStorage(name string, size int) *oneandone.SharedStorage {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.next++
+	s := &oneandone.SharedStorage{
+		Size:    size,
+		State:   StateActive,
+		SiteId:  "site0001",
+		NfsPath: fmt.Sprintf("10.0.0.1:/snas/%s", name),
+	}
+	s.Id = fmt.Sprintf("shared%08d", p.next)
+	s.Name = name
+	p.shared[s.Id] = s
+	if _, ok := p.access[s.SiteId]; !ok {
+		p.access[s.SiteId] = &oneandone.SharedStorageAccess{
+			State:      StateActive,
+			SiteId:     s.SiteId,
+			UserDomain: "user0001",
+		}
+	}
+	return copySharedStorage(s)
+}
+
+// SetSharedStorageAccess replaces the credentials of a site
+func (p *Provider) SetSharedStorageAccess(access oneandone.SharedStorageAccess) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.access[access.SiteId] = &access
+}
+
+// SetState forces the state of a block or shared storage, e.g. to unstick it
+func (p *Provider) SetState(storageID, state string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if s, ok := p.storages[storageID]; ok {
+		s.State = state
+		return nil
+	}
+	if s, ok := p.shared[storageID]; ok {
+		s.State = state
+		return nil
+	}
+	return notFound("storage", storageID)
+}
+
+// call records the operation and applies latency and injected faults
+func (p *Provider) call(ctx context.Context, op string) (bool, error) {
+	p.mu.Lock()
+	p.calls[op]++
+	latency := p.Latency
+	var stuck bool
+	var err error
+	if f, ok := p.faults[op]; ok {
+		latency += f.Latency
+		stuck, err = f.Stuck, f.Err
+		if f.Times > 0 {
+			f.Times--
+			if f.Times == 0 {
+				delete(p.faults, op)
+			}
+		}
+	}
+	p.mu.Unlock()
+
+	if latency > 0 {
+		t := time.NewTimer(latency)
+		defer t.Stop()
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-t.C:
+		}
+	}
+	return stuck, err
+}
+
+// GetServer retrieves the server by ID
+func (p *Provider) GetServer(ctx context.Context, serverID string) (*oneandone.Server, error) {
+	if _, err := p.call(ctx, OpGetServer); err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s, ok := p.servers[serverID]
+	if !ok {
+		return nil, notFound("server", serverID)
+	}
+	return copyServer(s), nil
+}
+
+// FindServerFromNodeName retrieves the server with an IP matching the node name
+func (p *Provider) FindServerFromNodeName(ctx context.Context, node string) (*oneandone.Server, error) {
+	if _, err := p.call(ctx, OpFindServerFromNodeName); err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, id := range p.serverIDs() {
+		for _, ip := range p.servers[id].Ips {
+			if ip.Ip == node {
+				return copyServer(p.servers[id]), nil
+			}
+		}
+	}
+	return nil, &cloud.Error{Class: cloud.ErrorNotFound, Err: fmt.Errorf("could not match node name to server name")}
+}
+
+// GetBlockstorage retrieves the block storage by ID
+func (p *Provider) GetBlockstorage(ctx context.Context, storageID string) (*oneandone.BlockStorage, error) {
+	if _, err := p.call(ctx, OpGetBlockstorage); err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s, ok := p.storages[storageID]
+	if !ok {
+		return nil, notFound("block storage", storageID)
+	}
+	return copyBlockStorage(s), nil
+}
+
+// GetBlockstorageByName retrieves the block storage with the given name
+func (p *Provider) GetBlockstorageByName(ctx context.Context, name string) (*oneandone.BlockStorage, error) {
+	if _, err := p.call(ctx, OpGetBlockstorageByName); err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, id := range p.storageIDs() {
+		if p.storages[id].Name == name {
+			return copyBlockStorage(p.storages[id]), nil
+		}
+	}
+	return nil, &cloud.Error{Class: cloud.ErrorNotFound, Err: fmt.Errorf("storage with name %q was not found", name)}
+}
+
+// ListBlockstorages returns all block storages ordered by ID
+func (p *Provider) ListBlockstorages(ctx context.Context) ([]oneandone.BlockStorage, error) {
+	if _, err := p.call(ctx, OpListBlockstorages); err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	result := []oneandone.BlockStorage{}
+	for _, id := range p.storageIDs() {
+		result = append(result, *copyBlockStorage(p.storages[id]))
+	}
+	return result, nil
+}
+
+// CreateStorageAndWait creates a block storage
+func (p *Provider) CreateStorageAndWait(ctx context.Context, request *oneandone.BlockStorageRequest) (*oneandone.BlockStorage, error) {
+	stuck, err := p.call(ctx, OpCreateStorageAndWait)
+	if err != nil {
+		return nil, err
+	}
+	if request.Size == nil || *request.Size <= 0 {
+		return nil, APIError(http.StatusBadRequest, "size is required")
+	}
+	if request.ServerId != "" {
+		return nil, APIError(http.StatusBadRequest, "creating attached storages is not supported")
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, id := range p.storageIDs() {
+		if s := p.storages[id]; s.Name == request.Name && s.Description == request.Description {
+			if s.State != StatePoweredOn {
+				return nil, inProgress("block storage", s.Id, s.State, StatePoweredOn)
+			}
+			return copyBlockStorage(s), nil
+		}
+	}
+	s := p.newBlockStorage(request.Name, *request.Size)
+	s.Description = request.Description
+	s.State = StateDeploying
+	if stuck {
+		return nil, inProgress("block storage", s.Id, s.State, StatePoweredOn)
+	}
+	s.State = StatePoweredOn
+	return copyBlockStorage(s), nil
+}
+
+// DeleteStorageAndWait deletes an unattached block storage
+func (p *Provider) DeleteStorageAndWait(ctx context.Context, storageID string) error {
+	stuck, err := p.call(ctx, OpDeleteStorageAndWait)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s, ok := p.storages[storageID]
+	if !ok {
+		return notFound("block storage", storageID)
+	}
+	if s.State == StateRemoving {
+		return inProgress("block storage", storageID, s.State, "deleted")
+	}
+	if s.State != StatePoweredOn {
+		return busy("block storage", storageID, s.State)
+	}
+	if s.Server != nil {
+		return APIError(http.StatusConflict, fmt.Sprintf("block storage %s is attached to server %s", storageID, s.Server.Id))
+	}
+	s.State = StateRemoving
+	if stuck {
+		return inProgress("block storage", storageID, s.State, "deleted")
+	}
+	delete(p.storages, storageID)
+	return nil
+}
+
+// ResizeStorageAndWait grows the block storage to size GB
+func (p *Provider) ResizeStorageAndWait(ctx context.Context, storageID string, size int) error {
+	stuck, err := p.call(ctx, OpResizeStorageAndWait)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s, ok := p.storages[storageID]
+	if !ok {
+		return notFound("block storage", storageID)
+	}
+	if s.State == StateConfiguring && s.Size >= size {
+		return inProgress("block storage", storageID, s.State, fmt.Sprintf("resized to %d GB", size))
+	}
+	if s.State != StatePoweredOn {
+		return busy("block storage", storageID, s.State)
+	}
+	if size < s.Size {
+		return APIError(http.StatusBadRequest, fmt.Sprintf("block storage %s cannot shrink from %d GB to %d GB", storageID, s.Size, size))
+	}
+	s.Size = size
+	s.State = StateConfiguring
+	if stuck {
+		return inProgress("block storage", storageID, s.State, fmt.Sprintf("resized to %d GB", size))
+	}
+	s.State = StatePoweredOn
+	return nil
+}
+
+// AssignStorageAndWait attaches the block storage to the server
+func (p *Provider) AssignStorageAndWait(ctx context.Context, storageID string, serverID string) error {
+	stuck, err := p.call(ctx, OpAssignStorageAndWait)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s, ok := p.storages[storageID]
+	if !ok {
+		return notFound("block storage", storageID)
+	}
+	server, ok := p.servers[serverID]
+	if !ok {
+		return notFound("server", serverID)
+	}
+	if s.Server != nil && s.Server.Id == serverID {
+		if s.State != StatePoweredOn {
+			return inProgress("block storage", storageID, s.State, "attached to server "+serverID)
+		}
+		return nil
+	}
+	if s.State != StatePoweredOn {
+		return busy("block storage", storageID, s.State)
+	}
+	if s.Server != nil {
+		return APIError(http.StatusConflict, fmt.Sprintf("block storage %s is attached to server %s", storageID, s.Server.Id))
+	}
+	s.Server = &oneandone.BlockStorageServer{Id: server.Id, Name: server.Name}
+	s.State = StateConfiguring
+	if stuck {
+		return inProgress("block storage", storageID, s.State, "attached to server "+serverID)
+	}
+	s.State = StatePoweredOn
+	return nil
+}
+
+// RemoveStorageAndWait detaches the block storage from the server
+func (p *Provider) RemoveStorageAndWait(ctx context.Context, storageID string, serverID string) error {
+	stuck, err := p.call(ctx, OpRemoveStorageAndWait)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s, ok := p.storages[storageID]
+	if !ok {
+		return notFound("block storage", storageID)
+	}
+	if s.Server == nil || s.Server.Id != serverID {
+		return APIError(http.StatusBadRequest, fmt.Sprintf("block storage %s is not attached to server %s", storageID, serverID))
+	}
+	if s.State != StatePoweredOn {
+		return inProgress("block storage", storageID, s.State, "detached from server "+serverID)
+	}
+	s.State = StateConfiguring
+	if stuck {
+		return inProgress("block storage", storageID, s.State, "detached from server "+serverID)
+	}
+	s.Server = nil
+	s.State = StatePoweredOn
+	return nil
+}
+
+// GetSharedStorage retrieves the shared storage by ID
+func (p *Provider) GetSharedStorage(ctx context.Context, storageID string) (*oneandone.SharedStorage, error) {
+	if _, err := p.call(ctx, OpGetSharedStorage); err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s, ok := p.shared[storageID]
+	if !ok {
+		return nil, notFound("shared storage", storageID)
+	}
+	return copySharedStorage(s), nil
+}
+
+// GetSharedStorageByName retrieves the shared storage with the given name
+func (p *Provider) GetSharedStorageByName(ctx context.Context, name string) (*oneandone.SharedStorage, error) {
+	if _, err := p.call(ctx, OpGetSharedStorageByName); err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ids := []string{}
+	for id := range p.shared {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		if p.shared[id].Name == name {
+			return copySharedStorage(p.shared[id]), nil
+		}
+	}
+	return nil, &cloud.Error{Class: cloud.ErrorNotFound, Err: fmt.Errorf("shared storage with name %q was not found", name)}
+}
+
+// GrantSharedStorageAccessAndWait gives the server access to the shared storage,
+// changing its rights when it has access already
+func (p *Provider) GrantSharedStorageAccessAndWait(ctx context.Context, storageID string, serverID string, rights string) error {
+	stuck, err := p.call(ctx, OpGrantSharedStorageAccessAndWait)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s, ok := p.shared[storageID]
+	if !ok {
+		return notFound("shared storage", storageID)
+	}
+	server, ok := p.servers[serverID]
+	if !ok {
+		return notFound("server", serverID)
+	}
+	granted := -1
+	for i, a := range s.Servers {
+		if a.Id == serverID {
+			if a.Rights == rights {
+				return nil
+			}
+			granted = i
+		}
+	}
+	if s.State != StateActive {
+		return busy("shared storage", storageID, s.State)
+	}
+	if granted >= 0 {
+		s.Servers[granted].Rights = rights
+	} else {
+		s.Servers = append(s.Servers, oneandone.SharedStorageServer{Id: server.Id, Name: server.Name, Rights: rights})
+	}
+	s.State = StateConfiguring
+	if stuck {
+		return inProgress("shared storage", storageID, s.State, StateActive)
+	}
+	s.State = StateActive
+	return nil
+}
+
+// RevokeSharedStorageAccessAndWait removes the server access to the shared storage
+func (p *Provider) RevokeSharedStorageAccessAndWait(ctx context.Context, storageID string, serverID string) error {
+	stuck, err := p.call(ctx, OpRevokeSharedStorageAccessAndWait)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s, ok := p.shared[storageID]
+	if !ok {
+		return notFound("shared storage", storageID)
+	}
+	if s.State != StateActive {
+		return busy("shared storage", storageID, s.State)
+	}
+	servers := []oneandone.SharedStorageServer{}
+	for _, a := range s.Servers {
+		if a.Id != serverID {
+			servers = append(servers, a)
+		}
+	}
+	if len(servers) == len(s.Servers) {
+		return notFound("shared storage server", serverID)
+	}
+	s.Servers = servers
+	s.State = StateConfiguring
+	if stuck {
+		return inProgress("shared storage", storageID, s.State, StateActive)
+	}
+	s.State = StateActive
+	return nil
+}
+
+// GetSharedStorageCredentials returns the credentials of the storage's site
+func (p *Provider) GetSharedStorageCredentials(ctx context.Context, storage *oneandone.SharedStorage) (*oneandone.SharedStorageAccess, error) {
+	if _, err := p.call(ctx, OpGetSharedStorageCredentials); err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	a, ok := p.access[storage.SiteId]
+	if !ok {
+		return nil, fmt.Errorf("no shared storage credentials found for site %s", storage.SiteId)
+	}
+	access := *a
+	return &access, nil
+}
+
+func (p *Provider) newBlockStorage(name string, size int) *oneandone.BlockStorage {
+	p.next++
+	s := &oneandone.BlockStorage{
+		Size:         size,
+		Name:         name,
+		CreationDate: time.Now(),
+		UUID:         fmt.Sprintf("600144f0%024x", p.next),
+	}
+	s.Id = fmt.Sprintf("storage%08d", p.next)
+	p.storages[s.Id] = s
+	return s
+}
+
+func (p *Provider) serverIDs() []string {
+	ids := []string{}
+	for id := range p.servers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (p *Provider) storageIDs() []string {
+	ids := []string{}
+	for id := range p.storages {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func copyServer(s *oneandone.Server) *oneandone.Server {
+	c := *s
+	c.Ips = append([]oneandone.ServerIp(nil), s.Ips...)
+	return &c
+}
+
+func copyBlockStorage(s *oneandone.BlockStorage) *oneandone.BlockStorage {
+	c := *s
+	if s.Server != nil {
+		server := *s.Server
+		c.Server = &server
+	}
+	return &c
+}
+
+func copySharedStorage(s *oneandone.SharedStorage) *oneandone.SharedStorage {
+	c := *s
+	c.Servers = append([]oneandone.SharedStorageServer(nil), s.Servers...)
+	return &c
+}
@@ -0,0 +1,106 @@
+package fake
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/1and1/oneandone-flex-volume/pkg/oneandone/cloud"
+)
+
+func TestAttachDetach(t *testing.T) {
+	p := NewProvider()
+	server := p.AddServer("server01", "node01", "10.0.0.10")
+	storage := p.AddBlockStorage("pv-data", 20)
+
+	if err := p.AssignStorageAndWait(context.Background(), storage.Id, server.Id); err != nil {
+		t.Fatalf("unexpected error attaching storage: %s", err)
+	}
+	s, _ := p.GetBlockstorage(context.Background(), storage.Id)
+	if s.Server == nil || s.Server.Id != server.Id || s.State != StatePoweredOn {
+		t.Errorf("expected storage attached to %s and powered on but got %+v", server.Id, s)
+	}
+
+	if err := p.AssignStorageAndWait(context.Background(), storage.Id, server.Id); err != nil {
+		t.Errorf("expected attaching again to the same server to succeed but got %s", err)
+	}
+	other := p.AddServer("server02", "node02", "10.0.0.20")
+	if err := p.AssignStorageAndWait(context.Background(), storage.Id, other.Id); err == nil {
+		t.Errorf("expected error attaching a storage attached to another server")
+	}
+	if err := p.DeleteStorageAndWait(context.Background(), storage.Id); err == nil {
+		t.Errorf("expected error deleting an attached storage")
+	}
+
+	if err := p.RemoveStorageAndWait(context.Background(), storage.Id, server.Id); err != nil {
+		t.Fatalf("unexpected error detaching storage: %s", err)
+	}
+	if err := p.DeleteStorageAndWait(context.Background(), storage.Id); err != nil {
+		t.Fatalf("unexpected error deleting storage: %s", err)
+	}
+	if _, err := p.GetBlockstorage(context.Background(), storage.Id); !cloud.IsNotFound(err) {
+		t.Errorf("expected not found error for deleted storage but got %v", err)
+	}
+}
+
+func TestInjectedError(t *testing.T) {
+	p := NewProvider()
+	storage := p.AddBlockStorage("pv-data", 20)
+	injected := errors.New("injected")
+	p.InjectFault(OpGetBlockstorage, Fault{Err: injected, Times: 2})
+
+	for i := 0; i < 2; i++ {
+		if _, err := p.GetBlockstorage(context.Background(), storage.Id); err != injected {
+			t.Errorf("call %d expected injected error but got %v", i, err)
+		}
+	}
+	if _, err := p.GetBlockstorage(context.Background(), storage.Id); err != nil {
+		t.Errorf("expected fault to be exhausted but got %v", err)
+	}
+	if calls := p.Calls(OpGetBlockstorage); calls != 3 {
+		t.Errorf("expected 3 calls but got %d", calls)
+	}
+}
+
+func TestStuckState(t *testing.T) {
+	p := NewProvider()
+	server := p.AddServer("server01", "node01", "10.0.0.10")
+	storage := p.AddBlockStorage("pv-data", 20)
+	p.InjectFault(OpAssignStorageAndWait, Fault{Stuck: true, Times: 1})
+
+	if err := p.AssignStorageAndWait(context.Background(), storage.Id, server.Id); !cloud.IsInProgress(err) {
+		t.Fatalf("expected stuck attach to be in progress but got %v", err)
+	}
+	if err := p.AssignStorageAndWait(context.Background(), storage.Id, server.Id); !cloud.IsInProgress(err) {
+		t.Errorf("expected the resumed attach to be in progress but got %v", err)
+	}
+	s, _ := p.GetBlockstorage(context.Background(), storage.Id)
+	if s.State != StateConfiguring || s.Server == nil {
+		t.Errorf("expected storage to be attached and configuring but got %+v", s)
+	}
+	if err := p.RemoveStorageAndWait(context.Background(), storage.Id, server.Id); err == nil {
+		t.Errorf("expected busy error detaching a configuring storage")
+	}
+
+	p.SetState(storage.Id, StatePoweredOn)
+	if err := p.AssignStorageAndWait(context.Background(), storage.Id, server.Id); err != nil {
+		t.Errorf("expected the resumed attach to succeed once powered on but got %s", err)
+	}
+	if err := p.RemoveStorageAndWait(context.Background(), storage.Id, server.Id); err != nil {
+		t.Errorf("unexpected error detaching storage: %s", err)
+	}
+}
+
+func TestLatency(t *testing.T) {
+	p := NewProvider()
+	p.InjectFault(OpListBlockstorages, Fault{Latency: 20 * time.Millisecond})
+
+	start := time.Now()
+	if _, err := p.ListBlockstorages(context.Background()); err != nil {
+		t.Fatalf("unexpected error listing storages: %s", err)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("expected call to take at least 20ms but took %s", elapsed)
+	}
+}
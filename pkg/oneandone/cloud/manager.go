@@ -17,12 +17,10 @@ limitations under the License.
 package cloud
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
-	"os/exec"
-	"regexp"
+	"net/http"
 	"runtime"
 	"strings"
 	"time"
@@ -31,14 +29,26 @@ import (
 	"github.com/1and1/oneandone-flex-volume/helper"
 )
 
+// Storage states
+const (
+	statePoweredOn = "POWERED_ON"
+	stateRemoving  = "REMOVING"
+	stateActive    = "ACTIVE"
+)
+
 // OneandoneManager communicates with the 1&1 API
 type OneandoneManager struct {
 	client *oneandone.API
 	region string
+	// retry runs every call to the API
+	retry *Retrier
+	// poll waits for storages to reach a state
+	poll *Poller
 }
 
-// NewOneandoneManager returns a 1&1 manager
-func NewOneandoneManager(token string) (*OneandoneManager, error) {
+// NewOneandoneManager returns a 1&1 manager talking to apiURL, or to the
+// public 1&1 Cloud API when apiURL is empty
+func NewOneandoneManager(token, apiURL string) (*OneandoneManager, error) {
 	_, file, no, ok := runtime.Caller(0)
 
 	if ok {
@@ -51,158 +61,243 @@ func NewOneandoneManager(token string) (*OneandoneManager, error) {
 		return nil, errors.New("1and1 token is empty")
 	}
 
-	helper.DebugFile(fmt.Sprintf("Using token -> %s", token))
+	if apiURL == "" {
+		apiURL = oneandone.BaseUrl
+	}
+	helper.DebugFile(fmt.Sprintf("Using API at %s", apiURL))
 
-	client := oneandone.New(token, oneandone.BaseUrl)
+	client := oneandone.New(token, strings.TrimRight(apiURL, "/"))
 
 	m := &OneandoneManager{
 		client: client,
+		retry:  NewRetrier(),
+		poll:   NewPoller(),
 	}
 
 	return m, nil
 }
 
-type Result struct {
-	Blockdevices []struct {
-		Mountpoint string `json:"mountpoint"`
-		Name       string `json:"name"`
-		Children   []struct {
-			Mountpoint string `json:"mountpoint"`
-			Name       string `json:"name"`
-		} `json:"children,omitempty"`
-	} `json:"blockdevices"`
+// Timeouts tunes the retries and waits of the manager, zero values keep
+// the defaults
+type Timeouts struct {
+	// Retry is how long a call to the API is tried for
+	Retry time.Duration
+	// PollInterval is the delay between two checks of a wait
+	PollInterval time.Duration
+	// Poll is how long a wait lasts before it fails
+	Poll time.Duration
+}
+
+// SetTimeouts replaces the retry deadline and the poll interval and timeout
+func (m *OneandoneManager) SetTimeouts(t Timeouts) {
+	if t.Retry > 0 {
+		m.retry.Deadline = t.Retry
+	}
+	if t.PollInterval > 0 {
+		m.poll.Interval = t.PollInterval
+	}
+	if t.Poll > 0 {
+		m.poll.Timeout = t.Poll
+	}
 }
 
 // GetServer retrieves the server by ID
-func (m *OneandoneManager) GetServer(serverID string) (*oneandone.Server, error) {
-	server, err := m.client.GetServer(serverID)
+func (m *OneandoneManager) GetServer(ctx context.Context, serverID string) (*oneandone.Server, error) {
+	var server *oneandone.Server
+	err := m.retry.Do(ctx, "GetServer", func() (err error) {
+		server, err = m.client.GetServer(serverID)
+		return err
+	})
 
 	if err != nil {
-		return nil, fmt.Errorf("error fetching server %s not found %s", serverID, err.Error())
+		return nil, wrapError(err, "error fetching server %s not found", serverID)
 	}
 	return server, nil
 }
 
 // GetBlockstorage given an unique 1&1 identifier returns the block storage
-func (m *OneandoneManager) GetBlockstorage(storageID string) (*oneandone.BlockStorage, error) {
-	storage, err := m.client.GetBlockStorage(storageID)
+func (m *OneandoneManager) GetBlockstorage(ctx context.Context, storageID string) (*oneandone.BlockStorage, error) {
+	storage, err := m.getBlockStorage(ctx, storageID)
 
 	if err != nil {
-		return nil, fmt.Errorf("error fetching 1and1 block storage %s %s", storageID, err.Error())
+		return nil, wrapError(err, "error fetching 1and1 block storage %s", storageID)
 	}
 
 	return storage, nil
 }
 
+// ListBlockstorages returns all block storages of the account
+func (m *OneandoneManager) ListBlockstorages(ctx context.Context) ([]oneandone.BlockStorage, error) {
+	storages, err := m.listBlockStorages(ctx)
+
+	if err != nil {
+		return nil, wrapError(err, "error listing 1and1 block storages")
+	}
+
+	return storages, nil
+}
+
 // GetBlockstorageByName given a name identifier returns the block storage
-func (m *OneandoneManager) GetBlockstorageByName(name string) (*oneandone.BlockStorage, error) {
-	storages, err := m.client.ListBlockStorages()
+func (m *OneandoneManager) GetBlockstorageByName(ctx context.Context, name string) (*oneandone.BlockStorage, error) {
+	storages, err := m.listBlockStorages(ctx)
 
 	if err != nil {
 		return nil, err
 	}
 
 	for _, s := range storages {
-		if strings.Contains(name, s.Name) {
+		if s.Name == name {
 			return &s, nil
 		}
 	}
 
-	return nil, fmt.Errorf("storage with name %q was not found", name)
+	return nil, notFoundError("storage with name %q was not found", name)
 }
 
 // AssignStorageAndWait attaches volume to given server
 // it will wait until the attach action is completed
-func (m *OneandoneManager) AssignStorageAndWait(storageID string, serverID string) error {
-	storage, err := m.client.AddBlockStorageServer(storageID, serverID)
-	if err != nil {
-		return fmt.Errorf("error occured while adding storage to the server id %s, storage id %s, error %s", serverID, storageID, err.Error())
-	}
-
-	err = m.client.WaitForState(storage, "POWERED_ON", 10, 100)
-	if err != nil {
+func (m *OneandoneManager) AssignStorageAndWait(ctx context.Context, storageID string, serverID string) error {
+	err := m.retry.Do(ctx, "AddBlockStorageServer", func() error {
+		// a failed attempt or a call that ran out of time may have attached
+		// the storage already, waiting for it resumes
+		storage, err := m.client.GetBlockStorage(storageID)
+		if err != nil || (storage.Server != nil && storage.Server.Id == serverID) {
+			return err
+		}
+		_, err = m.client.AddBlockStorageServer(storageID, serverID)
 		return err
+	})
+	if err != nil {
+		return wrapError(err, "error occured while adding storage to the server id %s, storage id %s, error", serverID, storageID)
 	}
 
-	return nil
+	_, err = m.waitForBlockStorage(ctx, storageID, "attached to server "+serverID, func(s *oneandone.BlockStorage) (bool, error) {
+		// the storage may be POWERED_ON before the server shows up, only
+		// another server means the attach did not take
+		if s.Server != nil && s.Server.Id != serverID {
+			return false, fmt.Errorf("block storage %s is attached to server %s instead of %s", storageID, s.Server.Id, serverID)
+		}
+		return s.Server != nil && s.State == statePoweredOn, nil
+	})
+	return err
 }
 
-// GetDeviceName finds system name of the block storage
-func (m *OneandoneManager) GetDeviceName() (string, error) {
-	deviceBaseName := "/dev/%s"
-
-	var stdOut, stdErr bytes.Buffer
-	cmd := exec.Command("lsblk", "-o", "MOUNTPOINT,NAME", "-J")
-	cmd.Stdout = &stdOut
-	cmd.Stderr = &stdErr
-
-	err := cmd.Run()
+// RemoveStorageAndWait detaches the volume from the given server
+// it will wait until the storage is no longer attached
+func (m *OneandoneManager) RemoveStorageAndWait(ctx context.Context, storageID string, serverID string) error {
+	err := m.RemoveBlockStorageServer(ctx, storageID, serverID)
 	if err != nil {
-		return "", fmt.Errorf("Error: %s, %s", err.Error(), stdErr.String())
+		return wrapError(err, "error occured while removing storage from the server id %s, storage id %s, error", serverID, storageID)
 	}
 
-	resultObj := &Result{}
-
-	json.Unmarshal(stdOut.Bytes(), resultObj)
+	_, err = m.waitForBlockStorage(ctx, storageID, "detached from server "+serverID, func(s *oneandone.BlockStorage) (bool, error) {
+		return s.Server == nil, nil
+	})
+	return err
+}
 
-	for _, b := range resultObj.Blockdevices {
-		if b.Mountpoint == "" && len(b.Children) == 0 {
-			return fmt.Sprintf(deviceBaseName, b.Name), nil
+// CreateStorageAndWait creates a block storage
+// it will wait until the storage is ready to be attached
+func (m *OneandoneManager) CreateStorageAndWait(ctx context.Context, request *oneandone.BlockStorageRequest) (*oneandone.BlockStorage, error) {
+	var storage *oneandone.BlockStorage
+	err := m.retry.Do(ctx, "CreateBlockStorage", func() (err error) {
+		// a failed attempt or a call that ran out of time may have created
+		// the storage already, waiting for it resumes
+		if storage, err = m.findBlockStorage(request); err != nil || storage != nil {
+			return err
 		}
+		_, storage, err = m.client.CreateBlockStorage(request)
+		return err
+	})
+	if err != nil {
+		return nil, wrapError(err, "error occured while creating storage %s, error", request.Name)
 	}
-	return "", err
-}
-
-// GetMountPoint finds a mount point of the block storage
-func (m *OneandoneManager) GetMountPoint(storageID string) (string, error) {
-	deviceBaseName := "/dev/%s"
-
-	var validID = regexp.MustCompile(`pvc-[A-Za-z0-9-]*`)
-	var volumeName = validID.FindString(storageID)
 
-	var stdOut, stdErr bytes.Buffer
-	cmd := exec.Command("lsblk", "-o", "MOUNTPOINT,NAME", "-J")
-	cmd.Stdout = &stdOut
-	cmd.Stderr = &stdErr
+	return m.waitForBlockStorage(ctx, storage.Id, statePoweredOn, func(s *oneandone.BlockStorage) (bool, error) {
+		return s.State == statePoweredOn, nil
+	})
+}
 
-	err := cmd.Run()
+// DeleteStorageAndWait deletes a block storage
+// it will wait until the API no longer knows the storage
+func (m *OneandoneManager) DeleteStorageAndWait(ctx context.Context, storageID string) error {
+	attempt := 0
+	err := m.retry.Do(ctx, "DeleteBlockStorage", func() error {
+		attempt++
+		// a call that ran out of time has started removing the storage
+		// already, waiting for it resumes
+		storage, err := m.client.GetBlockStorage(storageID)
+		if err != nil || storage.State == stateRemoving {
+			return err
+		}
+		_, err = m.client.DeleteBlockStorage(storageID)
+		if attempt > 1 && IsNotFound(err) {
+			// the failed attempt deleted the storage all the same
+			return nil
+		}
+		return err
+	})
 	if err != nil {
-		return "", fmt.Errorf("Error: %s, %s", err.Error(), stdErr.String())
+		return wrapError(err, "error occured while deleting storage id %s, error", storageID)
 	}
 
-	resultObj := &Result{}
-
-	json.Unmarshal(stdOut.Bytes(), resultObj)
+	return m.poll.Poll(ctx, "block storage "+storageID, "deleted", func() (string, bool, error) {
+		storage, err := m.getBlockStorage(ctx, storageID)
+		if IsNotFound(err) {
+			return "", true, nil
+		}
+		if err != nil {
+			return "", false, err
+		}
+		return storage.State, false, nil
+	})
+}
 
-	for _, b := range resultObj.Blockdevices {
-		match := validID.FindString(b.Mountpoint)
-		if match == volumeName {
-			return fmt.Sprintf(deviceBaseName, b.Name), nil
+// ResizeStorageAndWait grows the block storage to the given size in GB
+// it will wait until the API reports the new size
+func (m *OneandoneManager) ResizeStorageAndWait(ctx context.Context, storageID string, size int) error {
+	req := struct {
+		Size *int `json:"size"`
+	}{oneandone.Int2Pointer(size)}
+	url := fmt.Sprintf("%s/block_storages/%s", m.client.Endpoint, storageID)
+
+	err := m.retry.Do(ctx, "UpdateBlockStorage", func() error {
+		// a failed attempt or a call that ran out of time may have resized
+		// the storage already, waiting for it resumes
+		storage, err := m.client.GetBlockStorage(storageID)
+		if err != nil || storage.Size >= size {
+			return err
 		}
+		result := new(oneandone.BlockStorage)
+		return m.client.Client.Put(url, &req, result, http.StatusOK)
+	})
+	if err != nil {
+		return wrapError(err, "error occured while resizing storage id %s to %d GB, error", storageID, size)
 	}
-	return "", err
+
+	_, err = m.waitForBlockStorage(ctx, storageID, fmt.Sprintf("resized to %d GB", size), func(s *oneandone.BlockStorage) (bool, error) {
+		return s.Size >= size && s.State == statePoweredOn, nil
+	})
+	return err
 }
 
 // RemoveBlockStorageServer detaches a disk to given server
-func (m *OneandoneManager) RemoveBlockStorageServer(storageID string, serverID string) error {
-
-	storage, err := m.client.GetBlockStorage(storageID)
+func (m *OneandoneManager) RemoveBlockStorageServer(ctx context.Context, storageID string, serverID string) error {
+	err := m.retry.Do(ctx, "RemoveBlockStorageServer", func() error {
+		// a failed attempt may have detached the storage all the same, and
+		// a call that ran out of time may be detaching it, waiting for it
+		// resumes
+		storage, err := m.client.GetBlockStorage(storageID)
+		if err != nil || storage.Server == nil || storage.State != statePoweredOn {
+			return err
+		}
+		_, err = m.client.RemoveBlockStorageServer(storageID, serverID)
+		return err
+	})
 	if err != nil {
+		helper.DebugFile(fmt.Sprintf("error while RemoveBlockStorageServer %s", err.Error()))
 		return err
 	}
-	if storage.Server != nil {
-		_, err := m.client.RemoveBlockStorageServer(storageID, serverID)
-
-		if err != nil {
-			helper.DebugFile(fmt.Sprintf("failed once, trying again"))
-			time.Sleep(1 * time.Second)
-			_, err := m.client.RemoveBlockStorageServer(storageID, serverID)
-			if err != nil {
-				helper.DebugFile(fmt.Sprintf("error while RemoveBlockStorageServer %s", err.Error()))
-				return err
-			}
-		}
-	}
 
 	return nil
 
@@ -211,9 +306,13 @@ func (m *OneandoneManager) RemoveBlockStorageServer(storageID string, serverID s
 // FindServerFromNodeName retrieves the server given the kubernetes node name
 // Droplet name and Node name should match.
 // If not, we will try to match the name with private and public IP
-func (m *OneandoneManager) FindServerFromNodeName(node string) (*oneandone.Server, error) {
+func (m *OneandoneManager) FindServerFromNodeName(ctx context.Context, node string) (*oneandone.Server, error) {
 	// try to find server with same name as the kubernetes node
-	servers, err := m.client.ListServers()
+	var servers []oneandone.Server
+	err := m.retry.Do(ctx, "ListServers", func() (err error) {
+		servers, err = m.client.ListServers()
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -225,5 +324,59 @@ func (m *OneandoneManager) FindServerFromNodeName(node string) (*oneandone.Serve
 			}
 		}
 	}
-	return nil, fmt.Errorf("could not match node name to server name")
+	return nil, notFoundError("could not match node name to server name")
+}
+
+// getBlockStorage fetches the block storage, retrying transient errors
+func (m *OneandoneManager) getBlockStorage(ctx context.Context, storageID string) (*oneandone.BlockStorage, error) {
+	var storage *oneandone.BlockStorage
+	err := m.retry.Do(ctx, "GetBlockStorage", func() (err error) {
+		storage, err = m.client.GetBlockStorage(storageID)
+		return err
+	})
+	return storage, err
+}
+
+// listBlockStorages lists the block storages, retrying transient errors
+func (m *OneandoneManager) listBlockStorages(ctx context.Context) ([]oneandone.BlockStorage, error) {
+	var storages []oneandone.BlockStorage
+	err := m.retry.Do(ctx, "ListBlockStorages", func() (err error) {
+		storages, err = m.client.ListBlockStorages()
+		return err
+	})
+	return storages, err
+}
+
+// findBlockStorage returns the block storage an earlier call created for
+// the request, nil when there is none
+func (m *OneandoneManager) findBlockStorage(request *oneandone.BlockStorageRequest) (*oneandone.BlockStorage, error) {
+	storages, err := m.client.ListBlockStorages()
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range storages {
+		if s.Name == request.Name && s.Description == request.Description {
+			return &s, nil
+		}
+	}
+	return nil, nil
+}
+
+// waitForBlockStorage polls the block storage until done reports it in the
+// wanted state and returns it
+func (m *OneandoneManager) waitForBlockStorage(ctx context.Context, storageID, want string, done func(*oneandone.BlockStorage) (bool, error)) (*oneandone.BlockStorage, error) {
+	var storage *oneandone.BlockStorage
+	err := m.poll.Poll(ctx, "block storage "+storageID, want, func() (string, bool, error) {
+		s, err := m.getBlockStorage(ctx, storageID)
+		if err != nil {
+			return "", false, err
+		}
+		storage = s
+		ok, err := done(s)
+		return s.State, ok, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return storage, nil
 }
@@ -0,0 +1,242 @@
+package cloud
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/1and1/oneandone-cloudserver-sdk-go"
+	"github.com/1and1/oneandone-flex-volume/pkg/oneandone/mockapi"
+)
+
+func TestManagerAgainstMockAPI(t *testing.T) {
+	api := mockapi.NewServer()
+	defer api.Close()
+	api.Token = "secret"
+	api.AddServer("server01", "node01", "10.0.0.10")
+
+	m, err := NewOneandoneManager("secret", api.URL)
+	if err != nil {
+		t.Fatalf("an error ocurred creating the manager %s", err)
+	}
+
+	server, err := m.FindServerFromNodeName(context.Background(), "10.0.0.10")
+	if err != nil || server.Id != "server01" {
+		t.Fatalf("expected server01 but got %v and error %v", server, err)
+	}
+
+	storage, err := m.CreateStorageAndWait(context.Background(), &oneandone.BlockStorageRequest{Name: "pv-0123", Size: oneandone.Int2Pointer(20)})
+	if err != nil {
+		t.Fatalf("an error ocurred creating the storage %s", err)
+	}
+
+	found, err := m.GetBlockstorageByName(context.Background(), "pv-0123")
+	if err != nil || found.Id != storage.Id {
+		t.Errorf("expected to find storage %s by name but got %v and error %v", storage.Id, found, err)
+	}
+
+	if err := m.AssignStorageAndWait(context.Background(), storage.Id, server.Id); err != nil {
+		t.Fatalf("an error ocurred attaching the storage %s", err)
+	}
+	if attached := api.BlockStorage(storage.Id); attached.Server == nil || attached.Server.Id != server.Id {
+		t.Errorf("expected storage to be attached to %s but got %+v", server.Id, attached.Server)
+	}
+
+	if err := m.ResizeStorageAndWait(context.Background(), storage.Id, 30); err != nil {
+		t.Fatalf("an error ocurred resizing the storage %s", err)
+	}
+	if size := api.BlockStorage(storage.Id).Size; size != 30 {
+		t.Errorf("expected size 30 but got %d", size)
+	}
+
+	if err := m.DeleteStorageAndWait(context.Background(), storage.Id); err == nil {
+		t.Errorf("expected deleting an attached storage to fail")
+	}
+
+	if err := m.RemoveStorageAndWait(context.Background(), storage.Id, server.Id); err != nil {
+		t.Fatalf("an error ocurred detaching the storage %s", err)
+	}
+	if err := m.DeleteStorageAndWait(context.Background(), storage.Id); err != nil {
+		t.Fatalf("an error ocurred deleting the storage %s", err)
+	}
+
+	_, err = m.GetBlockstorage(context.Background(), storage.Id)
+	if !IsNotFound(err) {
+		t.Errorf("expected a not found error but got %v", err)
+	}
+}
+
+func TestManagerSharedStorageAgainstMockAPI(t *testing.T) {
+	api := mockapi.NewServer()
+	defer api.Close()
+	api.AddServer("server01", "node01", "10.0.0.10")
+	id := api.AddSharedStorage("shared01", 50)
+
+	m, err := NewOneandoneManager("token", api.URL)
+	if err != nil {
+		t.Fatalf("an error ocurred creating the manager %s", err)
+	}
+
+	if err := m.GrantSharedStorageAccessAndWait(context.Background(), id, "server01", SharedStorageReadWrite); err != nil {
+		t.Fatalf("an error ocurred granting access %s", err)
+	}
+
+	storage, err := m.GetSharedStorageByName(context.Background(), "shared01")
+	if err != nil {
+		t.Fatalf("an error ocurred getting the shared storage %s", err)
+	}
+	if len(storage.Servers) != 1 || storage.Servers[0].Rights != SharedStorageReadWrite {
+		t.Errorf("expected server01 to have RW access but got %+v", storage.Servers)
+	}
+
+	credentials, err := m.GetSharedStorageCredentials(context.Background(), storage)
+	if err != nil || credentials.SiteId != storage.SiteId {
+		t.Errorf("expected credentials for site %s but got %v and error %v", storage.SiteId, credentials, err)
+	}
+
+	if err := m.RevokeSharedStorageAccessAndWait(context.Background(), id, "server01"); err != nil {
+		t.Fatalf("an error ocurred revoking access %s", err)
+	}
+	if servers := api.SharedStorage(id).Servers; len(servers) != 0 {
+		t.Errorf("expected no servers with access but got %+v", servers)
+	}
+}
+
+func TestManagerRejectsInvalidToken(t *testing.T) {
+	api := mockapi.NewServer()
+	defer api.Close()
+	api.Token = "secret"
+
+	m, err := NewOneandoneManager("wrong", api.URL)
+	if err != nil {
+		t.Fatalf("an error ocurred creating the manager %s", err)
+	}
+	if _, err := m.ListBlockstorages(context.Background()); !IsAuth(err) {
+		t.Errorf("expected an auth error using an invalid token but got %v", err)
+	}
+}
+
+func TestManagerRetriesTransientErrors(t *testing.T) {
+	api := mockapi.NewServer()
+	defer api.Close()
+	api.AddServer("server01", "node01", "10.0.0.10")
+	id := api.AddBlockStorage("pv-0123", 20)
+
+	m, err := NewOneandoneManager("token", api.URL)
+	if err != nil {
+		t.Fatalf("an error ocurred creating the manager %s", err)
+	}
+	m.retry.Interval = time.Millisecond
+	m.retry.MaxInterval = time.Millisecond
+
+	api.Fail(http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	if _, err := m.GetServer(context.Background(), "server01"); err != nil {
+		t.Errorf("expected the transient errors to be retried but got %s", err)
+	}
+
+	api.Fail(http.StatusBadGateway)
+	if err := m.AssignStorageAndWait(context.Background(), id, "server01"); err != nil {
+		t.Fatalf("an error ocurred attaching the storage %s", err)
+	}
+
+	api.Fail(http.StatusInternalServerError, http.StatusInternalServerError)
+	if err := m.RemoveStorageAndWait(context.Background(), id, "server01"); err != nil {
+		t.Fatalf("an error ocurred detaching the storage %s", err)
+	}
+	if storage := api.BlockStorage(id); storage.Server != nil {
+		t.Errorf("expected storage to be detached but got %+v", storage.Server)
+	}
+
+	api.Fail(http.StatusConflict, http.StatusInternalServerError)
+	if _, err := m.GetBlockstorage(context.Background(), id); !IsConflict(err) {
+		t.Errorf("expected a conflict error but got %v", err)
+	}
+
+	m.retry.Deadline = 0
+	api.Fail(http.StatusServiceUnavailable)
+	if _, err := m.ListBlockstorages(context.Background()); !IsRetryable(err) {
+		t.Errorf("expected a retryable error once the deadline passed but got %v", err)
+	}
+}
+
+func TestManagerResumesWaitInProgress(t *testing.T) {
+	api := mockapi.NewServer()
+	defer api.Close()
+	api.AddServer("server01", "node01", "10.0.0.10")
+	id := api.AddBlockStorage("pv-0123", 20)
+	api.SetState(id, "CONFIGURING")
+
+	m, err := NewOneandoneManager("token", api.URL)
+	if err != nil {
+		t.Fatalf("an error ocurred creating the manager %s", err)
+	}
+	m.poll.Interval = 10 * time.Millisecond
+	m.poll.Margin = 20 * time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := m.AssignStorageAndWait(ctx, id, "server01"); !IsInProgress(err) {
+		t.Fatalf("expected the attach to be in progress but got %v", err)
+	}
+	if attached := api.BlockStorage(id); attached.Server == nil || attached.Server.Id != "server01" {
+		t.Errorf("expected storage to be attached to server01 but got %+v", attached.Server)
+	}
+
+	api.SetState(id, "POWERED_ON")
+	if err := m.AssignStorageAndWait(context.Background(), id, "server01"); err != nil {
+		t.Errorf("expected the attach to resume but got %s", err)
+	}
+
+	api.SetState(id, "FAILED")
+	if err := m.ResizeStorageAndWait(context.Background(), id, 30); err == nil || IsInProgress(err) {
+		t.Errorf("expected a storage in a failed state to fail the wait but got %v", err)
+	}
+}
+
+func TestManagerWaitsForAttach(t *testing.T) {
+	cases := []struct {
+		name          string
+		server        string
+		state         string
+		expectedError bool
+	}{
+		{"attached late", "server01", "POWERED_ON", false},
+		{"attached to another server", "server02", "POWERED_ON", true},
+		{"failed", "", "FAILED", true},
+	}
+
+	for _, c := range cases {
+		api := mockapi.NewServer()
+		api.AddServer("server01", "node01", "10.0.0.10")
+		api.AddServer("server02", "node02", "10.0.0.20")
+		id := api.AddBlockStorage("pv-0123", 20)
+		api.DeferAttach = true
+
+		m, err := NewOneandoneManager("token", api.URL)
+		if err != nil {
+			t.Fatalf("an error ocurred creating the manager %s", err)
+		}
+		// the storage is POWERED_ON without a server until the first wait
+		waits := 0
+		m.poll.sleep = func(ctx context.Context, d time.Duration) error {
+			waits++
+			api.SetServer(id, c.server)
+			api.SetState(id, c.state)
+			return nil
+		}
+
+		err = m.AssignStorageAndWait(context.Background(), id, "server01")
+		if c.expectedError {
+			if err == nil || IsInProgress(err) {
+				t.Errorf("%s: expected the attach to fail but got %v", c.name, err)
+			}
+		} else if err != nil {
+			t.Errorf("%s: an error ocurred attaching the storage %s", c.name, err)
+		}
+		if waits != 1 {
+			t.Errorf("%s: expected 1 wait but got %d", c.name, waits)
+		}
+		api.Close()
+	}
+}
@@ -0,0 +1,116 @@
+package cloud
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Poll defaults
+const (
+	DefaultPollInterval = 10 * time.Second
+	DefaultPollTimeout  = 15 * time.Minute
+	DefaultPollMargin   = 5 * time.Second
+)
+
+// failedStates are the states a resource does not leave on its own
+var failedStates = map[string]bool{
+	"FAILED": true,
+	"ERROR":  true,
+}
+
+// InProgressError reports an operation the 1&1 API is still carrying out
+// when the deadline of the caller comes. Calling the same method again
+// resumes waiting for it instead of starting it over.
+type InProgressError struct {
+	// Resource names the resource waited for
+	Resource string
+	// State is the last state seen
+	State string
+	// Want is the state waited for
+	Want string
+}
+
+func (e *InProgressError) Error() string {
+	return fmt.Sprintf("%s is still %s, waiting to be %s is in progress and resumes on the next try", e.Resource, e.State, e.Want)
+}
+
+// IsInProgress reports whether the operation goes on at 1&1 and the call
+// should be repeated to wait for it
+func IsInProgress(err error) bool {
+	return ClassOf(err) == ErrorInProgress
+}
+
+// Poller waits for a resource of the 1&1 API to reach a state
+type Poller struct {
+	// Interval is the delay between two checks
+	Interval time.Duration
+	// Timeout is how long to wait before failing
+	Timeout time.Duration
+	// Margin is kept before the deadline of the context, so the caller gets
+	// the in progress result before its own caller gives up
+	Margin time.Duration
+	// sleep is replaced in tests
+	sleep func(context.Context, time.Duration) error
+}
+
+// NewPoller returns a poller with the default interval, timeout and margin
+func NewPoller() *Poller {
+	return &Poller{
+		Interval: DefaultPollInterval,
+		Timeout:  DefaultPollTimeout,
+		Margin:   DefaultPollMargin,
+		sleep:    sleepContext,
+	}
+}
+
+// Poll calls check until it reports the resource done. It fails as soon as
+// check fails or the resource is in a failed state, and after the timeout.
+// When the deadline of the context comes first it returns an
+// InProgressError.
+func (p *Poller) Poll(ctx context.Context, resource, want string, check func() (state string, done bool, err error)) error {
+	timeout := time.Now().Add(p.Timeout)
+	for {
+		state, done, err := check()
+		if err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+		if failedStates[state] {
+			return fmt.Errorf("%s is %s, it will not be %s", resource, state, want)
+		}
+
+		wait := p.Interval
+		if deadline, ok := ctx.Deadline(); ok {
+			if left := time.Until(deadline) - p.Margin; left < wait {
+				wait = left
+			}
+			if wait <= 0 {
+				return &InProgressError{Resource: resource, State: state, Want: want}
+			}
+		}
+		if time.Now().Add(wait).After(timeout) {
+			return fmt.Errorf("timeout waiting for %s to be %s, still %s", resource, want, state)
+		}
+		if err := p.sleep(ctx, wait); err != nil {
+			if err == context.DeadlineExceeded {
+				return &InProgressError{Resource: resource, State: state, Want: want}
+			}
+			return err
+		}
+	}
+}
+
+// sleepContext waits for the duration or until the context is done
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
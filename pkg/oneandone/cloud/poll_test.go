@@ -0,0 +1,94 @@
+package cloud
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// testPoller returns a poller that records its sleeps instead of sleeping
+func testPoller(slept *[]time.Duration) *Poller {
+	p := NewPoller()
+	p.Interval = time.Second
+	p.Timeout = time.Minute
+	p.Margin = 0
+	p.sleep = func(ctx context.Context, d time.Duration) error {
+		*slept = append(*slept, d)
+		return nil
+	}
+	return p
+}
+
+// states returns a check reporting the states in turn, done at want
+func states(want string, seen ...string) func() (string, bool, error) {
+	return func() (string, bool, error) {
+		state := seen[0]
+		if len(seen) > 1 {
+			seen = seen[1:]
+		}
+		return state, state == want, nil
+	}
+}
+
+func TestPoll(t *testing.T) {
+	slept := []time.Duration{}
+	err := testPoller(&slept).Poll(context.Background(), "block storage 0123", "POWERED_ON", states("POWERED_ON", "DEPLOYING", "CONFIGURING", "POWERED_ON"))
+	if err != nil {
+		t.Fatalf("an error ocurred polling %s", err)
+	}
+	if len(slept) != 2 || slept[0] != time.Second {
+		t.Errorf("expected two sleeps of 1s but got %v", slept)
+	}
+}
+
+func TestPollFailsFast(t *testing.T) {
+	slept := []time.Duration{}
+	p := testPoller(&slept)
+
+	err := p.Poll(context.Background(), "block storage 0123", "POWERED_ON", states("POWERED_ON", "DEPLOYING", "FAILED"))
+	if err == nil || len(slept) != 1 {
+		t.Errorf("expected a failed state to stop polling but got error %v after sleeps %v", err, slept)
+	}
+
+	checkErr := errors.New("409 - Type: CONFLICT; Message: attached")
+	err = p.Poll(context.Background(), "block storage 0123", "POWERED_ON", func() (string, bool, error) { return "", false, checkErr })
+	if err != checkErr {
+		t.Errorf("expected the error of the check but got %v", err)
+	}
+}
+
+func TestPollTimeout(t *testing.T) {
+	p := NewPoller()
+	p.Interval = 10 * time.Millisecond
+	p.Timeout = 30 * time.Millisecond
+
+	err := p.Poll(context.Background(), "block storage 0123", "POWERED_ON", states("POWERED_ON", "DEPLOYING"))
+	if err == nil || IsInProgress(err) {
+		t.Errorf("expected a timeout error but got %v", err)
+	}
+}
+
+func TestPollInProgress(t *testing.T) {
+	p := NewPoller()
+	p.Interval = time.Hour
+	p.Margin = 10 * time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := p.Poll(ctx, "block storage 0123", "POWERED_ON", states("POWERED_ON", "CONFIGURING"))
+	if !IsInProgress(err) {
+		t.Fatalf("expected an in progress error but got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 45*time.Millisecond {
+		t.Errorf("expected the poll to return before the deadline less the margin but it took %s", elapsed)
+	}
+	e := err.(*InProgressError)
+	if e.State != "CONFIGURING" || e.Want != "POWERED_ON" {
+		t.Errorf("expected CONFIGURING waiting for POWERED_ON but got %+v", e)
+	}
+	if IsInProgress(wrapError(err, "error attaching")) != true {
+		t.Errorf("expected the wrapped error to stay in progress")
+	}
+}
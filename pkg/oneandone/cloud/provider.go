@@ -0,0 +1,33 @@
+package cloud
+
+import (
+	"context"
+
+	"github.com/1and1/oneandone-cloudserver-sdk-go"
+)
+
+// Provider is the set of 1&1 operations the volume plugins rely on.
+// OneandoneManager implements it against the 1&1 API. The methods waiting
+// for an operation return an InProgressError when the deadline of the
+// context comes first, calling them again resumes waiting.
+type Provider interface {
+	GetServer(ctx context.Context, serverID string) (*oneandone.Server, error)
+	FindServerFromNodeName(ctx context.Context, node string) (*oneandone.Server, error)
+
+	GetBlockstorage(ctx context.Context, storageID string) (*oneandone.BlockStorage, error)
+	GetBlockstorageByName(ctx context.Context, name string) (*oneandone.BlockStorage, error)
+	ListBlockstorages(ctx context.Context) ([]oneandone.BlockStorage, error)
+	CreateStorageAndWait(ctx context.Context, request *oneandone.BlockStorageRequest) (*oneandone.BlockStorage, error)
+	DeleteStorageAndWait(ctx context.Context, storageID string) error
+	ResizeStorageAndWait(ctx context.Context, storageID string, size int) error
+	AssignStorageAndWait(ctx context.Context, storageID string, serverID string) error
+	RemoveStorageAndWait(ctx context.Context, storageID string, serverID string) error
+
+	GetSharedStorage(ctx context.Context, storageID string) (*oneandone.SharedStorage, error)
+	GetSharedStorageByName(ctx context.Context, name string) (*oneandone.SharedStorage, error)
+	GrantSharedStorageAccessAndWait(ctx context.Context, storageID string, serverID string, rights string) error
+	RevokeSharedStorageAccessAndWait(ctx context.Context, storageID string, serverID string) error
+	GetSharedStorageCredentials(ctx context.Context, storage *oneandone.SharedStorage) (*oneandone.SharedStorageAccess, error)
+}
+
+var _ Provider = &OneandoneManager{}
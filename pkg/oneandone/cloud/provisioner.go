@@ -0,0 +1,117 @@
+package cloud
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"text/template"
+
+	"github.com/1and1/oneandone-cloudserver-sdk-go"
+	"github.com/1and1/oneandone-flex-volume/helper"
+)
+
+// ReclaimPolicy decides what happens to a block storage when its volume is deleted
+type ReclaimPolicy string
+
+// Reclaim policies
+const (
+	ReclaimDelete ReclaimPolicy = "Delete"
+	ReclaimRetain ReclaimPolicy = "Retain"
+)
+
+// defaultNameTemplate names the block storage after the persistent volume
+const defaultNameTemplate = "{{.PVName}}"
+
+// ProvisionOptions contains the parameters used to create a block storage
+type ProvisionOptions struct {
+	// Size of the block storage in GB
+	Size           int
+	DatacenterID   string
+	ExecutionGroup string
+	// NameTemplate is a text/template rendered with the ProvisionOptions
+	NameTemplate string
+	PVName       string
+	PVCName      string
+	PVCNamespace string
+}
+
+// StorageName renders the name template of the options
+func (o *ProvisionOptions) StorageName() (string, error) {
+	text := o.NameTemplate
+	if text == "" {
+		text = defaultNameTemplate
+	}
+
+	t, err := template.New("name").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("invalid name template %q: %s", text, err.Error())
+	}
+
+	var name bytes.Buffer
+	if err := t.Execute(&name, o); err != nil {
+		return "", fmt.Errorf("could not render name template %q: %s", text, err.Error())
+	}
+
+	if name.Len() == 0 {
+		return "", fmt.Errorf("name template %q rendered an empty storage name", text)
+	}
+	return name.String(), nil
+}
+
+// Provisioner creates and deletes 1&1 block storages
+type Provisioner struct {
+	manager Provider
+}
+
+// NewProvisioner returns a provisioner using the 1&1 provider
+func NewProvisioner(m Provider) *Provisioner {
+	return &Provisioner{
+		manager: m,
+	}
+}
+
+// Provision creates a block storage and waits for it to be usable
+func (p *Provisioner) Provision(ctx context.Context, o *ProvisionOptions) (*oneandone.BlockStorage, error) {
+	if o.Size <= 0 {
+		return nil, fmt.Errorf("invalid block storage size %d", o.Size)
+	}
+
+	name, err := o.StorageName()
+	if err != nil {
+		return nil, err
+	}
+
+	helper.DebugFile(fmt.Sprintf("Provisioning storage %s of %d GB", name, o.Size))
+
+	return p.manager.CreateStorageAndWait(ctx, &oneandone.BlockStorageRequest{
+		Name:           name,
+		Description:    fmt.Sprintf("kubernetes volume %s", o.PVName),
+		Size:           oneandone.Int2Pointer(o.Size),
+		DatacenterId:   o.DatacenterID,
+		ExecutionGroup: o.ExecutionGroup,
+	})
+}
+
+// Delete removes the block storage if the reclaim policy allows it
+func (p *Provisioner) Delete(ctx context.Context, storageID string, policy ReclaimPolicy) error {
+	switch policy {
+	case ReclaimRetain:
+		helper.DebugFile(fmt.Sprintf("Retaining storage %s", storageID))
+		return nil
+	case ReclaimDelete, "":
+	default:
+		return fmt.Errorf("unknown reclaim policy %q", policy)
+	}
+
+	storage, err := p.manager.GetBlockstorage(ctx, storageID)
+	if err != nil {
+		return err
+	}
+
+	if storage.Server != nil {
+		return fmt.Errorf("storage %s is still attached to server %s", storageID, storage.Server.Id)
+	}
+
+	helper.DebugFile(fmt.Sprintf("Deleting storage %s", storageID))
+	return p.manager.DeleteStorageAndWait(ctx, storageID)
+}
@@ -0,0 +1,56 @@
+package cloud
+
+import (
+	"testing"
+)
+
+func TestStorageName(t *testing.T) {
+	cases := []struct {
+		options       ProvisionOptions
+		expectedName  string
+		expectedError bool
+	}{
+		{
+			ProvisionOptions{PVName: "pvc-0123"},
+			"pvc-0123",
+			false,
+		},
+		{
+			ProvisionOptions{NameTemplate: "k8s-{{.PVCNamespace}}-{{.PVCName}}", PVCName: "data", PVCNamespace: "default"},
+			"k8s-default-data",
+			false,
+		},
+		{
+			ProvisionOptions{NameTemplate: "{{.Unknown}}"},
+			"",
+			true,
+		},
+		{
+			ProvisionOptions{NameTemplate: "{{.PVName"},
+			"",
+			true,
+		},
+		{
+			ProvisionOptions{},
+			"",
+			true,
+		},
+	}
+
+	for _, c := range cases {
+		name, e := c.options.StorageName()
+		if c.expectedError {
+			if e == nil {
+				t.Errorf("expected error rendering storage name for options %+v", c.options)
+			}
+			continue
+		}
+		if e != nil {
+			t.Errorf("an error ocurred rendering storage name for options %+v: %s", c.options, e)
+			continue
+		}
+		if name != c.expectedName {
+			t.Errorf("options %+v expected storage name %q but got %q", c.options, c.expectedName, name)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package cloud
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/1and1/oneandone-flex-volume/helper"
+)
+
+// Retry defaults
+const (
+	DefaultRetryDeadline    = 2 * time.Minute
+	DefaultRetryInterval    = time.Second
+	DefaultRetryMaxInterval = 30 * time.Second
+)
+
+// Retrier calls the 1&1 API again after retryable errors, doubling the
+// delay between the attempts up to a maximum, until a deadline
+type Retrier struct {
+	// Deadline is how long a call is tried for
+	Deadline time.Duration
+	// Interval is the delay before the second attempt
+	Interval time.Duration
+	// MaxInterval caps the delay between two attempts
+	MaxInterval time.Duration
+	// sleep and jitter are replaced in tests
+	sleep  func(context.Context, time.Duration) error
+	jitter func(time.Duration) time.Duration
+}
+
+// NewRetrier returns a retrier with the default deadline and intervals
+func NewRetrier() *Retrier {
+	return &Retrier{
+		Deadline:    DefaultRetryDeadline,
+		Interval:    DefaultRetryInterval,
+		MaxInterval: DefaultRetryMaxInterval,
+		sleep:       sleepContext,
+		jitter:      equalJitter,
+	}
+}
+
+// Do runs the call until it succeeds, fails with an error that is not
+// retryable or the next attempt would start after the deadline of the
+// retrier or of the context. The error it returns is classified.
+func (r *Retrier) Do(ctx context.Context, op string, call func() error) error {
+	deadline := time.Now().Add(r.Deadline)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	interval := r.Interval
+	for attempt := 1; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return &Error{Class: ErrorRetryable, Attempts: attempt - 1, Err: fmt.Errorf("%s was not tried: %s", op, err.Error())}
+		}
+		err := call()
+		if err == nil {
+			return nil
+		}
+
+		e := classify(err, attempt)
+		if e.Class != ErrorRetryable {
+			return e
+		}
+
+		wait := r.jitter(interval)
+		if time.Now().Add(wait).After(deadline) {
+			helper.DebugFile(fmt.Sprintf("%s gave up after %d attempts: %s", op, attempt, err.Error()))
+			return e
+		}
+		helper.DebugFile(fmt.Sprintf("%s failed at attempt %d, trying again in %s: %s", op, attempt, wait, err.Error()))
+		if err := r.sleep(ctx, wait); err != nil {
+			return e
+		}
+
+		interval *= 2
+		if interval > r.MaxInterval {
+			interval = r.MaxInterval
+		}
+	}
+}
+
+// equalJitter spreads the retries of concurrent callers over the second
+// half of the interval
+func equalJitter(interval time.Duration) time.Duration {
+	if interval <= 1 {
+		return interval
+	}
+	half := interval / 2
+	return half + time.Duration(rand.Int63n(int64(interval-half)))
+}
@@ -0,0 +1,128 @@
+package cloud
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// testRetrier returns a retrier that records its sleeps instead of sleeping
+func testRetrier(slept *[]time.Duration) *Retrier {
+	r := NewRetrier()
+	r.Interval = time.Second
+	r.MaxInterval = 4 * time.Second
+	r.sleep = func(ctx context.Context, d time.Duration) error {
+		*slept = append(*slept, d)
+		return nil
+	}
+	r.jitter = func(d time.Duration) time.Duration { return d }
+	return r
+}
+
+func TestRetrierBacksOff(t *testing.T) {
+	slept := []time.Duration{}
+	r := testRetrier(&slept)
+
+	calls := 0
+	err := r.Do(context.Background(), "test", func() error {
+		calls++
+		if calls < 5 {
+			return errors.New("503 - Type: SERVICE_UNAVAILABLE; Message: down")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("an error ocurred retrying %s", err)
+	}
+
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second}
+	if len(slept) != len(expected) {
+		t.Fatalf("expected sleeps %v but got %v", expected, slept)
+	}
+	for i := range expected {
+		if slept[i] != expected[i] {
+			t.Errorf("expected sleeps %v but got %v", expected, slept)
+			break
+		}
+	}
+}
+
+func TestRetrierStopsOnPermanentErrors(t *testing.T) {
+	cases := []struct {
+		err   error
+		class ErrorClass
+	}{
+		{errors.New("404 - Type: NOT_FOUND; Message: gone"), ErrorNotFound},
+		{errors.New("409 - Type: CONFLICT; Message: attached"), ErrorConflict},
+		{errors.New("401 - Type: UNAUTHORIZED; Message: invalid token"), ErrorAuth},
+		{errors.New("400 - Type: BAD_REQUEST; Message: invalid"), ErrorPermanent},
+	}
+
+	for _, c := range cases {
+		slept := []time.Duration{}
+		calls := 0
+		err := testRetrier(&slept).Do(context.Background(), "test", func() error {
+			calls++
+			return c.err
+		})
+		if calls != 1 {
+			t.Errorf("expected %v to be tried once but it was tried %d times", c.err, calls)
+		}
+		e, ok := err.(*Error)
+		if !ok || e.Class != c.class {
+			t.Errorf("expected a %s error but got %#v", c.class, err)
+		}
+	}
+}
+
+func TestRetrierDeadline(t *testing.T) {
+	slept := []time.Duration{}
+	r := testRetrier(&slept)
+	r.Deadline = 0
+
+	calls := 0
+	err := r.Do(context.Background(), "test", func() error {
+		calls++
+		return errors.New("500 - Type: INTERNAL_SERVER_ERROR; Message: boom")
+	})
+	if calls != 1 || len(slept) != 0 {
+		t.Errorf("expected one attempt without sleeping but got %d attempts and sleeps %v", calls, slept)
+	}
+	if !IsRetryable(err) {
+		t.Errorf("expected a retryable error but got %v", err)
+	}
+}
+
+func TestRetrierContextDeadline(t *testing.T) {
+	slept := []time.Duration{}
+	r := testRetrier(&slept)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+	defer cancel()
+	calls := 0
+	err := r.Do(ctx, "test", func() error {
+		calls++
+		return errors.New("502 - Type: BAD_GATEWAY; Message: down")
+	})
+	if calls != 2 || len(slept) != 1 {
+		t.Errorf("expected the context deadline to stop after the first retry but got %d attempts and sleeps %v", calls, slept)
+	}
+	if !IsRetryable(err) {
+		t.Errorf("expected a retryable error but got %v", err)
+	}
+
+	cancel()
+	calls = 0
+	if err := r.Do(ctx, "test", func() error { calls++; return nil }); err == nil || calls != 0 {
+		t.Errorf("expected a done context to fail without calling but got %d calls and error %v", calls, err)
+	}
+}
+
+func TestEqualJitter(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		if d := equalJitter(time.Second); d < 500*time.Millisecond || d >= time.Second {
+			t.Fatalf("expected a delay between 500ms and 1s but got %s", d)
+		}
+	}
+}
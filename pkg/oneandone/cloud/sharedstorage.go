@@ -0,0 +1,145 @@
+package cloud
+
+import (
+	"context"
+
+	"github.com/1and1/oneandone-cloudserver-sdk-go"
+)
+
+// Shared storage access rights
+const (
+	SharedStorageReadWrite = "RW"
+	SharedStorageReadOnly  = "R"
+)
+
+// GetSharedStorage given an unique 1&1 identifier returns the shared storage
+func (m *OneandoneManager) GetSharedStorage(ctx context.Context, storageID string) (*oneandone.SharedStorage, error) {
+	storage, err := m.getSharedStorage(ctx, storageID)
+
+	if err != nil {
+		return nil, wrapError(err, "error fetching 1and1 shared storage %s", storageID)
+	}
+
+	return storage, nil
+}
+
+// GetSharedStorageByName given a name identifier returns the shared storage
+func (m *OneandoneManager) GetSharedStorageByName(ctx context.Context, name string) (*oneandone.SharedStorage, error) {
+	var storages []oneandone.SharedStorage
+	err := m.retry.Do(ctx, "ListSharedStorages", func() (err error) {
+		storages, err = m.client.ListSharedStorages()
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, s := range storages {
+		if s.Name == name {
+			return &s, nil
+		}
+	}
+
+	return nil, notFoundError("shared storage with name %q was not found", name)
+}
+
+// GrantSharedStorageAccessAndWait gives the server access to the shared storage
+// with the rights, it will wait until the access is configured
+func (m *OneandoneManager) GrantSharedStorageAccessAndWait(ctx context.Context, storageID string, serverID string, rights string) error {
+	storage, err := m.GetSharedStorage(ctx, storageID)
+	if err != nil {
+		return err
+	}
+	for _, s := range storage.Servers {
+		// the API does not change the rights of a server, its access is
+		// revoked and granted again
+		if s.Id == serverID && s.Rights != rights {
+			if err := m.RevokeSharedStorageAccessAndWait(ctx, storageID, serverID); err != nil {
+				return err
+			}
+		}
+	}
+
+	err = m.retry.Do(ctx, "AddSharedStorageServers", func() error {
+		// a failed attempt may have granted the access all the same
+		storage, err := m.client.GetSharedStorage(storageID)
+		if err != nil {
+			return err
+		}
+		for _, s := range storage.Servers {
+			if s.Id == serverID && s.Rights == rights {
+				return nil
+			}
+		}
+
+		_, err = m.client.AddSharedStorageServers(storageID, []oneandone.SharedStorageServer{{Id: serverID, Rights: rights}})
+		return err
+	})
+	if err != nil {
+		return wrapError(err, "error occured while granting server id %s access to shared storage id %s, error", serverID, storageID)
+	}
+
+	return m.waitForSharedStorage(ctx, storageID)
+}
+
+// RevokeSharedStorageAccessAndWait removes the server access to the shared storage
+// it will wait until the access is removed
+func (m *OneandoneManager) RevokeSharedStorageAccessAndWait(ctx context.Context, storageID string, serverID string) error {
+	attempt := 0
+	err := m.retry.Do(ctx, "DeleteSharedStorageServer", func() error {
+		attempt++
+		_, err := m.client.DeleteSharedStorageServer(storageID, serverID)
+		if attempt > 1 && IsNotFound(err) {
+			// the failed attempt revoked the access all the same
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return wrapError(err, "error occured while revoking server id %s access to shared storage id %s, error", serverID, storageID)
+	}
+
+	return m.waitForSharedStorage(ctx, storageID)
+}
+
+// GetSharedStorageCredentials returns the shared storage access of the storage's site
+func (m *OneandoneManager) GetSharedStorageCredentials(ctx context.Context, storage *oneandone.SharedStorage) (*oneandone.SharedStorageAccess, error) {
+	var access []oneandone.SharedStorageAccess
+	err := m.retry.Do(ctx, "GetSharedStorageCredentials", func() (err error) {
+		access, err = m.client.GetSharedStorageCredentials()
+		return err
+	})
+	if err != nil {
+		return nil, wrapError(err, "error fetching 1and1 shared storage credentials")
+	}
+
+	for _, a := range access {
+		if a.SiteId == storage.SiteId {
+			return &a, nil
+		}
+	}
+
+	return nil, notFoundError("no shared storage credentials found for site %s", storage.SiteId)
+}
+
+// getSharedStorage fetches the shared storage, retrying transient errors
+func (m *OneandoneManager) getSharedStorage(ctx context.Context, storageID string) (*oneandone.SharedStorage, error) {
+	var storage *oneandone.SharedStorage
+	err := m.retry.Do(ctx, "GetSharedStorage", func() (err error) {
+		storage, err = m.client.GetSharedStorage(storageID)
+		return err
+	})
+	return storage, err
+}
+
+// waitForSharedStorage waits until the shared storage is active again
+func (m *OneandoneManager) waitForSharedStorage(ctx context.Context, storageID string) error {
+	return m.poll.Poll(ctx, "shared storage "+storageID, stateActive, func() (string, bool, error) {
+		storage, err := m.getSharedStorage(ctx, storageID)
+		if err != nil {
+			return "", false, err
+		}
+		return storage.State, storage.State == stateActive, nil
+	})
+}
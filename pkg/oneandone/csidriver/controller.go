@@ -0,0 +1,398 @@
+package csidriver
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/1and1/oneandone-cloudserver-sdk-go"
+	"github.com/1and1/oneandone-flex-volume/pkg/format"
+	"github.com/1and1/oneandone-flex-volume/pkg/oneandone/cloud"
+	"github.com/1and1/oneandone-flex-volume/pkg/scsi"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// gigabyte is the allocation unit of 1&1 block storages
+	gigabyte = 1024 * 1024 * 1024
+	// defaultSize is the size in GB of volumes created without a capacity range
+	defaultSize = 20
+	// devicePathKey is the publish context key holding the device path
+	devicePathKey = "devicePath"
+	// storageUUIDKey is the publish context key holding the storage UUID
+	// the node matches the disk WWID against
+	storageUUIDKey = "storageUUID"
+	// formatPolicyKey is the parameter and volume context key holding the
+	// format policy
+	formatPolicyKey = "formatPolicy"
+	// mkfsOptionsKey is the parameter and volume context key holding the
+	// mkfs options
+	mkfsOptionsKey = "mkfsOptions"
+	// storageClassKey is the parameter and volume context key holding the
+	// storage class profile of the driver config
+	storageClassKey = "storageClass"
+)
+
+// supported volume access modes, a block storage can only be attached to a single server
+var accessModes = map[csi.VolumeCapability_AccessMode_Mode]bool{
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER:      true,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY: true,
+}
+
+var controllerCapabilities = []csi.ControllerServiceCapability_RPC_Type{
+	csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+	csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
+	csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+}
+
+// CreateVolume creates a block storage
+func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+	if req.GetName() == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume name is missing")
+	}
+	if err := validateCapabilities(req.GetVolumeCapabilities()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	size, err := storageSize(req.GetCapacityRange())
+	if err != nil {
+		return nil, status.Error(codes.OutOfRange, err.Error())
+	}
+
+	storages, err := d.cloud.ListBlockstorages(ctx)
+	if err != nil {
+		return nil, cloudError(err)
+	}
+	for i := range storages {
+		if storages[i].Name != req.GetName() {
+			continue
+		}
+		if storages[i].Size != size {
+			return nil, status.Errorf(codes.AlreadyExists, "volume %s already exists with size %d GB", req.GetName(), storages[i].Size)
+		}
+		return &csi.CreateVolumeResponse{Volume: newVolume(&storages[i])}, nil
+	}
+
+	params := req.GetParameters()
+	if _, err := format.ParsePolicy(params[formatPolicyKey]); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	for _, c := range req.GetVolumeCapabilities() {
+		class, err := d.volumeClass(c, params)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		if c.GetBlock() != nil {
+			continue
+		}
+		if _, err := d.profiles.MkfsOptions(class.FsType, class.MkfsOptions); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+
+	storage, err := d.cloud.CreateStorageAndWait(ctx, &oneandone.BlockStorageRequest{
+		Name:           req.GetName(),
+		Description:    fmt.Sprintf("kubernetes volume %s", req.GetName()),
+		Size:           oneandone.Int2Pointer(size),
+		DatacenterId:   params["datacenterID"],
+		ExecutionGroup: params["executionGroup"],
+	})
+	if err != nil {
+		return nil, cloudError(err)
+	}
+	glog.Infof("created storage %s for volume %s", storage.Id, req.GetName())
+
+	volume := newVolume(storage)
+	for _, key := range []string{formatPolicyKey, mkfsOptionsKey, storageClassKey} {
+		if value := params[key]; value != "" {
+			if volume.VolumeContext == nil {
+				volume.VolumeContext = map[string]string{}
+			}
+			volume.VolumeContext[key] = value
+		}
+	}
+	return &csi.CreateVolumeResponse{Volume: volume}, nil
+}
+
+// DeleteVolume deletes a block storage
+func (d *Driver) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id is missing")
+	}
+
+	storage, err := d.cloud.GetBlockstorage(ctx, req.GetVolumeId())
+	if err != nil {
+		if cloud.IsNotFound(err) {
+			return &csi.DeleteVolumeResponse{}, nil
+		}
+		return nil, cloudError(err)
+	}
+
+	if storage.Server != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "volume %s is still attached to server %s", storage.Id, storage.Server.Id)
+	}
+
+	if err := d.cloud.DeleteStorageAndWait(ctx, storage.Id); err != nil {
+		return nil, cloudError(err)
+	}
+	glog.Infof("deleted storage %s", storage.Id)
+
+	return &csi.DeleteVolumeResponse{}, nil
+}
+
+// ControllerPublishVolume attaches the block storage to the node's server
+func (d *Driver) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id is missing")
+	}
+	if req.GetNodeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "node id is missing")
+	}
+	if req.GetVolumeCapability() == nil {
+		return nil, status.Error(codes.InvalidArgument, "volume capability is missing")
+	}
+	if err := validateCapabilities([]*csi.VolumeCapability{req.GetVolumeCapability()}); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	storage, err := d.getStorage(ctx, req.GetVolumeId())
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := d.cloud.GetServer(ctx, req.GetNodeId()); err != nil {
+		if cloud.IsNotFound(err) {
+			return nil, status.Errorf(codes.NotFound, "node %s not found", req.GetNodeId())
+		}
+		return nil, cloudError(err)
+	}
+
+	if storage.Server != nil {
+		if storage.Server.Id != req.GetNodeId() {
+			return nil, status.Errorf(codes.FailedPrecondition, "volume %s is attached to server %s", storage.Id, storage.Server.Id)
+		}
+		return newPublishResponse(storage), nil
+	}
+
+	if err := d.cloud.AssignStorageAndWait(ctx, storage.Id, req.GetNodeId()); err != nil {
+		return nil, cloudError(err)
+	}
+
+	storage, err = d.getStorage(ctx, storage.Id)
+	if err != nil {
+		return nil, err
+	}
+	glog.Infof("attached storage %s to server %s", storage.Id, req.GetNodeId())
+
+	return newPublishResponse(storage), nil
+}
+
+// ControllerUnpublishVolume detaches the block storage from the node's server
+func (d *Driver) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id is missing")
+	}
+
+	storage, err := d.cloud.GetBlockstorage(ctx, req.GetVolumeId())
+	if err != nil {
+		if cloud.IsNotFound(err) {
+			return &csi.ControllerUnpublishVolumeResponse{}, nil
+		}
+		return nil, cloudError(err)
+	}
+
+	if storage.Server == nil || (req.GetNodeId() != "" && storage.Server.Id != req.GetNodeId()) {
+		return &csi.ControllerUnpublishVolumeResponse{}, nil
+	}
+
+	if err := d.cloud.RemoveStorageAndWait(ctx, storage.Id, storage.Server.Id); err != nil {
+		return nil, cloudError(err)
+	}
+	glog.Infof("detached storage %s from server %s", storage.Id, storage.Server.Id)
+
+	return &csi.ControllerUnpublishVolumeResponse{}, nil
+}
+
+// ValidateVolumeCapabilities checks whether the block storage supports the capabilities
+func (d *Driver) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id is missing")
+	}
+	if len(req.GetVolumeCapabilities()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "volume capabilities are missing")
+	}
+
+	if _, err := d.getStorage(ctx, req.GetVolumeId()); err != nil {
+		return nil, err
+	}
+
+	if err := validateCapabilities(req.GetVolumeCapabilities()); err != nil {
+		return &csi.ValidateVolumeCapabilitiesResponse{Message: err.Error()}, nil
+	}
+
+	return &csi.ValidateVolumeCapabilitiesResponse{
+		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
+			VolumeContext:      req.GetVolumeContext(),
+			VolumeCapabilities: req.GetVolumeCapabilities(),
+			Parameters:         req.GetParameters(),
+		},
+	}, nil
+}
+
+// ListVolumes lists the block storages of the account
+func (d *Driver) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
+	if req.GetMaxEntries() < 0 {
+		return nil, status.Error(codes.InvalidArgument, "max entries must not be negative")
+	}
+
+	storages, err := d.cloud.ListBlockstorages(ctx)
+	if err != nil {
+		return nil, cloudError(err)
+	}
+
+	start := 0
+	if req.GetStartingToken() != "" {
+		start, err = strconv.Atoi(req.GetStartingToken())
+		if err != nil || start < 0 || start > len(storages) {
+			return nil, status.Errorf(codes.Aborted, "invalid starting token %q", req.GetStartingToken())
+		}
+	}
+
+	end := len(storages)
+	if req.GetMaxEntries() > 0 && start+int(req.GetMaxEntries()) < end {
+		end = start + int(req.GetMaxEntries())
+	}
+
+	resp := &csi.ListVolumesResponse{}
+	for i := start; i < end; i++ {
+		resp.Entries = append(resp.Entries, &csi.ListVolumesResponse_Entry{Volume: newVolume(&storages[i])})
+	}
+	if end < len(storages) {
+		resp.NextToken = strconv.Itoa(end)
+	}
+
+	return resp, nil
+}
+
+// GetCapacity is not supported
+func (d *Driver) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "GetCapacity is not supported")
+}
+
+// ControllerGetCapabilities returns the capabilities of the controller service
+func (d *Driver) ControllerGetCapabilities(ctx context.Context, req *csi.ControllerGetCapabilitiesRequest) (*csi.ControllerGetCapabilitiesResponse, error) {
+	resp := &csi.ControllerGetCapabilitiesResponse{}
+	for _, c := range controllerCapabilities {
+		resp.Capabilities = append(resp.Capabilities, &csi.ControllerServiceCapability{
+			Type: &csi.ControllerServiceCapability_Rpc{
+				Rpc: &csi.ControllerServiceCapability_RPC{Type: c},
+			},
+		})
+	}
+	return resp, nil
+}
+
+// CreateSnapshot is not supported
+func (d *Driver) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "CreateSnapshot is not supported")
+}
+
+// DeleteSnapshot is not supported
+func (d *Driver) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "DeleteSnapshot is not supported")
+}
+
+// ListSnapshots is not supported
+func (d *Driver) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "ListSnapshots is not supported")
+}
+
+// getStorage fetches the block storage and maps the errors to CSI status codes
+func (d *Driver) getStorage(ctx context.Context, storageID string) (*oneandone.BlockStorage, error) {
+	storage, err := d.cloud.GetBlockstorage(ctx, storageID)
+	if err != nil {
+		if cloud.IsNotFound(err) {
+			return nil, status.Errorf(codes.NotFound, "volume %s not found", storageID)
+		}
+		return nil, cloudError(err)
+	}
+	return storage, nil
+}
+
+// cloudError maps a 1&1 API error to the CSI status code of its class
+func cloudError(err error) error {
+	switch cloud.ClassOf(err) {
+	case cloud.ErrorRetryable:
+		return status.Error(codes.Unavailable, err.Error())
+	case cloud.ErrorConflict:
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case cloud.ErrorNotFound:
+		return status.Error(codes.NotFound, err.Error())
+	case cloud.ErrorAuth:
+		return status.Error(codes.PermissionDenied, err.Error())
+	case cloud.ErrorInProgress:
+		// the CO retries the call, which resumes waiting
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+// validateCapabilities checks the access mode and type of every capability
+func validateCapabilities(caps []*csi.VolumeCapability) error {
+	if len(caps) == 0 {
+		return fmt.Errorf("volume capabilities are missing")
+	}
+	for _, c := range caps {
+		if c.GetMount() == nil && c.GetBlock() == nil {
+			return fmt.Errorf("volume capability needs a mount or a block access type")
+		}
+		if !accessModes[c.GetAccessMode().GetMode()] {
+			return fmt.Errorf("access mode %s is not supported", c.GetAccessMode().GetMode())
+		}
+	}
+	return nil
+}
+
+// storageSize returns the size in GB fitting the capacity range
+func storageSize(r *csi.CapacityRange) (int, error) {
+	required, limit := r.GetRequiredBytes(), r.GetLimitBytes()
+	if required < 0 || limit < 0 {
+		return 0, fmt.Errorf("capacity range must not be negative")
+	}
+
+	size := int64(defaultSize)
+	if required > 0 {
+		size = (required + gigabyte - 1) / gigabyte
+	} else if limit > 0 && limit < size*gigabyte {
+		size = limit / gigabyte
+	}
+
+	if size == 0 || (limit > 0 && size*gigabyte > limit) {
+		return 0, fmt.Errorf("no size in GB fits the capacity range %d-%d bytes", required, limit)
+	}
+	return int(size), nil
+}
+
+func newVolume(storage *oneandone.BlockStorage) *csi.Volume {
+	return &csi.Volume{
+		VolumeId:      storage.Id,
+		CapacityBytes: int64(storage.Size) * gigabyte,
+	}
+}
+
+func newPublishResponse(storage *oneandone.BlockStorage) *csi.ControllerPublishVolumeResponse {
+	return &csi.ControllerPublishVolumeResponse{
+		PublishContext: map[string]string{
+			devicePathKey:  devicePath(storage),
+			storageUUIDKey: storage.UUID,
+		},
+	}
+}
+
+// devicePath returns the stable device path of an attached block storage
+func devicePath(storage *oneandone.BlockStorage) string {
+	return scsi.ByIDPath(storage.UUID)
+}
@@ -0,0 +1,139 @@
+package csidriver
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/1and1/oneandone-flex-volume/pkg/format"
+	"github.com/1and1/oneandone-flex-volume/pkg/mount"
+	"github.com/1and1/oneandone-flex-volume/pkg/oneandone/cloud"
+	"github.com/1and1/oneandone-flex-volume/pkg/oneandone/plugin"
+	"github.com/1and1/oneandone-flex-volume/pkg/scsi"
+	"github.com/1and1/oneandone-flex-volume/pkg/version"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+// DriverName is the name the driver registers with the container orchestrator
+const DriverName = "csi.oneandone.com"
+
+// Driver implements the CSI identity, controller and node services
+type Driver struct {
+	endpoint string
+	nodeID   string
+	cloud    cloud.Provider
+	mounter  plugin.Mounter
+	profiles format.Profiles
+	server   *grpc.Server
+	// fsType and formatPolicy are used when neither the volume nor its
+	// storage class set them
+	fsType       string
+	formatPolicy format.Policy
+	// storageClasses are the profiles volumes select with the storageClass
+	// parameter
+	storageClasses plugin.StorageClasses
+	// waitForDevice returns the disk of a storage once it shows up
+	waitForDevice func(uuid string) (string, error)
+	// removeDevice deletes the disk of a storage from the node before it is
+	// detached
+	removeDevice func(uuid string) error
+}
+
+// Config holds the volume settings of the driver from the driver config
+type Config struct {
+	// Filesystems are the profiles volumes are formatted with
+	Filesystems format.Profiles
+	// FsType is the filesystem of volumes that name none, ext4 when empty
+	FsType string
+	// FormatPolicy is the format policy of volumes that name none
+	FormatPolicy format.Policy
+	// StorageClasses are the profiles volumes select with the storageClass
+	// parameter
+	StorageClasses plugin.StorageClasses
+}
+
+// NewDriver returns a CSI driver serving at the given unix socket endpoint,
+// formatting volumes with the settings of the config
+func NewDriver(endpoint, nodeID string, c cloud.Provider, m plugin.Mounter, cfg Config) *Driver {
+	return &Driver{
+		endpoint:       endpoint,
+		nodeID:         nodeID,
+		cloud:          c,
+		mounter:        m,
+		profiles:       cfg.Filesystems,
+		fsType:         cfg.FsType,
+		formatPolicy:   cfg.FormatPolicy,
+		storageClasses: cfg.StorageClasses,
+		waitForDevice:  scsi.NewDiscoverer().WaitForDevice,
+		removeDevice:   scsi.NewRemover(mount.New()).RemoveDevice,
+	}
+}
+
+// Run listens on the endpoint and serves CSI requests until Stop is called
+func (d *Driver) Run() error {
+	socket, err := socketPath(d.endpoint)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("could not remove stale socket %s: %s", socket, err.Error())
+	}
+	if err := os.MkdirAll(filepath.Dir(socket), 0750); err != nil {
+		return fmt.Errorf("could not create socket directory for %s: %s", socket, err.Error())
+	}
+
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return fmt.Errorf("could not listen at %s: %s", socket, err.Error())
+	}
+
+	d.server = grpc.NewServer(grpc.UnaryInterceptor(logRequest))
+	csi.RegisterIdentityServer(d.server, d)
+	csi.RegisterControllerServer(d.server, d)
+	csi.RegisterNodeServer(d.server, d)
+
+	glog.Infof("%s %s serving at %s", DriverName, version.Version, socket)
+	return d.server.Serve(listener)
+}
+
+// Stop stops serving CSI requests
+func (d *Driver) Stop() {
+	if d.server != nil {
+		d.server.GracefulStop()
+	}
+}
+
+// socketPath extracts the socket path from a unix:// endpoint
+func socketPath(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", fmt.Errorf("invalid endpoint %q: %s", endpoint, err.Error())
+	}
+	if u.Scheme != "unix" {
+		return "", fmt.Errorf("endpoint %q must use the unix scheme", endpoint)
+	}
+
+	path := u.Path
+	if u.Host != "" {
+		path = filepath.Join(u.Host, path)
+	}
+	if path == "" {
+		return "", fmt.Errorf("endpoint %q has no socket path", endpoint)
+	}
+	return path, nil
+}
+
+func logRequest(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	glog.V(4).Infof("%s called with %+v", info.FullMethod, req)
+	resp, err := handler(ctx, req)
+	if err != nil {
+		glog.Errorf("%s failed: %s", info.FullMethod, err.Error())
+	}
+	return resp, err
+}
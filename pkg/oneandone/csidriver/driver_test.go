@@ -0,0 +1,480 @@
+package csidriver
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/1and1/oneandone-flex-volume/pkg/format"
+	"github.com/1and1/oneandone-flex-volume/pkg/oneandone/cloud"
+	"github.com/1and1/oneandone-flex-volume/pkg/oneandone/cloud/fake"
+	"github.com/1and1/oneandone-flex-volume/pkg/oneandone/plugin"
+	"github.com/1and1/oneandone-flex-volume/pkg/scsi"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const testNodeID = "server0123456789"
+
+// startDriver serves a driver backed by fakes on a socket in a temporary directory
+func startDriver(t *testing.T) (string, *fakeMounter, func()) {
+	dir, err := ioutil.TempDir("", "csidriver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	socket := filepath.Join(dir, "csi.sock")
+	mounter := newFakeMounter()
+	provider := fake.NewProvider()
+	provider.AddServer(testNodeID, "node01", "10.0.0.10")
+	d := NewDriver("unix://"+socket, testNodeID, provider, mounter, Config{Filesystems: format.Profiles{"xfs": {MkfsOptions: "-b size=4096 -L data"}}})
+	d.waitForDevice = func(uuid string) (string, error) { return scsi.ByIDPath(uuid), nil }
+	d.removeDevice = func(uuid string) error { return nil }
+
+	go d.Run()
+	for i := 0; i < 50; i++ {
+		if _, err := os.Stat(socket); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return socket, mounter, func() {
+		d.Stop()
+		os.RemoveAll(dir)
+	}
+}
+
+func dial(t *testing.T, socket string) *grpc.ClientConn {
+	conn, err := grpc.Dial(socket, grpc.WithInsecure(), grpc.WithDialer(func(addr string, timeout time.Duration) (net.Conn, error) {
+		return net.DialTimeout("unix", addr, timeout)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func mountCapability() *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+}
+
+func TestVolumeLifecycle(t *testing.T) {
+	socket, mounter, stop := startDriver(t)
+	defer stop()
+	conn := dial(t, socket)
+	defer conn.Close()
+
+	ctx := context.Background()
+	controller := csi.NewControllerClient(conn)
+	node := csi.NewNodeClient(conn)
+	capability := mountCapability()
+
+	created, err := controller.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "pvc-0123",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 25 * gigabyte},
+		VolumeCapabilities: []*csi.VolumeCapability{capability},
+	})
+	if err != nil {
+		t.Fatalf("CreateVolume failed: %s", err)
+	}
+	volumeID := created.GetVolume().GetVolumeId()
+	if created.GetVolume().GetCapacityBytes() != 25*gigabyte {
+		t.Errorf("expected capacity of 25 GB but got %d bytes", created.GetVolume().GetCapacityBytes())
+	}
+
+	again, err := controller.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "pvc-0123",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 25 * gigabyte},
+		VolumeCapabilities: []*csi.VolumeCapability{capability},
+	})
+	if err != nil || again.GetVolume().GetVolumeId() != volumeID {
+		t.Errorf("expected CreateVolume to be idempotent, got %v and error %v", again, err)
+	}
+
+	published, err := controller.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+		VolumeId:         volumeID,
+		NodeId:           testNodeID,
+		VolumeCapability: capability,
+	})
+	if err != nil {
+		t.Fatalf("ControllerPublishVolume failed: %s", err)
+	}
+	device := published.GetPublishContext()[devicePathKey]
+
+	staging, target := filepath.Join(filepath.Dir(socket), "staging"), filepath.Join(filepath.Dir(socket), "target")
+	if _, err := node.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+		VolumeId:          volumeID,
+		PublishContext:    published.GetPublishContext(),
+		StagingTargetPath: staging,
+		VolumeCapability:  capability,
+	}); err != nil {
+		t.Fatalf("NodeStageVolume failed: %s", err)
+	}
+	if mounter.source(staging) != device {
+		t.Errorf("expected %s to be mounted at %s but got %q", device, staging, mounter.source(staging))
+	}
+
+	if _, err := node.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+		VolumeId:          volumeID,
+		StagingTargetPath: staging,
+		TargetPath:        target,
+		VolumeCapability:  capability,
+	}); err != nil {
+		t.Fatalf("NodePublishVolume failed: %s", err)
+	}
+	if mounter.source(target) != staging {
+		t.Errorf("expected %s to be bind mounted at %s but got %q", staging, target, mounter.source(target))
+	}
+
+	if _, err := controller.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeID}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected deleting an attached volume to fail with FailedPrecondition but got %v", err)
+	}
+
+	if _, err := node.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: volumeID, TargetPath: target}); err != nil {
+		t.Fatalf("NodeUnpublishVolume failed: %s", err)
+	}
+	if _, err := node.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{VolumeId: volumeID, StagingTargetPath: staging}); err != nil {
+		t.Fatalf("NodeUnstageVolume failed: %s", err)
+	}
+	if _, err := controller.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{VolumeId: volumeID, NodeId: testNodeID}); err != nil {
+		t.Fatalf("ControllerUnpublishVolume failed: %s", err)
+	}
+	if _, err := controller.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeID}); err != nil {
+		t.Fatalf("DeleteVolume failed: %s", err)
+	}
+	if _, err := controller.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeID}); err != nil {
+		t.Errorf("expected deleting a missing volume to succeed but got %s", err)
+	}
+}
+
+func TestBlockVolume(t *testing.T) {
+	socket, mounter, stop := startDriver(t)
+	defer stop()
+	conn := dial(t, socket)
+	defer conn.Close()
+
+	ctx := context.Background()
+	node := csi.NewNodeClient(conn)
+	capability := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+	device := "/dev/disk/by-id/scsi-3vol0123"
+	staging, target := filepath.Join(filepath.Dir(socket), "staging"), filepath.Join(filepath.Dir(socket), "pods", "vol0123")
+
+	if _, err := node.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+		VolumeId:          "vol0123",
+		PublishContext:    map[string]string{storageUUIDKey: "vol0123"},
+		StagingTargetPath: staging,
+		VolumeCapability:  capability,
+	}); err != nil {
+		t.Fatalf("NodeStageVolume failed: %s", err)
+	}
+	if source := mounter.source(staging); source != "" {
+		t.Errorf("expected nothing staged for a block volume but got %q", source)
+	}
+
+	if _, err := node.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+		VolumeId:          "vol0123",
+		PublishContext:    map[string]string{storageUUIDKey: "vol0123"},
+		StagingTargetPath: staging,
+		TargetPath:        target,
+		VolumeCapability:  capability,
+		Readonly:          true,
+	}); err != nil {
+		t.Fatalf("NodePublishVolume failed: %s", err)
+	}
+	if mounter.source(target) != device {
+		t.Errorf("expected %s to be mapped at %s but got %q", device, target, mounter.source(target))
+	}
+	if !reflect.DeepEqual(mounter.mountOptions(target), []string{"bind", "ro"}) {
+		t.Errorf("expected a read only bind mount but got %v", mounter.mountOptions(target))
+	}
+
+	if _, err := node.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: "vol0123", TargetPath: target}); err != nil {
+		t.Fatalf("NodeUnpublishVolume failed: %s", err)
+	}
+	if source := mounter.source(target); source != "" {
+		t.Errorf("expected %s to be unmapped but got %q", target, source)
+	}
+}
+
+func TestNodeStageMountFlags(t *testing.T) {
+	socket, mounter, stop := startDriver(t)
+	defer stop()
+	conn := dial(t, socket)
+	defer conn.Close()
+
+	ctx := context.Background()
+	node := csi.NewNodeClient(conn)
+	staging := filepath.Join(filepath.Dir(socket), "staging")
+
+	cases := []struct {
+		fsType   string
+		flags    []string
+		mode     csi.VolumeCapability_AccessMode_Mode
+		expected []string
+		code     codes.Code
+	}{
+		{"", nil, csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, nil, codes.OK},
+		{"xfs", []string{"noatime", "nouuid"}, csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, []string{"noatime", "nouuid"}, codes.OK},
+		{"ext4", []string{"nosuid"}, csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY, []string{"nosuid", "ro"}, codes.OK},
+		{"ext4", []string{"nouuid"}, csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, nil, codes.InvalidArgument},
+		{"ext4", []string{"suid"}, csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, nil, codes.InvalidArgument},
+	}
+
+	for _, c := range cases {
+		_, err := node.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+			VolumeId:          "vol0123",
+			PublishContext:    map[string]string{storageUUIDKey: "vol0123"},
+			StagingTargetPath: staging,
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: c.fsType, MountFlags: c.flags}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: c.mode},
+			},
+		})
+		if code := status.Code(err); code != c.code {
+			t.Errorf("%s %v: expected code %s but got %s", c.fsType, c.flags, c.code, code)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(mounter.mountOptions(staging), c.expected) {
+			t.Errorf("%s %v: expected mount options %v but got %v", c.fsType, c.flags, c.expected, mounter.mountOptions(staging))
+		}
+		if err == nil && c.fsType == "xfs" && !reflect.DeepEqual(mounter.formatOptions(staging).MkfsOptions, format.MkfsOptions{{Flag: "-b", Value: "size=4096"}, {Flag: "-L", Value: "data"}}) {
+			t.Errorf("expected the xfs profile mkfs options but got %v", mounter.formatOptions(staging).MkfsOptions)
+		}
+		mounter.Unmount(staging)
+	}
+}
+
+func TestNodeUnstageRemovesDisk(t *testing.T) {
+	provider := fake.NewProvider()
+	provider.AddServer(testNodeID, "node01", "10.0.0.10")
+	storage := provider.AddBlockStorage("pv-data", 20)
+	provider.AssignStorageAndWait(context.Background(), storage.Id, testNodeID)
+
+	d := NewDriver("unix:///tmp/csi.sock", testNodeID, provider, newFakeMounter(), Config{})
+	removed := []string{}
+	d.removeDevice = func(uuid string) error {
+		removed = append(removed, uuid)
+		return nil
+	}
+
+	ctx := context.Background()
+	if _, err := d.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{VolumeId: storage.Id, StagingTargetPath: "/staging"}); err != nil {
+		t.Fatalf("NodeUnstageVolume failed: %s", err)
+	}
+	if !reflect.DeepEqual(removed, []string{storage.UUID}) {
+		t.Errorf("expected the disk of %s to be removed but got %v", storage.UUID, removed)
+	}
+
+	if _, err := d.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{VolumeId: "missing", StagingTargetPath: "/staging"}); err != nil {
+		t.Errorf("expected unstaging a missing volume to succeed but got %s", err)
+	}
+
+	d.removeDevice = func(uuid string) error { return errors.New("refusing to remove sdb: sdb is held by dm-0") }
+	_, err := d.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{VolumeId: storage.Id, StagingTargetPath: "/staging"})
+	if code := status.Code(err); code != codes.FailedPrecondition {
+		t.Errorf("expected code %s but got %s", codes.FailedPrecondition, code)
+	}
+}
+
+func TestControllerErrors(t *testing.T) {
+	socket, _, stop := startDriver(t)
+	defer stop()
+	conn := dial(t, socket)
+	defer conn.Close()
+
+	ctx := context.Background()
+	controller := csi.NewControllerClient(conn)
+	capability := mountCapability()
+
+	cases := []struct {
+		name     string
+		call     func() error
+		expected codes.Code
+	}{
+		{
+			"create without name",
+			func() error {
+				_, err := controller.CreateVolume(ctx, &csi.CreateVolumeRequest{VolumeCapabilities: []*csi.VolumeCapability{capability}})
+				return err
+			},
+			codes.InvalidArgument,
+		},
+		{
+			"create without capabilities",
+			func() error {
+				_, err := controller.CreateVolume(ctx, &csi.CreateVolumeRequest{Name: "pvc-0123"})
+				return err
+			},
+			codes.InvalidArgument,
+		},
+		{
+			"create beyond limit",
+			func() error {
+				_, err := controller.CreateVolume(ctx, &csi.CreateVolumeRequest{
+					Name:               "pvc-0123",
+					CapacityRange:      &csi.CapacityRange{RequiredBytes: gigabyte + 1, LimitBytes: gigabyte + 2},
+					VolumeCapabilities: []*csi.VolumeCapability{capability},
+				})
+				return err
+			},
+			codes.OutOfRange,
+		},
+		{
+			"create with unknown format policy",
+			func() error {
+				_, err := controller.CreateVolume(ctx, &csi.CreateVolumeRequest{
+					Name:               "pvc-0123",
+					Parameters:         map[string]string{formatPolicyKey: "always"},
+					VolumeCapabilities: []*csi.VolumeCapability{capability},
+				})
+				return err
+			},
+			codes.InvalidArgument,
+		},
+		{
+			"create with invalid mkfs options",
+			func() error {
+				_, err := controller.CreateVolume(ctx, &csi.CreateVolumeRequest{
+					Name:               "pvc-0123",
+					Parameters:         map[string]string{mkfsOptionsKey: "-b 4096 -f"},
+					VolumeCapabilities: []*csi.VolumeCapability{capability},
+				})
+				return err
+			},
+			codes.InvalidArgument,
+		},
+		{
+			"publish missing volume",
+			func() error {
+				_, err := controller.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+					VolumeId:         "missing",
+					NodeId:           testNodeID,
+					VolumeCapability: capability,
+				})
+				return err
+			},
+			codes.NotFound,
+		},
+		{
+			"validate missing volume",
+			func() error {
+				_, err := controller.ValidateVolumeCapabilities(ctx, &csi.ValidateVolumeCapabilitiesRequest{
+					VolumeId:           "missing",
+					VolumeCapabilities: []*csi.VolumeCapability{capability},
+				})
+				return err
+			},
+			codes.NotFound,
+		},
+		{
+			"list with invalid token",
+			func() error {
+				_, err := controller.ListVolumes(ctx, &csi.ListVolumesRequest{StartingToken: "invalid"})
+				return err
+			},
+			codes.Aborted,
+		},
+	}
+
+	for _, c := range cases {
+		if code := status.Code(c.call()); code != c.expected {
+			t.Errorf("%s: expected code %s but got %s", c.name, c.expected, code)
+		}
+	}
+}
+
+func TestCloudError(t *testing.T) {
+	cases := []struct {
+		status   int
+		expected codes.Code
+	}{
+		{http.StatusServiceUnavailable, codes.Unavailable},
+		{http.StatusConflict, codes.FailedPrecondition},
+		{http.StatusNotFound, codes.NotFound},
+		{http.StatusForbidden, codes.PermissionDenied},
+		{http.StatusBadRequest, codes.Internal},
+	}
+
+	for _, c := range cases {
+		if code := status.Code(cloudError(fake.APIError(c.status, "injected"))); code != c.expected {
+			t.Errorf("expected code %s for status %d but got %s", c.expected, c.status, code)
+		}
+	}
+
+	inProgress := &cloud.InProgressError{Resource: "block storage 0123", State: "CONFIGURING", Want: "POWERED_ON"}
+	if code := status.Code(cloudError(inProgress)); code != codes.DeadlineExceeded {
+		t.Errorf("expected code %s for an operation in progress but got %s", codes.DeadlineExceeded, code)
+	}
+}
+
+func TestVolumeClass(t *testing.T) {
+	d := NewDriver("unix:///tmp/csi.sock", testNodeID, fake.NewProvider(), newFakeMounter(), Config{
+		FsType:       "xfs",
+		FormatPolicy: format.PolicyNever,
+		StorageClasses: plugin.StorageClasses{
+			"fast": {FsType: "ext4", FormatPolicy: "overwrite", MkfsOptions: "-m 0", MountFlags: "noatime"},
+		},
+	})
+
+	cases := []struct {
+		fsType   string
+		params   map[string]string
+		expected plugin.StorageClass
+	}{
+		{"", nil, plugin.StorageClass{FsType: "xfs", FormatPolicy: "never"}},
+		{"", map[string]string{storageClassKey: "fast"}, plugin.StorageClass{FsType: "ext4", FormatPolicy: "overwrite", MkfsOptions: "-m 0", MountFlags: "noatime"}},
+		{"xfs", map[string]string{storageClassKey: "fast", formatPolicyKey: "ifEmpty", mkfsOptionsKey: "-L data"}, plugin.StorageClass{FsType: "xfs", FormatPolicy: "ifEmpty", MkfsOptions: "-L data", MountFlags: "noatime"}},
+	}
+
+	for _, c := range cases {
+		capability := &csi.VolumeCapability{AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: c.fsType}}}
+		class, err := d.volumeClass(capability, c.params)
+		if err != nil {
+			t.Errorf("an error ocurred resolving %v: %s", c.params, err)
+			continue
+		}
+		if class != c.expected {
+			t.Errorf("%v: expected %+v but got %+v", c.params, c.expected, class)
+		}
+	}
+
+	if _, err := d.volumeClass(&csi.VolumeCapability{}, map[string]string{storageClassKey: "slow"}); err == nil {
+		t.Errorf("expected an unknown storage class to fail")
+	}
+}
+
+// TestSanity runs csi-sanity against the driver when the binary is installed
+func TestSanity(t *testing.T) {
+	sanity, err := exec.LookPath("csi-sanity")
+	if err != nil {
+		t.Skip("csi-sanity not found in PATH")
+	}
+
+	socket, _, stop := startDriver(t)
+	defer stop()
+
+	dir := filepath.Dir(socket)
+	cmd := exec.Command(sanity,
+		"-csi.endpoint", socket,
+		"-csi.mountdir", filepath.Join(dir, "mount"),
+		"-csi.stagingdir", filepath.Join(dir, "staging"))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("csi-sanity failed with error [%s] and output [%s]", err, string(out))
+	}
+}
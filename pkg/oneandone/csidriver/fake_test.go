@@ -0,0 +1,72 @@
+package csidriver
+
+import (
+	"os"
+	"sync"
+
+	"github.com/1and1/oneandone-flex-volume/pkg/oneandone/plugin"
+)
+
+// fakeMounter records mounts instead of touching the host
+type fakeMounter struct {
+	mu      sync.Mutex
+	mounts  map[string]string
+	options map[string][]string
+	formats map[string]plugin.FormatOptions
+}
+
+func newFakeMounter() *fakeMounter {
+	return &fakeMounter{mounts: map[string]string{}, options: map[string][]string{}, formats: map[string]plugin.FormatOptions{}}
+}
+
+func (m *fakeMounter) FormatAndMount(device, targetDir string, opts plugin.FormatOptions) error {
+	m.mu.Lock()
+	m.formats[targetDir] = opts
+	m.mu.Unlock()
+	return m.Mount(device, targetDir, opts.FsType, opts.MountOptions)
+}
+
+func (m *fakeMounter) Mount(source, targetDir, fsType string, options []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := os.MkdirAll(targetDir, 0750); err != nil {
+		return err
+	}
+	m.mounts[targetDir] = source
+	m.options[targetDir] = options
+	return nil
+}
+
+func (m *fakeMounter) MapBlock(device, target string, readOnly bool) error {
+	options := []string{"bind"}
+	if readOnly {
+		options = append(options, "ro")
+	}
+	return m.Mount(device, target, "", options)
+}
+
+func (m *fakeMounter) Unmount(targetDir string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.mounts, targetDir)
+	delete(m.options, targetDir)
+	return nil
+}
+
+func (m *fakeMounter) source(targetDir string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.mounts[targetDir]
+}
+
+func (m *fakeMounter) mountOptions(targetDir string) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.options[targetDir]
+}
+
+func (m *fakeMounter) formatOptions(targetDir string) plugin.FormatOptions {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.formats[targetDir]
+}
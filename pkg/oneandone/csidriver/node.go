@@ -0,0 +1,243 @@
+package csidriver
+
+import (
+	"github.com/1and1/oneandone-flex-volume/pkg/format"
+	"github.com/1and1/oneandone-flex-volume/pkg/mount"
+	"github.com/1and1/oneandone-flex-volume/pkg/oneandone/plugin"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// NodeStageVolume formats the block storage and mounts it at the staging path
+func (d *Driver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id is missing")
+	}
+	if req.GetStagingTargetPath() == "" {
+		return nil, status.Error(codes.InvalidArgument, "staging target path is missing")
+	}
+	if req.GetVolumeCapability() == nil {
+		return nil, status.Error(codes.InvalidArgument, "volume capability is missing")
+	}
+	if err := validateCapabilities([]*csi.VolumeCapability{req.GetVolumeCapability()}); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if req.GetVolumeCapability().GetBlock() != nil {
+		// raw block volumes are published straight from the device
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
+	device, err := d.nodeDevice(ctx, req.GetVolumeId(), req.GetPublishContext())
+	if err != nil {
+		return nil, err
+	}
+
+	class, err := d.volumeClass(req.GetVolumeCapability(), req.GetVolumeContext())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	fsType := class.FsType
+
+	policy, err := format.ParsePolicy(class.FormatPolicy)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	mkfsOptions, err := d.profiles.MkfsOptions(fsType, class.MkfsOptions)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	options := req.GetVolumeCapability().GetMount().GetMountFlags()
+	if len(options) == 0 && class.MountFlags != "" {
+		options = mount.SplitOptions(class.MountFlags)
+	}
+	if err := mount.ValidateOptions(fsType, options); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if req.GetVolumeCapability().GetAccessMode().GetMode() == csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY && !mount.HasOption(options, "ro") {
+		options = append(options, "ro")
+	}
+
+	if err := d.mounter.FormatAndMount(device, req.GetStagingTargetPath(), plugin.FormatOptions{FsType: fsType, Policy: policy, MkfsOptions: mkfsOptions, MountOptions: options}); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	glog.Infof("staged volume %s at %s", req.GetVolumeId(), req.GetStagingTargetPath())
+
+	return &csi.NodeStageVolumeResponse{}, nil
+}
+
+// nodeDevice waits for the disk of the volume to show up on the node, the
+// storage is looked up when the publish context has no UUID
+func (d *Driver) nodeDevice(ctx context.Context, volumeID string, publishContext map[string]string) (string, error) {
+	uuid := publishContext[storageUUIDKey]
+	if uuid == "" {
+		storage, err := d.getStorage(ctx, volumeID)
+		if err != nil {
+			return "", err
+		}
+		uuid = storage.UUID
+	}
+
+	device, err := d.waitForDevice(uuid)
+	if err != nil {
+		return "", status.Error(codes.Internal, err.Error())
+	}
+	return device, nil
+}
+
+// volumeClass returns the filesystem settings of the volume capability and
+// parameters, filling those they leave empty from the storage class of the
+// volume and then from the driver defaults. The mount flags are those of the
+// storage class only.
+func (d *Driver) volumeClass(c *csi.VolumeCapability, params map[string]string) (plugin.StorageClass, error) {
+	class := plugin.StorageClass{}
+	if name := params[storageClassKey]; name != "" {
+		var err error
+		if class, err = d.storageClasses.Get(name); err != nil {
+			return class, err
+		}
+	}
+
+	if fsType := c.GetMount().GetFsType(); fsType != "" {
+		class.FsType = fsType
+	}
+	if class.FsType == "" {
+		class.FsType = d.fsType
+	}
+	if class.FsType == "" {
+		class.FsType = plugin.DefaultFsType
+	}
+	if policy := params[formatPolicyKey]; policy != "" {
+		class.FormatPolicy = policy
+	}
+	if class.FormatPolicy == "" {
+		class.FormatPolicy = string(d.formatPolicy)
+	}
+	if options := params[mkfsOptionsKey]; options != "" {
+		class.MkfsOptions = options
+	}
+	return class, nil
+}
+
+// NodeUnstageVolume unmounts the staging path
+func (d *Driver) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id is missing")
+	}
+	if req.GetStagingTargetPath() == "" {
+		return nil, status.Error(codes.InvalidArgument, "staging target path is missing")
+	}
+
+	if err := d.mounter.Unmount(req.GetStagingTargetPath()); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	// the disk is deleted before the controller detaches the storage so no
+	// stale device is left for the next attach to collide with
+	storage, err := d.getStorage(ctx, req.GetVolumeId())
+	if err != nil && status.Code(err) != codes.NotFound {
+		return nil, err
+	}
+	if storage != nil {
+		if err := d.removeDevice(storage.UUID); err != nil {
+			return nil, status.Error(codes.FailedPrecondition, err.Error())
+		}
+	}
+	glog.Infof("unstaged volume %s from %s", req.GetVolumeId(), req.GetStagingTargetPath())
+
+	return &csi.NodeUnstageVolumeResponse{}, nil
+}
+
+// NodePublishVolume bind mounts the staging path at the target path
+func (d *Driver) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id is missing")
+	}
+	if req.GetStagingTargetPath() == "" {
+		return nil, status.Error(codes.InvalidArgument, "staging target path is missing")
+	}
+	if req.GetTargetPath() == "" {
+		return nil, status.Error(codes.InvalidArgument, "target path is missing")
+	}
+	if req.GetVolumeCapability() == nil {
+		return nil, status.Error(codes.InvalidArgument, "volume capability is missing")
+	}
+	if err := validateCapabilities([]*csi.VolumeCapability{req.GetVolumeCapability()}); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	readOnly := req.GetReadonly() || req.GetVolumeCapability().GetAccessMode().GetMode() == csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY
+
+	if req.GetVolumeCapability().GetBlock() != nil {
+		device, err := d.nodeDevice(ctx, req.GetVolumeId(), req.GetPublishContext())
+		if err != nil {
+			return nil, err
+		}
+		if err := d.mounter.MapBlock(device, req.GetTargetPath(), readOnly); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		glog.Infof("published block volume %s at %s", req.GetVolumeId(), req.GetTargetPath())
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
+	options := []string{"bind"}
+	if readOnly {
+		options = append(options, "ro")
+	}
+
+	if err := d.mounter.Mount(req.GetStagingTargetPath(), req.GetTargetPath(), "", options); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	glog.Infof("published volume %s at %s", req.GetVolumeId(), req.GetTargetPath())
+
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+// NodeUnpublishVolume unmounts the target path
+func (d *Driver) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id is missing")
+	}
+	if req.GetTargetPath() == "" {
+		return nil, status.Error(codes.InvalidArgument, "target path is missing")
+	}
+
+	if err := d.mounter.Unmount(req.GetTargetPath()); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	glog.Infof("unpublished volume %s from %s", req.GetVolumeId(), req.GetTargetPath())
+
+	return &csi.NodeUnpublishVolumeResponse{}, nil
+}
+
+// NodeGetVolumeStats is not supported
+func (d *Driver) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "NodeGetVolumeStats is not supported")
+}
+
+// NodeGetCapabilities returns the capabilities of the node service
+func (d *Driver) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
+	return &csi.NodeGetCapabilitiesResponse{
+		Capabilities: []*csi.NodeServiceCapability{
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
+					},
+				},
+			},
+		},
+	}, nil
+}
+
+// NodeGetInfo returns the 1&1 server ID of the node
+func (d *Driver) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
+	return &csi.NodeGetInfoResponse{
+		NodeId: d.nodeID,
+	}, nil
+}
@@ -0,0 +1,540 @@
+/*
+Package mockapi provides a local stand-in for the 1&1 Cloud API and the
+server metadata API, so the driver binaries can be tested end to end.
+
+It serves the block_storages, servers and shared_storages endpoints with the
+JSON shapes of the vendored SDK types, and keeps its state in memory.
+*/
+package mockapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/1and1/oneandone-cloudserver-sdk-go"
+)
+
+// MetadataPath is the path of the server ID in the metadata API
+const MetadataPath = "/latest/meta_data/server_id"
+
+// Server is a mock 1&1 Cloud API
+type Server struct {
+	*httptest.Server
+
+	// Token is the API token requests must carry, any token is accepted when empty
+	Token string
+	// ServerID is returned by the metadata endpoint
+	ServerID string
+	// DeferAttach leaves attached block storages without a server until
+	// SetServer is called, as the API does while it configures the attach
+	DeferAttach bool
+
+	mu       sync.Mutex
+	next     int
+	failures []int
+	servers  map[string]*oneandone.Server
+	storages map[string]*oneandone.BlockStorage
+	shared   map[string]*oneandone.SharedStorage
+	access   []oneandone.SharedStorageAccess
+}
+
+// NewServer starts a mock 1&1 Cloud API, it must be closed after use
+func NewServer() *Server {
+	s := &Server{
+		servers:  map[string]*oneandone.Server{},
+		storages: map[string]*oneandone.BlockStorage{},
+		shared:   map[string]*oneandone.SharedStorage{},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// AddServer registers a server reachable at the given IPs
+func (s *Server) AddServer(id, name string, ips ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	server := &oneandone.Server{
+		Status: &oneandone.Status{State: "POWERED_ON"},
+	}
+	server.Id = id
+	server.Name = name
+	for i, ip := range ips {
+		serverIP := oneandone.ServerIp{Ip: ip}
+		serverIP.Id = fmt.Sprintf("%s-ip%d", id, i)
+		serverIP.Type = "IPV4"
+		server.Ips = append(server.Ips, serverIP)
+	}
+	s.servers[id] = server
+}
+
+// AddBlockStorage registers an unattached block storage and returns its ID
+func (s *Server) AddBlockStorage(name string, size int) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.newBlockStorage(&oneandone.BlockStorageRequest{Name: name, Size: &size}).Id
+}
+
+// AddSharedStorage registers a shared storage and returns its ID
+func (s *Server) AddSharedStorage(name string, size int) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.newSharedStorage(&oneandone.SharedStorageRequest{Name: name, Size: &size}).Id
+}
+
+// SetState forces the state of a block or shared storage, e.g. to keep it in
+// a transitional state
+func (s *Server) SetState(id, state string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if storage, ok := s.storages[id]; ok {
+		storage.State = state
+	}
+	if storage, ok := s.shared[id]; ok {
+		storage.State = state
+	}
+}
+
+// SetServer forces the server a block storage is attached to, none when
+// serverID is empty
+func (s *Server) SetServer(id, serverID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	storage, ok := s.storages[id]
+	if !ok {
+		return
+	}
+	storage.Server = nil
+	if server, ok := s.servers[serverID]; ok {
+		storage.Server = &oneandone.BlockStorageServer{Id: server.Id, Name: server.Name}
+	}
+}
+
+// BlockStorage returns a copy of the block storage, nil when it does not exist
+func (s *Server) BlockStorage(id string) *oneandone.BlockStorage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	storage, ok := s.storages[id]
+	if !ok {
+		return nil
+	}
+	c := *storage
+	return &c
+}
+
+// SharedStorage returns a copy of the shared storage, nil when it does not exist
+func (s *Server) SharedStorage(id string) *oneandone.SharedStorage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	storage, ok := s.shared[id]
+	if !ok {
+		return nil
+	}
+	c := *storage
+	c.Servers = append([]oneandone.SharedStorageServer(nil), storage.Servers...)
+	return &c
+}
+
+// Fail makes the next API requests fail with the statuses, one request per
+// status
+func (s *Server) Fail(statuses ...int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = append(s.failures, statuses...)
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == MetadataPath {
+		fmt.Fprintln(w, s.ServerID)
+		return
+	}
+
+	if s.Token != "" && r.Header.Get("X-Token") != s.Token {
+		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "invalid token")
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.failures) > 0 {
+		status := s.failures[0]
+		s.failures = s.failures[1:]
+		writeError(w, status, "INJECTED", fmt.Sprintf("injected %d on %s %s", status, r.Method, r.URL.Path))
+		return
+	}
+
+	switch parts[0] {
+	case "block_storages":
+		s.serveBlockStorages(w, r, parts[1:])
+	case "servers":
+		s.serveServers(w, r, parts[1:])
+	case "shared_storages":
+		s.serveSharedStorages(w, r, parts[1:])
+	default:
+		writeError(w, http.StatusNotFound, "NOT_FOUND", fmt.Sprintf("unknown path %s", r.URL.Path))
+	}
+}
+
+func (s *Server) serveBlockStorages(w http.ResponseWriter, r *http.Request, parts []string) {
+	switch {
+	case len(parts) == 0 && r.Method == http.MethodGet:
+		result := []oneandone.BlockStorage{}
+		for _, id := range sortedKeys(s.storages) {
+			result = append(result, *s.storages[id])
+		}
+		writeJSON(w, http.StatusOK, result)
+
+	case len(parts) == 0 && r.Method == http.MethodPost:
+		req := &oneandone.BlockStorageRequest{}
+		if !readJSON(w, r, req) {
+			return
+		}
+		if req.Name == "" || req.Size == nil {
+			writeError(w, http.StatusBadRequest, "BAD_REQUEST", "name and size are required")
+			return
+		}
+		writeJSON(w, http.StatusCreated, s.newBlockStorage(req))
+
+	case len(parts) >= 1:
+		storage, ok := s.storages[parts[0]]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NOT_FOUND", fmt.Sprintf("block storage %s not found", parts[0]))
+			return
+		}
+		if len(parts) == 1 {
+			s.serveBlockStorage(w, r, storage)
+			return
+		}
+		if len(parts) == 2 && parts[1] == "server" {
+			s.serveBlockStorageServer(w, r, storage)
+			return
+		}
+		writeError(w, http.StatusNotFound, "NOT_FOUND", fmt.Sprintf("unknown path %s", r.URL.Path))
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", r.Method)
+	}
+}
+
+func (s *Server) serveBlockStorage(w http.ResponseWriter, r *http.Request, storage *oneandone.BlockStorage) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, storage)
+
+	case http.MethodPut:
+		req := &struct {
+			Name        string `json:"name,omitempty"`
+			Description string `json:"description,omitempty"`
+			Size        *int   `json:"size,omitempty"`
+		}{}
+		if !readJSON(w, r, req) {
+			return
+		}
+		if req.Size != nil {
+			if *req.Size < storage.Size {
+				writeError(w, http.StatusBadRequest, "BAD_REQUEST", "block storages cannot shrink")
+				return
+			}
+			storage.Size = *req.Size
+		}
+		if req.Name != "" {
+			storage.Name = req.Name
+		}
+		if req.Description != "" {
+			storage.Description = req.Description
+		}
+		writeJSON(w, http.StatusOK, storage)
+
+	case http.MethodDelete:
+		if storage.Server != nil {
+			writeError(w, http.StatusConflict, "CONFLICT", fmt.Sprintf("block storage %s is attached", storage.Id))
+			return
+		}
+		delete(s.storages, storage.Id)
+		writeJSON(w, http.StatusOK, storage)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", r.Method)
+	}
+}
+
+func (s *Server) serveBlockStorageServer(w http.ResponseWriter, r *http.Request, storage *oneandone.BlockStorage) {
+	switch r.Method {
+	case http.MethodGet:
+		if storage.Server == nil {
+			writeError(w, http.StatusNotFound, "NOT_FOUND", fmt.Sprintf("block storage %s is not attached", storage.Id))
+			return
+		}
+		writeJSON(w, http.StatusCreated, storage.Server)
+
+	case http.MethodPost:
+		req := &oneandone.BlockStorageServer{}
+		if !readJSON(w, r, req) {
+			return
+		}
+		server, ok := s.servers[req.ServerId]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NOT_FOUND", fmt.Sprintf("server %s not found", req.ServerId))
+			return
+		}
+		if storage.Server != nil {
+			writeError(w, http.StatusConflict, "CONFLICT", fmt.Sprintf("block storage %s is attached to server %s", storage.Id, storage.Server.Id))
+			return
+		}
+		if !s.DeferAttach {
+			storage.Server = &oneandone.BlockStorageServer{Id: server.Id, Name: server.Name}
+		}
+		writeJSON(w, http.StatusCreated, storage)
+
+	case http.MethodDelete:
+		if storage.Server == nil {
+			writeError(w, http.StatusBadRequest, "BAD_REQUEST", fmt.Sprintf("block storage %s is not attached", storage.Id))
+			return
+		}
+		storage.Server = nil
+		writeJSON(w, http.StatusOK, storage)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", r.Method)
+	}
+}
+
+func (s *Server) serveServers(w http.ResponseWriter, r *http.Request, parts []string) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", r.Method)
+		return
+	}
+
+	switch len(parts) {
+	case 0:
+		result := []oneandone.Server{}
+		for _, id := range sortedKeys(s.servers) {
+			result = append(result, *s.servers[id])
+		}
+		writeJSON(w, http.StatusOK, result)
+	case 1:
+		server, ok := s.servers[parts[0]]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NOT_FOUND", fmt.Sprintf("server %s not found", parts[0]))
+			return
+		}
+		writeJSON(w, http.StatusOK, server)
+	default:
+		writeError(w, http.StatusNotFound, "NOT_FOUND", fmt.Sprintf("unknown path %s", r.URL.Path))
+	}
+}
+
+func (s *Server) serveSharedStorages(w http.ResponseWriter, r *http.Request, parts []string) {
+	switch {
+	case len(parts) == 0 && r.Method == http.MethodGet:
+		result := []oneandone.SharedStorage{}
+		for _, id := range sortedKeys(s.shared) {
+			result = append(result, *s.shared[id])
+		}
+		writeJSON(w, http.StatusOK, result)
+
+	case len(parts) == 0 && r.Method == http.MethodPost:
+		req := &oneandone.SharedStorageRequest{}
+		if !readJSON(w, r, req) {
+			return
+		}
+		if req.Name == "" || req.Size == nil {
+			writeError(w, http.StatusBadRequest, "BAD_REQUEST", "name and size are required")
+			return
+		}
+		writeJSON(w, http.StatusAccepted, s.newSharedStorage(req))
+
+	case len(parts) == 1 && parts[0] == "access":
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, s.access)
+		case http.MethodPut:
+			for i := range s.access {
+				s.access[i].NeedsPasswordReset = 0
+			}
+			writeJSON(w, http.StatusAccepted, s.access)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", r.Method)
+		}
+
+	case len(parts) >= 1:
+		storage, ok := s.shared[parts[0]]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NOT_FOUND", fmt.Sprintf("shared storage %s not found", parts[0]))
+			return
+		}
+		switch {
+		case len(parts) == 1 && r.Method == http.MethodGet:
+			writeJSON(w, http.StatusOK, storage)
+		case len(parts) == 1 && r.Method == http.MethodPut:
+			req := &oneandone.SharedStorageRequest{}
+			if !readJSON(w, r, req) {
+				return
+			}
+			if req.Size != nil {
+				storage.Size = *req.Size
+			}
+			if req.Name != "" {
+				storage.Name = req.Name
+			}
+			if req.Description != "" {
+				storage.Description = req.Description
+			}
+			writeJSON(w, http.StatusAccepted, storage)
+		case len(parts) == 1 && r.Method == http.MethodDelete:
+			delete(s.shared, storage.Id)
+			writeJSON(w, http.StatusAccepted, storage)
+		case len(parts) == 2 && parts[1] == "servers":
+			s.serveSharedStorageServers(w, r, storage)
+		case len(parts) == 3 && parts[1] == "servers":
+			s.serveSharedStorageServer(w, r, storage, parts[2])
+		default:
+			writeError(w, http.StatusNotFound, "NOT_FOUND", fmt.Sprintf("unknown path %s", r.URL.Path))
+		}
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", r.Method)
+	}
+}
+
+func (s *Server) serveSharedStorageServers(w http.ResponseWriter, r *http.Request, storage *oneandone.SharedStorage) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, storage.Servers)
+
+	case http.MethodPost:
+		req := &struct {
+			Servers []oneandone.SharedStorageServer `json:"servers"`
+		}{}
+		if !readJSON(w, r, req) {
+			return
+		}
+		for _, requested := range req.Servers {
+			server, ok := s.servers[requested.Id]
+			if !ok {
+				writeError(w, http.StatusNotFound, "NOT_FOUND", fmt.Sprintf("server %s not found", requested.Id))
+				return
+			}
+			storage.Servers = append(storage.Servers, oneandone.SharedStorageServer{Id: server.Id, Name: server.Name, Rights: requested.Rights})
+		}
+		writeJSON(w, http.StatusAccepted, storage)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", r.Method)
+	}
+}
+
+func (s *Server) serveSharedStorageServer(w http.ResponseWriter, r *http.Request, storage *oneandone.SharedStorage, serverID string) {
+	for i, server := range storage.Servers {
+		if server.Id != serverID {
+			continue
+		}
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, server)
+		case http.MethodDelete:
+			storage.Servers = append(storage.Servers[:i], storage.Servers[i+1:]...)
+			writeJSON(w, http.StatusAccepted, storage)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", r.Method)
+		}
+		return
+	}
+	writeError(w, http.StatusNotFound, "NOT_FOUND", fmt.Sprintf("server %s has no access to shared storage %s", serverID, storage.Id))
+}
+
+func (s *Server) newBlockStorage(req *oneandone.BlockStorageRequest) *oneandone.BlockStorage {
+	s.next++
+	storage := &oneandone.BlockStorage{
+		Size:         *req.Size,
+		State:        "POWERED_ON",
+		Name:         req.Name,
+		CreationDate: time.Now().UTC(),
+		UUID:         fmt.Sprintf("600144f0%024x", s.next),
+		DiskID:       fmt.Sprintf("disk%08d", s.next),
+	}
+	storage.Id = fmt.Sprintf("%032X", s.next)
+	storage.Description = req.Description
+	if req.DatacenterId != "" {
+		storage.Datacenter = &oneandone.Datacenter{}
+		storage.Datacenter.Id = req.DatacenterId
+	}
+	if server, ok := s.servers[req.ServerId]; ok {
+		storage.Server = &oneandone.BlockStorageServer{Id: server.Id, Name: server.Name}
+	}
+	s.storages[storage.Id] = storage
+	return storage
+}
+
+func (s *Server) newSharedStorage(req *oneandone.SharedStorageRequest) *oneandone.SharedStorage {
+	s.next++
+	storage := &oneandone.SharedStorage{
+		Size:         *req.Size,
+		State:        "ACTIVE",
+		SiteId:       "site0001",
+		NfsPath:      fmt.Sprintf("127.0.0.1:/snas/%s", req.Name),
+		CifsPath:     fmt.Sprintf("\\\\127.0.0.1\\%s", req.Name),
+		CreationDate: time.Now().UTC().Format(time.RFC3339),
+	}
+	storage.Id = fmt.Sprintf("%032X", s.next)
+	storage.Name = req.Name
+	storage.Description = req.Description
+	s.shared[storage.Id] = storage
+
+	if len(s.access) == 0 {
+		s.access = append(s.access, oneandone.SharedStorageAccess{
+			State:      "ACTIVE",
+			SiteId:     storage.SiteId,
+			UserDomain: "user0001",
+		})
+	}
+	return storage
+}
+
+func sortedKeys(m interface{}) []string {
+	keys := []string{}
+	switch v := m.(type) {
+	case map[string]*oneandone.Server:
+		for k := range v {
+			keys = append(keys, k)
+		}
+	case map[string]*oneandone.BlockStorage:
+		for k := range v {
+			keys = append(keys, k)
+		}
+	case map[string]*oneandone.SharedStorage:
+		for k := range v {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, "BAD_REQUEST", err.Error())
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, errorType, message string) {
+	writeJSON(w, status, map[string]string{
+		"type":    errorType,
+		"message": message,
+	})
+}
@@ -0,0 +1,25 @@
+package mockapi
+
+import (
+	"testing"
+
+	"github.com/1and1/oneandone-flex-volume/helper"
+)
+
+func TestMetadataServerID(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.ServerID = "server01"
+
+	defaultURL := helper.MetadataURL
+	defer func() { helper.MetadataURL = defaultURL }()
+	helper.MetadataURL = s.URL
+
+	id, err := helper.GetServerID()
+	if err != nil {
+		t.Fatalf("an error ocurred getting the server ID %s", err)
+	}
+	if id != "server01" {
+		t.Errorf("expected server01 but got %s", id)
+	}
+}
@@ -1,17 +1,41 @@
 package plugin
 
 import (
+	"fmt"
+
+	"github.com/1and1/oneandone-flex-volume/helper"
 	"github.com/1and1/oneandone-flex-volume/pkg/flex"
 )
 
 // Attach volume to the node
 func (v *VolumePlugin) Attach(options string, node string) (*flex.DriverStatus, error) {
+	ctx, cancel := v.commandContext()
+	defer cancel()
+
 	opt, err := v.newOptions(options)
 	if err != nil {
 		return nil, err
 	}
+	if v, err = v.forVolume(opt.ApiKey); err != nil {
+		return nil, err
+	}
+	// detach is called with the volume name of getvolumename only
+	if err := v.rememberVolume(opt.StorageName, opt); err != nil {
+		return nil, err
+	}
 
-	storage, err := v.manager.GetBlockstorage(opt.StorageID)
+	if opt.Type == volumeTypeShared {
+		shared, err := v.manager.GetSharedStorage(ctx, opt.StorageID)
+		if err != nil {
+			return nil, err
+		}
+		return &flex.DriverStatus{
+			Status:     flex.StatusSuccess,
+			DevicePath: shared.Name,
+		}, nil
+	}
+
+	storage, err := v.manager.GetBlockstorage(ctx, opt.StorageID)
 	if err != nil {
 		return nil, err
 	}
@@ -24,22 +48,41 @@ func (v *VolumePlugin) Attach(options string, node string) (*flex.DriverStatus,
 
 // Detach the volume from the node
 func (v *VolumePlugin) Detach(device, node string) (*flex.DriverStatus, error) {
-	// storage, err := v.manager.GetBlockstorageByName(device)
-	// if err != nil {
-	// 	return nil, err
-	// }
-
-	// d, err := v.manager.FindServerFromNodeName(node)
-	// if err != nil {
-	// 	return nil, err
-	// }
-
-	// if storage.Server == nil {
-	// 	err := v.manager.RemoveBlockStorageServer(storage.Id, d.Id)
-	// 	if err != nil {
-	// 		return nil, err
-	// 	}
-	// }
+	ctx, cancel := v.commandContext()
+	defer cancel()
+
+	helper.DebugFile(fmt.Sprintf("Detaching device %s from node %s", device, node))
+
+	v, record, err := v.recallVolume(device)
+	if err != nil {
+		return nil, err
+	}
+
+	server, err := v.manager.FindServerFromNodeName(ctx, node)
+	if err != nil {
+		return nil, err
+	}
+
+	storage, shared, err := v.findVolume(ctx, device, record)
+	if err != nil {
+		return nil, err
+	}
+	if shared != nil {
+		r, err := v.detachShared(ctx, shared, server.Id)
+		if err == nil {
+			v.forgetVolume(device)
+		}
+		return r, err
+	}
+
+	if storage.Server != nil && storage.Server.Id == server.Id {
+		err := v.manager.RemoveStorageAndWait(ctx, storage.Id, server.Id)
+		if err != nil {
+			helper.DebugFile(fmt.Sprintf("RemoveStorageAndWait failure %s", err.Error()))
+			return nil, err
+		}
+	}
+	v.forgetVolume(device)
 
 	return &flex.DriverStatus{
 		Status: flex.StatusSuccess,
@@ -54,10 +97,54 @@ func (v *VolumePlugin) WaitForAttach(device string, options string) (*flex.Drive
 	return r, nil
 }
 
+// WaitForDetach no need to implement since we wait at the Detach command
+func (v *VolumePlugin) WaitForDetach(device string) (*flex.DriverStatus, error) {
+	r := &flex.DriverStatus{
+		Status: flex.StatusNotSupported,
+	}
+	return r, nil
+}
+
 // IsAttached checks for the volume to be attached to the node
 func (v *VolumePlugin) IsAttached(options string, node string) (*flex.DriverStatus, error) {
+	ctx, cancel := v.commandContext()
+	defer cancel()
+
+	opt, err := v.newOptions(options)
+	if err != nil {
+		return nil, err
+	}
+	if v, err = v.forVolume(opt.ApiKey); err != nil {
+		return nil, err
+	}
+
+	if opt.StorageID == "" {
+		return nil, fmt.Errorf("1&1 volume needs StorageID property at flex options")
+	}
+
+	server, err := v.manager.FindServerFromNodeName(ctx, node)
+	if err != nil {
+		return nil, fmt.Errorf("could not find 1&1 server for node %s: %s", node, err.Error())
+	}
+
+	if opt.Type == volumeTypeShared {
+		shared, err := v.manager.GetSharedStorage(ctx, opt.StorageID)
+		if err != nil {
+			return nil, fmt.Errorf("could not check access to shared storage %s: %s", opt.StorageID, err.Error())
+		}
+		return &flex.DriverStatus{
+			Status:   flex.StatusSuccess,
+			Attached: hasSharedAccess(shared, server.Id),
+		}, nil
+	}
+
+	storage, err := v.manager.GetBlockstorage(ctx, opt.StorageID)
+	if err != nil {
+		return nil, fmt.Errorf("could not check attachment of storage %s: %s", opt.StorageID, err.Error())
+	}
+
 	return &flex.DriverStatus{
 		Status:   flex.StatusSuccess,
-		Attached: true,
+		Attached: storage.Server != nil && storage.Server.Id == server.Id,
 	}, nil
 }
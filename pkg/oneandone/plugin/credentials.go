@@ -0,0 +1,51 @@
+package plugin
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/1and1/oneandone-flex-volume/pkg/oneandone/cloud"
+)
+
+// managerFor returns the manager of the token in the base64 encoded apiKey
+// secret of the volume, the manager of the global token when there is none
+func (v *VolumePlugin) managerFor(apiKey string) (cloud.Provider, error) {
+	if apiKey == "" {
+		if v.manager == nil {
+			return nil, errors.New("the volume has no apiKey secret and no global 1&1 token is configured")
+		}
+		return v.manager, nil
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(apiKey)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode the apiKey secret: %s", err.Error())
+	}
+	token := strings.TrimSpace(string(decoded))
+	if token == "" {
+		return nil, errors.New("the apiKey secret is empty")
+	}
+	if v.newManager == nil {
+		return nil, errors.New("the plugin cannot use the apiKey secret of volumes")
+	}
+
+	m, err := v.newManager(token)
+	if err != nil {
+		return nil, fmt.Errorf("could not create a 1&1 manager for the apiKey secret: %s", err.Error())
+	}
+	return m, nil
+}
+
+// forVolume returns a copy of the plugin using the manager of the apiKey
+// secret of the volume
+func (v *VolumePlugin) forVolume(apiKey string) (*VolumePlugin, error) {
+	m, err := v.managerFor(apiKey)
+	if err != nil {
+		return nil, err
+	}
+	c := *v
+	c.manager = m
+	return &c, nil
+}
@@ -0,0 +1,88 @@
+package plugin
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/1and1/oneandone-flex-volume/helper"
+	"github.com/1and1/oneandone-flex-volume/pkg/format"
+	"github.com/1and1/oneandone-flex-volume/pkg/journal"
+	"github.com/1and1/oneandone-flex-volume/pkg/luks"
+)
+
+// luksType is the probed type of LUKS devices
+const luksType = "crypto_LUKS"
+
+// mappingName names the dm-crypt mapping of a block storage
+func mappingName(storageID string) string {
+	return "oneandone-" + storageID
+}
+
+// passphrase returns the passphrase of an encrypted volume from the flex
+// secret, or from the key file of the driver config when there is none
+func (v *VolumePlugin) passphrase(opt *oneandoneOptions) ([]byte, error) {
+	if opt.Passphrase != "" {
+		key, err := base64.StdEncoding.DecodeString(opt.Passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("could not decode the passphrase secret: %s", err.Error())
+		}
+		if len(key) == 0 {
+			return nil, fmt.Errorf("the passphrase secret is empty")
+		}
+		return key, nil
+	}
+
+	if v.keyFile == "" {
+		return nil, fmt.Errorf("encrypted volumes need a passphrase secret or a key file in the driver config")
+	}
+	key, err := ioutil.ReadFile(v.keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read key file %s: %s", v.keyFile, err.Error())
+	}
+	if len(key) == 0 {
+		return nil, fmt.Errorf("key file %s is empty", v.keyFile)
+	}
+	return key, nil
+}
+
+// openEncrypted opens the LUKS device of the storage, formatting it first
+// on first use if the format policy allows it, and returns the mapped device
+func (v *VolumePlugin) openEncrypted(device, storageID string, key []byte, policy format.Policy, entry *journal.Entry) (string, error) {
+	name := mappingName(storageID)
+	result, err := v.probe(device)
+	if err != nil {
+		return "", err
+	}
+
+	if result.Type == luksType {
+		if err := v.crypt.Open(device, name, key); err != nil {
+			return "", err
+		}
+		return luks.MapperPath(name), nil
+	}
+
+	if _, err := format.Decide(device, result, luksType, policy); err != nil {
+		return "", err
+	}
+	entry.Device = device
+	if err := v.journal.Phase(entry, phaseFormat); err != nil {
+		return "", err
+	}
+	helper.DebugFile(fmt.Sprintf("Formatting %s as LUKS", device))
+	if err := v.crypt.Format(device, name, key); err != nil {
+		return "", err
+	}
+	return luks.MapperPath(name), nil
+}
+
+// closeEncrypted closes the mapping of the storage if it is open
+func (v *VolumePlugin) closeEncrypted(storageID string) error {
+	name := mappingName(storageID)
+	open, err := v.crypt.IsOpen(name)
+	if err != nil || !open {
+		return err
+	}
+	helper.DebugFile(fmt.Sprintf("Closing mapping %s", name))
+	return v.crypt.Close(name)
+}
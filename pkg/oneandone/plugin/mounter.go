@@ -1,47 +1,141 @@
 package plugin
 
 import (
-	"bufio"
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 
 	"github.com/1and1/oneandone-flex-volume/helper"
 	"github.com/1and1/oneandone-flex-volume/pkg/flex"
+	"github.com/1and1/oneandone-flex-volume/pkg/format"
+	"github.com/1and1/oneandone-flex-volume/pkg/journal"
+	"github.com/1and1/oneandone-flex-volume/pkg/mount"
+	"github.com/1and1/oneandone-flex-volume/pkg/probe"
 
 	"golang.org/x/sys/unix"
 )
 
 // MountDevice mounts the volume as a device
 func (v *VolumePlugin) MountDevice(mountdir, device string, options string) (*flex.DriverStatus, error) {
+	ctx, cancel := v.commandContext()
+	defer cancel()
+
 	helper.DebugFile(fmt.Sprintf("Device Name %s", device))
 
 	opt, err := v.newOptions(options)
 	if err != nil {
 		return nil, err
 	}
+	if v, err = v.forVolume(opt.ApiKey); err != nil {
+		return nil, err
+	}
+	// unmountdevice is called with the mount directory only
+	if err := v.rememberVolume(mountdir, opt); err != nil {
+		return nil, err
+	}
+
+	serverID, err := v.getServerID()
+	if err != nil {
+		return nil, fmt.Errorf("could not get the 1&1 server ID of the node: %s", err.Error())
+	}
 
-	serverID, err := helper.GetServerID()
+	entry := &journal.Entry{
+		Operation: opMountDevice,
+		StorageID: opt.StorageID,
+		Device:    device,
+		MountDir:  mountdir,
+		Keys:      v.LockKeys(opMountDevice, device, mountdir, options),
+	}
+	if err := v.journal.Begin(entry, phaseAttach); err != nil {
+		return nil, err
+	}
+	// only a killed process leaves the entry behind, the kubelet retries
+	// the operations that failed
+	defer v.journal.Done(entry)
+
+	if opt.Type == volumeTypeShared {
+		if err := v.mountShared(ctx, mountdir, serverID, opt); err != nil {
+			return nil, err
+		}
+		return &flex.DriverStatus{
+			Status: flex.StatusSuccess,
+		}, nil
+	}
 
-	storage, err := v.manager.GetBlockstorage(opt.StorageID)
+	policy, err := format.ParsePolicy(opt.FormatPolicy)
 	if err != nil {
 		return nil, err
 	}
 
-	if storage.Server == nil {
-		err := v.manager.AssignStorageAndWait(storage.Id, serverID)
+	var key []byte
+	if opt.encrypted() {
+		if key, err = v.passphrase(opt); err != nil {
+			return nil, err
+		}
+	}
+
+	storage, err := v.manager.GetBlockstorage(ctx, opt.StorageID)
+	if err != nil {
+		return nil, err
+	}
+
+	// a storage attached to this server may still be attaching after an
+	// earlier try ran out of time, assigning it again resumes the wait
+	if storage.Server == nil || storage.Server.Id == serverID {
+		err := v.manager.AssignStorageAndWait(ctx, storage.Id, serverID)
 		if err != nil {
 			helper.DebugFile(fmt.Sprintf("Error: %s", err.Error()))
 			return nil, err
 		}
 	}
-	storage, err = v.manager.GetBlockstorage(opt.StorageID)
+	storage, err = v.manager.GetBlockstorage(ctx, opt.StorageID)
+	if err != nil {
+		return nil, err
+	}
+	entry.UUID = storage.UUID
+
+	devicePath, err := v.waitForDevice(storage.UUID)
+	if err != nil {
+		return nil, err
+	}
+	if opt.encrypted() {
+		if devicePath, err = v.openEncrypted(devicePath, storage.Id, key, policy, entry); err != nil {
+			return nil, err
+		}
+	}
+
+	if opt.VolumeMode == volumeModeBlock {
+		if err := v.journal.Phase(entry, phaseMount); err != nil {
+			return nil, err
+		}
+		if err := v.mounter.MapBlock(devicePath, mountdir, opt.RW == "ro"); err != nil {
+			return nil, err
+		}
+		return &flex.DriverStatus{
+			Status: flex.StatusSuccess,
+		}, nil
+	}
+
+	mountOptions, err := opt.mountOptions()
+	if err != nil {
+		return nil, err
+	}
+	mkfsOptions, err := v.profiles.MkfsOptions(opt.fsType(), opt.MkfsOptions)
 	if err != nil {
 		return nil, err
 	}
 
-	err = v.internalMount(mountdir, fmt.Sprintf("/dev/disk/by-id/scsi-3%s", storage.UUID), opt.FsType)
+	if err := v.journalFormat(entry, devicePath, opt.fsType(), policy); err != nil {
+		return nil, err
+	}
+	err = v.mounter.FormatAndMount(devicePath, mountdir, FormatOptions{
+		FsType:       opt.fsType(),
+		Policy:       policy,
+		MkfsOptions:  mkfsOptions,
+		MountOptions: mountOptions,
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -53,27 +147,83 @@ func (v *VolumePlugin) MountDevice(mountdir, device string, options string) (*fl
 
 // UnmountDevice from the node
 func (v *VolumePlugin) UnmountDevice(device string) (*flex.DriverStatus, error) {
+	ctx, cancel := v.commandContext()
+	defer cancel()
+
 	helper.DebugFile(fmt.Sprintf("Unmounting Device %s", device))
 
-	storage, err := v.manager.GetBlockstorageByName(device)
+	entry := &journal.Entry{
+		Operation: opUnmountDevice,
+		Device:    device,
+		Keys:      v.LockKeys(opUnmountDevice, device, "", ""),
+	}
+	if err := v.journal.Begin(entry, phaseUnmount); err != nil {
+		return nil, err
+	}
+	defer v.journal.Done(entry)
+
+	v, record, err := v.recallVolume(device)
+	if err != nil {
+		return nil, err
+	}
+
+	// volumes without a record are looked up by the volume name the mount
+	// directory ends in
+	storage, shared, err := v.findVolume(ctx, filepath.Base(device), record)
 	if err != nil {
 		return nil, err
 	}
+	if shared != nil {
+		if err := v.unmountShared(ctx, device, shared); err != nil {
+			return nil, err
+		}
+		v.forgetVolume(device)
+		return &flex.DriverStatus{
+			Status: flex.StatusSuccess,
+		}, nil
+	}
+
+	// without the server ID the storage could not be told attached here
+	serverID, err := v.getServerID()
+	if err != nil {
+		return nil, fmt.Errorf("could not get the 1&1 server ID of the node: %s", err.Error())
+	}
 
-	if err := v.internalUnmount(device); err != nil {
-		helper.DebugFile(fmt.Sprintf("internalUnmount failure  %s", err.Error()))
+	if err := v.mounter.Unmount(device); err != nil {
+		helper.DebugFile(fmt.Sprintf("Unmount failure  %s", err.Error()))
 		return nil, err
 	}
 
-	serverID, err := helper.GetServerID()
+	entry.StorageID = storage.Id
+	if err := v.journal.Phase(entry, phaseClose); err != nil {
+		return nil, err
+	}
+	if err := v.closeEncrypted(storage.Id); err != nil {
+		helper.DebugFile(fmt.Sprintf("Closing encrypted device failure %s", err.Error()))
+		return nil, err
+	}
 
-	if storage.Server != nil {
-		err := v.manager.RemoveBlockStorageServer(storage.Id, serverID)
+	if storage.Server != nil && storage.Server.Id == serverID {
+		if err := v.journal.Phase(entry, phaseDetach); err != nil {
+			return nil, err
+		}
+		// the disk is deleted before the detach so no stale device is left
+		// for the next attach to collide with
+		if err := v.removeDevice(storage.UUID); err != nil {
+			helper.DebugFile(fmt.Sprintf("Device removal failure %s", err.Error()))
+			return nil, err
+		}
+		err := v.manager.RemoveStorageAndWait(ctx, storage.Id, serverID)
 		if err != nil {
-			helper.DebugFile(fmt.Sprintf("RemoveBlockStorageServer failure  %s", err.Error()))
+			helper.DebugFile(fmt.Sprintf("RemoveStorageAndWait failure  %s", err.Error()))
+			return nil, err
+		}
+		if err := v.confirmRemoved(storage.UUID); err != nil {
+			helper.DebugFile(fmt.Sprintf("Device removal failure %s", err.Error()))
 			return nil, err
 		}
 	}
+	v.forgetVolume(device)
 
 	r := &flex.DriverStatus{
 		Status: flex.StatusSuccess,
@@ -81,52 +231,76 @@ func (v *VolumePlugin) UnmountDevice(device string) (*flex.DriverStatus, error)
 	return r, nil
 }
 
-func (v *VolumePlugin) isMounted(targetDir string) (bool, error) {
-	findmntCmd := exec.Command("findmnt", "-n", targetDir)
-	findmntStdout, err := findmntCmd.StdoutPipe()
-	if err != nil {
-		return false, fmt.Errorf("could not get findmount stdout pipe: %s", err.Error())
-	}
+// FormatOptions tells how a block device is formatted and mounted
+type FormatOptions struct {
+	// FsType is the filesystem to mount, ext4 when empty
+	FsType string
+	// Policy tells whether the device may be formatted
+	Policy format.Policy
+	// MkfsOptions are the options the device is formatted with
+	MkfsOptions format.MkfsOptions
+	// MountOptions are the mount(8) style options the filesystem is
+	// mounted with
+	MountOptions []string
+}
 
-	if err = findmntCmd.Start(); err != nil {
-		return false, fmt.Errorf("findmnt failed to start: %s", err.Error())
-	}
+// Mounter formats and mounts volumes on the node
+type Mounter interface {
+	// FormatAndMount mounts the block device at the target directory,
+	// formatting it first if it does not hold the filesystem and the
+	// format policy allows it
+	FormatAndMount(device, targetDir string, opts FormatOptions) error
+	// Mount mounts the source at the target directory
+	Mount(source, targetDir, fsType string, options []string) error
+	// MapBlock publishes the block device at the target path by bind
+	// mounting it over a file
+	MapBlock(device, target string, readOnly bool) error
+	// Unmount unmounts the target directory and removes it once it is no
+	// longer mounted and empty
+	Unmount(targetDir string) error
+}
 
-	findmntScanner := bufio.NewScanner(findmntStdout)
-	findmntScanner.Split(bufio.ScanWords)
-	findmntScanner.Scan()
-	if findmntScanner.Err() != nil {
-		return false, fmt.Errorf("could not get findmount output: %s", findmntScanner.Err().Error())
-	}
+// NodeMounter mounts volumes on the host running the plugin
+type NodeMounter struct {
+	mounter mount.Mounter
+	probe   func(device string) (*probe.Result, error)
+	// busyPolicy tells whether busy mount points are unmounted anyway
+	busyPolicy mount.BusyPolicy
+}
 
-	findmntText := findmntScanner.Text()
-	if err = findmntCmd.Wait(); err != nil {
-		_, isExitError := err.(*exec.ExitError)
-		if !isExitError {
-			return false, fmt.Errorf("findmount command failed: %s", err.Error())
-		}
-	}
+// NewNodeMounter returns a NodeMounter mounting through m and unmounting
+// busy mount points as the policy tells
+func NewNodeMounter(m mount.Mounter, policy mount.BusyPolicy) *NodeMounter {
+	return &NodeMounter{mounter: m, probe: probe.Probe, busyPolicy: policy}
+}
 
-	return findmntText == targetDir, nil
+// isMounted checks whether the target directory is a mount point
+func (n *NodeMounter) isMounted(targetDir string) (bool, error) {
+	mounts, err := mount.MountsAtPath(n.mounter, targetDir)
+	if err != nil {
+		return false, err
+	}
+	for _, m := range mounts {
+		helper.DebugFile(fmt.Sprintf("%s is mounted from %s%s (%s, %s)", targetDir, m.Source, m.Root, m.FsType, m.Propagation()))
+	}
+	return len(mounts) > 0, nil
 }
 
-func (v *VolumePlugin) internalMount(targetDir string, device string, fsType string) error {
+// FormatAndMount mounts the block device at the target directory,
+// formatting it first if it does not hold the filesystem and the format
+// policy allows it
+func (n *NodeMounter) FormatAndMount(device string, targetDir string, opts FormatOptions) error {
 	helper.DebugFile("Mounting " + device)
+	fsType := opts.FsType
 	if fsType == "" {
-		// default to ext4
-		fsType = "ext4"
-	}
-
-	var res unix.Stat_t
-	if err := unix.Stat(device, &res); err != nil {
-		return fmt.Errorf("could not stat device %s: %s", device, err.Error())
+		fsType = DefaultFsType
 	}
 
-	if res.Mode&unix.S_IFMT != unix.S_IFBLK {
-		return fmt.Errorf("device %s is not a block device", device)
+	if err := checkBlockDevice(device); err != nil {
+		return err
 	}
 
-	mounted, err := v.isMounted(targetDir)
+	mounted, err := n.isMounted(targetDir)
 	if err != nil {
 		return err
 	}
@@ -134,15 +308,20 @@ func (v *VolumePlugin) internalMount(targetDir string, device string, fsType str
 		return nil
 	}
 
-	format, err := v.currentFormat(device)
+	needsFormat, err := format.NeedsFormat(device, fsType, opts.Policy, n.probe)
 	if err != nil {
 		return err
 	}
 
-	if !strings.Contains(format, fsType) {
-		mkfsCmd := exec.Command("mkfs", "-t", fsType, device)
+	if needsFormat {
+		if err := format.ValidateFsType(fsType); err != nil {
+			return err
+		}
+		args := format.MkfsArgs(device, fsType, opts.MkfsOptions, opts.Policy)
+		helper.DebugFile(fmt.Sprintf("Formatting %s with mkfs %s", device, strings.Join(args, " ")))
+		mkfsCmd := exec.Command("mkfs", args...)
 		if mkfsOut, err := mkfsCmd.CombinedOutput(); err != nil {
-			return fmt.Errorf("mkfs -t %s %s failed with error [%s] and output [%s]", fsType, device, err.Error(), string(mkfsOut))
+			return fmt.Errorf("mkfs %s failed with error [%s] and output [%s]", strings.Join(args, " "), err.Error(), string(mkfsOut))
 		}
 	}
 
@@ -152,58 +331,79 @@ func (v *VolumePlugin) internalMount(targetDir string, device string, fsType str
 		}
 	}
 
-	mountCmd := exec.Command("mount", device, targetDir)
-	if mountOut, err := mountCmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("mounting device %s at dir %s failed with error [%s] and output [%s] ", device, targetDir, err.Error(), string(mountOut))
+	return n.mounter.Mount(device, targetDir, fsType, opts.MountOptions)
+}
+
+// checkBlockDevice fails when the device is not a block device node
+func checkBlockDevice(device string) error {
+	var res unix.Stat_t
+	if err := unix.Stat(device, &res); err != nil {
+		return fmt.Errorf("could not stat device %s: %s", device, err.Error())
 	}
 
+	if res.Mode&unix.S_IFMT != unix.S_IFBLK {
+		return fmt.Errorf("device %s is not a block device", device)
+	}
 	return nil
 }
 
-func (v *VolumePlugin) internalUnmount(targetDir string) error {
-	helper.DebugFile("targetDir: " + targetDir)
-	mounted, err := v.isMounted(targetDir)
+// MapBlock publishes the block device at the target path by bind mounting
+// it over a file, replacing an empty directory at the target path
+func (n *NodeMounter) MapBlock(device, target string, readOnly bool) error {
+	helper.DebugFile(fmt.Sprintf("Mapping %s at %s", device, target))
+	if err := checkBlockDevice(device); err != nil {
+		return err
+	}
+
+	mounted, err := n.isMounted(target)
 	if err != nil {
 		return err
 	}
-	if !mounted {
-		helper.DebugFile("!mounted")
+	if mounted {
 		return nil
 	}
 
-	umountCmd := exec.Command("umount", targetDir)
-	if umountOut, err := umountCmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("!!!!unmounting the device at %s failed with error [%s] and output [%s]", targetDir, err.Error(), string(umountOut))
+	if err := os.MkdirAll(filepath.Dir(target), 0750); err != nil {
+		return fmt.Errorf("could not create directory %s: %s", filepath.Dir(target), err.Error())
+	}
+	if info, err := os.Stat(target); err == nil && info.IsDir() {
+		if err := os.Remove(target); err != nil {
+			return fmt.Errorf("could not replace directory %s with a device file: %s", target, err.Error())
+		}
+	}
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_RDONLY, 0640)
+	if err != nil {
+		return fmt.Errorf("could not create device file %s: %s", target, err.Error())
 	}
+	f.Close()
 
-	//Cleanup after unmount
-	if os.RemoveAll(targetDir); err != nil {
-		return fmt.Errorf("Error while trying to remove %s, %s", targetDir, err)
+	options := []string{"bind"}
+	if readOnly {
+		options = append(options, "ro")
 	}
-	return nil
+	return n.mounter.Mount(device, target, "", options)
 }
 
-func (v *VolumePlugin) currentFormat(device string) (string, error) {
+// Unmount unmounts the target directory and removes it once it is no
+// longer mounted and empty
+func (n *NodeMounter) Unmount(targetDir string) error {
+	helper.DebugFile("targetDir: " + targetDir)
+	return mount.Teardown(n.mounter, targetDir, n.busyPolicy)
+}
 
-	lsblkCmd := exec.Command("lsblk", "-n", "-o", "FSTYPE", device)
-	lsblkOut, err := lsblkCmd.CombinedOutput()
+// Mount mounts the source at the target directory
+func (n *NodeMounter) Mount(source, targetDir, fsType string, options []string) error {
+	mounted, err := n.isMounted(targetDir)
 	if err != nil {
-		return "", fmt.Errorf("lsblk -n -o FSTYPE %s: output[%s] error[%s]", device, string(lsblkOut), err.Error())
+		return err
 	}
-
-	output := strings.TrimSuffix(string(lsblkOut), "\n")
-	lines := strings.Split(output, "\n")
-	if lines[0] != "" {
-		// The device is formatted
-		return lines[0], nil
+	if mounted {
+		return nil
 	}
 
-	if len(lines) == 1 {
-		// The device is unformatted and has no dependent devices
-		return "", nil
+	if err := os.MkdirAll(targetDir, 0750); err != nil {
+		return fmt.Errorf("could not create directory %s: %s", targetDir, err.Error())
 	}
 
-	// The device has dependent devices, most probably partitions (LVM, LUKS
-	// and MD RAID are reported as FSTYPE and caught above).
-	return "unknown data, probably partitions", nil
+	return n.mounter.Mount(source, targetDir, fsType, options)
 }
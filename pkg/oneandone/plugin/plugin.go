@@ -1,16 +1,104 @@
 package plugin
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"strconv"
+	"time"
 
+	"github.com/1and1/oneandone-flex-volume/helper"
 	"github.com/1and1/oneandone-flex-volume/pkg/flex"
+	"github.com/1and1/oneandone-flex-volume/pkg/format"
+	"github.com/1and1/oneandone-flex-volume/pkg/journal"
+	"github.com/1and1/oneandone-flex-volume/pkg/luks"
+	"github.com/1and1/oneandone-flex-volume/pkg/mount"
 	"github.com/1and1/oneandone-flex-volume/pkg/oneandone/cloud"
+	"github.com/1and1/oneandone-flex-volume/pkg/probe"
+	"github.com/1and1/oneandone-flex-volume/pkg/scsi"
+)
+
+// Volume types
+const (
+	volumeTypeBlock  = "block"
+	volumeTypeShared = "shared"
+)
+
+// DefaultTimeout is how long a command waits for the 1&1 API before it
+// reports the operation still in progress, well below the time the kubelet
+// gives a driver call
+const DefaultTimeout = 90 * time.Second
+
+// Volume modes
+const (
+	volumeModeFilesystem = "filesystem"
+	volumeModeBlock      = "block"
 )
 
 // VolumePlugin is a 1&1 flex volume plugin
 type VolumePlugin struct {
-	manager *cloud.OneandoneManager
+	// manager uses the global token, nil when there is none
+	manager cloud.Provider
+	// newManager creates the manager of the token in the apiKey secret of
+	// a volume, each command runs in its own process and creates its own
+	newManager func(token string) (cloud.Provider, error)
+	// volumesDir keeps the records of volumes for the commands without
+	// options, empty keeps none
+	volumesDir  string
+	mounter     Mounter
+	getServerID func() (string, error)
+	profiles    format.Profiles
+	crypt       luks.Cryptsetup
+	probe       func(device string) (*probe.Result, error)
+	keyFile     string
+	// waitForDevice returns the disk of a storage once it shows up
+	waitForDevice func(uuid string) (string, error)
+	// rescanDevice makes the node see the new size of a disk
+	rescanDevice func(devicePath string) error
+	// removeDevice deletes the disk of a storage from the node before it is
+	// detached and confirmRemoved checks it is gone afterwards
+	removeDevice   func(uuid string) error
+	confirmRemoved func(uuid string) error
+	// journal records the phases of node operations, nil records nothing
+	journal *journal.Journal
+	// timeout bounds the wait of a command for the 1&1 API
+	timeout time.Duration
+	// fsType and formatPolicy are used when neither the volume nor its
+	// storage class set them
+	fsType       string
+	formatPolicy format.Policy
+	// storageClasses are the profiles volumes select with the storageClass
+	// option
+	storageClasses StorageClasses
+}
+
+// Config holds the node settings of the plugin from the driver config
+type Config struct {
+	// Filesystems are the profiles volumes are formatted with
+	Filesystems format.Profiles
+	// KeyFile holds the passphrase of encrypted volumes without a
+	// passphrase secret
+	KeyFile string
+	// BusyPolicy tells whether mount points processes keep busy are
+	// unmounted anyway
+	BusyPolicy mount.BusyPolicy
+	// Timeout bounds the wait of a command for the 1&1 API, DefaultTimeout
+	// when zero
+	Timeout time.Duration
+	// FsType is the filesystem of volumes that name none, ext4 when empty
+	FsType string
+	// FormatPolicy is the format policy of volumes that name none
+	FormatPolicy format.Policy
+	// StorageClasses are the profiles volumes select with the storageClass
+	// option
+	StorageClasses StorageClasses
+	// NewManager creates the manager of the token in the apiKey secret of
+	// a volume, volumes with a secret fail without it
+	NewManager func(token string) (cloud.Provider, error)
+	// VolumesDir keeps the type, storage and apiKey secret of volumes for
+	// the commands the kubelet calls without options, DefaultVolumesDir
+	// when empty
+	VolumesDir string
 }
 
 // oneandoneOptions from the flex plugin
@@ -21,13 +109,68 @@ type oneandoneOptions struct {
 	RW             string `json:"kubernetes.io/readwrite"`
 	StorageName    string `json:"storageName,omitempty"`
 	StorageID      string `json:"storageID,omitempty"`
+	Type           string `json:"type,omitempty"`
+	NFSOptions     string `json:"nfsOptions,omitempty"`
+	FormatPolicy   string `json:"formatPolicy,omitempty"`
+	MountOptions   string `json:"kubernetes.io/mountsOptions,omitempty"`
+	MountFlags     string `json:"mountFlags,omitempty"`
+	MkfsOptions    string `json:"mkfsOptions,omitempty"`
+	VolumeMode     string `json:"volumeMode,omitempty"`
+	Encrypted      string `json:"encrypted,omitempty"`
+	Passphrase     string `json:"kubernetes.io/secret/passphrase,omitempty"`
+	StorageClass   string `json:"storageClass,omitempty"`
+
+	// provisioning parameters
+	Size           string `json:"size,omitempty"`
+	DatacenterID   string `json:"datacenterID,omitempty"`
+	NameTemplate   string `json:"nameTemplate,omitempty"`
+	ExecutionGroup string `json:"executionGroup,omitempty"`
+	ReclaimPolicy  string `json:"reclaimPolicy,omitempty"`
+	PVCName        string `json:"kubernetes.io/pvcName,omitempty"`
+	PVCNamespace   string `json:"kubernetes.io/pvcNamespace,omitempty"`
 }
 
-// NewOneandoneVolumePlugin creates a 1&1 flex plugin
-func NewOneandoneVolumePlugin(m *cloud.OneandoneManager) flex.VolumePlugin {
+// NewOneandoneVolumePlugin creates a 1&1 flex plugin with the node settings.
+// The manager of the global token is used by volumes without an apiKey
+// secret, it may be nil.
+func NewOneandoneVolumePlugin(m cloud.Provider, c Config) flex.VolumePlugin {
+	mounter := mount.New()
+	remover := scsi.NewRemover(mounter)
+	volumesDir := c.VolumesDir
+	if volumesDir == "" {
+		volumesDir = DefaultVolumesDir
+	}
 	return &VolumePlugin{
-		manager: m,
+		manager:        m,
+		newManager:     c.NewManager,
+		volumesDir:     volumesDir,
+		mounter:        NewNodeMounter(mounter, c.BusyPolicy),
+		getServerID:    helper.GetServerID,
+		profiles:       c.Filesystems,
+		crypt:          luks.New(),
+		probe:          probe.Probe,
+		keyFile:        c.KeyFile,
+		waitForDevice:  scsi.NewDiscoverer().WaitForDevice,
+		removeDevice:   remover.RemoveDevice,
+		confirmRemoved: remover.ConfirmRemoved,
+		rescanDevice:   scsi.RescanDevice,
+		journal:        journal.New(journal.DefaultDir),
+		timeout:        c.Timeout,
+		fsType:         c.FsType,
+		formatPolicy:   c.FormatPolicy,
+		storageClasses: c.StorageClasses,
+	}
+}
+
+// commandContext returns the context of a command. Its deadline makes the waits
+// for the 1&1 API return an in progress error the kubelet retries, the
+// retry resumes the wait.
+func (v *VolumePlugin) commandContext() (context.Context, context.CancelFunc) {
+	timeout := v.timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
 	}
+	return context.WithTimeout(context.Background(), timeout)
 }
 
 // Init driver
@@ -36,8 +179,9 @@ func (v *VolumePlugin) Init() (*flex.DriverStatus, error) {
 		Status:  flex.StatusSuccess,
 		Message: "1and1 flex driver initialized",
 		Capabilities: &flex.DriverCapabilities{
-			Attach:         true,
-			SELinuxRelabel: true,
+			Attach:           true,
+			SELinuxRelabel:   true,
+			RequiresFSResize: true,
 		},
 	}, nil
 }
@@ -47,9 +191,145 @@ func (v *VolumePlugin) newOptions(options string) (*oneandoneOptions, error) {
 	if err := json.Unmarshal([]byte(options), opts); err != nil {
 		return nil, err
 	}
+
+	switch opts.Type {
+	case "":
+		opts.Type = volumeTypeBlock
+	case volumeTypeBlock, volumeTypeShared:
+	default:
+		return nil, fmt.Errorf("unknown 1&1 volume type %q", opts.Type)
+	}
+
+	if err := v.applyDefaults(opts); err != nil {
+		return nil, err
+	}
+
+	switch opts.VolumeMode {
+	case "":
+		opts.VolumeMode = volumeModeFilesystem
+	case volumeModeFilesystem:
+	case volumeModeBlock:
+		if opts.Type == volumeTypeShared {
+			return nil, fmt.Errorf("shared volumes cannot use the %s volume mode", volumeModeBlock)
+		}
+		if opts.MkfsOptions != "" || opts.MountOptions != "" || opts.MountFlags != "" {
+			return nil, fmt.Errorf("mkfs and mount options do not apply to volumes in %s mode", volumeModeBlock)
+		}
+	default:
+		return nil, fmt.Errorf("unknown volume mode %q, use %s or %s", opts.VolumeMode, volumeModeFilesystem, volumeModeBlock)
+	}
+
+	if opts.Encrypted != "" {
+		encrypted, err := strconv.ParseBool(opts.Encrypted)
+		if err != nil {
+			return nil, fmt.Errorf("invalid encrypted option %q: %s", opts.Encrypted, err.Error())
+		}
+		if encrypted && opts.Type == volumeTypeShared {
+			return nil, fmt.Errorf("shared volumes cannot be encrypted")
+		}
+	}
+
+	if _, err := format.ParsePolicy(opts.FormatPolicy); err != nil {
+		return nil, err
+	}
+	if _, err := opts.mountOptions(); err != nil {
+		return nil, err
+	}
+	if opts.Type == volumeTypeBlock && opts.VolumeMode == volumeModeFilesystem {
+		if _, err := v.profiles.MkfsOptions(opts.fsType(), opts.MkfsOptions); err != nil {
+			return nil, err
+		}
+	}
 	return opts, nil
 }
 
+// applyDefaults fills the filesystem options the block volume leaves empty
+// from its storage class and then from the driver defaults
+func (v *VolumePlugin) applyDefaults(opts *oneandoneOptions) error {
+	if opts.Type != volumeTypeBlock {
+		if opts.StorageClass != "" {
+			return fmt.Errorf("storage classes do not apply to %s volumes", opts.Type)
+		}
+		return nil
+	}
+
+	if opts.StorageClass != "" {
+		class, err := v.storageClasses.Get(opts.StorageClass)
+		if err != nil {
+			return err
+		}
+		if opts.FsType == "" {
+			opts.FsType = class.FsType
+		}
+		if opts.FormatPolicy == "" {
+			opts.FormatPolicy = class.FormatPolicy
+		}
+		if opts.VolumeMode != volumeModeBlock {
+			if opts.MkfsOptions == "" {
+				opts.MkfsOptions = class.MkfsOptions
+			}
+			if opts.MountFlags == "" {
+				opts.MountFlags = class.MountFlags
+			}
+		}
+	}
+
+	if opts.FsType == "" {
+		opts.FsType = v.fsType
+	}
+	if opts.FormatPolicy == "" {
+		opts.FormatPolicy = string(v.formatPolicy)
+	}
+	return nil
+}
+
+// encrypted tells whether the volume is encrypted with LUKS
+func (o *oneandoneOptions) encrypted() bool {
+	encrypted, _ := strconv.ParseBool(o.Encrypted)
+	return encrypted
+}
+
+// fsType returns the filesystem of the volume, ext4 when neither the
+// volume nor the driver config set one
+func (o *oneandoneOptions) fsType() string {
+	if o.FsType == "" {
+		return DefaultFsType
+	}
+	return o.FsType
+}
+
+// mountOptions merges the NFS options of shared volumes, the PV mount
+// options and the mountFlags option, adding ro for read only volumes, and
+// validates them against the allowlist of the filesystem
+func (o *oneandoneOptions) mountOptions() ([]string, error) {
+	fsType := o.fsType()
+	options := []string{}
+	if o.Type == volumeTypeShared {
+		fsType = "nfs"
+		nfsOptions := o.NFSOptions
+		if nfsOptions == "" {
+			nfsOptions = defaultNFSOptions
+		}
+		options = append(options, mount.SplitOptions(nfsOptions)...)
+	}
+	options = append(options, mount.SplitOptions(o.MountOptions)...)
+	options = append(options, mount.SplitOptions(o.MountFlags)...)
+
+	if o.RW == "ro" {
+		if mount.HasOption(options, "rw") {
+			return nil, fmt.Errorf("mount option rw conflicts with the read only volume")
+		}
+		if !mount.HasOption(options, "ro") {
+			options = append(options, "ro")
+		}
+	}
+
+	if err := mount.ValidateOptions(fsType, options); err != nil {
+		return nil, err
+	}
+	return options, nil
+}
+
 // GetVolumeName Retrieves a unique volume name
 func (v *VolumePlugin) GetVolumeName(options string) (*flex.DriverStatus, error) {
 	opt, err := v.newOptions(options)
@@ -68,6 +348,28 @@ func (v *VolumePlugin) GetVolumeName(options string) (*flex.DriverStatus, error)
 	return r, nil
 }
 
+// LockKeys locks the storage ID and name from the options together with
+// the device and mount directory, so attach and detach of a storage
+// exclude each other as well as mountdevice and unmountdevice of a path
+func (v *VolumePlugin) LockKeys(command, device, mountdir, options string) []string {
+	keys := []string{}
+	opt := &oneandoneOptions{}
+	if options != "" && json.Unmarshal([]byte(options), opt) == nil {
+		if opt.StorageID != "" {
+			keys = append(keys, "storage:"+opt.StorageID)
+		}
+		if opt.StorageName != "" {
+			keys = append(keys, flex.PathKey(opt.StorageName))
+		}
+	}
+	for _, arg := range []string{device, mountdir} {
+		if arg != "" {
+			keys = append(keys, flex.PathKey(arg))
+		}
+	}
+	return keys
+}
+
 // Mount volume at the dir where pods will use it
 func (v *VolumePlugin) Mount(mountdir string, options string) (*flex.DriverStatus, error) {
 	r := &flex.DriverStatus{
@@ -1,9 +1,27 @@
 package plugin
 
 import (
+	"github.com/1and1/oneandone-cloudserver-sdk-go"
 	"github.com/1and1/oneandone-flex-volume/pkg/flex"
+	"github.com/1and1/oneandone-flex-volume/pkg/format"
+	"github.com/1and1/oneandone-flex-volume/pkg/journal"
+	luksfake "github.com/1and1/oneandone-flex-volume/pkg/luks/fake"
+	"github.com/1and1/oneandone-flex-volume/pkg/mount"
+	mountfake "github.com/1and1/oneandone-flex-volume/pkg/mount/fake"
+	"github.com/1and1/oneandone-flex-volume/pkg/oneandone/cloud"
+	"github.com/1and1/oneandone-flex-volume/pkg/oneandone/cloud/fake"
+	"github.com/1and1/oneandone-flex-volume/pkg/probe"
+	"github.com/1and1/oneandone-flex-volume/pkg/scsi"
 
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -19,15 +37,15 @@ func TestGetVolumeName(t *testing.T) {
 			true,
 		},
 		{
-			`{"kubernetes.io/fsType":"ext4","kubernetes.io/pvOrVolumeName":"prueba","kubernetes.io/readwrite":"rw","volumeID":"","volumeName":"prueba"}`,
+			`{"kubernetes.io/fsType":"ext4","kubernetes.io/pvOrVolumeName":"prueba","kubernetes.io/readwrite":"rw","storageID":"","storageName":"prueba"}`,
 			nil,
 			true,
 		},
 		{
-			`{"kubernetes.io/fsType":"ext4","kubernetes.io/pvOrVolumeName":"prueba","kubernetes.io/readwrite":"rw","volumeID":"id0123456789","volumeName":"prueba"}`,
+			`{"kubernetes.io/fsType":"ext4","kubernetes.io/pvOrVolumeName":"prueba","kubernetes.io/readwrite":"rw","storageID":"id0123456789","storageName":"prueba"}`,
 			&flex.DriverStatus{
 				Status:     flex.StatusSuccess,
-				VolumeName: "id0123456789",
+				VolumeName: "prueba",
 			},
 			false,
 		},
@@ -58,3 +76,1153 @@ func TestGetVolumeName(t *testing.T) {
 		}
 	}
 }
+
+// fakeMounter records mounts instead of touching the host
+type fakeMounter struct {
+	mounts  map[string]string
+	options map[string][]string
+	formats map[string]FormatOptions
+}
+
+func (m *fakeMounter) FormatAndMount(device, targetDir string, opts FormatOptions) error {
+	m.formats[targetDir] = opts
+	return m.Mount(device, targetDir, opts.FsType, opts.MountOptions)
+}
+
+func (m *fakeMounter) Mount(source, targetDir, fsType string, options []string) error {
+	m.mounts[targetDir] = source
+	m.options[targetDir] = options
+	return nil
+}
+
+func (m *fakeMounter) MapBlock(device, target string, readOnly bool) error {
+	options := []string{"bind"}
+	if readOnly {
+		options = append(options, "ro")
+	}
+	return m.Mount(device, target, "", options)
+}
+
+func (m *fakeMounter) Unmount(targetDir string) error {
+	delete(m.mounts, targetDir)
+	delete(m.options, targetDir)
+	return nil
+}
+
+func newTestPlugin() (*VolumePlugin, *fake.Provider, *fakeMounter) {
+	p := fake.NewProvider()
+	p.AddServer("server01", "node01", "10.0.0.10")
+	m := &fakeMounter{mounts: map[string]string{}, options: map[string][]string{}, formats: map[string]FormatOptions{}}
+	c := luksfake.NewCryptsetup()
+	return &VolumePlugin{
+		manager:     p,
+		mounter:     m,
+		getServerID: func() (string, error) { return "server01", nil },
+		crypt:       c,
+		waitForDevice: func(uuid string) (string, error) {
+			return scsi.ByIDPath(uuid), nil
+		},
+		rescanDevice:   func(devicePath string) error { return nil },
+		removeDevice:   func(uuid string) error { return nil },
+		confirmRemoved: func(uuid string) error { return nil },
+		probe: func(device string) (*probe.Result, error) {
+			if c.IsLUKS(device) {
+				return &probe.Result{Type: luksType, Usage: probe.UsageCrypto}, nil
+			}
+			return &probe.Result{Empty: true}, nil
+		},
+	}, p, m
+}
+
+func TestVolumeLifecycle(t *testing.T) {
+	vp, p, m := newTestPlugin()
+	storage := p.AddBlockStorage("pv-data", 20)
+	options := fmt.Sprintf(`{"kubernetes.io/fsType":"ext4","kubernetes.io/readwrite":"rw","storageID":"%s","storageName":"pv-data"}`, storage.Id)
+	mountdir := "/var/lib/kubelet/plugins/kubernetes.io/flexvolume/oneandone/mounts/pv-data"
+
+	ds, err := vp.Attach(options, "10.0.0.10")
+	if err != nil {
+		t.Fatalf("unexpected error attaching: %s", err)
+	}
+	device := ds.DevicePath
+
+	if ds, err := vp.IsAttached(options, "10.0.0.10"); err != nil || ds.Attached {
+		t.Errorf("expected volume not to be attached before mounting, got %+v and error %v", ds, err)
+	}
+
+	if _, err := vp.MountDevice(mountdir, device, options); err != nil {
+		t.Fatalf("unexpected error mounting device: %s", err)
+	}
+	if source := m.mounts[mountdir]; source != "/dev/disk/by-id/scsi-3"+storage.UUID {
+		t.Errorf("expected storage device mounted at %s but got %q", mountdir, source)
+	}
+	if ds, err := vp.IsAttached(options, "10.0.0.10"); err != nil || !ds.Attached {
+		t.Errorf("expected volume to be attached after mounting, got %+v and error %v", ds, err)
+	}
+
+	if _, err := vp.UnmountDevice(mountdir); err != nil {
+		t.Fatalf("unexpected error unmounting device: %s", err)
+	}
+	if _, ok := m.mounts[mountdir]; ok {
+		t.Errorf("expected %s to be unmounted", mountdir)
+	}
+	if ds, err := vp.IsAttached(options, "10.0.0.10"); err != nil || ds.Attached {
+		t.Errorf("expected volume to be detached after unmounting, got %+v and error %v", ds, err)
+	}
+
+	if _, err := vp.Detach(device, "10.0.0.10"); err != nil {
+		t.Errorf("unexpected error detaching a detached volume: %s", err)
+	}
+}
+
+func TestVolumeCredentials(t *testing.T) {
+	vp, global, m := newTestPlugin()
+	dir, err := ioutil.TempDir("", "credentials")
+	if err != nil {
+		t.Fatalf("an error ocurred creating a temporary directory %s", err)
+	}
+	defer os.RemoveAll(dir)
+	vp.volumesDir = dir
+
+	account := fake.NewProvider()
+	account.AddServer("server01", "node01", "10.0.0.10")
+	created := []string{}
+	vp.newManager = func(token string) (cloud.Provider, error) {
+		created = append(created, token)
+		return account, nil
+	}
+
+	storage := account.AddBlockStorage("pv-account", 20)
+	options := fmt.Sprintf(`{"kubernetes.io/secret/apiKey":"%s","storageID":"%s","storageName":"pv-account"}`, base64.StdEncoding.EncodeToString([]byte("account-token\n")), storage.Id)
+	mountdir := "/var/lib/kubelet/plugins/kubernetes.io/flexvolume/oneandone/mounts/pv-account"
+
+	ds, err := vp.Attach(options, "10.0.0.10")
+	if err != nil {
+		t.Fatalf("an error ocurred attaching %s", err)
+	}
+	if _, err := vp.MountDevice(mountdir, ds.DevicePath, options); err != nil {
+		t.Fatalf("an error ocurred mounting the device %s", err)
+	}
+	if s, _ := account.GetBlockstorage(context.Background(), storage.Id); s.Server == nil {
+		t.Errorf("expected the storage of the account to be attached")
+	}
+
+	// unmountdevice and detach get no options, the secret is remembered
+	if _, err := vp.UnmountDevice(mountdir); err != nil {
+		t.Fatalf("an error ocurred unmounting the device %s", err)
+	}
+	if _, ok := m.mounts[mountdir]; ok {
+		t.Errorf("expected %s to be unmounted", mountdir)
+	}
+	if s, _ := account.GetBlockstorage(context.Background(), storage.Id); s.Server != nil {
+		t.Errorf("expected the storage of the account to be detached")
+	}
+	if _, err := vp.Detach(ds.DevicePath, "10.0.0.10"); err != nil {
+		t.Errorf("an error ocurred detaching %s", err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("expected the secrets to be forgotten after detaching but got %d files", len(files))
+	}
+
+	for _, token := range created {
+		if token != "account-token" {
+			t.Errorf("expected the managers to use the decoded token but got %q", token)
+		}
+	}
+	if len(created) == 0 {
+		t.Errorf("expected a manager for the apiKey secret")
+	}
+	if global.Calls(fake.OpGetBlockstorage)+global.Calls(fake.OpFindServerFromNodeName) != 0 {
+		t.Errorf("expected the global manager not to be used")
+	}
+
+	// the kubelet detaches by the volume name, which need not be the name
+	// of the storage
+	claimed := fmt.Sprintf(`{"kubernetes.io/secret/apiKey":"%s","storageID":"%s","storageName":"pv-claim"}`, base64.StdEncoding.EncodeToString([]byte("account-token")), storage.Id)
+	if _, err := vp.Attach(claimed, "10.0.0.10"); err != nil {
+		t.Fatalf("an error ocurred attaching %s", err)
+	}
+	if _, err := os.Stat(vp.recordPath("pv-claim")); err != nil {
+		t.Errorf("expected the secret to be kept under the volume name but got %s", err)
+	}
+	vp.forgetVolume("pv-claim")
+
+	invalid := fmt.Sprintf(`{"kubernetes.io/secret/apiKey":"not base64","storageID":"%s"}`, storage.Id)
+	if _, err := vp.Attach(invalid, "10.0.0.10"); err == nil {
+		t.Errorf("expected an apiKey secret that is not base64 to fail")
+	}
+
+	vp.manager = nil
+	if _, err := vp.Attach(fmt.Sprintf(`{"storageID":"%s"}`, storage.Id), "10.0.0.10"); err == nil {
+		t.Errorf("expected a volume without apiKey secret to fail without a global token")
+	}
+}
+
+func TestMountOptions(t *testing.T) {
+	cases := []struct {
+		options       string
+		expected      []string
+		expectedError bool
+	}{
+		{
+			`{"kubernetes.io/readwrite":"rw"}`,
+			[]string{},
+			false,
+		},
+		{
+			`{"kubernetes.io/readwrite":"ro"}`,
+			[]string{"ro"},
+			false,
+		},
+		{
+			`{"kubernetes.io/fsType":"xfs","kubernetes.io/readwrite":"ro","kubernetes.io/mountsOptions":"noatime,nouuid","mountFlags":"nosuid,nodev"}`,
+			[]string{"noatime", "nouuid", "nosuid", "nodev", "ro"},
+			false,
+		},
+		{
+			`{"kubernetes.io/readwrite":"ro","kubernetes.io/mountsOptions":"ro,data=ordered"}`,
+			[]string{"ro", "data=ordered"},
+			false,
+		},
+		{
+			`{"type":"shared","kubernetes.io/readwrite":"ro"}`,
+			[]string{"hard", "nfsvers=3", "ro"},
+			false,
+		},
+		{
+			`{"type":"shared","nfsOptions":"soft,nfsvers=4.1","mountFlags":"noexec"}`,
+			[]string{"soft", "nfsvers=4.1", "noexec"},
+			false,
+		},
+		{
+			`{"kubernetes.io/fsType":"ext4","mountFlags":"nouuid"}`,
+			nil,
+			true,
+		},
+		{
+			`{"kubernetes.io/mountsOptions":"bind"}`,
+			nil,
+			true,
+		},
+		{
+			`{"type":"shared","mountFlags":"suid"}`,
+			nil,
+			true,
+		},
+		{
+			`{"kubernetes.io/readwrite":"ro","mountFlags":"rw"}`,
+			nil,
+			true,
+		},
+	}
+
+	for _, c := range cases {
+		vp, p, m := newTestPlugin()
+		block := p.AddBlockStorage("pv-data", 20)
+		shared := p.AddSharedStorage("pv-shared", 50)
+		id := block.Id
+		if strings.Contains(c.options, "shared") {
+			id = shared.Id
+		}
+		options := strings.Replace(c.options, "{", fmt.Sprintf(`{"storageID":"%s",`, id), 1)
+		mountdir := "/mnt/pv-data"
+
+		_, err := vp.MountDevice(mountdir, "pv-data", options)
+		if c.expectedError {
+			if err == nil {
+				t.Errorf("expected error mounting with options %q", c.options)
+			}
+			if _, ok := m.mounts[mountdir]; ok {
+				t.Errorf("options %q expected nothing mounted at %s", c.options, mountdir)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("an error ocurred mounting with options %q: %s", c.options, err)
+			continue
+		}
+		if !reflect.DeepEqual(m.options[mountdir], c.expected) {
+			t.Errorf("options %q expected mount options %v but got %v", c.options, c.expected, m.options[mountdir])
+		}
+	}
+}
+
+func TestUnmountByRecord(t *testing.T) {
+	vp, p, m := newTestPlugin()
+	dir, err := ioutil.TempDir("", "volumes")
+	if err != nil {
+		t.Fatalf("an error ocurred creating a temporary directory %s", err)
+	}
+	defer os.RemoveAll(dir)
+	vp.volumesDir = dir
+
+	// the name of the block storage is part of the name of the shared one
+	block := p.AddBlockStorage("pv-data", 20)
+	shared := p.AddSharedStorage("pv-data-shared", 50)
+	blockDir := "/mnt/pv-data"
+	sharedDir := "/mnt/pv-data-shared"
+	if _, err := vp.MountDevice(blockDir, "pv-data", fmt.Sprintf(`{"storageID":"%s","storageName":"pv-data"}`, block.Id)); err != nil {
+		t.Fatalf("an error ocurred mounting the block storage %s", err)
+	}
+	sharedOptions := fmt.Sprintf(`{"type":"shared","storageID":"%s","storageName":"pv-data-shared"}`, shared.Id)
+	if _, err := vp.Attach(sharedOptions, "10.0.0.10"); err != nil {
+		t.Fatalf("an error ocurred attaching the shared storage %s", err)
+	}
+	if _, err := vp.MountDevice(sharedDir, "pv-data-shared", sharedOptions); err != nil {
+		t.Fatalf("an error ocurred mounting the shared storage %s", err)
+	}
+
+	if _, err := vp.UnmountDevice(sharedDir); err != nil {
+		t.Fatalf("an error ocurred unmounting the shared storage %s", err)
+	}
+	if _, ok := m.mounts[blockDir]; !ok {
+		t.Errorf("expected the block storage to stay mounted at %s", blockDir)
+	}
+	if s, _ := p.GetBlockstorage(context.Background(), block.Id); s.Server == nil {
+		t.Errorf("expected the block storage to stay attached")
+	}
+	if _, err := vp.Detach("pv-data-shared", "10.0.0.10"); err != nil {
+		t.Errorf("an error ocurred detaching the shared storage %s", err)
+	}
+	if s, _ := p.GetBlockstorage(context.Background(), block.Id); s.Server == nil {
+		t.Errorf("expected the block storage to stay attached after detaching the shared storage")
+	}
+
+	if _, err := vp.UnmountDevice(blockDir); err != nil {
+		t.Fatalf("an error ocurred unmounting the block storage %s", err)
+	}
+	if s, _ := p.GetBlockstorage(context.Background(), block.Id); s.Server != nil {
+		t.Errorf("expected the block storage to be detached")
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("expected the records to be removed but got %d files", len(files))
+	}
+}
+
+func TestMkfsOptions(t *testing.T) {
+	cases := []struct {
+		options       string
+		expected      format.MkfsOptions
+		expectedError bool
+	}{
+		{
+			`{}`,
+			format.MkfsOptions{{Flag: "-m", Value: "0"}},
+			false,
+		},
+		{
+			`{"mkfsOptions":"-m 1 -L data -E lazy_itable_init=0"}`,
+			format.MkfsOptions{{Flag: "-m", Value: "1"}, {Flag: "-L", Value: "data"}, {Flag: "-E", Value: "lazy_itable_init=0"}},
+			false,
+		},
+		{
+			`{"kubernetes.io/fsType":"xfs","mkfsOptions":"-L db"}`,
+			format.MkfsOptions{{Flag: "-b", Value: "size=8192"}, {Flag: "-L", Value: "db"}},
+			false,
+		},
+		{
+			`{"kubernetes.io/fsType":"btrfs","mkfsOptions":"-d raid1"}`,
+			format.MkfsOptions{{Flag: "-d", Value: "raid1"}},
+			false,
+		},
+		{
+			`{"kubernetes.io/fsType":"xfs","mkfsOptions":"-E lazy_itable_init=0"}`,
+			nil,
+			true,
+		},
+		{
+			`{"kubernetes.io/fsType":"zfs"}`,
+			nil,
+			true,
+		},
+	}
+
+	for _, c := range cases {
+		vp, p, m := newTestPlugin()
+		vp.profiles = format.Profiles{
+			"ext4": {MkfsOptions: "-m 0"},
+			"xfs":  {MkfsOptions: "-b size=8192"},
+		}
+		storage := p.AddBlockStorage("pv-data", 20)
+		options := strings.Replace(c.options, "{", fmt.Sprintf(`{"storageID":"%s",`, storage.Id), 1)
+		options = strings.Replace(options, ",}", "}", 1)
+		mountdir := "/mnt/pv-data"
+
+		_, err := vp.MountDevice(mountdir, "pv-data", options)
+		if c.expectedError {
+			if err == nil {
+				t.Errorf("expected error mounting with options %q", c.options)
+			}
+			if s, _ := p.GetBlockstorage(context.Background(), storage.Id); s.Server != nil {
+				t.Errorf("options %q expected the storage not to be attached", c.options)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("an error ocurred mounting with options %q: %s", c.options, err)
+			continue
+		}
+		if !reflect.DeepEqual(m.formats[mountdir].MkfsOptions, c.expected) {
+			t.Errorf("options %q expected mkfs options %v but got %v", c.options, c.expected, m.formats[mountdir].MkfsOptions)
+		}
+	}
+}
+
+func TestBlockVolumeMode(t *testing.T) {
+	vp, p, m := newTestPlugin()
+	storage := p.AddBlockStorage("pv-data", 20)
+	options := fmt.Sprintf(`{"kubernetes.io/readwrite":"ro","storageID":"%s","storageName":"pv-data","volumeMode":"block"}`, storage.Id)
+	target := "/var/lib/kubelet/plugins/kubernetes.io/flexvolume/oneandone/mounts/pv-data"
+
+	if _, err := vp.MountDevice(target, "pv-data", options); err != nil {
+		t.Fatalf("an error ocurred mapping the block volume: %s", err)
+	}
+	if source := m.mounts[target]; source != "/dev/disk/by-id/scsi-3"+storage.UUID {
+		t.Errorf("expected storage device mapped at %s but got %q", target, source)
+	}
+	if !reflect.DeepEqual(m.options[target], []string{"bind", "ro"}) {
+		t.Errorf("expected a read only bind mount but got %v", m.options[target])
+	}
+	if _, ok := m.formats[target]; ok {
+		t.Errorf("expected a block volume not to be formatted")
+	}
+
+	if _, err := vp.UnmountDevice(target); err != nil {
+		t.Fatalf("an error ocurred unmapping the block volume: %s", err)
+	}
+	if _, ok := m.mounts[target]; ok {
+		t.Errorf("expected %s to be unmapped", target)
+	}
+	if s, _ := p.GetBlockstorage(context.Background(), storage.Id); s.Server != nil {
+		t.Errorf("expected storage to be detached but got %+v", s.Server)
+	}
+
+	for _, invalid := range []string{
+		`{"volumeMode":"raw"}`,
+		`{"volumeMode":"block","type":"shared"}`,
+		`{"volumeMode":"block","mkfsOptions":"-m 0"}`,
+		`{"volumeMode":"block","mountFlags":"noatime"}`,
+	} {
+		if _, err := vp.newOptions(invalid); err == nil {
+			t.Errorf("expected error parsing options %q", invalid)
+		}
+	}
+}
+
+func TestStorageClass(t *testing.T) {
+	vp, _, _ := newTestPlugin()
+	vp.fsType = "xfs"
+	vp.formatPolicy = format.PolicyNever
+	vp.storageClasses = StorageClasses{
+		"fast": {FsType: "ext4", FormatPolicy: "overwrite", MkfsOptions: "-m 0", MountFlags: "noatime"},
+	}
+
+	cases := []struct {
+		options  string
+		expected StorageClass
+	}{
+		{`{"storageID":"id0123"}`, StorageClass{FsType: "xfs", FormatPolicy: "never"}},
+		{`{"storageID":"id0123","storageClass":"fast"}`, StorageClass{FsType: "ext4", FormatPolicy: "overwrite", MkfsOptions: "-m 0", MountFlags: "noatime"}},
+		{`{"storageID":"id0123","storageClass":"fast","kubernetes.io/fsType":"xfs","mkfsOptions":"-L data"}`, StorageClass{FsType: "xfs", FormatPolicy: "overwrite", MkfsOptions: "-L data", MountFlags: "noatime"}},
+		{`{"storageID":"id0123","storageClass":"fast","volumeMode":"block"}`, StorageClass{FsType: "ext4", FormatPolicy: "overwrite"}},
+	}
+
+	for _, c := range cases {
+		opt, err := vp.newOptions(c.options)
+		if err != nil {
+			t.Errorf("an error ocurred parsing %s: %s", c.options, err)
+			continue
+		}
+		got := StorageClass{FsType: opt.FsType, FormatPolicy: opt.FormatPolicy, MkfsOptions: opt.MkfsOptions, MountFlags: opt.MountFlags}
+		if got != c.expected {
+			t.Errorf("%s: expected %+v but got %+v", c.options, c.expected, got)
+		}
+	}
+
+	for _, options := range []string{
+		`{"storageID":"id0123","storageClass":"slow"}`,
+		`{"storageID":"id0123","storageClass":"fast","type":"shared"}`,
+	} {
+		if _, err := vp.newOptions(options); err == nil {
+			t.Errorf("expected %s to fail", options)
+		}
+	}
+}
+
+func TestMapBlockNeedsBlockDevice(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fm := mountfake.NewMounter()
+	n := NewNodeMounter(fm, mount.BusyFail)
+	image := filepath.Join(dir, "image")
+	if err := ioutil.WriteFile(image, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := n.MapBlock(image, filepath.Join(dir, "target"), false); err == nil {
+		t.Errorf("expected error mapping a regular file")
+	}
+	if len(fm.Actions()) != 0 {
+		t.Errorf("expected nothing mounted but got %+v", fm.Actions())
+	}
+}
+
+func TestEncryptedVolume(t *testing.T) {
+	vp, p, m := newTestPlugin()
+	c := vp.crypt.(*luksfake.Cryptsetup)
+	storage := p.AddBlockStorage("pv-data", 20)
+	device := "/dev/disk/by-id/scsi-3" + storage.UUID
+	mapped := "/dev/mapper/oneandone-" + storage.Id
+	secret := base64.StdEncoding.EncodeToString([]byte("s3cr3t"))
+	options := fmt.Sprintf(`{"encrypted":"true","kubernetes.io/secret/passphrase":"%s","storageID":"%s","storageName":"pv-data"}`, secret, storage.Id)
+	mountdir := "/mnt/pv-data"
+
+	if _, err := vp.MountDevice(mountdir, "pv-data", options); err != nil {
+		t.Fatalf("an error ocurred mounting the encrypted volume: %s", err)
+	}
+	if source := m.mounts[mountdir]; source != mapped {
+		t.Errorf("expected %s mounted at %s but got %q", mapped, mountdir, source)
+	}
+	if _, err := vp.UnmountDevice(mountdir); err != nil {
+		t.Fatalf("an error ocurred unmounting the encrypted volume: %s", err)
+	}
+	if open, _ := c.IsOpen("oneandone-" + storage.Id); open {
+		t.Errorf("expected the mapping to be closed after unmounting")
+	}
+
+	if _, err := vp.MountDevice(mountdir, "pv-data", options); err != nil {
+		t.Fatalf("an error ocurred mounting the encrypted volume again: %s", err)
+	}
+	expected := []string{"Format " + device, "Close oneandone-" + storage.Id, "Open " + device}
+	if !reflect.DeepEqual(c.Actions(), expected) {
+		t.Errorf("expected cryptsetup calls %v but got %v", expected, c.Actions())
+	}
+	vp.UnmountDevice(mountdir)
+
+	wrong := strings.Replace(options, secret, base64.StdEncoding.EncodeToString([]byte("wrong")), 1)
+	if _, err := vp.MountDevice(mountdir, "pv-data", wrong); err == nil {
+		t.Errorf("expected error opening the volume with a wrong passphrase")
+	}
+}
+
+func TestExpandEncryptedVolume(t *testing.T) {
+	vp, p, _ := newTestPlugin()
+	c := vp.crypt.(*luksfake.Cryptsetup)
+	storage := p.AddBlockStorage("pv-data", 20)
+	secret := base64.StdEncoding.EncodeToString([]byte("s3cr3t"))
+	options := fmt.Sprintf(`{"encrypted":"true","kubernetes.io/secret/passphrase":"%s","storageID":"%s","storageName":"pv-data","volumeMode":"block"}`, secret, storage.Id)
+	mountdir := "/mnt/pv-data"
+
+	if _, err := vp.MountDevice(mountdir, "pv-data", options); err != nil {
+		t.Fatalf("an error ocurred mounting the encrypted volume: %s", err)
+	}
+
+	wrong := strings.Replace(options, secret, base64.StdEncoding.EncodeToString([]byte("wrong")), 1)
+	if _, err := vp.ExpandFS(wrong, "pv-data", mountdir, 40, 20); err == nil {
+		t.Errorf("expected error resizing the mapping with a wrong passphrase")
+	}
+	if _, err := vp.ExpandFS(options, "pv-data", mountdir, 40, 20); err != nil {
+		t.Errorf("an error ocurred expanding the encrypted volume: %s", err)
+	}
+	actions := c.Actions()
+	if last := actions[len(actions)-1]; last != "Resize oneandone-"+storage.Id {
+		t.Errorf("expected the mapping to be resized but got cryptsetup calls %v", actions)
+	}
+}
+
+func TestPassphrase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, "key")
+	if err := ioutil.WriteFile(keyFile, []byte("from-file"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		secret        string
+		keyFile       string
+		expected      string
+		expectedError bool
+	}{
+		{base64.StdEncoding.EncodeToString([]byte("from-secret")), keyFile, "from-secret", false},
+		{"", keyFile, "from-file", false},
+		{"", "", "", true},
+		{"", filepath.Join(dir, "missing"), "", true},
+		{"not base64!", keyFile, "", true},
+	}
+
+	for _, c := range cases {
+		vp := &VolumePlugin{keyFile: c.keyFile}
+		key, err := vp.passphrase(&oneandoneOptions{Passphrase: c.secret})
+		if c.expectedError {
+			if err == nil {
+				t.Errorf("expected error reading the passphrase of secret %q and key file %q", c.secret, c.keyFile)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("an error ocurred reading the passphrase of secret %q and key file %q: %s", c.secret, c.keyFile, err)
+			continue
+		}
+		if string(key) != c.expected {
+			t.Errorf("expected passphrase %q but got %q", c.expected, key)
+		}
+	}
+}
+
+func TestEncryptedVolumeRefusesData(t *testing.T) {
+	vp, p, m := newTestPlugin()
+	vp.probe = func(device string) (*probe.Result, error) {
+		return &probe.Result{Type: "ext4", Usage: probe.UsageFilesystem}, nil
+	}
+	vp.keyFile = "/nonexistent"
+	storage := p.AddBlockStorage("pv-data", 20)
+	options := fmt.Sprintf(`{"encrypted":"true","kubernetes.io/secret/passphrase":"c2VjcmV0","storageID":"%s"}`, storage.Id)
+
+	if _, err := vp.MountDevice("/mnt/pv-data", "pv-data", options); err == nil {
+		t.Errorf("expected error encrypting a storage holding a filesystem")
+	}
+	if len(vp.crypt.(*luksfake.Cryptsetup).Actions()) != 0 || len(m.mounts) != 0 {
+		t.Errorf("expected the storage not to be formatted nor mounted")
+	}
+
+	for _, invalid := range []string{`{"encrypted":"maybe"}`, `{"encrypted":"true","type":"shared"}`} {
+		if _, err := vp.newOptions(invalid); err == nil {
+			t.Errorf("expected error parsing options %q", invalid)
+		}
+	}
+}
+
+func TestMountDeviceMissingDisk(t *testing.T) {
+	vp, p, m := newTestPlugin()
+	storage := p.AddBlockStorage("pv-data", 20)
+	options := fmt.Sprintf(`{"storageID":"%s","storageName":"pv-data"}`, storage.Id)
+	vp.waitForDevice = func(uuid string) (string, error) {
+		return "", fmt.Errorf("disk of storage %s did not show up", uuid)
+	}
+
+	_, err := vp.MountDevice("/mnt/pv-data", "pv-data", options)
+	if err == nil || !strings.Contains(err.Error(), storage.UUID) {
+		t.Errorf("expected the discovery error but got %v", err)
+	}
+	if len(m.mounts) != 0 || len(m.formats) != 0 {
+		t.Errorf("expected nothing formatted nor mounted when the disk is missing")
+	}
+}
+
+func TestUnmountDeviceRemovesDisk(t *testing.T) {
+	vp, p, _ := newTestPlugin()
+	storage := p.AddBlockStorage("pv-data", 20)
+	options := fmt.Sprintf(`{"storageID":"%s","storageName":"pv-data"}`, storage.Id)
+	if _, err := vp.MountDevice("/mnt/pv-data", "pv-data", options); err != nil {
+		t.Fatalf("an error ocurred mounting the device: %s", err)
+	}
+
+	steps := []string{}
+	attached := func() string {
+		s, _ := p.GetBlockstorage(context.Background(), storage.Id)
+		if s.Server != nil {
+			return "attached"
+		}
+		return "detached"
+	}
+	vp.removeDevice = func(uuid string) error {
+		steps = append(steps, "remove "+uuid+" "+attached())
+		return nil
+	}
+	vp.confirmRemoved = func(uuid string) error {
+		steps = append(steps, "confirm "+uuid+" "+attached())
+		return nil
+	}
+
+	if _, err := vp.UnmountDevice("pv-data"); err != nil {
+		t.Fatalf("an error ocurred unmounting the device: %s", err)
+	}
+	expected := []string{"remove " + storage.UUID + " attached", "confirm " + storage.UUID + " detached"}
+	if !reflect.DeepEqual(steps, expected) {
+		t.Errorf("expected %v but got %v", expected, steps)
+	}
+
+	if _, err := vp.MountDevice("/mnt/pv-data", "pv-data", options); err != nil {
+		t.Fatalf("an error ocurred mounting the device: %s", err)
+	}
+	vp.removeDevice = func(uuid string) error {
+		return fmt.Errorf("refusing to remove sdb: sdb is held by dm-0")
+	}
+	if _, err := vp.UnmountDevice("pv-data"); err == nil {
+		t.Errorf("expected error unmounting a device in use")
+	}
+	if s, _ := p.GetBlockstorage(context.Background(), storage.Id); s.Server == nil {
+		t.Errorf("expected the storage to stay attached when the disk could not be removed")
+	}
+}
+
+func TestMountDeviceStuckAttach(t *testing.T) {
+	vp, p, m := newTestPlugin()
+	storage := p.AddBlockStorage("pv-data", 20)
+	options := fmt.Sprintf(`{"storageID":"%s","storageName":"pv-data"}`, storage.Id)
+	mountdir := "/mnt/pv-data"
+
+	p.InjectFault(fake.OpAssignStorageAndWait, fake.Fault{Stuck: true, Times: 1})
+	if _, err := vp.MountDevice(mountdir, "pv-data", options); !cloud.IsInProgress(err) {
+		t.Fatalf("expected the attach to be in progress mounting a device stuck attaching but got %v", err)
+	}
+	if _, ok := m.mounts[mountdir]; ok {
+		t.Errorf("expected nothing mounted at %s", mountdir)
+	}
+
+	p.SetState(storage.Id, fake.StatePoweredOn)
+	if _, err := vp.MountDevice(mountdir, "pv-data", options); err != nil {
+		t.Errorf("unexpected error mounting device once attached: %s", err)
+	}
+}
+
+func TestServerIDFailure(t *testing.T) {
+	vp, p, m := newTestPlugin()
+	storage := p.AddBlockStorage("pv-data", 20)
+	options := fmt.Sprintf(`{"storageID":"%s","storageName":"pv-data"}`, storage.Id)
+	mountdir := "/mnt/pv-data"
+	if _, err := vp.MountDevice(mountdir, "pv-data", options); err != nil {
+		t.Fatalf("an error ocurred mounting the device %s", err)
+	}
+
+	vp.getServerID = func() (string, error) { return "", fmt.Errorf("metadata API unreachable") }
+	if _, err := vp.UnmountDevice(mountdir); err == nil {
+		t.Errorf("expected unmounting to fail without the server ID")
+	}
+	if _, ok := m.mounts[mountdir]; !ok {
+		t.Errorf("expected %s to stay mounted", mountdir)
+	}
+	if s, _ := p.GetBlockstorage(context.Background(), storage.Id); s.Server == nil {
+		t.Errorf("expected the storage to stay attached")
+	}
+
+	other := p.AddBlockStorage("pv-other", 20)
+	if _, err := vp.MountDevice("/mnt/pv-other", "pv-other", fmt.Sprintf(`{"storageID":"%s","storageName":"pv-other"}`, other.Id)); err == nil {
+		t.Errorf("expected mounting to fail without the server ID")
+	}
+	if p.Calls(fake.OpAssignStorageAndWait) != 1 {
+		t.Errorf("expected no attach without the server ID but got %d", p.Calls(fake.OpAssignStorageAndWait))
+	}
+}
+
+func TestDetach(t *testing.T) {
+	cases := []struct {
+		name           string
+		server         string
+		fault          error
+		expectedError  bool
+		expectedServer string
+	}{
+		{"attached to this server", "server01", nil, false, ""},
+		{"attached to another server", "server02", nil, false, "server02"},
+		{"not attached", "", nil, false, ""},
+		{"API error", "server01", fmt.Errorf("injected"), true, "server01"},
+	}
+
+	for _, c := range cases {
+		vp, p, _ := newTestPlugin()
+		p.AddServer("server02", "node02", "10.0.0.20")
+		storage := p.AddBlockStorage("pv-data", 20)
+		if c.server != "" {
+			p.AssignStorageAndWait(context.Background(), storage.Id, c.server)
+		}
+		if c.fault != nil {
+			p.InjectFault(fake.OpGetBlockstorageByName, fake.Fault{Err: c.fault})
+		}
+
+		_, err := vp.Detach("pv-data", "10.0.0.10")
+		if c.expectedError {
+			if err == nil {
+				t.Errorf("%s: expected error detaching", c.name)
+			}
+		} else if err != nil {
+			t.Errorf("%s: an error ocurred detaching %s", c.name, err)
+			continue
+		}
+
+		server := ""
+		if s, _ := p.GetBlockstorage(context.Background(), storage.Id); s.Server != nil {
+			server = s.Server.Id
+		}
+		if server != c.expectedServer {
+			t.Errorf("%s: expected the storage attached to %q but got %q", c.name, c.expectedServer, server)
+		}
+	}
+
+	vp, p, _ := newTestPlugin()
+	p.AddBlockStorage("pv-data", 20)
+	p.InjectFault(fake.OpFindServerFromNodeName, fake.Fault{Err: fmt.Errorf("injected")})
+	if _, err := vp.Detach("pv-data", "10.0.0.10"); err == nil {
+		t.Errorf("expected error when the node cannot be resolved")
+	}
+}
+
+func TestDetachExactName(t *testing.T) {
+	vp, p, _ := newTestPlugin()
+	// the name of the first storage is part of the name of the second one
+	short := p.AddBlockStorage("pv", 20)
+	storage := p.AddBlockStorage("pv-data", 20)
+	p.AssignStorageAndWait(context.Background(), short.Id, "server01")
+	p.AssignStorageAndWait(context.Background(), storage.Id, "server01")
+
+	if _, err := vp.Detach("pv-data", "10.0.0.10"); err != nil {
+		t.Fatalf("an error ocurred detaching %s", err)
+	}
+	if s, _ := p.GetBlockstorage(context.Background(), short.Id); s.Server == nil {
+		t.Errorf("expected pv to stay attached")
+	}
+	if s, _ := p.GetBlockstorage(context.Background(), storage.Id); s.Server != nil {
+		t.Errorf("expected pv-data to be detached")
+	}
+}
+
+func TestIsAttached(t *testing.T) {
+	cases := []struct {
+		name             string
+		server           string
+		fault            error
+		expectedError    bool
+		expectedAttached bool
+	}{
+		{"attached to this server", "server01", nil, false, true},
+		{"attached to another server", "server02", nil, false, false},
+		{"not attached", "", nil, false, false},
+		{"API error", "server01", fmt.Errorf("injected"), true, false},
+	}
+
+	for _, c := range cases {
+		vp, p, _ := newTestPlugin()
+		p.AddServer("server02", "node02", "10.0.0.20")
+		storage := p.AddBlockStorage("pv-data", 20)
+		if c.server != "" {
+			p.AssignStorageAndWait(context.Background(), storage.Id, c.server)
+		}
+		if c.fault != nil {
+			p.InjectFault(fake.OpGetBlockstorage, fake.Fault{Err: c.fault})
+		}
+
+		ds, err := vp.IsAttached(fmt.Sprintf(`{"storageID":"%s","storageName":"pv-data"}`, storage.Id), "10.0.0.10")
+		if c.expectedError {
+			if err == nil {
+				t.Errorf("%s: expected error checking the attachment", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: an error ocurred checking the attachment %s", c.name, err)
+			continue
+		}
+		if ds.Attached != c.expectedAttached {
+			t.Errorf("%s: expected attached %t but got %t", c.name, c.expectedAttached, ds.Attached)
+		}
+	}
+}
+
+func TestExpandVolume(t *testing.T) {
+	cases := []struct {
+		name            string
+		newSize         int64
+		expectedSize    int
+		expectedResizes int
+	}{
+		{"rounded up to the next GB", 21*gigabyte + 1, 22, 1},
+		{"whole GB", 30 * gigabyte, 30, 1},
+		{"already large enough", 10 * gigabyte, 20, 0},
+		{"same size", 20 * gigabyte, 20, 0},
+	}
+
+	for _, c := range cases {
+		vp, p, _ := newTestPlugin()
+		storage := p.AddBlockStorage("pv-data", 20)
+
+		_, err := vp.ExpandVolume(fmt.Sprintf(`{"storageID":"%s","storageName":"pv-data"}`, storage.Id), c.newSize, 20*gigabyte)
+		if err != nil {
+			t.Errorf("%s: an error ocurred expanding the volume %s", c.name, err)
+			continue
+		}
+		if resizes := p.Calls(fake.OpResizeStorageAndWait); resizes != c.expectedResizes {
+			t.Errorf("%s: expected %d resizes but got %d", c.name, c.expectedResizes, resizes)
+		}
+		if s, _ := p.GetBlockstorage(context.Background(), storage.Id); s.Size != c.expectedSize {
+			t.Errorf("%s: expected the storage to be %d GB but got %d", c.name, c.expectedSize, s.Size)
+		}
+	}
+}
+
+func TestSharedStorageRights(t *testing.T) {
+	vp, p, _ := newTestPlugin()
+	shared := p.AddSharedStorage("pv-shared", 50)
+	mountdir := "/mnt/pv-shared"
+
+	for _, c := range []struct {
+		rw     string
+		rights string
+	}{
+		{"ro", cloud.SharedStorageReadOnly},
+		{"rw", cloud.SharedStorageReadWrite},
+	} {
+		options := fmt.Sprintf(`{"kubernetes.io/readwrite":"%s","type":"shared","storageID":"%s","storageName":"pv-shared"}`, c.rw, shared.Id)
+		if _, err := vp.MountDevice(mountdir, "pv-shared", options); err != nil {
+			t.Fatalf("an error ocurred mounting the shared storage %s: %s", c.rw, err)
+		}
+		s, _ := p.GetSharedStorage(context.Background(), shared.Id)
+		if len(s.Servers) != 1 || s.Servers[0].Rights != c.rights {
+			t.Errorf("expected server01 to have %s access but got %+v", c.rights, s.Servers)
+		}
+	}
+}
+
+func TestSharedStorageCredentials(t *testing.T) {
+	vp, p, m := newTestPlugin()
+	shared := p.AddSharedStorage("pv-shared", 50)
+	options := fmt.Sprintf(`{"type":"shared","storageID":"%s","storageName":"pv-shared"}`, shared.Id)
+	mountdir := "/mnt/pv-shared"
+
+	p.SetSharedStorageAccess(oneandone.SharedStorageAccess{State: fake.StateActive, SiteId: shared.SiteId, UserDomain: "user0001", NeedsPasswordReset: 1})
+	if _, err := vp.MountDevice(mountdir, "pv-shared", options); err == nil {
+		t.Errorf("expected error mounting with credentials that need a password reset")
+	}
+	if _, ok := m.mounts[mountdir]; ok {
+		t.Errorf("expected nothing mounted at %s", mountdir)
+	}
+
+	p.SetSharedStorageAccess(oneandone.SharedStorageAccess{State: fake.StateActive, SiteId: shared.SiteId, UserDomain: "user0001"})
+	if _, err := vp.MountDevice(mountdir, "pv-shared", options); err != nil {
+		t.Fatalf("an error ocurred mounting the shared storage %s", err)
+	}
+	if source := m.mounts[mountdir]; source != shared.NfsPath {
+		t.Errorf("expected %s mounted at %s but got %q", shared.NfsPath, mountdir, source)
+	}
+}
+
+func TestResizeCommand(t *testing.T) {
+	cases := []struct {
+		format        string
+		expectedArgs  []string
+		expectedError bool
+	}{
+		{"ext4", []string{"resize2fs", "/dev/sdb"}, false},
+		{"ext3", []string{"resize2fs", "/dev/sdb"}, false},
+		{"xfs", []string{"xfs_growfs", "/mnt/pv-data"}, false},
+		{"btrfs", []string{"btrfs", "filesystem", "resize", "max", "/mnt/pv-data"}, false},
+		{"vfat", nil, true},
+		{"", nil, true},
+	}
+
+	for _, c := range cases {
+		cmd, err := resizeCommand(c.format, "/dev/sdb", "/mnt/pv-data")
+		if c.expectedError {
+			if err == nil {
+				t.Errorf("expected error resizing a %q filesystem", c.format)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("an error ocurred resizing a %q filesystem: %s", c.format, err)
+			continue
+		}
+		if !reflect.DeepEqual(cmd.Args, c.expectedArgs) {
+			t.Errorf("expected %q filesystem resized with %v but got %v", c.format, c.expectedArgs, cmd.Args)
+		}
+	}
+}
+
+func TestNodeMounter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fm := mountfake.NewMounter()
+	n := NewNodeMounter(fm, mount.BusyFail)
+	target := filepath.Join(dir, "shared")
+
+	if err := n.Mount("10.0.0.1:/snas/shared", target, "nfs", []string{"hard"}); err != nil {
+		t.Fatalf("an error ocurred mounting %s", err)
+	}
+	if err := n.Mount("10.0.0.1:/snas/shared", target, "nfs", []string{"hard"}); err != nil {
+		t.Fatalf("an error ocurred mounting again %s", err)
+	}
+	if mounts, _ := mount.MountsAtPath(fm, target); len(mounts) != 1 {
+		t.Errorf("expected a single mount at %s but got %+v", target, mounts)
+	}
+
+	if err := n.Unmount(target); err != nil {
+		t.Fatalf("an error ocurred unmounting %s", err)
+	}
+	if mounted, _ := mount.IsMountPoint(fm, target); mounted {
+		t.Errorf("expected %s to be unmounted", target)
+	}
+	if err := n.Unmount(target); err != nil {
+		t.Errorf("expected unmounting twice to succeed but got %s", err)
+	}
+	if _, err := os.Stat(target); !os.IsNotExist(err) {
+		t.Errorf("expected the empty directory %s to be removed", target)
+	}
+
+	// files written below the mount point while nothing was mounted are kept
+	if err := n.Mount("10.0.0.1:/snas/shared", target, "nfs", []string{"hard"}); err != nil {
+		t.Fatalf("an error ocurred mounting %s", err)
+	}
+	ioutil.WriteFile(filepath.Join(target, "data"), []byte("data"), 0644)
+	if err := n.Unmount(target); err == nil {
+		t.Errorf("expected error removing a directory that is not empty")
+	}
+	if _, err := os.Stat(filepath.Join(target, "data")); err != nil {
+		t.Errorf("expected the data below %s to be kept", target)
+	}
+}
+
+func TestLockKeys(t *testing.T) {
+	vp, _, _ := newTestPlugin()
+	options := `{"storageID":"0123","storageName":"pv-data"}`
+	mountdir := "/var/lib/kubelet/plugins/kubernetes.io/flexvolume/oneandone/mounts/pv-data"
+
+	cases := []struct {
+		first, second []string
+	}{
+		{vp.LockKeys("attach", "", "", options), vp.LockKeys("detach", "pv-data", "", "")},
+		{vp.LockKeys("mountdevice", "pv-data", mountdir, options), vp.LockKeys("unmountdevice", mountdir+"/", "", "")},
+		{vp.LockKeys("expandfs", "pv-data", mountdir, options), vp.LockKeys("attach", "", "", `{"storageID":"0123"}`)},
+	}
+
+	for _, c := range cases {
+		shared := false
+		for _, a := range c.first {
+			for _, b := range c.second {
+				shared = shared || a == b
+			}
+		}
+		if !shared {
+			t.Errorf("expected %v and %v to share a key", c.first, c.second)
+		}
+	}
+}
+
+// newRecoveryPlugin returns a plugin journaling in dir whose storage has
+// the file dir/sdb as its disk, whose WWID is the UUID of the storage
+func newRecoveryPlugin(t *testing.T, dir string) (*VolumePlugin, *fake.Provider, *fakeMounter, *oneandone.BlockStorage, string) {
+	vp, p, m := newTestPlugin()
+	vp.journal = journal.New(filepath.Join(dir, "journal"))
+	device := filepath.Join(dir, "sdb")
+	ioutil.WriteFile(device, bytes.Repeat([]byte{0xff}, 4096), 0644)
+	vp.waitForDevice = func(uuid string) (string, error) { return device, nil }
+
+	storage := p.AddBlockStorage("pv-data", 20)
+	probe.SysBlockPath = filepath.Join(dir, "sys/block")
+	wwid := filepath.Join(probe.SysBlockPath, "sdb", "device", "wwid")
+	os.MkdirAll(filepath.Dir(wwid), 0755)
+	ioutil.WriteFile(wwid, []byte("naa."+storage.UUID+"\n"), 0644)
+
+	options := fmt.Sprintf(`{"storageID":"%s","storageName":"pv-data"}`, storage.Id)
+	if _, err := vp.MountDevice("/mnt/pv-data", "pv-data", options); err != nil {
+		t.Fatalf("an error ocurred mounting the device: %s", err)
+	}
+	if pending, _ := vp.Pending(); len(pending) != 0 {
+		t.Fatalf("expected nothing pending after mounting but got %v", pending)
+	}
+	return vp, p, m, storage, device
+}
+
+func TestRecoverMountDevice(t *testing.T) {
+	defer func(path string) { probe.SysBlockPath = path }(probe.SysBlockPath)
+	mountdir := "/mnt/pv-data"
+	cases := []struct {
+		phase            string
+		wwid             string
+		expectedError    bool
+		expectedWiped    bool
+		expectedAttached bool
+	}{
+		// nothing was done on the node yet
+		{phaseAttach, "", false, false, true},
+		{phaseFormat, "", false, true, false},
+		// the name of the disk now belongs to another storage
+		{phaseFormat, "naa.600144f0000000000000000000000099", true, false, true},
+		{phaseMount, "", false, false, false},
+	}
+
+	for _, c := range cases {
+		dir, err := ioutil.TempDir("", "plugin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		vp, p, m, storage, device := newRecoveryPlugin(t, dir)
+		if c.wwid != "" {
+			ioutil.WriteFile(filepath.Join(probe.SysBlockPath, "sdb", "device", "wwid"), []byte(c.wwid+"\n"), 0644)
+		}
+
+		// a process killed at the phase leaves its entry behind
+		killed := &journal.Entry{Operation: opMountDevice, StorageID: storage.Id, MountDir: mountdir, UUID: storage.UUID}
+		if c.phase == phaseFormat {
+			killed.Device = device
+		}
+		vp.journal.Begin(killed, c.phase)
+		pending, err := vp.Pending()
+		if err != nil || len(pending) != 1 {
+			t.Fatalf("%s: expected the killed operation to be pending but got %v %v", c.phase, pending, err)
+		}
+
+		err = vp.Recover(pending[0])
+		if c.expectedError {
+			if err == nil {
+				t.Errorf("%s: expected error recovering", c.phase)
+			}
+			if pending, _ := vp.Pending(); len(pending) != 1 {
+				t.Errorf("%s: expected the entry to be kept but got %v", c.phase, pending)
+			}
+		} else {
+			if err != nil {
+				t.Errorf("%s: an error ocurred recovering %s", c.phase, err)
+			}
+			if pending, _ := vp.Pending(); len(pending) != 0 {
+				t.Errorf("%s: expected nothing pending after recovering but got %v", c.phase, pending)
+			}
+		}
+
+		b, _ := ioutil.ReadFile(device)
+		if wiped := bytes.Equal(b, make([]byte, 4096)); wiped != c.expectedWiped {
+			t.Errorf("%s: expected the device wiped %t but got %t", c.phase, c.expectedWiped, wiped)
+		}
+		if _, ok := m.mounts[mountdir]; ok != c.expectedAttached {
+			t.Errorf("%s: expected %s mounted %t but got %t", c.phase, mountdir, c.expectedAttached, ok)
+		}
+		if s, _ := p.GetBlockstorage(context.Background(), storage.Id); (s.Server != nil) != c.expectedAttached {
+			t.Errorf("%s: expected the storage attached %t but got %+v", c.phase, c.expectedAttached, s.Server)
+		}
+	}
+}
+
+func TestRecoverUnmountDevice(t *testing.T) {
+	defer func(path string) { probe.SysBlockPath = path }(probe.SysBlockPath)
+	dir, err := ioutil.TempDir("", "plugin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	vp, p, m, storage, _ := newRecoveryPlugin(t, dir)
+
+	// an unmountdevice killed before the detach is finished
+	killed := &journal.Entry{Operation: opUnmountDevice, StorageID: storage.Id, Device: "/mnt/pv-data"}
+	vp.journal.Begin(killed, phaseDetach)
+	if err := vp.Recover(*killed); err != nil {
+		t.Fatalf("an error ocurred recovering %s", err)
+	}
+	if s, _ := p.GetBlockstorage(context.Background(), storage.Id); s.Server != nil || len(m.mounts) != 0 {
+		t.Errorf("expected the storage to be unmounted and detached")
+	}
+
+	if err := vp.Recover(journal.Entry{Operation: "attach"}); err == nil {
+		t.Errorf("expected error recovering an unknown operation")
+	}
+}
@@ -0,0 +1,85 @@
+package plugin
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/1and1/oneandone-flex-volume/helper"
+	"github.com/1and1/oneandone-flex-volume/pkg/flex"
+	"github.com/1and1/oneandone-flex-volume/pkg/oneandone/cloud"
+)
+
+// Provision creates a block storage for a new volume
+func (v *VolumePlugin) Provision(options string) (*flex.DriverStatus, error) {
+	ctx, cancel := v.commandContext()
+	defer cancel()
+
+	opt, err := v.newOptions(options)
+	if err != nil {
+		return nil, err
+	}
+	if v, err = v.forVolume(opt.ApiKey); err != nil {
+		return nil, err
+	}
+
+	size, err := strconv.Atoi(opt.Size)
+	if err != nil {
+		return nil, fmt.Errorf("1&1 volume needs a numeric size property at flex options: %s", err.Error())
+	}
+
+	storage, err := cloud.NewProvisioner(v.manager).Provision(ctx, &cloud.ProvisionOptions{
+		Size:           size,
+		DatacenterID:   opt.DatacenterID,
+		ExecutionGroup: opt.ExecutionGroup,
+		NameTemplate:   opt.NameTemplate,
+		PVName:         opt.PVorVolumeName,
+		PVCName:        opt.PVCName,
+		PVCNamespace:   opt.PVCNamespace,
+	})
+	if err != nil {
+		helper.DebugFile(fmt.Sprintf("Provision failure %s", err.Error()))
+		return nil, err
+	}
+
+	r := &flex.DriverStatus{
+		Status:     flex.StatusSuccess,
+		VolumeName: storage.Name,
+		Options: map[string]string{
+			"storageID":   storage.Id,
+			"storageName": storage.Name,
+		},
+	}
+	// the node commands of the volume use the same storage class profile
+	if opt.StorageClass != "" {
+		r.Options["storageClass"] = opt.StorageClass
+	}
+	return r, nil
+}
+
+// Delete removes the block storage of a released volume
+func (v *VolumePlugin) Delete(options string) (*flex.DriverStatus, error) {
+	ctx, cancel := v.commandContext()
+	defer cancel()
+
+	opt, err := v.newOptions(options)
+	if err != nil {
+		return nil, err
+	}
+	if v, err = v.forVolume(opt.ApiKey); err != nil {
+		return nil, err
+	}
+
+	if opt.StorageID == "" {
+		return nil, fmt.Errorf("1&1 volume needs StorageID property at flex options")
+	}
+
+	err = cloud.NewProvisioner(v.manager).Delete(ctx, opt.StorageID, cloud.ReclaimPolicy(opt.ReclaimPolicy))
+	if err != nil {
+		helper.DebugFile(fmt.Sprintf("Delete failure %s", err.Error()))
+		return nil, err
+	}
+
+	return &flex.DriverStatus{
+		Status: flex.StatusSuccess,
+	}, nil
+}
@@ -0,0 +1,128 @@
+package plugin
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/1and1/oneandone-cloudserver-sdk-go"
+	"github.com/1and1/oneandone-flex-volume/helper"
+	"github.com/1and1/oneandone-flex-volume/pkg/oneandone/cloud"
+)
+
+// DefaultVolumesDir keeps the records of the volumes attached and mounted by
+// the host, for the commands the kubelet calls without options
+const DefaultVolumesDir = "/var/lib/oneandone-flex-volume/volumes"
+
+// volumeRecord is what attach and mountdevice keep of a volume for detach
+// and unmountdevice, which only get its name or mount directory
+type volumeRecord struct {
+	// Type is the volume type, block or shared
+	Type string `json:"type"`
+	// StorageID is the block or shared storage of the volume
+	StorageID string `json:"storageID"`
+	// APIKey is the base64 encoded apiKey secret of the volume, if any
+	APIKey string `json:"apiKey,omitempty"`
+}
+
+// rememberVolume keeps the type, storage and apiKey secret of the volume
+// under the key, the volume name or mount directory
+func (v *VolumePlugin) rememberVolume(key string, opt *oneandoneOptions) error {
+	if v.volumesDir == "" || key == "" {
+		return nil
+	}
+	b, err := json.Marshal(volumeRecord{Type: opt.Type, StorageID: opt.StorageID, APIKey: opt.ApiKey})
+	if err != nil {
+		return fmt.Errorf("could not encode the record of %s: %s", key, err.Error())
+	}
+	if err := os.MkdirAll(v.volumesDir, 0700); err != nil {
+		return fmt.Errorf("could not create volume records directory %s: %s", v.volumesDir, err.Error())
+	}
+	if err := ioutil.WriteFile(v.recordPath(key), b, 0600); err != nil {
+		return fmt.Errorf("could not write the record of %s: %s", key, err.Error())
+	}
+	return nil
+}
+
+// recallVolume returns the record kept under the key, nil when there is
+// none, and a copy of the plugin using the apiKey secret of the record or
+// the global token
+func (v *VolumePlugin) recallVolume(key string) (*VolumePlugin, *volumeRecord, error) {
+	var record *volumeRecord
+	if v.volumesDir != "" {
+		b, err := ioutil.ReadFile(v.recordPath(key))
+		switch {
+		case os.IsNotExist(err):
+		case err != nil:
+			return nil, nil, fmt.Errorf("could not read the record of %s: %s", key, err.Error())
+		default:
+			record = &volumeRecord{}
+			if err := json.Unmarshal(b, record); err != nil {
+				return nil, nil, fmt.Errorf("could not parse the record of %s: %s", key, err.Error())
+			}
+		}
+	}
+
+	apiKey := ""
+	if record != nil {
+		apiKey = record.APIKey
+	}
+	c, err := v.forVolume(apiKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c, record, nil
+}
+
+// forgetVolume removes the record kept under the key
+func (v *VolumePlugin) forgetVolume(key string) {
+	if v.volumesDir == "" {
+		return
+	}
+	if err := os.Remove(v.recordPath(key)); err != nil && !os.IsNotExist(err) {
+		helper.DebugFile(fmt.Sprintf("could not remove the record of %s: %s", key, err.Error()))
+	}
+}
+
+// recordPath hashes the key, a volume name or mount directory, into a file
+// name
+func (v *VolumePlugin) recordPath(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(v.volumesDir, hex.EncodeToString(sum[:]))
+}
+
+// findVolume returns the block or the shared storage of the volume, by the
+// storage ID of its record or, for volumes without a record, by its name
+func (v *VolumePlugin) findVolume(ctx context.Context, name string, record *volumeRecord) (*oneandone.BlockStorage, *oneandone.SharedStorage, error) {
+	if record != nil {
+		if record.Type == volumeTypeShared {
+			shared, err := v.manager.GetSharedStorage(ctx, record.StorageID)
+			return nil, shared, err
+		}
+		storage, err := v.manager.GetBlockstorage(ctx, record.StorageID)
+		return storage, nil, err
+	}
+
+	storage, err := v.manager.GetBlockstorageByName(ctx, name)
+	if err == nil {
+		return storage, nil, nil
+	}
+	if !cloud.IsNotFound(err) {
+		return nil, nil, err
+	}
+	shared, serr := v.manager.GetSharedStorageByName(ctx, name)
+	if serr == nil {
+		return nil, shared, nil
+	}
+	if !cloud.IsNotFound(serr) || v.volumesDir == "" {
+		return nil, nil, err
+	}
+	// a volume with an apiKey secret is not found with the global token
+	// once its record is lost
+	return nil, nil, fmt.Errorf("%s, and there is no record of the volume in %s", err.Error(), v.volumesDir)
+}
@@ -0,0 +1,103 @@
+package plugin
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/1and1/oneandone-flex-volume/helper"
+	"github.com/1and1/oneandone-flex-volume/pkg/format"
+	"github.com/1and1/oneandone-flex-volume/pkg/journal"
+	"github.com/1and1/oneandone-flex-volume/pkg/luks"
+	"github.com/1and1/oneandone-flex-volume/pkg/scsi"
+)
+
+// Journaled operations
+const (
+	opMountDevice   = "mountdevice"
+	opUnmountDevice = "unmountdevice"
+)
+
+// Phases of the journaled operations
+const (
+	phaseAttach  = "attach"
+	phaseFormat  = "format"
+	phaseMount   = "mount"
+	phaseUnmount = "unmount"
+	phaseClose   = "close"
+	phaseDetach  = "detach"
+)
+
+// journalFormat records the format phase with the device when it is about
+// to be formatted, the mount phase otherwise
+func (v *VolumePlugin) journalFormat(entry *journal.Entry, device, fsType string, policy format.Policy) error {
+	result, err := v.probe(device)
+	if err == nil {
+		if needsFormat, err := format.Decide(device, result, fsType, policy); err == nil && needsFormat {
+			entry.Device = device
+			return v.journal.Phase(entry, phaseFormat)
+		}
+	}
+	return v.journal.Phase(entry, phaseMount)
+}
+
+// Pending returns the node operations a killed process left unfinished
+func (v *VolumePlugin) Pending() ([]journal.Entry, error) {
+	return v.journal.Pending()
+}
+
+// Recover undoes an unfinished mountdevice, the kubelet mounts the volume
+// again from scratch, and finishes an unfinished unmountdevice. A mountdevice
+// killed while attaching left nothing on the node to undo, the next one
+// picks the storage up as it is. A device killed while being formatted is
+// wiped first so it is formatted again rather than mounted half formatted.
+func (v *VolumePlugin) Recover(e journal.Entry) error {
+	switch e.Operation {
+	case opMountDevice:
+		if e.Phase == phaseAttach {
+			break
+		}
+		if e.Phase == phaseFormat && e.Device != "" {
+			if err := checkDevice(e); err != nil {
+				return err
+			}
+			helper.DebugFile(fmt.Sprintf("Wiping %s left half formatted", e.Device))
+			if err := format.Wipe(e.Device); err != nil {
+				return err
+			}
+		}
+		if _, err := v.UnmountDevice(e.MountDir); err != nil {
+			return err
+		}
+	case opUnmountDevice:
+		if _, err := v.UnmountDevice(e.Device); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown operation %q", e.Operation)
+	}
+	return v.journal.Done(&e)
+}
+
+// checkDevice makes sure the device of the entry is still the disk of its
+// storage before it is wiped, the kernel reuses the names of detached disks
+func checkDevice(e journal.Entry) error {
+	// the mapping is named after the storage
+	if e.Device == luks.MapperPath(mappingName(e.StorageID)) {
+		return nil
+	}
+	if e.UUID == "" {
+		return fmt.Errorf("not wiping %s, the journal does not tell the UUID of storage %s", e.Device, e.StorageID)
+	}
+	dev, err := filepath.EvalSymlinks(e.Device)
+	if err != nil {
+		return fmt.Errorf("not wiping %s, it could not be resolved: %s", e.Device, err.Error())
+	}
+	wwid, err := scsi.WWID(filepath.Base(dev))
+	if err != nil {
+		return fmt.Errorf("not wiping %s, its WWID could not be read: %s", e.Device, err.Error())
+	}
+	if !scsi.MatchesUUID(wwid, e.UUID) {
+		return fmt.Errorf("not wiping %s, its WWID %s is not storage %s", e.Device, wwid, e.StorageID)
+	}
+	return nil
+}
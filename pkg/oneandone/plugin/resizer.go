@@ -0,0 +1,147 @@
+package plugin
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/1and1/oneandone-flex-volume/helper"
+	"github.com/1and1/oneandone-flex-volume/pkg/flex"
+	"github.com/1and1/oneandone-flex-volume/pkg/luks"
+)
+
+// gigabyte is the allocation unit of 1&1 block storages
+const gigabyte = 1024 * 1024 * 1024
+
+// ExpandVolume grows the block storage to the new size
+func (v *VolumePlugin) ExpandVolume(options string, newSize, oldSize int64) (*flex.DriverStatus, error) {
+	ctx, cancel := v.commandContext()
+	defer cancel()
+
+	helper.DebugFile(fmt.Sprintf("Expanding volume from %d to %d bytes", oldSize, newSize))
+
+	opt, err := v.newOptions(options)
+	if err != nil {
+		return nil, err
+	}
+	if v, err = v.forVolume(opt.ApiKey); err != nil {
+		return nil, err
+	}
+
+	if opt.StorageID == "" {
+		return nil, fmt.Errorf("1&1 volume needs StorageID property at flex options")
+	}
+
+	storage, err := v.manager.GetBlockstorage(ctx, opt.StorageID)
+	if err != nil {
+		return nil, err
+	}
+
+	size := int((newSize + gigabyte - 1) / gigabyte)
+	if storage.Size < size {
+		if err := v.manager.ResizeStorageAndWait(ctx, storage.Id, size); err != nil {
+			helper.DebugFile(fmt.Sprintf("ResizeStorageAndWait failure %s", err.Error()))
+			return nil, err
+		}
+	}
+
+	return &flex.DriverStatus{
+		Status: flex.StatusSuccess,
+	}, nil
+}
+
+// ExpandFS grows the filesystem of an expanded volume on the node
+func (v *VolumePlugin) ExpandFS(options, device, mountdir string, newSize, oldSize int64) (*flex.DriverStatus, error) {
+	ctx, cancel := v.commandContext()
+	defer cancel()
+
+	helper.DebugFile(fmt.Sprintf("Expanding filesystem at %s", mountdir))
+
+	opt, err := v.newOptions(options)
+	if err != nil {
+		return nil, err
+	}
+	if v, err = v.forVolume(opt.ApiKey); err != nil {
+		return nil, err
+	}
+
+	if opt.StorageID == "" {
+		return nil, fmt.Errorf("1&1 volume needs StorageID property at flex options")
+	}
+
+	storage, err := v.manager.GetBlockstorage(ctx, opt.StorageID)
+	if err != nil {
+		return nil, err
+	}
+
+	devicePath, err := v.waitForDevice(storage.UUID)
+	if err != nil {
+		return nil, err
+	}
+	if err := v.rescanDevice(devicePath); err != nil {
+		return nil, err
+	}
+
+	// encrypted volumes are resized through their mapping
+	name := mappingName(storage.Id)
+	open, err := v.crypt.IsOpen(name)
+	if err != nil {
+		return nil, err
+	}
+	if open {
+		key, err := v.passphrase(opt)
+		if err != nil {
+			return nil, err
+		}
+		if err := v.crypt.Resize(name, key); err != nil {
+			return nil, err
+		}
+		devicePath = luks.MapperPath(name)
+	}
+
+	if opt.VolumeMode == volumeModeBlock {
+		return &flex.DriverStatus{
+			Status: flex.StatusSuccess,
+		}, nil
+	}
+
+	if err := v.resizeFilesystem(devicePath, mountdir); err != nil {
+		return nil, err
+	}
+
+	return &flex.DriverStatus{
+		Status: flex.StatusSuccess,
+	}, nil
+}
+
+// resizeFilesystem grows the mounted filesystem to fill the device
+func (v *VolumePlugin) resizeFilesystem(devicePath, mountdir string) error {
+	result, err := v.probe(devicePath)
+	if err != nil {
+		return err
+	}
+
+	resizeCmd, err := resizeCommand(result.Type, devicePath, mountdir)
+	if err != nil {
+		return err
+	}
+	if out, err := resizeCmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s failed with error [%s] and output [%s]", strings.Join(resizeCmd.Args, " "), err.Error(), string(out))
+	}
+	return nil
+}
+
+// resizeCommand returns the command growing the filesystem mounted at
+// mountdir online
+func resizeCommand(format, devicePath, mountdir string) (*exec.Cmd, error) {
+	switch {
+	case strings.HasPrefix(format, "ext"):
+		return exec.Command("resize2fs", devicePath), nil
+	case format == "xfs":
+		return exec.Command("xfs_growfs", mountdir), nil
+	case format == "btrfs":
+		return exec.Command("btrfs", "filesystem", "resize", "max", mountdir), nil
+	default:
+		return nil, fmt.Errorf("online resize of filesystem %q on device %s is not supported", format, devicePath)
+	}
+}
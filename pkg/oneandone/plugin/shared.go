@@ -0,0 +1,99 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/1and1/oneandone-cloudserver-sdk-go"
+	"github.com/1and1/oneandone-flex-volume/helper"
+	"github.com/1and1/oneandone-flex-volume/pkg/flex"
+	"github.com/1and1/oneandone-flex-volume/pkg/oneandone/cloud"
+)
+
+// defaultNFSOptions are used when the volume sets no nfsOptions
+const defaultNFSOptions = "hard,nfsvers=3"
+
+// mountShared grants the server access to the shared storage and mounts it over NFS
+func (v *VolumePlugin) mountShared(ctx context.Context, mountdir, serverID string, opt *oneandoneOptions) error {
+	storage, err := v.manager.GetSharedStorage(ctx, opt.StorageID)
+	if err != nil {
+		return err
+	}
+
+	if storage.NfsPath == "" {
+		return fmt.Errorf("shared storage %s has no NFS path", storage.Id)
+	}
+
+	rights := cloud.SharedStorageReadWrite
+	if opt.RW == "ro" {
+		rights = cloud.SharedStorageReadOnly
+	}
+
+	if err := v.manager.GrantSharedStorageAccessAndWait(ctx, storage.Id, serverID, rights); err != nil {
+		helper.DebugFile(fmt.Sprintf("GrantSharedStorageAccessAndWait failure %s", err.Error()))
+		return err
+	}
+
+	access, err := v.manager.GetSharedStorageCredentials(ctx, storage)
+	if err != nil {
+		return err
+	}
+	if access.NeedsPasswordReset != 0 {
+		return fmt.Errorf("shared storage access of user %s needs a password reset before mounting", access.UserDomain)
+	}
+	if access.State != "ACTIVE" {
+		return fmt.Errorf("shared storage access of user %s is %s", access.UserDomain, access.State)
+	}
+
+	options, err := opt.mountOptions()
+	if err != nil {
+		return err
+	}
+
+	return v.mounter.Mount(storage.NfsPath, mountdir, "nfs", options)
+}
+
+// unmountShared unmounts the shared storage and revokes the server access
+func (v *VolumePlugin) unmountShared(ctx context.Context, mountdir string, storage *oneandone.SharedStorage) error {
+	if err := v.mounter.Unmount(mountdir); err != nil {
+		helper.DebugFile(fmt.Sprintf("Unmount failure %s", err.Error()))
+		return err
+	}
+
+	serverID, err := v.getServerID()
+	if err != nil {
+		return err
+	}
+
+	if hasSharedAccess(storage, serverID) {
+		if err := v.manager.RevokeSharedStorageAccessAndWait(ctx, storage.Id, serverID); err != nil {
+			helper.DebugFile(fmt.Sprintf("RevokeSharedStorageAccessAndWait failure %s", err.Error()))
+			return err
+		}
+	}
+	return nil
+}
+
+// detachShared revokes the server access to the shared storage
+func (v *VolumePlugin) detachShared(ctx context.Context, storage *oneandone.SharedStorage, serverID string) (*flex.DriverStatus, error) {
+	if hasSharedAccess(storage, serverID) {
+		if err := v.manager.RevokeSharedStorageAccessAndWait(ctx, storage.Id, serverID); err != nil {
+			helper.DebugFile(fmt.Sprintf("RevokeSharedStorageAccessAndWait failure %s", err.Error()))
+			return nil, err
+		}
+	}
+
+	return &flex.DriverStatus{
+		Status: flex.StatusSuccess,
+	}, nil
+}
+
+// hasSharedAccess checks whether the server has been granted access to the shared storage
+func hasSharedAccess(storage *oneandone.SharedStorage, serverID string) bool {
+	for _, s := range storage.Servers {
+		if s.Id == serverID {
+			return true
+		}
+	}
+	return false
+}
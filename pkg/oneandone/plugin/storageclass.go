@@ -0,0 +1,34 @@
+package plugin
+
+import "fmt"
+
+// DefaultFsType is the filesystem of volumes that name none when the
+// driver config sets no default either
+const DefaultFsType = "ext4"
+
+// StorageClass is a profile of the driver config a volume selects with the
+// storageClass option. It fills the options the volume leaves empty.
+type StorageClass struct {
+	// FsType is the filesystem volumes are formatted with
+	FsType string `json:"fsType,omitempty"`
+	// FormatPolicy tells which devices may be formatted
+	FormatPolicy string `json:"formatPolicy,omitempty"`
+	// MkfsOptions are passed to mkfs, the volume mkfsOptions replace them
+	MkfsOptions string `json:"mkfsOptions,omitempty"`
+	// MountFlags are the mount options of the volumes, the volume
+	// mountFlags replace them
+	MountFlags string `json:"mountFlags,omitempty"`
+}
+
+// StorageClasses are the storage class profiles by name
+type StorageClasses map[string]StorageClass
+
+// Get returns the profile of the storage class, an error when the driver
+// config has none of that name
+func (s StorageClasses) Get(name string) (StorageClass, error) {
+	class, ok := s[name]
+	if !ok {
+		return StorageClass{}, fmt.Errorf("unknown storage class %q, it is not in the driver config", name)
+	}
+	return class, nil
+}
@@ -0,0 +1,168 @@
+/*
+Package probe identifies what a block device holds by reading the on-disk
+signatures of filesystems, partition tables, RAID, LVM and LUKS headers, and
+lists the block devices of the host from sysfs, without calling blkid or lsblk.
+*/
+package probe
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Usages of the detected signature
+const (
+	UsageFilesystem     = "filesystem"
+	UsageCrypto         = "crypto"
+	UsageRaid           = "raid"
+	UsagePartitionTable = "partition_table"
+	UsageOther          = "other"
+)
+
+// emptyCheckSize is how much of the start and the end of a device must be
+// zeroed for the device to count as empty
+const emptyCheckSize = 1 << 20
+
+// Result describes the contents of a device
+type Result struct {
+	// Type names the signature found, such as ext4, xfs, crypto_LUKS or gpt
+	Type string
+	// Usage is the kind of signature, empty when none was found
+	Usage string
+	// UUID identifies the filesystem, volume or partition table
+	UUID string
+	// Label is the name given to the filesystem or volume
+	Label string
+	// Size of the device in bytes
+	Size int64
+	// Empty tells whether no signature was found and the start and the end
+	// of the device are zeroed
+	Empty bool
+}
+
+// String describes the result for error messages
+func (r *Result) String() string {
+	switch {
+	case r.Type != "":
+		return fmt.Sprintf("a %s %s signature", r.Type, r.Usage)
+	case r.Empty:
+		return "no data"
+	default:
+		return "unrecognized data"
+	}
+}
+
+// signature detects one type of contents
+type signature struct {
+	name  string
+	usage string
+	probe func(r io.ReaderAt, size int64) bool
+	// identify fills in the type version, UUID and label
+	identify func(r io.ReaderAt, size int64, result *Result)
+}
+
+// signatures are tried in order, so filesystems and headers come before the
+// partition tables whose magic they may also carry
+var signatures = []signature{
+	{"crypto_LUKS", UsageCrypto, magicAt(0, []byte("LUKS\xba\xbe")), identifyLUKS},
+	{"LVM2_member", UsageRaid, isLVM2, identifyLVM2},
+	{"linux_raid_member", UsageRaid, isMDRaid, identifyMDRaid},
+	{"xfs", UsageFilesystem, magicAt(0, []byte("XFSB")), identifyXFS},
+	{"btrfs", UsageFilesystem, magicAt(0x10040, []byte("_BHRfS_M")), identifyBtrfs},
+	{"ext", UsageFilesystem, magicAt(0x438, []byte{0x53, 0xef}), identifyExt},
+	{"swap", UsageOther, isSwap, identifySwap},
+	{"gpt", UsagePartitionTable, magicAt(512, []byte("EFI PART")), identifyGPT},
+	{"dos", UsagePartitionTable, magicAt(510, []byte{0x55, 0xaa}), identifyDOS},
+}
+
+// Probe identifies the contents of the device or image file at path
+func Probe(path string) (*Result, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open %s: %s", path, err.Error())
+	}
+	defer f.Close()
+
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, fmt.Errorf("could not get the size of %s: %s", path, err.Error())
+	}
+
+	result, err := ProbeReader(f, size)
+	if err != nil {
+		return nil, fmt.Errorf("could not probe %s: %s", path, err.Error())
+	}
+	return result, nil
+}
+
+// ProbeReader identifies the contents of size bytes read from r
+func ProbeReader(r io.ReaderAt, size int64) (*Result, error) {
+	for _, s := range signatures {
+		if s.probe(r, size) {
+			result := &Result{Type: s.name, Usage: s.usage, Size: size}
+			s.identify(r, size, result)
+			return result, nil
+		}
+	}
+
+	empty, err := isZeroed(r, size)
+	if err != nil {
+		return nil, err
+	}
+	return &Result{Size: size, Empty: empty}, nil
+}
+
+// readAt reads n bytes at off, nil when the device is too small
+func readAt(r io.ReaderAt, off int64, n int) []byte {
+	buf := make([]byte, n)
+	if _, err := r.ReadAt(buf, off); err != nil {
+		return nil
+	}
+	return buf
+}
+
+func magicAt(off int64, magic []byte) func(io.ReaderAt, int64) bool {
+	return func(r io.ReaderAt, size int64) bool {
+		return bytes.Equal(readAt(r, off, len(magic)), magic)
+	}
+}
+
+// isZeroed tells whether the start and the end of the device hold only zeros
+func isZeroed(r io.ReaderAt, size int64) (bool, error) {
+	ranges := [][2]int64{{0, minInt64(size, emptyCheckSize)}}
+	if size > emptyCheckSize {
+		ranges = append(ranges, [2]int64{maxInt64(emptyCheckSize, size-emptyCheckSize), size})
+	}
+
+	buf := make([]byte, 64<<10)
+	for _, rg := range ranges {
+		for off := rg[0]; off < rg[1]; off += int64(len(buf)) {
+			chunk := buf[:minInt64(int64(len(buf)), rg[1]-off)]
+			if _, err := r.ReadAt(chunk, off); err != nil && err != io.EOF {
+				return false, err
+			}
+			for _, b := range chunk {
+				if b != 0 {
+					return false, nil
+				}
+			}
+		}
+	}
+	return true, nil
+}
+
+func minInt64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
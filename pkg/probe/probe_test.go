@@ -0,0 +1,176 @@
+package probe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// image returns a zeroed image of size bytes with data written at offsets
+func image(size int64, data map[int64][]byte) []byte {
+	img := make([]byte, size)
+	for off, b := range data {
+		copy(img[off:], b)
+	}
+	return img
+}
+
+func le32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, v)
+	return b
+}
+
+func TestProbeReader(t *testing.T) {
+	const size = 4 << 20
+	cases := []struct {
+		name  string
+		img   []byte
+		typ   string
+		usage string
+		empty bool
+	}{
+		{"empty", image(size, nil), "", "", true},
+		{"data in the middle", image(size, map[int64][]byte{2 << 20: []byte("data")}), "", "", true},
+		{"unknown data", image(size, map[int64][]byte{100: []byte("data")}), "", "", false},
+		{"data at the end", image(size, map[int64][]byte{size - 1: {1}}), "", "", false},
+		{"ext2", image(size, map[int64][]byte{0x438: {0x53, 0xef}}), "ext2", UsageFilesystem, false},
+		{"ext3", image(size, map[int64][]byte{0x438: {0x53, 0xef}, 0x45c: le32(0x4)}), "ext3", UsageFilesystem, false},
+		{"ext4", image(size, map[int64][]byte{0x438: {0x53, 0xef}, 0x45c: le32(0x4), 0x460: le32(0x40)}), "ext4", UsageFilesystem, false},
+		{"xfs", image(size, map[int64][]byte{0: []byte("XFSB")}), "xfs", UsageFilesystem, false},
+		{"btrfs", image(size, map[int64][]byte{0x10040: []byte("_BHRfS_M")}), "btrfs", UsageFilesystem, false},
+		{"swap", image(size, map[int64][]byte{4086: []byte("SWAPSPACE2")}), "swap", UsageOther, false},
+		{"luks", image(size, map[int64][]byte{0: []byte("LUKS\xba\xbe")}), "crypto_LUKS", UsageCrypto, false},
+		{"lvm2", image(size, map[int64][]byte{512: []byte("LABELONE"), 536: []byte("LVM2 001")}), "LVM2_member", UsageRaid, false},
+		{"md 1.2", image(size, map[int64][]byte{4096: le32(0xa92b4efc)}), "linux_raid_member", UsageRaid, false},
+		{"md 0.90", image(size, map[int64][]byte{size - 64<<10: le32(0xa92b4efc)}), "linux_raid_member", UsageRaid, false},
+		{"gpt", image(size, map[int64][]byte{510: {0x55, 0xaa}, 512: []byte("EFI PART")}), "gpt", UsagePartitionTable, false},
+		{"mbr", image(size, map[int64][]byte{510: {0x55, 0xaa}}), "dos", UsagePartitionTable, false},
+	}
+
+	for _, c := range cases {
+		result, err := ProbeReader(bytes.NewReader(c.img), int64(len(c.img)))
+		if err != nil {
+			t.Errorf("%s: an error ocurred probing %s", c.name, err)
+			continue
+		}
+		if result.Type != c.typ || result.Usage != c.usage || result.Empty != c.empty {
+			t.Errorf("%s: expected %q %q empty %t but got %+v", c.name, c.typ, c.usage, c.empty, result)
+		}
+	}
+}
+
+func TestProbeImageFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "probe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Write(image(1<<20, map[int64][]byte{0: []byte("XFSB")}))
+	f.Close()
+
+	result, err := Probe(f.Name())
+	if err != nil {
+		t.Fatalf("an error ocurred probing %s", err)
+	}
+	if result.Type != "xfs" {
+		t.Errorf("expected xfs but got %+v", result)
+	}
+
+	if _, err := Probe(f.Name() + ".missing"); err == nil {
+		t.Errorf("expected an error probing a missing file")
+	}
+}
+
+func TestIdentify(t *testing.T) {
+	const size = 4 << 20
+	uuid := []byte{0x8a, 0x5c, 0x3e, 0x1f, 0x12, 0x34, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef, 0x01, 0x23, 0x45, 0x67}
+	const canonical = "8a5c3e1f-1234-4567-89ab-cdef01234567"
+
+	cases := []struct {
+		name  string
+		img   []byte
+		uuid  string
+		label string
+	}{
+		{"ext4", image(size, map[int64][]byte{0x438: {0x53, 0xef}, 0x460: le32(0x40), 0x468: uuid, 0x478: []byte("data")}), canonical, "data"},
+		{"xfs", image(size, map[int64][]byte{0: []byte("XFSB"), 32: uuid, 108: []byte("data")}), canonical, "data"},
+		{"btrfs", image(size, map[int64][]byte{0x10040: []byte("_BHRfS_M"), 0x10020: uuid, 0x1012b: []byte("data")}), canonical, "data"},
+		{"swap", image(size, map[int64][]byte{4086: []byte("SWAPSPACE2"), 1036: uuid, 1052: []byte("swap")}), canonical, "swap"},
+		{"luks1", image(size, map[int64][]byte{0: []byte("LUKS\xba\xbe\x00\x01"), 168: []byte(canonical)}), canonical, ""},
+		{"luks2", image(size, map[int64][]byte{0: []byte("LUKS\xba\xbe\x00\x02"), 24: []byte("secret"), 168: []byte(canonical)}), canonical, "secret"},
+		{"lvm2", image(size, map[int64][]byte{512: []byte("LABELONE"), 532: le32(32), 536: []byte("LVM2 001"), 544: []byte("Abcdef1234567890Abcdef1234567890")}), "Abcdef-1234-5678-90Ab-cdef-1234-567890", ""},
+		{"md 1.2", image(size, map[int64][]byte{4096: le32(0xa92b4efc), 4100: le32(1), 4112: uuid, 4128: []byte("node01:0")}), canonical, "node01:0"},
+		{"gpt", image(size, map[int64][]byte{510: {0x55, 0xaa}, 512: []byte("EFI PART"), 568: {0x1f, 0x3e, 0x5c, 0x8a, 0x34, 0x12, 0x67, 0x45, 0x89, 0xab, 0xcd, 0xef, 0x01, 0x23, 0x45, 0x67}}), canonical, ""},
+		{"dos", image(size, map[int64][]byte{440: le32(0x1234abcd), 510: {0x55, 0xaa}}), "1234abcd", ""},
+	}
+
+	for _, c := range cases {
+		result, err := ProbeReader(bytes.NewReader(c.img), size)
+		if err != nil {
+			t.Errorf("%s: an error ocurred probing %s", c.name, err)
+			continue
+		}
+		if result.UUID != c.uuid || result.Label != c.label || result.Size != size {
+			t.Errorf("%s: expected UUID %q label %q size %d but got %+v", c.name, c.uuid, c.label, size, result)
+		}
+	}
+}
+
+// TestMkfsImages compares the probe with blkid on images made by the
+// formatting tools installed on the host
+func TestMkfsImages(t *testing.T) {
+	blkid, err := exec.LookPath("blkid")
+	if err != nil {
+		t.Skip("blkid not found in PATH")
+	}
+
+	tools := []struct {
+		typ  string
+		args []string
+	}{
+		{"ext4", []string{"mkfs.ext4", "-q", "-F", "-L", "data"}},
+		{"ext3", []string{"mkfs.ext3", "-q", "-F", "-L", "data"}},
+		{"xfs", []string{"mkfs.xfs", "-q", "-f", "-L", "data"}},
+		{"btrfs", []string{"mkfs.btrfs", "-q", "-f", "-L", "data"}},
+		{"swap", []string{"mkswap", "-L", "data"}},
+	}
+
+	for _, tool := range tools {
+		if _, err := exec.LookPath(tool.args[0]); err != nil {
+			continue
+		}
+
+		f, err := ioutil.TempFile("", "probe")
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Truncate(300 << 20)
+		f.Close()
+		defer os.Remove(f.Name())
+
+		if out, err := exec.Command(tool.args[0], append(tool.args[1:], f.Name())...).CombinedOutput(); err != nil {
+			t.Errorf("%s failed with error [%s] and output [%s]", tool.args[0], err, string(out))
+			continue
+		}
+
+		result, err := Probe(f.Name())
+		if err != nil {
+			t.Errorf("%s: an error ocurred probing %s", tool.typ, err)
+			continue
+		}
+
+		out, err := exec.Command(blkid, "-o", "value", "-s", "UUID", f.Name()).Output()
+		if err != nil {
+			t.Errorf("%s: blkid failed %s", tool.typ, err)
+			continue
+		}
+		if uuid := strings.TrimSpace(string(out)); result.Type != tool.typ || result.Label != "data" || result.UUID != uuid {
+			t.Errorf("%s: expected UUID %s and label data but got %+v", tool.typ, uuid, result)
+		}
+	}
+}
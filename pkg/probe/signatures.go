@@ -0,0 +1,223 @@
+package probe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const mdRaidMagic = 0xa92b4efc
+
+// isLVM2 looks for the physical volume label in the first four sectors
+func isLVM2(r io.ReaderAt, size int64) bool {
+	return lvm2Label(r) >= 0
+}
+
+// lvm2Label returns the offset of the physical volume label, -1 if none
+func lvm2Label(r io.ReaderAt) int64 {
+	for sector := int64(0); sector < 4; sector++ {
+		label := readAt(r, sector*512, 32)
+		if label != nil && bytes.Equal(label[0:8], []byte("LABELONE")) && bytes.Equal(label[24:32], []byte("LVM2 001")) {
+			return sector * 512
+		}
+	}
+	return -1
+}
+
+// identifyLVM2 reads the physical volume UUID from the header the label
+// points to
+func identifyLVM2(r io.ReaderAt, size int64, result *Result) {
+	label := lvm2Label(r)
+	header := readAt(r, label+20, 4)
+	if header == nil {
+		return
+	}
+	id := readAt(r, label+int64(binary.LittleEndian.Uint32(header)), 32)
+	if id == nil {
+		return
+	}
+	// LVM prints its 32 characters IDs in groups of 6-4-4-4-4-4-6
+	groups := []int{6, 4, 4, 4, 4, 4, 6}
+	parts := []string{}
+	for _, n := range groups {
+		parts = append(parts, string(id[:n]))
+		id = id[n:]
+	}
+	result.UUID = strings.Join(parts, "-")
+}
+
+// isMDRaid looks for a version 1.x superblock at the start of the device or
+// a version 0.90 or 1.0 superblock at its end
+func isMDRaid(r io.ReaderAt, size int64) bool {
+	return mdRaidSuperblock(r, size) >= 0
+}
+
+// mdRaidSuperblock returns the offset of the RAID superblock, -1 if none
+func mdRaidSuperblock(r io.ReaderAt, size int64) int64 {
+	offsets := []int64{0, 4096}
+	if size >= 128<<10 {
+		offsets = append(offsets, (size&^(64<<10-1))-64<<10)
+	}
+	if size >= 8<<10 {
+		offsets = append(offsets, (size&^(4<<10-1))-8<<10)
+	}
+	for _, off := range offsets {
+		b := readAt(r, off, 4)
+		if b != nil && binary.LittleEndian.Uint32(b) == mdRaidMagic {
+			return off
+		}
+	}
+	return -1
+}
+
+// identifyMDRaid reads the array UUID and, for version 1.x, its name
+func identifyMDRaid(r io.ReaderAt, size int64, result *Result) {
+	sb := readAt(r, mdRaidSuperblock(r, size), 64)
+	if sb == nil {
+		return
+	}
+	if binary.LittleEndian.Uint32(sb[4:]) == 0 {
+		// version 0.90 splits the UUID in the words 5, 13, 14 and 15
+		uuid := append(append([]byte{}, sb[20:24]...), sb[52:64]...)
+		result.UUID = formatUUID(uuid)
+		return
+	}
+	result.UUID = formatUUID(sb[16:32])
+	result.Label = cString(sb[32:64])
+}
+
+// identifyLUKS reads the version, the UUID and, for LUKS2, the label
+func identifyLUKS(r io.ReaderAt, size int64, result *Result) {
+	hdr := readAt(r, 0, 208)
+	if hdr == nil {
+		return
+	}
+	result.UUID = cString(hdr[168:208])
+	if binary.BigEndian.Uint16(hdr[6:]) == 2 {
+		result.Label = cString(hdr[24:72])
+	}
+}
+
+// identifyXFS reads the UUID and the label of the primary superblock
+func identifyXFS(r io.ReaderAt, size int64, result *Result) {
+	sb := readAt(r, 0, 120)
+	if sb == nil {
+		return
+	}
+	result.UUID = formatUUID(sb[32:48])
+	result.Label = cString(sb[108:120])
+}
+
+// identifyBtrfs reads the filesystem UUID and the label
+func identifyBtrfs(r io.ReaderAt, size int64, result *Result) {
+	sb := readAt(r, 0x10000, 0x22b)
+	if sb == nil {
+		return
+	}
+	result.UUID = formatUUID(sb[0x20:0x30])
+	result.Label = cString(sb[0x12b:0x22b])
+}
+
+// identifyExt tells ext2, ext3 and ext4 apart from the superblock features
+// and reads the UUID and the label
+func identifyExt(r io.ReaderAt, size int64, result *Result) {
+	const (
+		compatHasJournal  = 0x4
+		incompatExtents   = 0x40
+		incompat64bit     = 0x80
+		incompatFlexBg    = 0x200
+		roCompatHugeFile  = 0x8
+		roCompatGdtCsum   = 0x10
+		roCompatDirNlink  = 0x20
+		roCompatExtraSize = 0x40
+	)
+	result.Type = "ext2"
+	sb := readAt(r, 1024, 0x88)
+	if sb == nil {
+		return
+	}
+	compat := binary.LittleEndian.Uint32(sb[0x5c:])
+	incompat := binary.LittleEndian.Uint32(sb[0x60:])
+	roCompat := binary.LittleEndian.Uint32(sb[0x64:])
+
+	switch {
+	case incompat&(incompatExtents|incompat64bit|incompatFlexBg) != 0,
+		roCompat&(roCompatHugeFile|roCompatGdtCsum|roCompatDirNlink|roCompatExtraSize) != 0:
+		result.Type = "ext4"
+	case compat&compatHasJournal != 0:
+		result.Type = "ext3"
+	}
+	result.UUID = formatUUID(sb[0x68:0x78])
+	result.Label = cString(sb[0x78:0x88])
+}
+
+// swapPageSizes are the page sizes the swap signature is looked for at
+var swapPageSizes = []int64{4096, 8192, 16384, 65536}
+
+// isSwap looks for the swap signature at the end of the first page
+func isSwap(r io.ReaderAt, size int64) bool {
+	for _, page := range swapPageSizes {
+		magic := readAt(r, page-10, 10)
+		if bytes.Equal(magic, []byte("SWAPSPACE2")) || bytes.Equal(magic, []byte("SWAP-SPACE")) {
+			return true
+		}
+	}
+	return false
+}
+
+// identifySwap reads the UUID and the label of a version 1 swap header
+func identifySwap(r io.ReaderAt, size int64, result *Result) {
+	for _, page := range swapPageSizes {
+		if bytes.Equal(readAt(r, page-10, 10), []byte("SWAPSPACE2")) {
+			hdr := readAt(r, 1024, 44)
+			if hdr == nil {
+				return
+			}
+			result.UUID = formatUUID(hdr[12:28])
+			result.Label = cString(hdr[28:44])
+			return
+		}
+	}
+}
+
+// identifyGPT reads the disk GUID of the primary header
+func identifyGPT(r io.ReaderAt, size int64, result *Result) {
+	guid := readAt(r, 512+56, 16)
+	if guid == nil {
+		return
+	}
+	// the first three fields of a GUID are stored little endian
+	b := []byte{
+		guid[3], guid[2], guid[1], guid[0],
+		guid[5], guid[4],
+		guid[7], guid[6],
+	}
+	result.UUID = formatUUID(append(b, guid[8:]...))
+}
+
+// identifyDOS reads the disk signature of the master boot record
+func identifyDOS(r io.ReaderAt, size int64, result *Result) {
+	id := readAt(r, 440, 4)
+	if id == nil {
+		return
+	}
+	result.UUID = fmt.Sprintf("%08x", binary.LittleEndian.Uint32(id))
+}
+
+// formatUUID formats 16 bytes as a canonical UUID, empty when all zeros
+func formatUUID(b []byte) string {
+	if bytes.Equal(b, make([]byte, len(b))) {
+		return ""
+	}
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// cString returns the text of a NUL padded field
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(bytes.TrimSpace(b))
+}
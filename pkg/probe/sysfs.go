@@ -0,0 +1,128 @@
+package probe
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// SysBlockPath is where the kernel lists the block devices
+var SysBlockPath = "/sys/block"
+
+// DevPath is where the device nodes are created
+var DevPath = "/dev"
+
+// Block device types
+const (
+	TypeDisk = "disk"
+	TypePart = "part"
+	TypeROM  = "rom"
+	TypeLoop = "loop"
+)
+
+// scsiCDROMMajor is the major number of SCSI CD-ROM drives
+const scsiCDROMMajor = 11
+
+// BlockDevice is a disk or a partition known to the kernel
+type BlockDevice struct {
+	Name       string
+	Path       string
+	Type       string
+	Major      int
+	Minor      int
+	Size       int64
+	ReadOnly   bool
+	Partitions []BlockDevice
+	// Holders are the devices built on top of this one, such as device
+	// mapper targets
+	Holders []string
+}
+
+// ListBlockDevices lists the disks in sysfs with their partitions
+func ListBlockDevices() ([]BlockDevice, error) {
+	entries, err := ioutil.ReadDir(SysBlockPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not list block devices: %s", err.Error())
+	}
+
+	devices := []BlockDevice{}
+	for _, e := range entries {
+		dir := filepath.Join(SysBlockPath, e.Name())
+		device, err := readBlockDevice(dir, e.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case device.Major == scsiCDROMMajor:
+			device.Type = TypeROM
+		case strings.HasPrefix(device.Name, "loop"):
+			device.Type = TypeLoop
+		default:
+			device.Type = TypeDisk
+		}
+
+		parts, _ := ioutil.ReadDir(dir)
+		for _, p := range parts {
+			if _, err := os.Stat(filepath.Join(dir, p.Name(), "partition")); err != nil {
+				continue
+			}
+			part, err := readBlockDevice(filepath.Join(dir, p.Name()), p.Name())
+			if err != nil {
+				return nil, err
+			}
+			part.Type = TypePart
+			device.Partitions = append(device.Partitions, part)
+		}
+		devices = append(devices, device)
+	}
+	return devices, nil
+}
+
+// readBlockDevice reads the attributes of the device at the sysfs directory
+func readBlockDevice(dir, name string) (BlockDevice, error) {
+	device := BlockDevice{
+		Name: name,
+		Path: filepath.Join(DevPath, name),
+	}
+
+	dev, err := readAttribute(dir, "dev")
+	if err != nil {
+		return device, err
+	}
+	if _, err := fmt.Sscanf(dev, "%d:%d", &device.Major, &device.Minor); err != nil {
+		return device, fmt.Errorf("malformed device number %q of %s: %s", dev, name, err.Error())
+	}
+
+	// sysfs reports the size in 512 bytes sectors whatever the block size
+	size, err := readAttribute(dir, "size")
+	if err != nil {
+		return device, err
+	}
+	sectors, err := strconv.ParseInt(size, 10, 64)
+	if err != nil {
+		return device, fmt.Errorf("malformed size %q of %s: %s", size, name, err.Error())
+	}
+	device.Size = sectors * 512
+
+	if ro, err := readAttribute(dir, "ro"); err == nil {
+		device.ReadOnly = ro == "1"
+	}
+
+	holders, _ := ioutil.ReadDir(filepath.Join(dir, "holders"))
+	for _, h := range holders {
+		device.Holders = append(device.Holders, h.Name())
+	}
+	return device, nil
+}
+
+func readAttribute(dir, name string) (string, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return "", fmt.Errorf("could not read %s: %s", filepath.Join(dir, name), err.Error())
+	}
+	return strings.TrimSpace(string(b)), nil
+}
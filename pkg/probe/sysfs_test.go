@@ -0,0 +1,65 @@
+package probe
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// writeSysfs creates the attribute files of a fake sysfs tree
+func writeSysfs(t *testing.T, root string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestListBlockDevices(t *testing.T) {
+	root, err := ioutil.TempDir("", "sysfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	writeSysfs(t, root, map[string]string{
+		"sda/dev":             "8:0",
+		"sda/size":            "41943040",
+		"sda/ro":              "0",
+		"sda/sda1/dev":        "8:1",
+		"sda/sda1/size":       "2048",
+		"sda/sda1/partition":  "1",
+		"sdb/dev":             "8:16",
+		"sdb/size":            "20971520",
+		"sdb/holders/dm-0/.x": "",
+		"sr0/dev":             "11:0",
+		"sr0/size":            "2097152",
+		"sr0/ro":              "1",
+	})
+	defaultPath := SysBlockPath
+	defer func() { SysBlockPath = defaultPath }()
+	SysBlockPath = root
+
+	devices, err := ListBlockDevices()
+	if err != nil {
+		t.Fatalf("an error ocurred listing block devices %s", err)
+	}
+
+	expected := []BlockDevice{
+		{
+			Name: "sda", Path: "/dev/sda", Type: TypeDisk, Major: 8, Minor: 0, Size: 20 << 30,
+			Partitions: []BlockDevice{{Name: "sda1", Path: "/dev/sda1", Type: TypePart, Major: 8, Minor: 1, Size: 1 << 20}},
+		},
+		{Name: "sdb", Path: "/dev/sdb", Type: TypeDisk, Major: 8, Minor: 16, Size: 10 << 30, Holders: []string{"dm-0"}},
+		{Name: "sr0", Path: "/dev/sr0", Type: TypeROM, Major: 11, Minor: 0, Size: 1 << 30, ReadOnly: true},
+	}
+	if !reflect.DeepEqual(devices, expected) {
+		t.Errorf("expected %+v but got %+v", expected, devices)
+	}
+}
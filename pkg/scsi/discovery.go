@@ -0,0 +1,198 @@
+/*
+Package scsi finds the disks of attached block storages on the node by
+rescanning the SCSI hosts through sysfs and matching the disks' WWIDs.
+*/
+package scsi
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/1and1/oneandone-flex-volume/pkg/probe"
+)
+
+// SCSIHostPath is where the kernel lists the SCSI hosts
+var SCSIHostPath = "/sys/class/scsi_host"
+
+// DiskByIDPath is where udev links the disks by their identifiers
+var DiskByIDPath = "/dev/disk/by-id"
+
+// Discovery defaults
+const (
+	DefaultTimeout     = 60 * time.Second
+	DefaultInterval    = 250 * time.Millisecond
+	DefaultMaxInterval = 4 * time.Second
+)
+
+// wwidPrefixes are the designator types the kernel prefixes WWIDs with
+var wwidPrefixes = []string{"naa.", "eui.", "t10."}
+
+// Discoverer waits for the disk of a block storage to show up
+type Discoverer struct {
+	// Timeout is how long to wait for the disk
+	Timeout time.Duration
+	// Interval is the first delay between two looks, doubled up to
+	// MaxInterval after every miss
+	Interval    time.Duration
+	MaxInterval time.Duration
+	// Rescan asks the SCSI hosts to look for new disks
+	Rescan func() error
+	// sleep is replaced in tests
+	sleep func(time.Duration)
+}
+
+// NewDiscoverer returns a discoverer with the default timeout and backoff
+// rescanning the SCSI hosts of the node
+func NewDiscoverer() *Discoverer {
+	return &Discoverer{
+		Timeout:     DefaultTimeout,
+		Interval:    DefaultInterval,
+		MaxInterval: DefaultMaxInterval,
+		Rescan:      RescanHosts,
+		sleep:       time.Sleep,
+	}
+}
+
+// WaitForDevice rescans the SCSI hosts until the disk whose WWID matches the
+// storage UUID shows up and returns its path, the udev by-id link when it
+// already exists. On timeout the error reports what was seen.
+func (d *Discoverer) WaitForDevice(uuid string) (string, error) {
+	deadline := time.Now().Add(d.Timeout)
+	interval := d.Interval
+	var rescanErr error
+
+	for {
+		device, seen := find(uuid)
+		if device != "" {
+			return device, nil
+		}
+
+		if time.Now().Add(interval).After(deadline) {
+			msg := fmt.Sprintf("disk of storage %s did not show up within %s: %s", uuid, d.Timeout, seen)
+			if rescanErr != nil {
+				msg += fmt.Sprintf(", the last rescan failed: %s", rescanErr.Error())
+			}
+			return "", errors.New(msg)
+		}
+
+		if d.Rescan != nil {
+			rescanErr = d.Rescan()
+		}
+		d.sleep(interval)
+		if interval *= 2; interval > d.MaxInterval {
+			interval = d.MaxInterval
+		}
+	}
+}
+
+// ByIDPath returns the udev link of the disk with the storage UUID
+func ByIDPath(uuid string) string {
+	return filepath.Join(DiskByIDPath, "scsi-3"+uuid)
+}
+
+// find looks for the disk of the storage, describing what it saw when the
+// disk is not there
+func find(uuid string) (string, string) {
+	seen := []string{}
+
+	link := ByIDPath(uuid)
+	if target, err := filepath.EvalSymlinks(link); err == nil {
+		name := filepath.Base(target)
+		wwid, err := WWID(name)
+		if err == nil && MatchesUUID(wwid, uuid) {
+			return link, ""
+		}
+		if err != nil {
+			seen = append(seen, fmt.Sprintf("%s points to %s whose WWID could not be read: %s", link, name, err.Error()))
+		} else {
+			seen = append(seen, fmt.Sprintf("%s points to %s with WWID %s", link, name, wwid))
+		}
+	} else {
+		seen = append(seen, fmt.Sprintf("%s does not exist", link))
+	}
+
+	devices, err := probe.ListBlockDevices()
+	if err != nil {
+		return "", strings.Join(append(seen, err.Error()), ", ")
+	}
+	disks := []string{}
+	for _, dev := range devices {
+		if dev.Type != probe.TypeDisk {
+			continue
+		}
+		wwid, err := WWID(dev.Name)
+		if err != nil {
+			disks = append(disks, dev.Name+" (no WWID)")
+			continue
+		}
+		if MatchesUUID(wwid, uuid) {
+			// udev has not created the link yet
+			return dev.Path, ""
+		}
+		disks = append(disks, fmt.Sprintf("%s (%s)", dev.Name, wwid))
+	}
+
+	if len(disks) == 0 {
+		seen = append(seen, "no disks found")
+	} else {
+		seen = append(seen, "disks found: "+strings.Join(disks, ", "))
+	}
+	return "", strings.Join(seen, ", ")
+}
+
+// WWID reads the world wide identifier of the disk from sysfs
+func WWID(name string) (string, error) {
+	b, err := ioutil.ReadFile(filepath.Join(probe.SysBlockPath, name, "device", "wwid"))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// MatchesUUID tells whether the WWID identifies the storage UUID
+func MatchesUUID(wwid, uuid string) bool {
+	id := strings.ToLower(wwid)
+	for _, p := range wwidPrefixes {
+		id = strings.TrimPrefix(id, p)
+	}
+	return id != "" && id == strings.ToLower(strings.Replace(uuid, "-", "", -1))
+}
+
+// RescanHosts asks every SCSI host to scan all its channels, targets and
+// LUNs for new disks
+func RescanHosts() error {
+	hosts, err := ioutil.ReadDir(SCSIHostPath)
+	if err != nil {
+		return fmt.Errorf("could not list SCSI hosts: %s", err.Error())
+	}
+
+	failed := []string{}
+	for _, h := range hosts {
+		scan := filepath.Join(SCSIHostPath, h.Name(), "scan")
+		if err := ioutil.WriteFile(scan, []byte("- - -"), 0200); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", h.Name(), err.Error()))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("could not rescan SCSI hosts %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// RescanDevice asks the SCSI layer to re-read the capacity of the disk
+func RescanDevice(devicePath string) error {
+	dev, err := filepath.EvalSymlinks(devicePath)
+	if err != nil {
+		return fmt.Errorf("could not resolve device %s: %s", devicePath, err.Error())
+	}
+
+	rescan := filepath.Join(probe.SysBlockPath, filepath.Base(dev), "device", "rescan")
+	if err := ioutil.WriteFile(rescan, []byte("1"), 0200); err != nil {
+		return fmt.Errorf("could not rescan device %s: %s", dev, err.Error())
+	}
+	return nil
+}
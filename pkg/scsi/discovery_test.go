@@ -0,0 +1,196 @@
+package scsi
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/1and1/oneandone-flex-volume/pkg/probe"
+)
+
+const testUUID = "600A0B800026B2820000A6A74F6C4D87"
+
+// fakeNode builds a sysfs and a /dev tree in a temporary directory
+type fakeNode struct {
+	t    *testing.T
+	root string
+}
+
+func newFakeNode(t *testing.T) (*fakeNode, func()) {
+	root, err := ioutil.TempDir("", "scsi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sysBlock, dev, byID := probe.SysBlockPath, probe.DevPath, DiskByIDPath
+	probe.SysBlockPath = filepath.Join(root, "sys/block")
+	probe.DevPath = filepath.Join(root, "dev")
+	DiskByIDPath = filepath.Join(root, "dev/disk/by-id")
+	for _, dir := range []string{probe.SysBlockPath, DiskByIDPath} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &fakeNode{t, root}, func() {
+		probe.SysBlockPath, probe.DevPath, DiskByIDPath = sysBlock, dev, byID
+		os.RemoveAll(root)
+	}
+}
+
+// addDisk creates the sysfs entry and the device file of a disk
+func (n *fakeNode) addDisk(name, wwid string) {
+	files := map[string]string{"dev": "8:0", "size": "2048"}
+	if wwid != "" {
+		files["device/wwid"] = wwid
+	}
+	for f, content := range files {
+		path := filepath.Join(probe.SysBlockPath, name, f)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := ioutil.WriteFile(path, []byte(content+"\n"), 0644); err != nil {
+			n.t.Fatal(err)
+		}
+	}
+	ioutil.WriteFile(filepath.Join(probe.DevPath, name), nil, 0644)
+}
+
+// link creates the udev by-id link of the storage to the disk
+func (n *fakeNode) link(uuid, name string) {
+	if err := os.Symlink(filepath.Join("../..", name), ByIDPath(uuid)); err != nil {
+		n.t.Fatal(err)
+	}
+}
+
+func testDiscoverer(rescan func() error) (*Discoverer, *[]time.Duration) {
+	sleeps := &[]time.Duration{}
+	return &Discoverer{
+		Timeout:     time.Second,
+		Interval:    100 * time.Millisecond,
+		MaxInterval: 400 * time.Millisecond,
+		Rescan:      rescan,
+		sleep:       func(d time.Duration) { *sleeps = append(*sleeps, d) },
+	}, sleeps
+}
+
+func TestWaitForDeviceLink(t *testing.T) {
+	node, cleanup := newFakeNode(t)
+	defer cleanup()
+	node.addDisk("sda", "naa.6000000000000000000000000000000a")
+	node.addDisk("sdb", "naa."+strings.ToLower(testUUID))
+	node.link(testUUID, "sdb")
+
+	d, _ := testDiscoverer(nil)
+	device, err := d.WaitForDevice(testUUID)
+	if err != nil {
+		t.Fatalf("an error ocurred waiting for the device: %s", err)
+	}
+	if device != ByIDPath(testUUID) {
+		t.Errorf("expected device %s but got %s", ByIDPath(testUUID), device)
+	}
+}
+
+func TestWaitForDeviceAfterRescan(t *testing.T) {
+	node, cleanup := newFakeNode(t)
+	defer cleanup()
+
+	rescans := 0
+	d, sleeps := testDiscoverer(func() error {
+		// the disk shows up after the third rescan, before udev links it
+		if rescans++; rescans == 3 {
+			node.addDisk("sdc", "naa."+testUUID)
+		}
+		return nil
+	})
+
+	device, err := d.WaitForDevice(testUUID)
+	if err != nil {
+		t.Fatalf("an error ocurred waiting for the device: %s", err)
+	}
+	if device != filepath.Join(probe.DevPath, "sdc") {
+		t.Errorf("expected device %s but got %s", filepath.Join(probe.DevPath, "sdc"), device)
+	}
+	expected := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond}
+	if len(*sleeps) != len(expected) {
+		t.Fatalf("expected backoff %v but got %v", expected, *sleeps)
+	}
+	for i := range expected {
+		if (*sleeps)[i] != expected[i] {
+			t.Errorf("expected backoff %v but got %v", expected, *sleeps)
+		}
+	}
+}
+
+func TestWaitForDeviceTimeout(t *testing.T) {
+	node, cleanup := newFakeNode(t)
+	defer cleanup()
+	node.addDisk("sda", "naa.6000000000000000000000000000000a")
+	node.addDisk("sdb", "")
+	node.link(testUUID, "sda")
+
+	d, _ := testDiscoverer(func() error { return os.ErrPermission })
+	d.Timeout = 0
+	_, err := d.WaitForDevice(testUUID)
+	if err == nil {
+		t.Fatalf("expected error when the WWID of the linked disk does not match")
+	}
+	for _, s := range []string{"points to sda with WWID naa.6000000000000000000000000000000a", "sdb (no WWID)"} {
+		if !strings.Contains(err.Error(), s) {
+			t.Errorf("expected the error to report %q but got %q", s, err)
+		}
+	}
+
+	d.Timeout = 150 * time.Millisecond
+	d.sleep = time.Sleep
+	start := time.Now()
+	_, err = d.WaitForDevice("missing")
+	if err == nil || !strings.Contains(err.Error(), "does not exist") || !strings.Contains(err.Error(), "the last rescan failed") {
+		t.Errorf("expected a missing link and a failed rescan to be reported but got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected to give up at the deadline but waited %s", elapsed)
+	}
+}
+
+func TestMatchesUUID(t *testing.T) {
+	cases := []struct {
+		wwid     string
+		uuid     string
+		expected bool
+	}{
+		{"naa.600a0b800026b2820000a6a74f6c4d87", testUUID, true},
+		{"eui.0025385b71b0c1d4", "0025385B71B0C1D4", true},
+		{"naa.600a0b800026b2820000a6a74f6c4d87", "600a0b80-0026-b282-0000-a6a74f6c4d87", true},
+		{"naa.600a0b800026b2820000a6a74f6c4d88", testUUID, false},
+		{"", "", false},
+	}
+
+	for _, c := range cases {
+		if matches := MatchesUUID(c.wwid, c.uuid); matches != c.expected {
+			t.Errorf("%q %q: expected %t but got %t", c.wwid, c.uuid, c.expected, matches)
+		}
+	}
+}
+
+func TestRescanHosts(t *testing.T) {
+	root, err := ioutil.TempDir("", "scsi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	defaultPath := SCSIHostPath
+	defer func() { SCSIHostPath = defaultPath }()
+	SCSIHostPath = root
+
+	for _, h := range []string{"host0", "host1"} {
+		os.MkdirAll(filepath.Join(root, h), 0755)
+	}
+	if err := RescanHosts(); err != nil {
+		t.Fatalf("an error ocurred rescanning: %s", err)
+	}
+	for _, h := range []string{"host0", "host1"} {
+		if b, _ := ioutil.ReadFile(filepath.Join(root, h, "scan")); string(b) != "- - -" {
+			t.Errorf("expected %s to be rescanned but got %q", h, b)
+		}
+	}
+}
@@ -0,0 +1,25 @@
+package scsi
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// flush writes the dirty pages of the device and drops its buffer cache
+func flush(device string) error {
+	f, err := os.OpenFile(device, os.O_RDONLY, 0)
+	if err != nil {
+		return fmt.Errorf("could not open %s: %s", device, err.Error())
+	}
+	defer f.Close()
+
+	if err := unix.Fsync(int(f.Fd())); err != nil {
+		return fmt.Errorf("could not sync %s: %s", device, err.Error())
+	}
+	if err := unix.IoctlSetInt(int(f.Fd()), unix.BLKFLSBUF, 0); err != nil {
+		return fmt.Errorf("could not flush the buffers of %s: %s", device, err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package scsi
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// flush is not supported on this platform
+func flush(device string) error {
+	return fmt.Errorf("flushing block devices is not supported on %s", runtime.GOOS)
+}
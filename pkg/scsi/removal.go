@@ -0,0 +1,144 @@
+package scsi
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/1and1/oneandone-flex-volume/pkg/mount"
+	"github.com/1and1/oneandone-flex-volume/pkg/probe"
+)
+
+// Remover tears the disk of a block storage down before it is detached, so
+// the kernel does not keep a stale device around
+type Remover struct {
+	// Timeout is how long to wait for the disk to go away once deleted
+	Timeout time.Duration
+	// Interval is the delay between two looks
+	Interval time.Duration
+	// Mounts lists the mount table the disk is checked against
+	Mounts func() ([]mount.MountInfo, error)
+	// flush and sleep are replaced in tests
+	flush func(device string) error
+	sleep func(time.Duration)
+}
+
+// NewRemover returns a remover checking the mount table of the mounter
+func NewRemover(m mount.Mounter) *Remover {
+	return &Remover{
+		Timeout:  DefaultTimeout,
+		Interval: DefaultInterval,
+		Mounts:   m.List,
+		flush:    flush,
+		sleep:    time.Sleep,
+	}
+}
+
+// RemoveDevice flushes the disk of the storage, checks that nothing holds or
+// mounts it, deletes it from the SCSI layer and waits for it to go away. It
+// does nothing when the disk is not on the node.
+func (r *Remover) RemoveDevice(uuid string) error {
+	device, _ := find(uuid)
+	if device == "" {
+		return nil
+	}
+
+	target, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		return fmt.Errorf("could not resolve device %s: %s", device, err.Error())
+	}
+	name := filepath.Base(target)
+
+	disk, err := blockDevice(name)
+	if err != nil {
+		return err
+	}
+	if err := r.checkUnused(disk); err != nil {
+		return err
+	}
+
+	if err := r.flush(target); err != nil {
+		return err
+	}
+
+	del := filepath.Join(probe.SysBlockPath, name, "device", "delete")
+	if err := ioutil.WriteFile(del, []byte("1"), 0200); err != nil {
+		return fmt.Errorf("could not delete SCSI device %s: %s", name, err.Error())
+	}
+
+	return r.waitGone(uuid, name)
+}
+
+// ConfirmRemoved waits until no disk of the storage is left on the node
+func (r *Remover) ConfirmRemoved(uuid string) error {
+	return r.waitGone(uuid, "")
+}
+
+// waitGone waits until the sysfs entry and the device node of the disk are
+// gone and no other disk carries the storage WWID
+func (r *Remover) waitGone(uuid, name string) error {
+	deadline := time.Now().Add(r.Timeout)
+	for {
+		left := []string{}
+		if name != "" {
+			for _, path := range []string{filepath.Join(probe.SysBlockPath, name), filepath.Join(probe.DevPath, name)} {
+				if _, err := os.Lstat(path); err == nil {
+					left = append(left, path)
+				}
+			}
+		}
+		if device, _ := find(uuid); device != "" {
+			left = append(left, device)
+		}
+		if len(left) == 0 {
+			return nil
+		}
+
+		if time.Now().Add(r.Interval).After(deadline) {
+			return fmt.Errorf("disk of storage %s is still present after %s: %s", uuid, r.Timeout, strings.Join(left, ", "))
+		}
+		r.sleep(r.Interval)
+	}
+}
+
+// checkUnused fails when the disk or one of its partitions is held by
+// another device or mounted
+func (r *Remover) checkUnused(disk *probe.BlockDevice) error {
+	devices := append([]probe.BlockDevice{*disk}, disk.Partitions...)
+
+	for _, d := range devices {
+		if len(d.Holders) > 0 {
+			return fmt.Errorf("refusing to remove %s: %s is held by %s", disk.Name, d.Name, strings.Join(d.Holders, ", "))
+		}
+	}
+
+	table, err := r.Mounts()
+	if err != nil {
+		return fmt.Errorf("could not list mounts: %s", err.Error())
+	}
+	for _, m := range table {
+		for _, d := range devices {
+			if m.Major == d.Major && m.Minor == d.Minor {
+				return fmt.Errorf("refusing to remove %s: %s is mounted at %s", disk.Name, d.Name, m.MountPoint)
+			}
+		}
+	}
+	return nil
+}
+
+// blockDevice returns the disk with the name from sysfs
+func blockDevice(name string) (*probe.BlockDevice, error) {
+	devices, err := probe.ListBlockDevices()
+	if err != nil {
+		return nil, err
+	}
+	for i := range devices {
+		if devices[i].Name == name {
+			return &devices[i], nil
+		}
+	}
+	return nil, fmt.Errorf("disk %s is not listed in %s", name, probe.SysBlockPath)
+}
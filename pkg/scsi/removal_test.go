@@ -0,0 +1,117 @@
+package scsi
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/1and1/oneandone-flex-volume/pkg/mount"
+	"github.com/1and1/oneandone-flex-volume/pkg/probe"
+)
+
+// testRemover returns a remover whose sleep lets the kernel remove the
+// deleted disks, and the devices flushed
+func testRemover(mounts []mount.MountInfo, kernelRemoves bool) (*Remover, *[]string) {
+	flushed := &[]string{}
+	return &Remover{
+		Timeout:  time.Second,
+		Interval: 100 * time.Millisecond,
+		Mounts:   func() ([]mount.MountInfo, error) { return mounts, nil },
+		flush: func(device string) error {
+			*flushed = append(*flushed, filepath.Base(device))
+			return nil
+		},
+		sleep: func(time.Duration) {
+			if !kernelRemoves {
+				return
+			}
+			dirs, _ := ioutil.ReadDir(probe.SysBlockPath)
+			for _, d := range dirs {
+				if b, _ := ioutil.ReadFile(filepath.Join(probe.SysBlockPath, d.Name(), "device", "delete")); string(b) == "1" {
+					os.RemoveAll(filepath.Join(probe.SysBlockPath, d.Name()))
+					os.Remove(filepath.Join(probe.DevPath, d.Name()))
+				}
+			}
+		},
+	}, flushed
+}
+
+func TestRemoveDevice(t *testing.T) {
+	node, cleanup := newFakeNode(t)
+	defer cleanup()
+	node.addDisk("sda", "naa.6000000000000000000000000000000a")
+	node.addDisk("sdb", "naa."+testUUID)
+	node.link(testUUID, "sdb")
+
+	r, flushed := testRemover(nil, true)
+	if err := r.RemoveDevice(testUUID); err != nil {
+		t.Fatalf("an error ocurred removing the device: %s", err)
+	}
+	if len(*flushed) != 1 || (*flushed)[0] != "sdb" {
+		t.Errorf("expected sdb to be flushed but got %v", *flushed)
+	}
+	if _, err := os.Stat(filepath.Join(probe.SysBlockPath, "sdb")); !os.IsNotExist(err) {
+		t.Errorf("expected sdb to be deleted")
+	}
+	if _, err := os.Stat(filepath.Join(probe.SysBlockPath, "sda")); err != nil {
+		t.Errorf("expected sda to be kept: %s", err)
+	}
+
+	if err := r.RemoveDevice(testUUID); err != nil {
+		t.Errorf("expected removing a missing device to succeed but got %s", err)
+	}
+	if err := r.ConfirmRemoved(testUUID); err != nil {
+		t.Errorf("an error ocurred confirming the removal: %s", err)
+	}
+}
+
+func TestRemoveDeviceInUse(t *testing.T) {
+	cases := []struct {
+		name    string
+		holders []string
+		mounts  []mount.MountInfo
+		message string
+	}{
+		{"held", []string{"dm-0"}, nil, "sdb is held by dm-0"},
+		{"mounted", nil, []mount.MountInfo{{Major: 8, Minor: 0, MountPoint: "/mnt/pv-data"}}, "sdb is mounted at /mnt/pv-data"},
+	}
+
+	for _, c := range cases {
+		node, cleanup := newFakeNode(t)
+		node.addDisk("sdb", "naa."+testUUID)
+		for _, h := range c.holders {
+			os.MkdirAll(filepath.Join(probe.SysBlockPath, "sdb", "holders", h), 0755)
+		}
+
+		r, flushed := testRemover(c.mounts, true)
+		err := r.RemoveDevice(testUUID)
+		if err == nil || !strings.Contains(err.Error(), c.message) {
+			t.Errorf("%s: expected error %q but got %v", c.name, c.message, err)
+		}
+		if len(*flushed) != 0 {
+			t.Errorf("%s: expected nothing flushed but got %v", c.name, *flushed)
+		}
+		if _, err := os.Stat(filepath.Join(probe.SysBlockPath, "sdb", "device", "delete")); !os.IsNotExist(err) {
+			t.Errorf("%s: expected sdb not to be deleted", c.name)
+		}
+		cleanup()
+	}
+}
+
+func TestRemoveDeviceTimeout(t *testing.T) {
+	node, cleanup := newFakeNode(t)
+	defer cleanup()
+	node.addDisk("sdb", "naa."+testUUID)
+
+	r, _ := testRemover(nil, false)
+	err := r.RemoveDevice(testUUID)
+	if err == nil || !strings.Contains(err.Error(), filepath.Join(probe.SysBlockPath, "sdb")) {
+		t.Errorf("expected a timeout listing the sysfs entry of sdb but got %v", err)
+	}
+	if err := r.ConfirmRemoved(testUUID); err == nil {
+		t.Errorf("expected confirming the removal to fail while sdb is present")
+	}
+}
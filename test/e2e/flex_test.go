@@ -0,0 +1,129 @@
+//go:build e2e
+// +build e2e
+
+package e2e
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/1and1/oneandone-flex-volume/pkg/flex"
+	"github.com/1and1/oneandone-flex-volume/pkg/oneandone/mockapi"
+)
+
+const pkg = "github.com/1and1/oneandone-flex-volume/cmd/oneandone-flex-volume"
+
+// buildDriver compiles the flex driver into a temporary directory
+func buildDriver(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "e2e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary := filepath.Join(dir, "oneandone-flex-volume")
+	if out, err := exec.Command("go", "build", "-o", binary, pkg).CombinedOutput(); err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("could not build the driver: %s %s", err, string(out))
+	}
+	return binary, func() { os.RemoveAll(dir) }
+}
+
+// run executes the driver against the mock API and parses its status
+func run(t *testing.T, binary string, api *mockapi.Server, args ...string) *flex.DriverStatus {
+	cmd := exec.Command(binary, args...)
+	cmd.Env = append(os.Environ(),
+		"ONEANDONE_TOKEN_FILE_PATH=",
+		"ONEANDONE_TOKEN="+api.Token,
+		"ONEANDONE_API_URL="+api.URL,
+		"ONEANDONE_METADATA_URL="+api.URL,
+	)
+	out, _ := cmd.Output()
+
+	status := &flex.DriverStatus{}
+	if err := json.Unmarshal(out, status); err != nil {
+		t.Fatalf("%v: could not parse driver output %q: %s", args, string(out), err)
+	}
+	return status
+}
+
+func TestFlexLifecycle(t *testing.T) {
+	binary, cleanup := buildDriver(t)
+	defer cleanup()
+
+	api := mockapi.NewServer()
+	defer api.Close()
+	api.Token = "e2e-token"
+	api.ServerID = "server01"
+	api.AddServer("server01", "node01", "10.0.0.10")
+
+	status := run(t, binary, api, "init")
+	if status.Status != flex.StatusSuccess || status.Capabilities == nil || !status.Capabilities.Attach {
+		t.Fatalf("expected init to succeed with attach capability but got %+v", status)
+	}
+
+	status = run(t, binary, api, "provision", `{"kubernetes.io/pvOrVolumeName":"pv-e2e","size":"20"}`)
+	if status.Status != flex.StatusSuccess {
+		t.Fatalf("expected provision to succeed but got %+v", status)
+	}
+	storageID := status.Options["storageID"]
+	if storage := api.BlockStorage(storageID); storage == nil || storage.Size != 20 {
+		t.Fatalf("expected a 20 GB storage %s but got %+v", storageID, storage)
+	}
+	options := `{"storageID":"` + storageID + `"}`
+
+	status = run(t, binary, api, "attach", options, "10.0.0.10")
+	if status.Status != flex.StatusSuccess || status.DevicePath != "pv-e2e" {
+		t.Errorf("expected attach to return device pv-e2e but got %+v", status)
+	}
+
+	status = run(t, binary, api, "isattached", options, "10.0.0.10")
+	if status.Status != flex.StatusSuccess || status.Attached {
+		t.Errorf("expected isattached to report a detached storage but got %+v", status)
+	}
+
+	status = run(t, binary, api, "expandvolume", options, "pv-e2e", "32212254720", "21474836480")
+	if status.Status != flex.StatusSuccess {
+		t.Errorf("expected expandvolume to succeed but got %+v", status)
+	}
+	if size := api.BlockStorage(storageID).Size; size != 30 {
+		t.Errorf("expected the storage to grow to 30 GB but got %d", size)
+	}
+
+	status = run(t, binary, api, "detach", "pv-e2e", "10.0.0.10")
+	if status.Status != flex.StatusSuccess {
+		t.Errorf("expected detach to succeed but got %+v", status)
+	}
+
+	status = run(t, binary, api, "delete", options)
+	if status.Status != flex.StatusSuccess {
+		t.Errorf("expected delete to succeed but got %+v", status)
+	}
+	if storage := api.BlockStorage(storageID); storage != nil {
+		t.Errorf("expected storage %s to be deleted but got %+v", storageID, storage)
+	}
+}
+
+func TestFlexInvalidToken(t *testing.T) {
+	binary, cleanup := buildDriver(t)
+	defer cleanup()
+
+	api := mockapi.NewServer()
+	defer api.Close()
+	api.Token = "rotated"
+	id := api.AddBlockStorage("pv-e2e", 20)
+
+	cmd := exec.Command(binary, "isattached", `{"storageID":"`+id+`"}`, "10.0.0.10")
+	cmd.Env = append(os.Environ(), "ONEANDONE_TOKEN_FILE_PATH=", "ONEANDONE_TOKEN=e2e-token", "ONEANDONE_API_URL="+api.URL)
+	out, _ := cmd.Output()
+
+	status := &flex.DriverStatus{}
+	if err := json.Unmarshal(out, status); err != nil {
+		t.Fatalf("could not parse driver output %q: %s", string(out), err)
+	}
+	if status.Status != flex.StatusFailure {
+		t.Errorf("expected a failure with an invalid token but got %+v", status)
+	}
+}